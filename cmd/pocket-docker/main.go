@@ -16,7 +16,7 @@ import (
 var rootCmd = &cobra.Command{
 	Use:   "pocket-docker",
 	Short: "pocket-docker written in Go",
-	Long:  "pocket-docker, commands: run / stop / ps / pull / logs",
+	Long:  "pocket-docker, commands: run / stop / ps / pull / logs / inspect / stats / update / pause / unpause / network / port / netdump",
 }
 
 func main() {
@@ -77,6 +77,17 @@ func main() {
 	rootCmd.AddCommand(cli.LogsCmd)
 	rootCmd.AddCommand(cli.RmCmd)
 	rootCmd.AddCommand(cli.ExecCmd)
+	rootCmd.AddCommand(cli.InspectCmd)
+	rootCmd.AddCommand(cli.StatsCmd)
+	rootCmd.AddCommand(cli.UpdateCmd)
+	rootCmd.AddCommand(cli.PauseCmd)
+	rootCmd.AddCommand(cli.UnpauseCmd)
+	rootCmd.AddCommand(cli.NetworkCmd)
+	rootCmd.AddCommand(cli.PortCmd)
+	rootCmd.AddCommand(cli.NetdumpCmd)
+	rootCmd.AddCommand(cli.PortProxyCmd)
+	rootCmd.AddCommand(cli.SlirpCmd)
+	rootCmd.AddCommand(cli.DNSCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
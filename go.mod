@@ -6,8 +6,10 @@ toolchain go1.24.3
 
 require (
 	github.com/creack/pty v1.1.24
+	github.com/klauspost/compress v1.18.0
 	github.com/mattn/go-shellwords v1.0.12
 	github.com/spf13/cobra v1.9.1
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/sys v0.33.0
 	golang.org/x/term v0.32.0
 	modernc.org/sqlite v1.38.0
@@ -0,0 +1,405 @@
+//go:build linux
+
+// Package archive unpacks root filesystem tarballs and image layers without
+// an external tar binary. Entries cannot be written outside of the
+// destination: names are taken relative to it, and symlinks met on the way
+// are resolved as if the destination were the root directory.
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks bounds the symlinks followed while resolving one path.
+const maxSymlinks = 255
+
+// xattrPrefix marks extended attributes in PAX records.
+const xattrPrefix = "SCHILY.xattr."
+
+// Whiteouts in image layers: ".wh.<name>" deletes name from the layers
+// below, ".wh..wh..opq" hides everything a directory held in them. Other
+// names starting with ".wh..wh." are reserved and skipped.
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutMeta   = ".wh..wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// ExtractFile unpacks the tarball at path into dir; see Extract.
+func ExtractFile(path, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := Extract(f, dir); err != nil {
+		return fmt.Errorf("extract %s: %w", path, err)
+	}
+	return nil
+}
+
+// Extract unpacks the tar stream r into dir, which must exist. The stream
+// may be compressed with gzip, bzip2, xz or zstd. Permissions, times,
+// extended attributes and, when running as root, ownership and device nodes
+// are restored; what the kernel does not allow is skipped. Names climbing
+// out of dir with ".." are rejected.
+func Extract(r io.Reader, dir string) error {
+	return extract(r, dir, false)
+}
+
+// ApplyLayer unpacks the image layer r onto dir, which holds the layers
+// below it, like Extract. Whiteout entries are not created but remove what
+// they name from dir, unless it was written by this layer.
+func ApplyLayer(r io.Reader, dir string) error {
+	return extract(r, dir, true)
+}
+
+func extract(r io.Reader, dir string, layer bool) error {
+	dr, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	x := extractor{root: root, root0: os.Geteuid() == 0}
+	if layer {
+		x.written = make(map[string]bool)
+	}
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.entry(hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+	// Creating entries updates the times of their directory and needs
+	// write access to it, so times and permissions of directories are set
+	// last, innermost first. Later entries may have replaced a directory
+	// or one of its parents with a symlink, so they are opened without
+	// following any.
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		d := x.dirs[i]
+		fd, err := x.openDir(d.path)
+		if err != nil {
+			continue
+		}
+		_ = unix.Fchmod(fd, uint32(d.hdr.Mode)&07777)
+		// The magic link of the descriptor is followed to the directory.
+		_ = unix.UtimesNanoAt(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd), times(d.hdr), 0)
+		unix.Close(fd)
+	}
+	return nil
+}
+
+// openDir opens the directory p below x.root, failing if p or any of its
+// parents below x.root is not a directory or is a symlink.
+func (x *extractor) openDir(p string) (int, error) {
+	rel, err := filepath.Rel(x.root, p)
+	if err != nil {
+		return -1, err
+	}
+	const flags = unix.O_RDONLY | unix.O_DIRECTORY | unix.O_NOFOLLOW | unix.O_CLOEXEC
+	fd, err := unix.Open(x.root, flags, 0)
+	if err != nil {
+		return -1, err
+	}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		next, err := unix.Openat(fd, part, flags, 0)
+		unix.Close(fd)
+		if err != nil {
+			return -1, err
+		}
+		fd = next
+	}
+	return fd, nil
+}
+
+// decompress returns r decompressed according to its magic number.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return io.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		xr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+type dirEntry struct {
+	path string
+	hdr  *tar.Header
+}
+
+type extractor struct {
+	root string
+	// root0 is set when running as root, which may chown and mknod.
+	root0 bool
+	dirs  []dirEntry
+	// written holds the paths created by the layer being applied, and is
+	// nil outside of ApplyLayer.
+	written map[string]bool
+}
+
+func (x *extractor) entry(hdr *tar.Header, r io.Reader) error {
+	target, err := x.resolve(hdr.Name)
+	if err != nil {
+		return err
+	}
+	if target == x.root {
+		// "./" describes the destination itself.
+		if hdr.Typeflag == tar.TypeDir {
+			x.setAttrs(target, hdr)
+			x.dirs = append(x.dirs, dirEntry{target, hdr})
+		}
+		return nil
+	}
+	if x.written != nil {
+		if base := path.Base(hdr.Name); strings.HasPrefix(base, whiteoutPrefix) {
+			return x.whiteout(filepath.Dir(target), base)
+		}
+		for p := target; p != x.root && !x.written[p]; p = filepath.Dir(p) {
+			x.written[p] = true
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	// An existing entry is replaced, except a directory by a directory.
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	}
+	mode := uint32(hdr.Mode) & 07777
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		x.setAttrs(target, hdr)
+		x.dirs = append(x.dirs, dirEntry{target, hdr})
+		return nil
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL|unix.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// The target is kept as is; it is only followed inside the
+		// container or through resolve.
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		old, err := x.resolve(hdr.Linkname)
+		if err != nil {
+			return fmt.Errorf("link to %s: %w", hdr.Linkname, err)
+		}
+		// Hard links to directories are refused by the kernel.
+		return os.Link(old, target)
+	case tar.TypeChar, tar.TypeBlock:
+		if !x.root0 {
+			return nil
+		}
+		kind := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			kind = unix.S_IFBLK
+		}
+		err := unix.Mknod(target, kind|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		if errors.Is(err, unix.EPERM) {
+			// Not allowed in a user namespace.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(target, mode); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	x.setAttrs(target, hdr)
+	if hdr.Typeflag != tar.TypeSymlink {
+		_ = unix.Chmod(target, mode)
+	}
+	setTimes(target, hdr)
+	return nil
+}
+
+// whiteout applies the whiteout entry base found in dir.
+func (x *extractor) whiteout(dir, base string) error {
+	if base == whiteoutOpaque {
+		return x.clearLower(dir)
+	}
+	if strings.HasPrefix(base, whiteoutMeta) {
+		return nil
+	}
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid whiteout")
+	}
+	p := filepath.Join(dir, name)
+	if x.written[p] {
+		return nil
+	}
+	return os.RemoveAll(p)
+}
+
+// clearLower removes what the layers below left in dir, keeping the
+// entries written by the current layer.
+func (x *extractor) clearLower(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		switch {
+		case !x.written[p]:
+			err = os.RemoveAll(p)
+		case e.IsDir():
+			err = x.clearLower(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the path of name inside x.root. Leading slashes are
+// dropped and symlinks in all but the last component are followed as if
+// x.root were "/", so the result never lies outside of it.
+func (x *extractor) resolve(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if rel := path.Clean(name); rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path escapes the destination")
+	}
+	var resolved []string
+	pending := strings.Split(clean, "/")
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		if len(pending) == 0 {
+			resolved = append(resolved, part)
+			break
+		}
+		p := filepath.Join(x.root, filepath.Join(resolved...), part)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+		link, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			resolved = nil
+		}
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+	return filepath.Join(x.root, filepath.Join(resolved...)), nil
+}
+
+// setAttrs restores the ownership and extended attributes of hdr on p;
+// permissions are set afterwards, since chown clears the set-user-ID bit.
+// Ownership needs root; attributes the filesystem or the caller cannot set
+// are skipped.
+func (x *extractor) setAttrs(p string, hdr *tar.Header) {
+	if x.root0 {
+		_ = os.Lchown(p, hdr.Uid, hdr.Gid)
+	}
+	for k, v := range hdr.PAXRecords {
+		if attr, ok := strings.CutPrefix(k, xattrPrefix); ok {
+			_ = unix.Lsetxattr(p, attr, []byte(v), 0)
+		}
+	}
+}
+
+func setTimes(p string, hdr *tar.Header) {
+	_ = unix.UtimesNanoAt(unix.AT_FDCWD, p, times(hdr), unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// times returns the access and modification times of hdr for utimensat.
+func times(hdr *tar.Header) []unix.Timespec {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return []unix.Timespec{timespec(atime), timespec(hdr.ModTime)}
+}
+
+func timespec(t time.Time) unix.Timespec {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}
+	}
+	return unix.NsecToTimespec(t.UnixNano())
+}
@@ -0,0 +1,375 @@
+//go:build linux
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"golang.org/x/sys/unix"
+)
+
+// entry is one member of a test archive.
+type entry struct {
+	name, body, link string
+	typ              byte
+	mode             int64
+	pax              map[string]string
+}
+
+func makeTar(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: e.mode, Linkname: e.link,
+			Size: int64(len(e.body)), ModTime: time.Unix(1600000000, 0), PAXRecords: e.pax}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, e.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sandbox returns an empty destination and a sibling directory that must
+// stay untouched.
+func sandbox(t *testing.T) (dir, outside string) {
+	t.Helper()
+	base := t.TempDir()
+	dir, outside = filepath.Join(base, "root"), filepath.Join(base, "outside")
+	for _, d := range []string{dir, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, outside
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func assertEmpty(t *testing.T, dir string) {
+	t.Helper()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("%s was written to: %v", dir, entries)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir, _ := sandbox(t)
+	data := makeTar(t,
+		entry{name: "./", typ: tar.TypeDir, mode: 0755},
+		entry{name: "bin/", typ: tar.TypeDir, mode: 0755},
+		entry{name: "bin/busybox", body: "#!", mode: 04755},
+		entry{name: "bin/sh", typ: tar.TypeSymlink, link: "/bin/busybox"},
+		entry{name: "bin/ls", typ: tar.TypeLink, link: "bin/busybox"},
+		entry{name: "etc/motd", body: "hi\n"},
+		entry{name: "ro/", typ: tar.TypeDir, mode: 0555},
+		entry{name: "ro/file", body: "x", mode: 0400},
+		entry{name: "run/fifo", typ: tar.TypeFifo, mode: 0600},
+		entry{name: "attr", body: "a", pax: map[string]string{"SCHILY.xattr.user.pocket": "docker"}},
+	)
+	if err := Extract(bytes.NewReader(data), dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "etc/motd")); got != "hi\n" {
+		t.Fatalf("etc/motd = %q", got)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "bin/busybox"))
+	if err != nil || fi.Mode() != 0755|os.ModeSetuid {
+		t.Fatalf("bin/busybox mode = %v, %v", fi.Mode(), err)
+	}
+	if !fi.ModTime().Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("bin/busybox mtime = %v", fi.ModTime())
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "bin/sh")); err != nil || link != "/bin/busybox" {
+		t.Fatalf("bin/sh -> %q, %v", link, err)
+	}
+	ls, err := os.Stat(filepath.Join(dir, "bin/ls"))
+	if err != nil || !os.SameFile(fi, ls) {
+		t.Fatalf("bin/ls is not a hard link of bin/busybox: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "ro")); err != nil || fi.Mode().Perm() != 0555 || !fi.ModTime().Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("ro = %v %v, %v", fi.Mode(), fi.ModTime(), err)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "run/fifo")); err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("run/fifo = %v, %v", fi, err)
+	}
+	buf := make([]byte, 16)
+	if n, err := unix.Getxattr(filepath.Join(dir, "attr"), "user.pocket", buf); err == nil {
+		if string(buf[:n]) != "docker" {
+			t.Fatalf("xattr = %q", buf[:n])
+		}
+	} else if !errors.Is(err, unix.ENOTSUP) && !errors.Is(err, unix.ENODATA) {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractDevices(t *testing.T) {
+	dir, _ := sandbox(t)
+	data := makeTar(t, entry{name: "dev/null", typ: tar.TypeChar, mode: 0666})
+	if err := Extract(bytes.NewReader(data), dir); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(filepath.Join(dir, "dev/null"))
+	if os.Geteuid() != 0 {
+		if err == nil {
+			t.Fatal("device node created without root")
+		}
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		t.Skip("mknod not permitted")
+	}
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 || fi.Mode().Perm() != 0666 {
+		t.Fatalf("dev/null = %v, %v", fi, err)
+	}
+}
+
+func TestExtractRejectsEscapes(t *testing.T) {
+	for _, name := range []string{"../evil", "a/../../evil", ".."} {
+		dir, outside := sandbox(t)
+		data := makeTar(t, entry{name: name, body: "pwned"})
+		if err := Extract(bytes.NewReader(data), dir); err == nil {
+			t.Errorf("%q extracted", name)
+		}
+		assertEmpty(t, outside)
+	}
+
+	dir, outside := sandbox(t)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0600)
+	data := makeTar(t, entry{name: "hl", typ: tar.TypeLink, link: "../outside/secret"})
+	if err := Extract(bytes.NewReader(data), dir); err == nil {
+		t.Fatal("hard link out of the destination extracted")
+	}
+}
+
+func TestExtractContainsSymlinks(t *testing.T) {
+	dir, outside := sandbox(t)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0600)
+	data := makeTar(t,
+		// Absolute names stay below the destination.
+		entry{name: "/abs/file", body: "abs"},
+		// Symlinked directories are resolved inside the destination.
+		entry{name: "absdir", typ: tar.TypeSymlink, link: outside},
+		entry{name: "absdir/pwned", body: "1"},
+		entry{name: "updir", typ: tar.TypeSymlink, link: "../../../../../../.."},
+		entry{name: "updir/" + outside + "/pwned", body: "2"},
+		entry{name: "etc", typ: tar.TypeSymlink, link: "/"},
+		entry{name: "etc/passwd", body: "3"},
+		// A hard link through a symlink cannot reach outside files.
+		entry{name: "hl", typ: tar.TypeLink, link: "absdir/pwned"},
+		// A file replaces a symlink instead of writing through it.
+		entry{name: "sl", typ: tar.TypeSymlink, link: filepath.Join(outside, "secret")},
+		entry{name: "sl", body: "4"},
+	)
+	if err := Extract(bytes.NewReader(data), dir); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles := map[string]string{
+		"abs/file":             "abs",
+		outside[1:] + "/pwned": "2",
+		"passwd":               "3",
+		"hl":                   "2",
+		"sl":                   "4",
+	}
+	for name, want := range assertFiles {
+		if got := readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 || readFile(t, filepath.Join(outside, "secret")) != "s" {
+		t.Fatalf("outside was modified: %v", entries)
+	}
+}
+
+func TestExtractSymlinkLoop(t *testing.T) {
+	dir, _ := sandbox(t)
+	data := makeTar(t,
+		entry{name: "a", typ: tar.TypeSymlink, link: "b"},
+		entry{name: "b", typ: tar.TypeSymlink, link: "a"},
+		entry{name: "a/file", body: "x"},
+	)
+	if err := Extract(bytes.NewReader(data), dir); err == nil || !strings.Contains(err.Error(), "symbolic links") {
+		t.Fatalf("Extract = %v", err)
+	}
+}
+
+func TestExtractCompressed(t *testing.T) {
+	plain := makeTar(t, entry{name: "hello", body: "world"})
+	compress := map[string]func(io.Writer) (io.WriteCloser, error){
+		"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		"xz":   func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		"zstd": func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+	}
+	for name, newWriter := range compress {
+		var buf bytes.Buffer
+		w, err := newWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(plain)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		dir, _ := sandbox(t)
+		if err := Extract(&buf, dir); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := readFile(t, filepath.Join(dir, "hello")); got != "world" {
+			t.Fatalf("%s: hello = %q", name, got)
+		}
+	}
+
+	// The standard library cannot write bzip2, so that one is a fixture.
+	dir, _ := sandbox(t)
+	if err := ExtractFile("testdata/hello.tar.bz2", dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "hello")); got != "world" {
+		t.Fatalf("bzip2: hello = %q", got)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	src, _ := sandbox(t)
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	os.WriteFile(filepath.Join(src, "bin/busybox"), []byte("#!"), 0755)
+	os.Symlink("busybox", filepath.Join(src, "bin/sh"))
+	os.Mkdir(filepath.Join(src, "tmp"), 0755)
+	os.Chmod(filepath.Join(src, "tmp"), os.ModeSticky|0777)
+
+	dir, _ := sandbox(t)
+	if err := CopyDir(src, dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "bin/sh")); got != "#!" {
+		t.Fatalf("bin/sh = %q", got)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "bin/sh")); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("bin/sh is not a symlink: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "tmp")); err != nil || fi.Mode() != os.ModeDir|os.ModeSticky|0777 {
+		t.Fatalf("tmp = %v, %v", fi.Mode(), err)
+	}
+	if err := CopyDir(filepath.Join(src, "missing"), dir); err == nil {
+		t.Fatal("copied a missing directory")
+	}
+}
+
+func TestApplyLayer(t *testing.T) {
+	dir, _ := sandbox(t)
+	base := makeTar(t,
+		entry{name: "etc/motd", body: "base"},
+		entry{name: "etc/issue", body: "base"},
+		entry{name: "var/cache/a", body: "a"},
+		entry{name: "var/cache/sub/b", body: "b"},
+		entry{name: "opt/keep", body: "k"},
+	)
+	top := makeTar(t,
+		// Whiteouts hide entries of the layers below.
+		entry{name: "etc/.wh.motd"},
+		entry{name: "etc/.wh.missing"},
+		entry{name: "opt/.wh..wh.plnk"},
+		// Written before the opaque marker, but by the same layer.
+		entry{name: "var/cache/sub/new", body: "n"},
+		entry{name: "var/cache/.wh..wh..opq"},
+		entry{name: "var/cache/c", body: "c"},
+		// A whiteout never hides what its own layer wrote.
+		entry{name: "new", body: "n"},
+		entry{name: ".wh.new"},
+	)
+	for _, layer := range [][]byte{base, top} {
+		if err := ApplyLayer(bytes.NewReader(layer), dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"etc/issue": "base", "var/cache/c": "c", "var/cache/sub/new": "n", "opt/keep": "k", "new": "n"} {
+		if got := readFile(t, filepath.Join(dir, name)); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"etc/motd", "var/cache/a", "var/cache/sub/b", "etc/.wh.missing", "opt/.wh..wh.plnk", "var/cache/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s exists: %v", name, err)
+		}
+	}
+
+	// Whiteouts cannot reach outside of the destination.
+	dir, outside := sandbox(t)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0600)
+	for _, name := range []string{"../outside/.wh.secret", "up/.wh.secret", ".wh.", ".wh.."} {
+		data := makeTar(t, entry{name: "up", typ: tar.TypeSymlink, link: "../outside"}, entry{name: name})
+		ApplyLayer(bytes.NewReader(data), dir)
+	}
+	if readFile(t, filepath.Join(outside, "secret")) != "s" {
+		t.Fatal("outside was modified")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Extract keeps whiteouts as plain files.
+	dir, _ = sandbox(t)
+	if err := Extract(bytes.NewReader(top), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "etc/.wh.motd")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractDirReplacedBySymlink(t *testing.T) {
+	dir, outside := sandbox(t)
+	secret := filepath.Join(outside, "secret")
+	os.WriteFile(secret, []byte("s"), 0600)
+	os.Mkdir(filepath.Join(outside, "sub"), 0700)
+	data := makeTar(t,
+		// The mode of a directory is set at the end, when a symlink
+		// to a file outside has taken its place.
+		entry{name: "a/", typ: tar.TypeDir, mode: 0777},
+		entry{name: "a", typ: tar.TypeSymlink, link: secret},
+		// The same for a parent of the directory.
+		entry{name: "p/sub/", typ: tar.TypeDir, mode: 0777},
+		entry{name: "p", typ: tar.TypeSymlink, link: outside},
+	)
+	if err := Extract(bytes.NewReader(data), dir); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]os.FileMode{secret: 0600, filepath.Join(outside, "sub"): os.ModeDir | 0700} {
+		if fi, err := os.Stat(p); err != nil || fi.Mode() != want {
+			t.Errorf("%s = %v, %v; want %v", p, fi.Mode(), err, want)
+		}
+	}
+}
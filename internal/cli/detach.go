@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/denysk0/pocketDocker/internal/store"
+	"golang.org/x/sys/unix"
+)
+
+// detachedEnv marks the run process that supervises a detached container.
+const detachedEnv = "POCKET_DOCKER_DETACHED"
+
+// runDetached runs the current `run` command again in a session of its own
+// and exits once that process printed the ID of the container, with its
+// status if it failed before. The process stays behind to supervise the
+// container as an attached run does: it restarts it, records OOM kills and
+// cleans up after it.
+func runDetached() {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c := exec.Command(exe, os.Args[1:]...)
+	c.Env = append(os.Environ(), detachedEnv+"=1")
+	c.Stderr = os.Stderr
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := c.StdoutPipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := c.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		_ = c.Wait()
+		if code := c.ProcessState.ExitCode(); code > 0 {
+			os.Exit(code)
+		}
+		os.Exit(1)
+	}
+	fmt.Print(line)
+	c.Process.Release()
+	os.Exit(0)
+}
+
+// detachOutput points stdout and stderr at /dev/null once the caller of a
+// detached run has exited: nobody reads them any more, and writing to a
+// closed pipe would kill the process.
+func detachOutput() {
+	fd, err := unix.Open("/dev/null", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return
+	}
+	_ = unix.Dup3(fd, 1, 0)
+	_ = unix.Dup3(fd, 2, 0)
+	unix.Close(fd)
+}
+
+// stoppedByUser reports whether container id was stopped with `stop` or
+// removed while a run supervised it; `stop` then cleans up after it.
+func stoppedByUser(st *store.Store, id string) bool {
+	return st != nil && st.StopRequested(id)
+}
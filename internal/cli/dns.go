@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/denysk0/pocketDocker/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var dnsNetwork string
+
+// DNSCmd is the embedded DNS server of a network. `run` starts one per
+// network on the gateway address; it exits once no container is left on
+// the network.
+var DNSCmd = &cobra.Command{
+	Use:    "dns",
+	Short:  "resolve container names on a network (internal)",
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		n, err := runtime.LookupNetwork(st, dnsNetwork)
+		if err != nil {
+			fmt.Println("error:", err)
+			return err
+		}
+		addr := net.JoinHostPort(n.Gateway, "53")
+		pc, err := net.ListenPacket("udp4", addr)
+		if errors.Is(err, syscall.EADDRINUSE) {
+			// Another run already started the server of this network.
+			fmt.Println("ready")
+			return nil
+		}
+		if err != nil {
+			fmt.Println("error:", err)
+			return err
+		}
+		defer pc.Close()
+		l, err := net.Listen("tcp4", addr)
+		if err != nil {
+			fmt.Println("error:", err)
+			return err
+		}
+		defer l.Close()
+
+		srv := runtime.NewDNSServer(func(name string) []netip.Addr {
+			return networkRecords(st, n, name)
+		})
+		go srv.ServeUDP(pc)
+		go srv.ServeTCP(l)
+		fmt.Println("ready")
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sigCh:
+				return nil
+			case <-ticker.C:
+				if !networkInUse(st, n.Name) {
+					return nil
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	DNSCmd.Flags().StringVar(&dnsNetwork, "network", "", "network to serve")
+}
+
+// networkRecords returns the addresses on network of the running containers
+// whose name, ID, short ID or alias on that network is name, including the
+// IPv6 ones of a dual-stack network.
+func networkRecords(st *store.Store, network runtime.Network, name string) []netip.Addr {
+	allocs, err := st.ListIPAllocations(network.Name)
+	if err != nil {
+		return nil
+	}
+	var addrs []netip.Addr
+	for _, a := range allocs {
+		c, err := st.GetContainer(a.ContainerID)
+		if err != nil || !isLive(c.State) || !processExists(c.PID) {
+			continue
+		}
+		names := []string{c.Name, c.ID, shortID(c.ID)}
+		if c.Network == network.Name {
+			names = append(names, c.Aliases...)
+		}
+		for _, n := range names {
+			if strings.EqualFold(n, name) {
+				if ip, err := netip.ParseAddr(a.IP); err == nil {
+					addrs = append(addrs, ip)
+				}
+				if ip, err := netip.ParseAddr(network.IPv6Address(a.IP)); err == nil {
+					addrs = append(addrs, ip)
+				}
+				break
+			}
+		}
+	}
+	return addrs
+}
+
+// networkInUse reports whether a container that is running or still being
+// started holds an address on network.
+func networkInUse(st *store.Store, network string) bool {
+	allocs, err := st.ListIPAllocations(network)
+	if err != nil {
+		return true
+	}
+	for _, a := range allocs {
+		c, err := st.GetContainer(a.ContainerID)
+		if err != nil || isLive(c.State) && processExists(c.PID) {
+			return true
+		}
+	}
+	return false
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// aliasRe matches valid --network-alias values, which are host names.
+var aliasRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+
+// dnsResolvConf is the resolv.conf of containers on network.
+func dnsResolvConf(network runtime.Network) string {
+	return "nameserver " + network.Gateway + "\noptions ndots:0\n"
+}
+
+// startDNS makes sure the DNS server of network runs.
+func startDNS(network runtime.Network) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	c := exec.Command(exe, "dns", "--network", network.Name)
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "ready" {
+		c.Process.Kill()
+		c.Wait()
+		if line == "" {
+			line = "exited"
+		}
+		return fmt.Errorf("dns server: %s", strings.TrimPrefix(line, "error: "))
+	}
+	// Reaped right away if the server was already running.
+	go c.Wait()
+	return nil
+}
@@ -37,6 +37,9 @@ func execRun(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("unknown container")
 	}
+	if info.State == "Paused" {
+		return fmt.Errorf("container is paused, unpause it first")
+	}
 	if info.State != "Running" {
 		return fmt.Errorf("container not running")
 	}
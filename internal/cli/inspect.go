@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var InspectCmd = &cobra.Command{
+	Use:   "inspect <ID>",
+	Short: "show low-level information about a container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		info, err := st.GetContainer(args[0])
+		if err != nil {
+			return fmt.Errorf("unknown container")
+		}
+		if isLive(info.State) && !processExists(info.PID) {
+			_ = st.UpdateContainerState(info.ID, "Stopped")
+			info.State = "Stopped"
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	},
+}
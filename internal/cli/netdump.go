@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/denysk0/pocketDocker/internal/runtime/capture"
+	"github.com/spf13/cobra"
+)
+
+var (
+	netdumpWrite   string
+	netdumpFilter  string
+	netdumpFormat  string
+	netdumpCount   int
+	netdumpNetwork string
+)
+
+var NetdumpCmd = &cobra.Command{
+	Use:   "netdump <ID> [-w FILE] [--filter EXPR] [--network NAME]",
+	Short: "capture the network traffic of a container as pcap",
+	Long: "Capture the frames on the host side veth of a container until interrupted.\n" +
+		"Without -w, or with -w -, the capture is streamed to stdout, e.g. into\n" +
+		"`wireshark -k -i -`. Files ending in .pcapng are written as pcapng.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		info, err := st.GetContainer(args[0])
+		if err != nil {
+			return fmt.Errorf("unknown container")
+		}
+		if !isLive(info.State) || !processExists(info.PID) {
+			return fmt.Errorf("container %s is not running", info.ID)
+		}
+		name := netdumpNetwork
+		if name == "" {
+			name = info.Network
+		}
+		attached := name == info.Network && info.NetworkSetup
+		if !attached {
+			addrs, err := st.ContainerAddresses(info.ID)
+			if err != nil {
+				return err
+			}
+			for _, a := range addrs {
+				attached = attached || a.Network == name
+			}
+		}
+		if !attached {
+			return fmt.Errorf("container %s has no interface on a bridge network %s", info.ID, name)
+		}
+		n, err := runtime.LookupNetwork(st, name)
+		if err != nil {
+			return err
+		}
+		filter, err := capture.ParseFilter(netdumpFilter)
+		if err != nil {
+			return err
+		}
+		format := netdumpFormat
+		if format == "" {
+			format = capture.FormatPcap
+			if strings.HasSuffix(netdumpWrite, ".pcapng") {
+				format = capture.FormatPcapng
+			}
+		}
+
+		var out io.Writer = cmd.OutOrStdout()
+		if netdumpWrite != "-" {
+			f, err := os.Create(netdumpWrite)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		} else if isTerminal(out) {
+			return fmt.Errorf("refusing to write a capture to a terminal; use -w FILE or a pipe")
+		}
+		host := n.HostVeth(info.ID)
+		c, err := capture.Open(host, capture.DefaultSnaplen)
+		if err != nil {
+			return fmt.Errorf("capture on %s: %w", host, err)
+		}
+		defer c.Close()
+		bw := bufio.NewWriter(out)
+		w, err := capture.NewWriter(bw, format, host, capture.DefaultSnaplen)
+		if err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		fmt.Fprintf(cmd.ErrOrStderr(), "capturing on %s\n", host)
+		count, err := dump(ctx, c, filter, w, bw)
+		fmt.Fprintf(cmd.ErrOrStderr(), "%d packets captured\n", count)
+		return err
+	},
+}
+
+func init() {
+	NetdumpCmd.Flags().StringVarP(&netdumpWrite, "write", "w", "-", "write the capture to FILE, - for stdout")
+	NetdumpCmd.Flags().StringVar(&netdumpFilter, "filter", "", "only capture frames matching EXPR, e.g. \"tcp port 80\"")
+	NetdumpCmd.Flags().StringVar(&netdumpFormat, "format", "", "capture format: pcap or pcapng (default from the file name)")
+	NetdumpCmd.Flags().IntVarP(&netdumpCount, "count", "c", 0, "stop after N packets")
+	NetdumpCmd.Flags().StringVar(&netdumpNetwork, "network", "", "capture on the interface of the container on NAME (default the network it was started on)")
+}
+
+// dump writes the frames of c matching filter to w until ctx is done or
+// netdumpCount frames were written. Each frame is flushed so readers of a
+// pipe see it immediately. It returns the number of frames written.
+func dump(ctx context.Context, c *capture.Capture, filter *capture.Filter, w *capture.Writer, bw *bufio.Writer) (int, error) {
+	count := 0
+	for netdumpCount == 0 || count < netdumpCount {
+		p, err := c.Next(ctx)
+		if ctx.Err() != nil {
+			return count, nil
+		}
+		if err == syscall.ENETDOWN {
+			// The veth went away with the container.
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if !filter.Match(p.Data) {
+			continue
+		}
+		if err := w.WritePacket(p); err != nil {
+			return count, err
+		}
+		if err := bw.Flush(); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
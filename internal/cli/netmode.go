@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/store"
+)
+
+// --network values that select a mode instead of a network.
+const (
+	networkNone      = "none"
+	networkHost      = "host"
+	networkContainer = "container:"
+)
+
+// isNetworkMode reports whether name is a --network mode without a bridge
+// of its own: none, host or container:<id>.
+func isNetworkMode(name string) bool {
+	return name == networkNone || name == networkHost || strings.HasPrefix(name, networkContainer)
+}
+
+// joinedContainerPID returns the PID of the running container named by a
+// --network container:<id> value.
+func joinedContainerPID(st *store.Store, mode string) (int, error) {
+	// Entering the namespace takes CAP_SYS_ADMIN on the host.
+	if os.Geteuid() != 0 {
+		return 0, fmt.Errorf("--network %s requires root", mode)
+	}
+	id := strings.TrimPrefix(mode, networkContainer)
+	if id == "" {
+		return 0, fmt.Errorf("--network %s: missing container ID", mode)
+	}
+	if st == nil {
+		return 0, fmt.Errorf("store not initialized")
+	}
+	info, err := st.GetContainer(id)
+	if err != nil {
+		return 0, fmt.Errorf("--network %s: unknown container", mode)
+	}
+	if !isLive(info.State) || !processExists(info.PID) {
+		return 0, fmt.Errorf("--network %s: container is not running", mode)
+	}
+	return info.PID, nil
+}
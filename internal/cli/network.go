@@ -0,0 +1,400 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/denysk0/pocketDocker/internal/logging"
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/denysk0/pocketDocker/internal/store"
+	"github.com/spf13/cobra"
+)
+
+// networkNameRe limits names so that the bridge name stays within the
+// 15 characters allowed for network interfaces.
+var networkNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,11}$`)
+
+var (
+	networkSubnet  string
+	networkGateway string
+	networkIPv6    bool
+	networkSubnet6 string
+	networkICC     bool
+	networkIntern  bool
+	connectIP      string
+)
+
+var NetworkCmd = &cobra.Command{
+	Use:   "network",
+	Short: "manage bridge networks",
+}
+
+var networkCreateCmd = &cobra.Command{
+	Use:   "create --subnet CIDR [--gateway IP] [--ipv6 [--subnet6 CIDR]] [--icc=false] [--internal] NAME",
+	Short: "create a bridge network",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		name := args[0]
+		if name == runtime.DefaultNetwork.Name || name == runtime.SlirpNetwork || isNetworkMode(name) {
+			return fmt.Errorf("network %s is predefined", name)
+		}
+		if !networkNameRe.MatchString(name) {
+			return fmt.Errorf("invalid network name %q: use up to 12 letters, digits, '_' or '-'", name)
+		}
+		n, err := newNetwork(name, networkSubnet, networkGateway)
+		if err != nil {
+			return err
+		}
+		if networkIPv6 || networkSubnet6 != "" {
+			if err := addIPv6(&n, networkSubnet6); err != nil {
+				return err
+			}
+		}
+		n.Isolated = !networkICC
+		n.Internal = networkIntern
+		if err := st.CreateNetwork(n); err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), name)
+		return nil
+	},
+}
+
+var networkLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "list networks",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		list, err := allNetworks(st)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tBRIDGE\tSUBNET\tGATEWAY\tIPV6 SUBNET\tCONTAINERS")
+		for _, n := range list {
+			allocs, _ := st.ListIPAllocations(n.Name)
+			subnet6 := n.Subnet6
+			if subnet6 == "" {
+				subnet6 = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", n.Name, n.Bridge, n.Subnet, n.Gateway, subnet6, len(allocs))
+		}
+		return w.Flush()
+	},
+}
+
+var networkRmCmd = &cobra.Command{
+	Use:   "rm NAME [NAME...]",
+	Short: "remove networks without attached containers",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		var failed bool
+		for _, name := range args {
+			if name == runtime.DefaultNetwork.Name {
+				fmt.Fprintf(cmd.ErrOrStderr(), "network %s is predefined and cannot be removed\n", name)
+				failed = true
+				continue
+			}
+			n, err := runtime.LookupNetwork(st, name)
+			if err != nil {
+				fmt.Fprintln(cmd.ErrOrStderr(), err)
+				failed = true
+				continue
+			}
+			if err := st.DeleteNetwork(name); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "network %s: %v\n", name, err)
+				failed = true
+				continue
+			}
+			runtime.RemoveNetwork(n)
+			fmt.Fprintln(cmd.OutOrStdout(), name)
+		}
+		if failed {
+			return fmt.Errorf("some networks could not be removed")
+		}
+		return nil
+	},
+}
+
+// networkDetails is the output of `network inspect`.
+type networkDetails struct {
+	Name       string
+	Bridge     string
+	Subnet     string
+	Gateway    string
+	Subnet6    string `json:",omitempty"`
+	Gateway6   string `json:",omitempty"`
+	ICC        bool
+	Internal   bool
+	Containers []store.IPAllocation
+}
+
+var networkInspectCmd = &cobra.Command{
+	Use:   "inspect NAME",
+	Short: "show a network and the addresses allocated on it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		n, err := runtime.LookupNetwork(st, args[0])
+		if err != nil {
+			return err
+		}
+		allocs, err := st.ListIPAllocations(n.Name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(networkDetails{Name: n.Name, Bridge: n.Bridge, Subnet: n.Subnet, Gateway: n.Gateway, Subnet6: n.Subnet6, Gateway6: n.Gateway6,
+			ICC: !n.Isolated, Internal: n.Internal, Containers: allocs})
+	},
+}
+
+var networkConnectCmd = &cobra.Command{
+	Use:   "connect [--ip IP] NETWORK CONTAINER",
+	Short: "attach a running container to a network",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		n, err := runtime.LookupNetwork(st, args[0])
+		if err != nil {
+			return err
+		}
+		info, err := st.GetContainer(args[1])
+		if err != nil {
+			return fmt.Errorf("unknown container")
+		}
+		if !isLive(info.State) || !processExists(info.PID) {
+			return fmt.Errorf("container %s is not running", info.ID)
+		}
+		if info.Network == networkHost || strings.HasPrefix(info.Network, networkContainer) {
+			return fmt.Errorf("container %s shares the network namespace of --network %s", info.ID, info.Network)
+		}
+		if strings.HasPrefix(info.Network, runtime.CNIPrefix) {
+			return fmt.Errorf("container %s is on the CNI network %s", info.ID, strings.TrimPrefix(info.Network, runtime.CNIPrefix))
+		}
+		if len(info.EgressAllow) > 0 {
+			// A second interface would bypass the egress rules.
+			return fmt.Errorf("container %s has an --egress-allow list", info.ID)
+		}
+		addrs, err := st.ContainerAddresses(info.ID)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if a.Network == n.Name {
+				return fmt.Errorf("container %s is already connected to %s", info.ID, n.Name)
+			}
+		}
+		ip, err := st.AllocateIP(n.Name, n.Subnet, n.Gateway, info.ID, connectIP)
+		if err != nil {
+			return err
+		}
+		firewall, err := runtime.ResolveFirewall(info.Firewall)
+		if err != nil {
+			return err
+		}
+		if err := checkNetworkPolicy(n, firewall); err != nil {
+			_ = st.ReleaseIP(n.Name, info.ID)
+			return err
+		}
+		if err := runtime.ConnectNetwork(n, info.PID, info.ID, ip, firewall, nil); err != nil {
+			_ = st.ReleaseIP(n.Name, info.ID)
+			return fmt.Errorf("connect %s: %w", n.Name, err)
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), ip)
+		return nil
+	},
+}
+
+var networkDisconnectCmd = &cobra.Command{
+	Use:   "disconnect NETWORK CONTAINER",
+	Short: "detach a container from a network joined with connect",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		n, err := runtime.LookupNetwork(st, args[0])
+		if err != nil {
+			return err
+		}
+		info, err := st.GetContainer(args[1])
+		if err != nil {
+			return fmt.Errorf("unknown container")
+		}
+		if info.NetworkSetup && info.Network == n.Name {
+			return fmt.Errorf("%s is the primary network of container %s", n.Name, info.ID)
+		}
+		addrs, err := st.ContainerAddresses(info.ID)
+		if err != nil {
+			return err
+		}
+		connected := false
+		for _, a := range addrs {
+			connected = connected || a.Network == n.Name
+		}
+		if !connected {
+			return fmt.Errorf("container %s is not connected to %s", info.ID, n.Name)
+		}
+		if err := runtime.DisconnectNetwork(n, info.ID, nil); err != nil {
+			return fmt.Errorf("disconnect %s: %w", n.Name, err)
+		}
+		if err := st.ReleaseIP(n.Name, info.ID); err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), info.ID)
+		return nil
+	},
+}
+
+func init() {
+	networkCreateCmd.Flags().StringVar(&networkSubnet, "subnet", "", "IPv4 subnet in CIDR notation (e.g. 10.50.0.0/24)")
+	networkCreateCmd.Flags().StringVar(&networkGateway, "gateway", "", "gateway address (default: first address of the subnet)")
+	networkCreateCmd.Flags().BoolVar(&networkIPv6, "ipv6", false, "make the network dual-stack with a random unique local /64 unless --subnet6 is given")
+	networkCreateCmd.Flags().StringVar(&networkSubnet6, "subnet6", "", "IPv6 subnet of a dual-stack network (e.g. fd00:50::/64); implies --ipv6")
+	networkCreateCmd.Flags().BoolVar(&networkICC, "icc", true, "let containers on the network reach each other; with --icc=false they only reach the gateway and the outside world")
+	networkCreateCmd.Flags().BoolVar(&networkIntern, "internal", false, "forward no traffic between the network and the outside world")
+	_ = networkCreateCmd.MarkFlagRequired("subnet")
+	networkConnectCmd.Flags().StringVar(&connectIP, "ip", "", "static address on the network")
+
+	NetworkCmd.AddCommand(networkCreateCmd, networkLsCmd, networkRmCmd, networkInspectCmd, networkConnectCmd, networkDisconnectCmd)
+}
+
+// checkNetworkPolicy returns an error if containers cannot join n with the
+// firewall backend of that name: the policies of isolated and internal
+// networks are enforced with firewall rules.
+func checkNetworkPolicy(n runtime.Network, firewall string) error {
+	if firewall != runtime.FirewallNone {
+		return nil
+	}
+	if n.Isolated {
+		return fmt.Errorf("network %s has --icc=false, which requires the nft or iptables firewall backend", n.Name)
+	}
+	if n.Internal {
+		return fmt.Errorf("network %s is internal, which requires the nft or iptables firewall backend", n.Name)
+	}
+	return nil
+}
+
+// newNetwork validates subnet and gateway of a network to be created. The
+// gateway defaults to the first host address.
+func newNetwork(name, subnet, gateway string) (store.NetworkInfo, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil || !prefix.Addr().Is4() {
+		return store.NetworkInfo{}, fmt.Errorf("invalid subnet %q: expected IPv4 CIDR", subnet)
+	}
+	if prefix.Bits() > 30 {
+		return store.NetworkInfo{}, fmt.Errorf("subnet %s is too small", subnet)
+	}
+	prefix = prefix.Masked()
+	if def := netip.MustParsePrefix(runtime.DefaultNetwork.Subnet); def.Overlaps(prefix) {
+		return store.NetworkInfo{}, fmt.Errorf("subnet %s overlaps network %s", prefix, runtime.DefaultNetwork.Name)
+	}
+	gw := prefix.Addr().Next()
+	if gateway != "" {
+		if gw, err = netip.ParseAddr(gateway); err != nil {
+			return store.NetworkInfo{}, fmt.Errorf("invalid gateway %q", gateway)
+		}
+		if !prefix.Contains(gw) || gw == prefix.Addr() {
+			return store.NetworkInfo{}, fmt.Errorf("gateway %s is not a host address of %s", gw, prefix)
+		}
+	}
+	return store.NetworkInfo{
+		Name:      name,
+		Bridge:    runtime.BridgeName(name),
+		Subnet:    prefix.String(),
+		Gateway:   gw.String(),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// addIPv6 makes n dual-stack with subnet6, or a random unique local /64 if
+// it is empty. Container addresses keep their IPv4 offset, so subnet6 must
+// have at least as many host bits as the IPv4 subnet.
+func addIPv6(n *store.NetworkInfo, subnet6 string) error {
+	var prefix netip.Prefix
+	if subnet6 == "" {
+		// RFC 4193: fd00::/8 followed by a random 40 bit global ID and
+		// subnet ID 0.
+		var b [16]byte
+		b[0] = 0xfd
+		if _, err := rand.Read(b[1:6]); err != nil {
+			return err
+		}
+		prefix = netip.PrefixFrom(netip.AddrFrom16(b), 64)
+	} else {
+		var err error
+		prefix, err = netip.ParsePrefix(subnet6)
+		if err != nil || !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return fmt.Errorf("invalid subnet6 %q: expected IPv6 CIDR", subnet6)
+		}
+		prefix = prefix.Masked()
+	}
+	v4 := netip.MustParsePrefix(n.Subnet)
+	if 128-prefix.Bits() < 32-v4.Bits() {
+		return fmt.Errorf("subnet6 %s has fewer addresses than subnet %s", prefix, n.Subnet)
+	}
+	n.Subnet6 = prefix.String()
+	n.Gateway6 = runtime.MapIPv6(n.Subnet, n.Subnet6, n.Gateway)
+	return nil
+}
+
+// allNetworks returns the default network followed by the user-defined ones.
+func allNetworks(st *store.Store) ([]runtime.Network, error) {
+	list, err := st.ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+	out := []runtime.Network{runtime.DefaultNetwork}
+	for _, ni := range list {
+		out = append(out, runtime.NetworkFromInfo(ni))
+	}
+	return out, nil
+}
+
+// reconnectNetworks restores the interfaces joined with `network connect`
+// after the container was restarted in a new network namespace.
+func reconnectNetworks(st *store.Store, id string, pid int, primary, firewall string) {
+	addrs, err := st.ContainerAddresses(id)
+	if err != nil {
+		return
+	}
+	for _, a := range addrs {
+		if a.Network == primary {
+			continue
+		}
+		n, err := runtime.LookupNetwork(st, a.Network)
+		if err != nil {
+			continue
+		}
+		if err := runtime.ConnectNetwork(n, pid, id, a.IP, firewall, nil); err != nil {
+			logging.Append(id, fmt.Sprintf("reconnect %s failed: %v", a.Network, err))
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/denysk0/pocketDocker/internal/store"
+)
+
+func TestNetworkCreateLsRm(t *testing.T) {
+	st, err := store.NewStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	SetStore(st)
+	defer SetStore(nil)
+
+	run := func(args ...string) (string, error) {
+		buf := &bytes.Buffer{}
+		NetworkCmd.SetOut(buf)
+		NetworkCmd.SetErr(buf)
+		NetworkCmd.SetArgs(args)
+		networkSubnet, networkGateway, networkIPv6, networkSubnet6 = "", "", false, ""
+		networkICC, networkIntern = true, false
+		err := NetworkCmd.Execute()
+		return buf.String(), err
+	}
+
+	if _, err := run("create", "--subnet", "10.50.0.0/24", "web"); err != nil {
+		t.Fatal(err)
+	}
+	n, err := st.GetNetwork("web")
+	if err != nil || n.Bridge != "pd-web" || n.Gateway != "10.50.0.1" {
+		t.Fatalf("stored network = %+v, %v", n, err)
+	}
+	if _, err := run("create", "--subnet", "10.51.0.0/24", "--ipv6", "ula"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.GetNetwork("ula"); err != nil || !strings.HasPrefix(n.Subnet6, "fd") || !strings.HasSuffix(n.Subnet6, "::/64") || n.Gateway6 != strings.TrimSuffix(n.Subnet6, "/64")+"1" {
+		t.Fatalf("stored dual-stack network = %+v, %v", n, err)
+	}
+	if _, err := run("create", "--subnet", "10.52.0.0/24", "--gateway", "10.52.0.254", "--subnet6", "fd00:52::/64", "v6"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.GetNetwork("v6"); err != nil || n.Subnet6 != "fd00:52::/64" || n.Gateway6 != "fd00:52::fe" {
+		t.Fatalf("stored dual-stack network = %+v, %v", n, err)
+	}
+	if _, err := run("create", "--subnet", "10.53.0.0/24", "--icc=false", "--internal", "ctf"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := st.GetNetwork("ctf"); err != nil || !n.Isolated || !n.Internal {
+		t.Fatalf("stored isolated network = %+v, %v", n, err)
+	}
+	if n, _ := st.GetNetwork("v6"); n.Isolated || n.Internal {
+		t.Fatalf("policy leaked into the next network: %+v", n)
+	}
+	for _, bad := range [][]string{
+		{"create", "--subnet", "10.60.0.0/24", "--subnet6", "fd00:52:0:0:1::/80", "overlap6"},
+		{"create", "--subnet", "10.60.0.0/16", "--subnet6", "fd00:60::/120", "small6"},
+		{"create", "--subnet", "10.60.0.0/24", "--subnet6", "10.61.0.0/24", "notv6"},
+		{"create", "--subnet", "10.42.0.0/16", "overlap"},
+		{"create", "--subnet", "10.60.0.0/24", "bridge"},
+		{"create", "--subnet", "10.60.0.0/24", "host"},
+		{"create", "--subnet", "10.60.0.0/24", "slirp"},
+		{"create", "--subnet", "10.60.0.0/24", "a-name-that-is-too-long"},
+		{"create", "--subnet", "10.60.0.0/24", "--gateway", "10.61.0.1", "gw"},
+	} {
+		if _, err := run(bad...); err == nil {
+			t.Fatalf("%v: expected error", bad)
+		}
+	}
+
+	out, err := run("ls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "bridge  pd0") || !strings.Contains(out, "web     pd-web  10.50.0.0/24") || !strings.Contains(out, "fd00:52::/64") {
+		t.Fatalf("unexpected ls output:\n%s", out)
+	}
+
+	if _, err := st.AllocateIP("web", n.Subnet, n.Gateway, "c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("rm", "web"); err == nil {
+		t.Fatal("removed a network with attached containers")
+	}
+	_ = st.ReleaseIP("web", "c1")
+	if _, err := run("rm", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetNetwork("web"); err == nil {
+		t.Fatal("network still stored after rm")
+	}
+}
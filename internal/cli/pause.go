@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
+	"github.com/spf13/cobra"
+)
+
+var PauseCmd = &cobra.Command{
+	Use:   "pause <ID> [ID...]",
+	Short: "suspend all processes of a container using the cgroup freezer",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setPaused(cmd, args, true)
+	},
+}
+
+var UnpauseCmd = &cobra.Command{
+	Use:   "unpause <ID> [ID...]",
+	Short: "resume a paused container",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return setPaused(cmd, args, false)
+	},
+}
+
+func setPaused(cmd *cobra.Command, ids []string, pause bool) error {
+	st := getStore()
+	if st == nil {
+		return fmt.Errorf("store not initialized")
+	}
+	from, to, verb := "Paused", "Running", "unpaused"
+	if pause {
+		from, to, verb = "Running", "Paused", "paused"
+	}
+	var failed bool
+	for _, id := range ids {
+		info, err := st.GetContainer(id)
+		if err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "unknown container %s\n", id)
+			failed = true
+			continue
+		}
+		if info.State != from || !processExists(info.PID) {
+			fmt.Fprintf(cmd.ErrOrStderr(), "container %s is not %s\n", id, strings.ToLower(from))
+			failed = true
+			continue
+		}
+		if pause {
+			err = cgroups.Freeze(info.ID)
+		} else {
+			err = cgroups.Thaw(info.ID)
+		}
+		if err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "container %s: %v\n", id, err)
+			failed = true
+			continue
+		}
+		if err := st.UpdateContainerState(info.ID, to); err != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "failed to update container state: %v\n", err)
+			failed = true
+			continue
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), info.ID)
+	}
+	if failed {
+		return fmt.Errorf("some containers could not be %s", verb)
+	}
+	return nil
+}
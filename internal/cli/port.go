@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/denysk0/pocketDocker/internal/store"
+	"github.com/spf13/cobra"
+)
+
+var PortCmd = &cobra.Command{
+	Use:   "port <ID> [PRIVATE_PORT[/PROTO]]",
+	Short: "list the published ports of a container",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		info, err := st.GetContainer(args[0])
+		if err != nil {
+			return fmt.Errorf("unknown container")
+		}
+		var filter runtime.PortMap
+		if len(args) == 2 {
+			if filter, err = runtime.ParsePortMap(args[1]); err != nil || filter.Host != 0 || filter.HostIP != "" {
+				return fmt.Errorf("invalid port %q: want PRIVATE_PORT[/PROTO]", args[1])
+			}
+		}
+		for _, pm := range info.Ports {
+			if len(args) == 2 && (pm.Protocol() != filter.Protocol() ||
+				filter.Container < pm.Container || filter.Container > max(pm.Container, pm.ContainerEnd)) {
+				continue
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s -> %s\n", pm.ContainerString(), pm.HostString())
+		}
+		return nil
+	},
+}
+
+// publishedPorts returns the port mappings of all running containers.
+func publishedPorts(st *store.Store) []runtime.PortMap {
+	list, err := st.ListContainers()
+	if err != nil {
+		return nil
+	}
+	var ports []runtime.PortMap
+	for _, c := range list {
+		if isLive(c.State) && processExists(c.PID) {
+			ports = append(ports, c.Ports...)
+		}
+	}
+	return ports
+}
+
+// reserveHostPorts assigns the host ports of ports for container id and
+// reserves them in st, so that a concurrent run cannot publish them too.
+// Ports picked from the ephemeral range are picked again if another run
+// reserved them in the meantime.
+func reserveHostPorts(st *store.Store, id string, ports []runtime.PortMap) ([]runtime.PortMap, error) {
+	if st == nil {
+		return runtime.AssignHostPorts(ports, nil)
+	}
+	for attempt := 0; ; attempt++ {
+		used := publishedPorts(st)
+		reserved, err := st.ListPortReservations()
+		if err != nil {
+			return nil, err
+		}
+		assigned, err := runtime.AssignHostPorts(ports, append(used, reserved...))
+		if err != nil {
+			return nil, err
+		}
+		err = st.ReservePorts(id, assigned)
+		if err == nil || !errors.Is(err, store.ErrPortInUse) || attempt == 2 {
+			return assigned, err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+var (
+	proxyPID          int
+	proxyIP           string
+	proxyPorts        string
+	proxySocketHelper bool
+)
+
+// PortProxyCmd is the shim that publishes ports from userspace when there
+// is no root or no firewall. `run` starts it in the background; it exits
+// with the container.
+var PortProxyCmd = &cobra.Command{
+	Use:    "port-proxy",
+	Short:  "forward published ports into a container (internal)",
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if proxySocketHelper {
+			return runtime.ServeNetnsSockets(os.NewFile(3, "socket-helper"))
+		}
+		var ports []runtime.PortMap
+		if err := json.Unmarshal([]byte(proxyPorts), &ports); err != nil {
+			return fmt.Errorf("invalid --ports: %w", err)
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		p, err := runtime.StartPortProxy(proxyPID, proxyIP, ports, []string{exe, "port-proxy", "--socket-helper"})
+		if err != nil {
+			fmt.Println("error:", err)
+			return err
+		}
+		defer p.Close()
+		fmt.Println("ready")
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sigCh:
+				return nil
+			case <-ticker.C:
+				if !processExists(proxyPID) {
+					return nil
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	PortProxyCmd.Flags().IntVar(&proxyPID, "pid", 0, "PID of the container")
+	PortProxyCmd.Flags().StringVar(&proxyIP, "ip", "", "container address to forward to (default: its loopback)")
+	PortProxyCmd.Flags().StringVar(&proxyPorts, "ports", "[]", "port mappings as JSON")
+	PortProxyCmd.Flags().BoolVar(&proxySocketHelper, "socket-helper", false, "serve sockets of the current network namespace on fd 3")
+}
+
+// startPortProxy starts the port-proxy shim for container pid in a session
+// of its own and waits until it listens. It returns the PID of the shim.
+func startPortProxy(pid int, ip string, ports []runtime.PortMap) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(ports)
+	if err != nil {
+		return 0, err
+	}
+	c := exec.Command(exe, "port-proxy", "--pid", strconv.Itoa(pid), "--ip", ip, "--ports", string(data))
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := c.Start(); err != nil {
+		return 0, err
+	}
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	line = strings.TrimSpace(line)
+	if line != "ready" {
+		c.Process.Kill()
+		c.Wait()
+		if line == "" {
+			line = "proxy exited"
+		}
+		return 0, fmt.Errorf("port proxy: %s", strings.TrimPrefix(line, "error: "))
+	}
+	shim := c.Process.Pid
+	c.Process.Release()
+	return shim, nil
+}
@@ -28,6 +28,11 @@ func processExists(pid int) bool {
 	return false
 }
 
+// isLive reports whether a container in state still owns a process.
+func isLive(state string) bool {
+	return state == "Running" || state == "Paused"
+}
+
 var PsCmd = &cobra.Command{
 	Use:   "ps",
 	Short: "list containers",
@@ -42,9 +47,9 @@ var PsCmd = &cobra.Command{
 			fmt.Fprintln(os.Stderr, err)
 			return
 		}
-		// Cleanup stale "Running" states if the kernel no longer knows this PID
+		// Cleanup stale "Running"/"Paused" states if the kernel no longer knows this PID
 		for i, c := range list {
-			if c.State == "Running" && !processExists(c.PID) {
+			if isLive(c.State) && !processExists(c.PID) {
 				_ = st.UpdateContainerState(c.ID, "Stopped")
 				c.State = "Stopped"
 				list[i] = c
@@ -57,7 +62,11 @@ var PsCmd = &cobra.Command{
 		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 		fmt.Fprintln(tw, "ID\tNAME\tIMAGE\tSTATE\tSTARTED\tRESTARTS")
 		for _, c := range list {
-			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", c.ID, c.Name, c.Image, c.State, c.StartedAt.Format(time.RFC3339), c.RestartCount)
+			state := c.State
+			if c.OOMKilled {
+				state += " (OOMKilled)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\n", c.ID, c.Name, c.Image, state, c.StartedAt.Format(time.RFC3339), c.RestartCount)
 		}
 		tw.Flush()
 	},
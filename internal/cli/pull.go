@@ -6,11 +6,12 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/denysk0/pocketDocker/internal/archive"
+	"github.com/denysk0/pocketDocker/internal/image"
 	"github.com/denysk0/pocketDocker/internal/store"
 	"github.com/spf13/cobra"
 )
@@ -18,11 +19,11 @@ import (
 var PullCmd = &cobra.Command{
 	Use:   "pull",
 	Short: "pull image",
-	Args:  cobra.ExactArgs(1),
+	Long: "Store a rootfs tarball, a docker save archive or an OCI image layout, given as a\n" +
+		"file, directory or URL, in the image cache. Anything else is pulled from a\n" +
+		"registry, as in `pull alpine:3.20`. Image layers are applied in order.",
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if _, err := exec.LookPath("tar"); err != nil {
-			return fmt.Errorf("tar command not found in PATH")
-		}
 		src := args[0]
 		home, _ := os.UserHomeDir()
 		cacheDir := filepath.Join(home, ".pocket-docker", "images")
@@ -30,9 +31,21 @@ var PullCmd = &cobra.Command{
 			return err
 		}
 
+		isURL := strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+		if _, err := os.Stat(src); err != nil && !isURL {
+			// A mistyped file name is reported as missing rather than
+			// looked up in a registry.
+			if isFilePath(src) {
+				return err
+			}
+			if ref, err := image.ParseReference(src); err == nil {
+				return pullReference(ref, src, cacheDir)
+			}
+		}
+
 		var localFile string
 		var tmpFile *os.File
-		if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		if isURL {
 			resp, err := http.Get(src)
 			if err != nil {
 				return err
@@ -84,7 +97,7 @@ var PullCmd = &cobra.Command{
 			}
 		}
 
-		name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))
+		name := imageName(src)
 		destDir := filepath.Join(cacheDir, name)
 		if _, err := os.Stat(destDir); err == nil {
 			fmt.Println("already up-to-date")
@@ -93,10 +106,14 @@ var PullCmd = &cobra.Command{
 		if err := os.MkdirAll(destDir, 0755); err != nil {
 			return err
 		}
-		tarCmd := exec.Command("tar", "-xf", localFile, "-C", destDir)
-		tarCmd.Stdout = os.Stdout
-		tarCmd.Stderr = os.Stderr
-		if err := tarCmd.Run(); err != nil {
+		format, err := image.Detect(localFile)
+		if err == nil && format != "" {
+			err = image.Unpack(localFile, destDir)
+		} else if err == nil {
+			err = archive.ExtractFile(localFile, destDir)
+		}
+		if err != nil {
+			os.RemoveAll(destDir)
 			return err
 		}
 		if tmpFile != nil {
@@ -112,8 +129,70 @@ var PullCmd = &cobra.Command{
 	},
 }
 
-var shaSum string
+var (
+	shaSum    string
+	plainHTTP bool
+)
+
+// pullReference pulls the image ref from its registry into cacheDir and
+// stores it under name, the reference as given.
+func pullReference(ref image.Reference, name, cacheDir string) error {
+	if shaSum != "" {
+		return fmt.Errorf("--sha256 applies to files; pin a registry image with NAME@sha256:DIGEST")
+	}
+	destDir := filepath.Join(cacheDir, strings.ReplaceAll(name, "/", "_"))
+	if _, err := os.Stat(destDir); err == nil {
+		fmt.Println("already up-to-date")
+		return nil
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	if err := image.Pull(ref, destDir, plainHTTP); err != nil {
+		os.RemoveAll(destDir)
+		return err
+	}
+	if st := getStore(); st != nil {
+		info := store.ImageInfo{Name: name, Path: destDir, CreatedAt: time.Now()}
+		if err := st.SaveImage(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveExts are the extensions of the image and rootfs archives pull
+// reads.
+var archiveExts = []string{".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst"}
+
+// isFilePath reports whether src names a file rather than an image
+// reference: it is absolute, relative to the current or parent directory,
+// or has an archive extension.
+func isFilePath(src string) bool {
+	if src == "." || src == ".." || strings.HasPrefix(src, "/") || strings.HasPrefix(src, "./") || strings.HasPrefix(src, "../") {
+		return true
+	}
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(src, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageName returns the name of the image at path: its base name without
+// the extension, or both extensions of a compressed tarball.
+func imageName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".gz", ".tgz", ".bz2", ".xz", ".zst"} {
+		if base, ok := strings.CutSuffix(name, ext); ok {
+			return strings.TrimSuffix(base, ".tar")
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
 
 func init() {
 	PullCmd.Flags().StringVar(&shaSum, "sha256", "", "expected sha256 sum")
+	PullCmd.Flags().BoolVar(&plainHTTP, "plain-http", false, "talk to the registry over HTTP instead of HTTPS")
 }
@@ -0,0 +1,22 @@
+package cli
+
+import "testing"
+
+func TestIsFilePath(t *testing.T) {
+	for src, want := range map[string]bool{
+		"busybox.tar":            true,
+		"./img":                  true,
+		"../images/rootfs":       true,
+		"/srv/rootfs.tar.zst":    true,
+		"alpine.tgz":             true,
+		"alpine":                 false,
+		"alpine:3.20":            false,
+		"ghcr.io/team/app:1.0":   false,
+		"localhost:5000/app":     false,
+		"registry.example.com/a": false,
+	} {
+		if got := isFilePath(src); got != want {
+			t.Errorf("isFilePath(%q) = %v, want %v", src, got, want)
+		}
+	}
+}
@@ -51,7 +51,7 @@ var RmCmd = &cobra.Command{
 			id = strings.Trim(strings.TrimSpace(id), "\n\r\t")
 			info, err := st.GetContainer(id)
 			if err == nil {
-				if info.State == "Running" {
+				if isLive(info.State) {
 					fmt.Fprintf(os.Stderr, "container %s is still running – stop it first\n", id)
 					continue
 				}
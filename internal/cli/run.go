@@ -5,15 +5,14 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"github.com/denysk0/pocketDocker/internal/archive"
 	"github.com/denysk0/pocketDocker/internal/logging"
 	"github.com/denysk0/pocketDocker/internal/runtime"
 	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
 	"github.com/mattn/go-shellwords"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,6 +22,8 @@ import (
 	"golang.org/x/term"
 )
 
+// prepareRootfs unpacks the tarball or copies the directory src into a new
+// temporary directory.
 func prepareRootfs(src string) (string, error) {
 	dir, err := os.MkdirTemp("", "pocketdocker-rootfs-")
 	if err != nil {
@@ -33,33 +34,13 @@ func prepareRootfs(src string) (string, error) {
 		return "", err
 	}
 	if fi.IsDir() {
-		cmd1 := exec.Command("tar", "-cC", src, ".")
-		cmd2 := exec.Command("tar", "-xC", dir)
-		r, w := io.Pipe()
-		cmd1.Stdout = w
-		cmd2.Stdin = r
-		cmd1.Stderr = os.Stderr
-		cmd2.Stderr = os.Stderr
-		if err := cmd1.Start(); err != nil {
-			return "", err
-		}
-		if err := cmd2.Start(); err != nil {
-			return "", err
-		}
-		if err := cmd1.Wait(); err != nil {
-			return "", err
-		}
-		w.Close()
-		if err := cmd2.Wait(); err != nil {
-			return "", err
-		}
+		err = archive.CopyDir(src, dir)
 	} else {
-		tarCmd := exec.Command("tar", "-xf", src, "-C", dir)
-		tarCmd.Stdout = os.Stdout
-		tarCmd.Stderr = os.Stderr
-		if err := tarCmd.Run(); err != nil {
-			return "", err
-		}
+		err = archive.ExtractFile(src, dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
 	}
 	return dir, nil
 }
@@ -69,11 +50,24 @@ var (
 	command        string
 	memoryLimit    int64
 	cpuShares      int64
+	cpus           float64
+	pidsLimit      int64
 	publish        []string
-	enableNet      bool
+	publishAll     bool
+	expose         []string
+	networkName    string
+	networkAliases []string
+	egressAllow    []string
+	netRate        string
+	netDelay       string
+	netLoss        string
+	staticIP       string
+	firewallName   string
 	healthCmd      string
 	healthInterval int
+	healthPSI      []string
 	restartMax     int
+	restartOnOOM   bool
 	detach         bool
 	interactive    bool
 	tty            bool
@@ -83,6 +77,12 @@ var RunCmd = &cobra.Command{
 	Use:   "run",
 	Short: "run a container",
 	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 0 {
+			// `--network NAME` leaves NAME behind as an argument since
+			// the flag value is optional.
+			fmt.Fprintf(os.Stderr, "unexpected argument %q (use --network=NAME to pick a network)\n", args[0])
+			os.Exit(1)
+		}
 		var (
 			pr       io.ReadCloser
 			oldState *term.State
@@ -105,7 +105,18 @@ var RunCmd = &cobra.Command{
 			fmt.Fprintln(os.Stderr, "both --rootfs and --cmd flags are required")
 			os.Exit(1)
 		}
-		if !strings.Contains(rootfs, "/") && !strings.HasSuffix(rootfs, ".tar") {
+		if detach && os.Getenv(detachedEnv) == "" {
+			runDetached()
+		}
+		// The output of a detached container only goes to its log; stdout
+		// carries its ID to the caller.
+		var output io.Writer = os.Stdout
+		if detach {
+			output = io.Discard
+		}
+		// Images pulled from a registry keep their reference as name, which
+		// may contain slashes.
+		if _, err := os.Stat(rootfs); os.IsNotExist(err) || (!strings.Contains(rootfs, "/") && !strings.HasSuffix(rootfs, ".tar")) {
 			if st := getStore(); st != nil {
 				if img, err := st.GetImage(rootfs); err == nil {
 					rootfs = img.Path
@@ -117,9 +128,14 @@ var RunCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		if _, err := exec.LookPath("tar"); err != nil {
-			fmt.Fprintln(os.Stderr, "tar command not found in PATH")
-			os.Exit(1)
+		var psiThresholds []cgroups.PSIThreshold
+		for _, expr := range healthPSI {
+			th, err := cgroups.ParsePSIThreshold(expr)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			psiThresholds = append(psiThresholds, th)
 		}
 
 		idBytes := make([]byte, 16)
@@ -134,18 +150,200 @@ var RunCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		name := strings.TrimSuffix(filepath.Base(rootfs), filepath.Ext(rootfs))
+		name := imageName(rootfs)
 
 		restartCount := 0
 		printedID := false
-		var ipForwardOrig string
-		var ipSuffix int
-		for {
-			rootfsDir, err := prepareRootfs(rootfs)
+		var ipForwardOrig, ip6ForwardOrig string
+		var ipAddress string
+		var ipAllocated, portsReserved bool
+		var network runtime.Network
+		var cniConf runtime.CNIConfig
+		var ports []runtime.PortMap
+		// exitStart reports that the container could not be started and
+		// exits, releasing the address and host ports reserved for it.
+		// Before the first start no container record owns them yet, so
+		// nothing else would; a failed restart first marks the record
+		// stopped, so that it no longer claims them.
+		exitStart := func(format string, a ...any) {
+			fmt.Fprintf(os.Stderr, format, a...)
+			if st := getStore(); st != nil {
+				if restartCount > 0 {
+					_ = st.UpdateContainerState(id, "Stopped")
+				}
+				if ipAllocated {
+					_ = st.ReleaseIP(network.Name, id)
+				}
+				if portsReserved {
+					_ = st.ReleasePorts(id)
+				}
+			}
+			os.Exit(1)
+		}
+		for _, p := range publish {
+			pm, err := runtime.ParsePortMap(p)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			ports = append(ports, pm)
+		}
+		if publishAll {
+			for _, e := range expose {
+				pm, err := runtime.ParsePortMap(e)
+				if err != nil || pm.Host != 0 || pm.HostIP != "" {
+					fmt.Fprintf(os.Stderr, "invalid expose %q: want containerPort[-end][/proto]\n", e)
+					os.Exit(1)
+				}
+				ports = append(ports, pm)
+			}
+		}
+		// Without root, ports are published by the userspace proxy into the
+		// otherwise unconfigured network namespace.
+		if networkName == "" && len(ports) > 0 && os.Geteuid() == 0 {
+			networkName = runtime.DefaultNetwork.Name
+		}
+		egress, err := runtime.ParseEgressRules(egressAllow)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		shape, err := runtime.ParseNetShape(netRate, netDelay, netLoss)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if isNetworkMode(networkName) {
+			if len(ports) > 0 {
+				if networkName != networkHost {
+					fmt.Fprintf(os.Stderr, "conflicting options: --publish and --network %s\n", networkName)
+					os.Exit(1)
+				}
+				fmt.Fprintln(os.Stderr, "warning: published ports are discarded with --network host")
+				ports = nil
+			}
+			if staticIP != "" {
+				fmt.Fprintf(os.Stderr, "--ip cannot be used with --network %s\n", networkName)
+				os.Exit(1)
+			}
+			if strings.HasPrefix(networkName, networkContainer) {
+				if _, err := joinedContainerPID(getStore(), networkName); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
+			network.Name = networkName
+		} else if networkName == runtime.SlirpNetwork {
+			if staticIP != "" {
+				fmt.Fprintln(os.Stderr, "--ip cannot be used with --network slirp")
+				os.Exit(1)
+			}
+			network.Name = runtime.SlirpNetwork
+		} else if strings.HasPrefix(networkName, runtime.CNIPrefix) {
+			// The plugins configure the host side of the interface.
+			if os.Geteuid() != 0 {
+				fmt.Fprintf(os.Stderr, "--network %s requires root\n", networkName)
+				os.Exit(1)
+			}
+			if staticIP != "" {
+				fmt.Fprintf(os.Stderr, "--ip cannot be used with --network %s\n", networkName)
+				os.Exit(1)
+			}
+			cniConf, err = runtime.LoadCNIConfig(strings.TrimPrefix(networkName, runtime.CNIPrefix))
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
+			if len(ports) > 0 && !cniConf.SupportsPorts() {
+				fmt.Fprintf(os.Stderr, "CNI network %s has no plugin with the portMappings capability; ports cannot be published\n", cniConf.Name)
+				os.Exit(1)
+			}
+			network.Name = networkName
+		} else if networkName != "" {
+			st := getStore()
+			if st == nil {
+				fmt.Fprintln(os.Stderr, "network setup failed: store not initialized")
+				os.Exit(1)
+			}
+			network, err = runtime.LookupNetwork(st, networkName)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			firewallName, err = runtime.ResolveFirewall(firewallName)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if len(egress) > 0 && firewallName == runtime.FirewallNone {
+				fmt.Fprintln(os.Stderr, "--egress-allow requires the nft or iptables firewall backend")
+				os.Exit(1)
+			}
+			if err := checkNetworkPolicy(network, firewallName); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if network.Internal && len(ports) > 0 {
+				fmt.Fprintf(os.Stderr, "network %s is internal; ports cannot be published\n", network.Name)
+				os.Exit(1)
+			}
+			ipAddress, err = st.AllocateIP(network.Name, network.Subnet, network.Gateway, id, staticIP)
+			if err != nil {
+				exitStart("failed to allocate address: %v\n", err)
+			}
+			ipAllocated = true
+		} else if staticIP != "" {
+			exitStart("--ip requires --network or --publish\n")
+		}
+		if len(ports) > 0 {
+			ports, err = reserveHostPorts(getStore(), id, ports)
+			if err != nil {
+				exitStart("%v\n", err)
+			}
+			portsReserved = true
+		}
+		slirpMode := networkName == runtime.SlirpNetwork
+		cniMode := strings.HasPrefix(networkName, runtime.CNIPrefix)
+		bridged := networkName != "" && !slirpMode && !cniMode && !isNetworkMode(networkName)
+		if len(networkAliases) > 0 && !bridged {
+			exitStart("--network-alias requires a bridge network\n")
+		}
+		for _, a := range networkAliases {
+			if !aliasRe.MatchString(a) {
+				exitStart("invalid network alias %q\n", a)
+			}
+		}
+		if len(egress) > 0 && !bridged {
+			exitStart("--egress-allow requires a bridge network\n")
+		}
+		if !shape.IsZero() && !bridged {
+			exitStart("--net-rate, --net-delay and --net-loss require a bridge network\n")
+		}
+		var egressSpecs []string
+		for _, r := range egress {
+			egressSpecs = append(egressSpecs, r.String())
+		}
+		useProxy := len(ports) > 0 && !cniMode && (networkName == "" || slirpMode || firewallName == runtime.FirewallNone)
+		for {
+			rootfsDir, err := prepareRootfs(rootfs)
+			if err != nil {
+				exitStart("%v\n", err)
+			}
+			if slirpMode {
+				// Queries go to the DNS address of the user-mode stack.
+				_ = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+				_ = os.WriteFile(filepath.Join(rootfsDir, "etc", "resolv.conf"), []byte(runtime.SlirpResolvConf()), 0644)
+			} else if bridged {
+				// The embedded DNS server of the network listens on
+				// the gateway; it is started with the networking below.
+				_ = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+				_ = os.WriteFile(filepath.Join(rootfsDir, "etc", "resolv.conf"), []byte(dnsResolvConf(network)), 0644)
+			} else if networkName == networkHost {
+				if data, err := os.ReadFile("/etc/resolv.conf"); err == nil {
+					_ = os.MkdirAll(filepath.Join(rootfsDir, "etc"), 0755)
+					_ = os.WriteFile(filepath.Join(rootfsDir, "etc", "resolv.conf"), data, 0644)
+				}
+			}
 			// Resolve the real path of the binary *inside* the extracted rootfs.
 			cmdPath := parts[0]
 			if !strings.Contains(cmdPath, "/") {
@@ -175,10 +373,53 @@ var RunCmd = &cobra.Command{
 				}
 			}
 
-			pid, master, err := runtime.CloneAndRun(cmdPath, parts[1:], rootfsDir, interactive, tty)
+			var netns runtime.NetNamespace
+			switch {
+			case networkName == networkHost:
+				netns.Host = true
+			case strings.HasPrefix(networkName, networkContainer):
+				// Looked up again on every start: the other container
+				// may have been restarted with a new PID.
+				if netns.JoinPID, err = joinedContainerPID(getStore(), networkName); err != nil {
+					exitStart("%v\n", err)
+				}
+			}
+			pid, master, err := runtime.CloneAndRun(cmdPath, parts[1:], rootfsDir, interactive, tty, netns)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to run command: %v\n", err)
-				os.Exit(1)
+				exitStart("failed to run command: %v\n", err)
+			}
+			var slirpPID, proxyPID int
+			var cniResult string
+			networkSetup := false
+			// abortStart is exitStart for failures after the process was
+			// cloned: it kills the process and undoes what was set up for
+			// it so far, as no record is left to clean up after it.
+			abortStart := func(format string, a ...any) {
+				_ = syscall.Kill(pid, syscall.SIGKILL)
+				var ws syscall.WaitStatus
+				_, _ = syscall.Wait4(pid, &ws, 0, nil)
+				var ns runtime.NetworkStore
+				if st := getStore(); st != nil {
+					ns = st
+				}
+				runtime.Cleanup(store.ContainerInfo{
+					ID:             id,
+					PID:            pid,
+					State:          "Running",
+					RootfsDir:      rootfsDir,
+					Ports:          ports,
+					IpForwardOrig:  ipForwardOrig,
+					Ip6ForwardOrig: ip6ForwardOrig,
+					NetworkSetup:   networkSetup,
+					Network:        network.Name,
+					Firewall:       firewallName,
+					ProxyPID:       proxyPID,
+					SlirpPID:       slirpPID,
+					EgressAllow:    egressSpecs,
+					CNIResult:      cniResult,
+					IPAddress:      ipAddress,
+				}, ns, false)
+				exitStart(format, a...)
 			}
 			
 			ctx, cancel := context.WithCancel(context.Background())
@@ -207,45 +448,68 @@ var RunCmd = &cobra.Command{
 					}
 				}
 				if pr != nil {
-					go func() { _, _ = io.Copy(os.Stdout, pr) }()
+					go func() { _, _ = io.Copy(output, pr) }()
 				}
 			}
 
+			// Every container gets its own cgroup so that stats work even
+			// when no limits were requested; rootless runs may not be allowed to.
+			_ = cgroups.AddProcess(id, pid)
+
 			if memoryLimit > 0 {
 				if err := cgroups.ApplyMemoryLimit(id, pid, memoryLimit); err != nil {
-					fmt.Fprintf(os.Stderr, "failed to apply memory limit: %v\n", err)
-					os.Exit(1)
+					abortStart("failed to apply memory limit: %v\n", err)
 				}
 			}
 			if cpuShares > 0 {
 				if err := cgroups.ApplyCPUShares(id, pid, cpuShares); err != nil {
-					fmt.Fprintf(os.Stderr, "failed to apply CPU shares: %v\n", err)
-					os.Exit(1)
+					abortStart("failed to apply CPU shares: %v\n", err)
 				}
 			}
 
-			if enableNet || len(publish) > 0 {
-				var pm []runtime.PortMap
-				for _, p := range publish {
-					parts := strings.SplitN(p, ":", 2)
-					if len(parts) != 2 {
-						fmt.Fprintf(os.Stderr, "invalid publish format: %s\n", p)
-						os.Exit(1)
-					}
-					hp, err1 := strconv.Atoi(parts[0])
-					cp, err2 := strconv.Atoi(parts[1])
-					if err1 != nil || err2 != nil {
-						fmt.Fprintf(os.Stderr, "invalid publish format: %s\n", p)
-						os.Exit(1)
+			if cpus > 0 || pidsLimit > 0 {
+				if err := cgroups.ApplyResources(id, cgroups.Resources{CPUs: cpus, PidsMax: pidsLimit}); err != nil {
+					abortStart("failed to apply resource limits: %v\n", err)
+				}
+			}
+
+			ip6Address := network.IPv6Address(ipAddress)
+			if slirpMode {
+				slirpPID, err = startSlirp(pid)
+				if err != nil {
+					abortStart("network setup failed: %v\n", err)
+				}
+			} else if bridged {
+				ipForwardOrig, ip6ForwardOrig, err = runtime.SetupNetworking(network, pid, id, ipAddress, ports, egress, firewallName, nil)
+				if err != nil {
+					abortStart("network setup failed: %v\n", err)
+				}
+				networkSetup = true
+				if !shape.IsZero() {
+					if err := runtime.ShapeNetwork(network, pid, id, shape, nil); err != nil {
+						abortStart("traffic shaping failed: %v\n", err)
 					}
-					pm = append(pm, runtime.PortMap{Host: hp, Container: cp})
 				}
-				ipForwardOrig, ipSuffix, err = runtime.SetupNetworking(pid, id, pm, nil)
+				if err := startDNS(network); err != nil {
+					fmt.Fprintf(os.Stderr, "warning: container names will not resolve: %v\n", err)
+				}
+			} else if cniMode {
+				cniResult, err = runtime.CNIAdd(cniConf, id, pid, ports)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "network setup failed: %v\n", err)
-					os.Exit(1)
+					abortStart("network setup failed: %v\n", err)
+				}
+				ipAddress, ip6Address = runtime.CNIAddresses(cniResult)
+			}
+			if useProxy {
+				proxyPID, err = startPortProxy(pid, ipAddress, ports)
+				if err != nil {
+					abortStart("port publishing failed: %v\n", err)
+				}
+			}
+			if restartCount > 0 {
+				if st := getStore(); st != nil {
+					reconnectNetworks(st, id, pid, network.Name, firewallName)
 				}
-			} else {
 			}
 
 			info := store.ContainerInfo{
@@ -259,11 +523,28 @@ var RunCmd = &cobra.Command{
 				RestartCount:   restartCount,
 				HealthCmd:      healthCmd,
 				HealthInterval: healthInterval,
+				HealthPSI:      strings.Join(healthPSI, ","),
 				RestartMax:     restartMax,
-				Ports:          strings.Join(publish, ","),
+				Ports:          ports,
 				IpForwardOrig:  ipForwardOrig,
-				NetworkSetup:   enableNet || len(publish) > 0,
-				IPSuffix:       ipSuffix,
+				Ip6ForwardOrig: ip6ForwardOrig,
+				NetworkSetup:   networkSetup,
+				Network:        network.Name,
+				Firewall:       firewallName,
+				ProxyPID:       proxyPID,
+				SlirpPID:       slirpPID,
+				Aliases:        networkAliases,
+				EgressAllow:    egressSpecs,
+				NetRate:        shape.RateString(),
+				NetDelay:       shape.DelayString(),
+				NetLoss:        shape.LossString(),
+				CNIResult:      cniResult,
+				IPAddress:      ipAddress,
+				IPv6Address:    ip6Address,
+				MemoryLimit:    memoryLimit,
+				CPUs:           cpus,
+				PidsLimit:      pidsLimit,
+				CPUShares:      cpuShares,
 			}
 			st := getStore()
 			if st != nil {
@@ -272,19 +553,9 @@ var RunCmd = &cobra.Command{
 			if !printedID {
 				fmt.Println(id)
 				printedID = true
-			}
-			if detach {
-				go func() {
-					var ws syscall.WaitStatus
-					syscall.Wait4(pid, &ws, 0, nil)
-					
-					if st := getStore(); st != nil {
-						info.State = "Stopped"
-						_ = st.SaveContainer(info)
-					}
-					runtime.Cleanup(info)
-				}()
-				return
+				if detach {
+					detachOutput()
+				}
 			}
 
 			if pr != nil && master != nil {
@@ -294,7 +565,7 @@ var RunCmd = &cobra.Command{
 				if errAttach != nil {
 					fmt.Fprintf(os.Stderr, "failed to re-attach logs with context: %v\n", errAttach)
 				} else {
-					go func() { _, _ = io.Copy(os.Stdout, pr) }()
+					go func() { _, _ = io.Copy(output, pr) }()
 				}
 			}
 			
@@ -303,7 +574,7 @@ var RunCmd = &cobra.Command{
 			if interval <= 0 {
 				interval = 30 * time.Second
 			}
-			runtime.StartWatchdog(ctx, pid, interval, healthCmd, failCh)
+			runtime.StartWatchdogForContainer(ctx, id, pid, interval, healthCmd, psiThresholds, failCh)
 
 			exitCh := make(chan struct{})
 			go func() {
@@ -318,20 +589,49 @@ var RunCmd = &cobra.Command{
 			case <-exitCh:
 			}
 
-			cancel()
-			runtime.Cleanup(info)
-			if pr != nil {
-				_, _ = io.Copy(io.Discard, pr)
-				pr.Close()
-				pr = nil
+			if stoppedByUser(st, id) {
+				cancel()
+				return
+			}
+			// Must be checked before Cleanup removes the cgroup.
+			oomAt, oomKilled := cgroups.OOMKilled(id)
+			if oomKilled {
+				info.OOMKilled = true
+				info.OOMKilledAt = oomAt
+				logging.Append(id, "OOMKilled")
 			}
 
+			cancel()
+			if st != nil {
+				refreshLimits(st, &info)
+			}
 			shouldRestart := false
 			if restartMax == -1 {
 				shouldRestart = true
 			} else if restartMax > 0 && restartCount < restartMax {
 				shouldRestart = true
 			}
+			if oomKilled && !restartOnOOM {
+				shouldRestart = false
+			}
+
+			// Addresses and host ports are kept across restarts and
+			// released by the final Cleanup.
+			var ns runtime.NetworkStore
+			if st != nil {
+				ns = st
+			}
+			runtime.Cleanup(info, ns, !shouldRestart)
+			if pr != nil {
+				_, _ = io.Copy(io.Discard, pr)
+				pr.Close()
+				pr = nil
+			}
+			// `stop` or `rm` may have come in while the process was
+			// cleaned up; the record is theirs then.
+			if stoppedByUser(st, id) {
+				return
+			}
 
 			if !shouldRestart {
 				if st != nil {
@@ -345,22 +645,47 @@ var RunCmd = &cobra.Command{
 			restartCount++
 			logging.Append(id, fmt.Sprintf("Restart #%d …", restartCount))
 		}
-		if rawSet {
-			term.Restore(int(os.Stdin.Fd()), oldState)
-		}
 	},
 }
 
+// refreshLimits picks up limits changed with `update` while the container
+// was running, so that they survive restarts and the final state save.
+func refreshLimits(st *store.Store, info *store.ContainerInfo) {
+	cur, err := st.GetContainer(info.ID)
+	if err != nil {
+		return
+	}
+	info.MemoryLimit, memoryLimit = cur.MemoryLimit, cur.MemoryLimit
+	info.CPUs, cpus = cur.CPUs, cur.CPUs
+	info.PidsLimit, pidsLimit = cur.PidsLimit, cur.PidsLimit
+	info.CPUShares, cpuShares = cur.CPUShares, cur.CPUShares
+	info.RestartMax, restartMax = cur.RestartMax, cur.RestartMax
+}
+
 func init() {
 	RunCmd.Flags().StringVar(&rootfs, "rootfs", "", "path to container rootfs tar")
 	RunCmd.Flags().StringVar(&command, "cmd", "", "command to run inside container (e.g. \"/bin/sh\")")
 	RunCmd.Flags().Int64Var(&memoryLimit, "memory", 0, "memory limit in bytes (e.g. 104857600 for 100 MB)")
 	RunCmd.Flags().Int64Var(&cpuShares, "cpu-shares", 0, "CPU weight 1–10000 (100 = default)")
-	RunCmd.Flags().StringArrayVarP(&publish, "publish", "p", nil, "publish port mapping H:C")
-	RunCmd.Flags().BoolVar(&enableNet, "network", false, "enable networking namespace")
+	RunCmd.Flags().Float64Var(&cpus, "cpus", 0, "number of CPUs (e.g. 1.5)")
+	RunCmd.Flags().Int64Var(&pidsLimit, "pids-limit", 0, "maximum number of processes (0 = unlimited)")
+	RunCmd.Flags().StringArrayVarP(&publish, "publish", "p", nil, "publish ports as [hostIP:][hostPort[-end]]:containerPort[-end][/tcp|udp|sctp], with an IPv6 hostIP in brackets; without hostPort a free one is picked")
+	RunCmd.Flags().BoolVarP(&publishAll, "publish-all", "P", false, "publish the --expose ports to free host ports")
+	RunCmd.Flags().StringArrayVar(&expose, "expose", nil, "container port or range to publish with --publish-all, e.g. 80 or 5000-5010/udp")
+	RunCmd.Flags().StringVar(&networkName, "network", "", "attach to a network; --network alone uses the default \"bridge\" network, --network=NAME a user-defined one, --network=slirp a user-mode stack that works without root; modes: none, host, container:<ID>, cni:<NAME> for a CNI config list")
+	RunCmd.Flags().Lookup("network").NoOptDefVal = runtime.DefaultNetwork.Name
+	RunCmd.Flags().StringVar(&firewallName, "firewall-backend", "", "firewall used for bridge and port rules: nft or iptables (default: iptables if installed, else nft)")
+	RunCmd.Flags().StringArrayVar(&networkAliases, "network-alias", nil, "additional name of the container in the DNS of its network")
+	RunCmd.Flags().StringArrayVar(&egressAllow, "egress-allow", nil, "only let the container send to ADDR[/BITS][:PORT[-END]][/tcp|udp|sctp]; repeatable, replies are always allowed")
+	RunCmd.Flags().StringVar(&netRate, "net-rate", "", "limit the bandwidth of the container in each direction, e.g. 10mbit or 500kbps")
+	RunCmd.Flags().StringVar(&netDelay, "net-delay", "", "delay packets of the container in each direction, e.g. 50ms")
+	RunCmd.Flags().StringVar(&netLoss, "net-loss", "", "drop a percentage of the packets of the container in each direction, e.g. 1%")
+	RunCmd.Flags().StringVar(&staticIP, "ip", "", "static address on the network (e.g. 10.42.0.50)")
 	RunCmd.Flags().StringVar(&healthCmd, "health-cmd", "", "health check command")
+	RunCmd.Flags().StringArrayVar(&healthPSI, "health-psi", nil, "pressure threshold treated as unhealthy, e.g. memory.some.avg10>40")
 	RunCmd.Flags().IntVar(&healthInterval, "health-interval", 30, "health check interval seconds")
 	RunCmd.Flags().IntVar(&restartMax, "restart-max", 0, "max restarts (0 = no restarts, −1 = unlimited)")
+	RunCmd.Flags().BoolVar(&restartOnOOM, "restart-on-oom", true, "restart after an OOM kill (counts towards --restart-max)")
 	RunCmd.Flags().BoolVarP(&detach, "detach", "d", false, "run container in background")
 	RunCmd.Flags().BoolVarP(&interactive, "interactive", "i", false, "keep stdin open (forward host STDIN)")
 	RunCmd.Flags().BoolVarP(&tty, "tty", "t", false, "allocate a pseudo‑TTY")
@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/spf13/cobra"
+)
+
+var slirpPID int
+
+// SlirpCmd is the shim of `--network slirp` when slirp4netns is not
+// installed: it runs the built-in user-mode stack for the container in the
+// background and exits with it.
+var SlirpCmd = &cobra.Command{
+	Use:    "slirp",
+	Short:  "connect a container through a user-mode network stack (internal)",
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		s, err := runtime.StartSlirp(slirpPID, []string{exe, "port-proxy", "--socket-helper"})
+		if err != nil {
+			fmt.Println("error:", err)
+			return err
+		}
+		defer s.Close()
+		fmt.Println("ready")
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sigCh:
+				return nil
+			case err := <-s.Done():
+				return err
+			case <-ticker.C:
+				if !processExists(slirpPID) {
+					return nil
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	SlirpCmd.Flags().IntVar(&slirpPID, "pid", 0, "PID of the container")
+}
+
+// startSlirp connects container pid to the slirp network, with slirp4netns
+// if it is installed and the built-in stack otherwise. It returns the PID of
+// the process forwarding the traffic.
+func startSlirp(pid int) (int, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	var c *exec.Cmd
+	path, lookErr := exec.LookPath("slirp4netns")
+	if lookErr == nil {
+		// Its addresses and DNS server are the ones of the built-in stack.
+		c = exec.Command(path, "--configure", "--mtu=65520", "--disable-host-loopback", "--ready-fd=3", strconv.Itoa(pid), "tap0")
+		c.ExtraFiles = []*os.File{w}
+	} else {
+		exe, err := os.Executable()
+		if err != nil {
+			w.Close()
+			return 0, err
+		}
+		c = exec.Command(exe, "slirp", "--pid", strconv.Itoa(pid))
+		c.Stdout = w
+	}
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = c.Start()
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+	var line string
+	if lookErr == nil {
+		// slirp4netns writes "1" once the device is configured.
+		b := make([]byte, 1)
+		if n, _ := r.Read(b); n == 1 && b[0] == '1' {
+			line = "ready"
+		}
+	} else {
+		line, _ = bufio.NewReader(r).ReadString('\n')
+		line = strings.TrimSpace(line)
+	}
+	if line != "ready" {
+		c.Process.Kill()
+		c.Wait()
+		if line == "" {
+			line = "exited before the network was ready"
+		}
+		return 0, fmt.Errorf("slirp: %s", strings.TrimPrefix(line, "error: "))
+	}
+	shim := c.Process.Pid
+	c.Process.Release()
+	return shim, nil
+}
@@ -0,0 +1,225 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
+	"github.com/denysk0/pocketDocker/internal/store"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+var (
+	statsNoStream bool
+	statsFormat   string
+)
+
+// statsInterval is the sampling period used to compute CPU usage.
+const statsInterval = time.Second
+
+// containerStats is one row of `stats` output. The table only shows the
+// "some avg10" pressure values, JSON carries the full PSI data.
+type containerStats struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryUsage   uint64  `json:"memory_usage"`
+	MemoryLimit   uint64  `json:"memory_limit"`
+	MemoryPercent float64 `json:"memory_percent"`
+	Pids          uint64  `json:"pids"`
+	BlockRead     uint64  `json:"block_read"`
+	BlockWrite    uint64  `json:"block_write"`
+	NetRx         uint64  `json:"net_rx"`
+	NetTx         uint64  `json:"net_tx"`
+
+	CPUPressure    cgroups.Pressure `json:"cpu_pressure"`
+	MemoryPressure cgroups.Pressure `json:"memory_pressure"`
+	IOPressure     cgroups.Pressure `json:"io_pressure"`
+}
+
+type cpuSample struct {
+	usageUsec uint64
+	at        time.Time
+}
+
+var StatsCmd = &cobra.Command{
+	Use:   "stats [ID...]",
+	Short: "display live resource usage of containers",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if statsFormat != "table" && statsFormat != "json" {
+			return fmt.Errorf("unsupported format %q (use table or json)", statsFormat)
+		}
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		var list []store.ContainerInfo
+		if len(args) == 0 {
+			all, err := st.ListContainers()
+			if err != nil {
+				return err
+			}
+			for _, c := range all {
+				if isLive(c.State) && processExists(c.PID) {
+					list = append(list, c)
+				}
+			}
+		} else {
+			for _, id := range args {
+				c, err := st.GetContainer(id)
+				if err != nil {
+					return fmt.Errorf("unknown container %s", id)
+				}
+				list = append(list, c)
+			}
+		}
+
+		out := cmd.OutOrStdout()
+		clear := statsFormat == "table" && !statsNoStream && isTerminal(out)
+		prev := map[string]cpuSample{}
+		for _, c := range list {
+			prev[c.ID] = sampleCPU(c.ID)
+		}
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cmd.Context().Done():
+				return nil
+			case <-ticker.C:
+			}
+			rows := make([]containerStats, 0, len(list))
+			for _, c := range list {
+				row, sample := collectStats(c, prev[c.ID])
+				prev[c.ID] = sample
+				rows = append(rows, row)
+			}
+			if clear {
+				fmt.Fprint(out, "\033[2J\033[H")
+			}
+			if err := writeStats(out, rows); err != nil {
+				return err
+			}
+			if statsNoStream {
+				return nil
+			}
+		}
+	},
+}
+
+func init() {
+	StatsCmd.Flags().BoolVar(&statsNoStream, "no-stream", false, "print a single sample and exit")
+	StatsCmd.Flags().StringVar(&statsFormat, "format", "table", "output format: table or json")
+}
+
+func sampleCPU(id string) cpuSample {
+	s, _ := cgroups.ReadStats(id)
+	return cpuSample{usageUsec: s.CPUUsageUsec, at: time.Now()}
+}
+
+// collectStats reads the current counters of c and computes CPU usage
+// relative to prev. It returns the row and the new CPU sample.
+func collectStats(c store.ContainerInfo, prev cpuSample) (containerStats, cpuSample) {
+	row := containerStats{ID: c.ID, Name: c.Name}
+	s, err := cgroups.ReadStats(c.ID)
+	now := time.Now()
+	sample := cpuSample{usageUsec: s.CPUUsageUsec, at: now}
+	if err != nil {
+		return row, sample
+	}
+	row.CPUPercent = cpuPercent(prev, sample)
+	row.MemoryUsage = s.MemoryUsage()
+	row.MemoryLimit = s.MemoryLimit
+	if row.MemoryLimit == 0 {
+		row.MemoryLimit = hostMemory()
+	}
+	if row.MemoryLimit > 0 {
+		row.MemoryPercent = float64(row.MemoryUsage) / float64(row.MemoryLimit) * 100
+	}
+	row.Pids = s.PidsCurrent
+	row.BlockRead = s.IOReadBytes
+	row.BlockWrite = s.IOWriteBytes
+	row.CPUPressure = s.CPUPressure
+	row.MemoryPressure = s.MemoryPressure
+	row.IOPressure = s.IOPressure
+	if c.NetworkSetup {
+		var lookup runtime.NetworkLookup
+		if st := getStore(); st != nil {
+			lookup = st
+		}
+		n, _ := runtime.LookupNetwork(lookup, c.Network)
+		if ns, err := runtime.ReadNetStats(n, c.ID); err == nil {
+			row.NetRx = ns.RxBytes
+			row.NetTx = ns.TxBytes
+		}
+	}
+	return row, sample
+}
+
+// cpuPercent returns the CPU time consumed between two samples as a
+// percentage of one CPU, so a busy container on 4 cores can reach 400%.
+func cpuPercent(prev, cur cpuSample) float64 {
+	wall := cur.at.Sub(prev.at).Microseconds()
+	if wall <= 0 || cur.usageUsec < prev.usageUsec {
+		return 0
+	}
+	return float64(cur.usageUsec-prev.usageUsec) / float64(wall) * 100
+}
+
+func writeStats(out io.Writer, rows []containerStats) error {
+	if statsFormat == "json" {
+		enc := json.NewEncoder(out)
+		for _, r := range rows {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tCPU %\tMEM USAGE / LIMIT\tMEM %\tPIDS\tBLOCK I/O\tNET I/O\tPSI CPU/MEM/IO")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%.2f%%\t%s / %s\t%.2f%%\t%d\t%s / %s\t%s / %s\t%.2f/%.2f/%.2f\n",
+			r.ID, r.Name, r.CPUPercent,
+			humanBytes(r.MemoryUsage), humanBytes(r.MemoryLimit), r.MemoryPercent,
+			r.Pids,
+			humanBytes(r.BlockRead), humanBytes(r.BlockWrite),
+			humanBytes(r.NetRx), humanBytes(r.NetTx),
+			r.CPUPressure.Some.Avg10, r.MemoryPressure.Some.Avg10, r.IOPressure.Some.Avg10)
+	}
+	return tw.Flush()
+}
+
+// humanBytes formats n using binary units, e.g. 1.5MiB.
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func hostMemory() uint64 {
+	var si unix.Sysinfo_t
+	if err := unix.Sysinfo(&si); err != nil {
+		return 0
+	}
+	return uint64(si.Totalram) * uint64(si.Unit)
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
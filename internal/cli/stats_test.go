@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHumanBytes(t *testing.T) {
+	cases := map[uint64]string{
+		0:                      "0B",
+		512:                    "512B",
+		1536:                   "1.5KiB",
+		104857600:              "100.0MiB",
+		3 * 1024 * 1024 * 1024: "3.0GiB",
+	}
+	for in, want := range cases {
+		if got := humanBytes(in); got != want {
+			t.Fatalf("humanBytes(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCPUPercent(t *testing.T) {
+	start := time.Unix(100, 0)
+	prev := cpuSample{usageUsec: 1_000_000, at: start}
+	cur := cpuSample{usageUsec: 1_500_000, at: start.Add(time.Second)}
+	if got := cpuPercent(prev, cur); got != 50 {
+		t.Fatalf("cpuPercent = %v, want 50", got)
+	}
+	// A counter reset (e.g. after a restart) must not produce a bogus value.
+	if got := cpuPercent(cur, prev); got != 0 {
+		t.Fatalf("cpuPercent after reset = %v, want 0", got)
+	}
+}
@@ -53,13 +53,15 @@ var StopCmd = &cobra.Command{
 				continue
 			}
 
-			runtime.Cleanup(info)
-
-			if err := st.UpdateContainerState(id, "Stopped"); err != nil {
+			// Marked first so that the run supervising the container
+			// neither restarts it nor cleans up after it.
+			if err := st.MarkStopped(id); err != nil {
 				fmt.Fprintf(os.Stderr, "failed to update container state: %v\n", err)
 				continue
 			}
 
+			runtime.Cleanup(info, st, true)
+
 			fmt.Println("Container", id, "stopped")
 		}
 	},
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
+	"github.com/spf13/cobra"
+)
+
+var (
+	updateMemory     int64
+	updateCPUs       float64
+	updatePidsLimit  int64
+	updateCPUShares  int64
+	updateRestartMax int
+)
+
+var UpdateCmd = &cobra.Command{
+	Use:   "update <ID>",
+	Short: "change resource limits of a container",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		st := getStore()
+		if st == nil {
+			return fmt.Errorf("store not initialized")
+		}
+		info, err := st.GetContainer(args[0])
+		if err != nil {
+			return fmt.Errorf("unknown container")
+		}
+		flags := cmd.Flags()
+		// Zero would record no limit while the old one stays in force.
+		for _, name := range []string{"memory", "cpus", "pids-limit", "cpu-shares"} {
+			if flags.Changed(name) && flags.Lookup(name).Value.String() == "0" {
+				return fmt.Errorf("invalid --%s 0: use -1 to remove the limit", name)
+			}
+		}
+		var res cgroups.Resources
+		if flags.Changed("memory") {
+			res.MemoryMax = updateMemory
+			info.MemoryLimit = max(updateMemory, 0)
+		}
+		if flags.Changed("cpus") {
+			res.CPUs = updateCPUs
+			info.CPUs = max(updateCPUs, 0)
+		}
+		if flags.Changed("pids-limit") {
+			res.PidsMax = updatePidsLimit
+			info.PidsLimit = max(updatePidsLimit, 0)
+		}
+		if flags.Changed("cpu-shares") {
+			res.CPUWeight = updateCPUShares
+			info.CPUShares = max(updateCPUShares, 0)
+		}
+		if flags.Changed("restart-max") {
+			info.RestartMax = updateRestartMax
+		}
+		if res == (cgroups.Resources{}) && !flags.Changed("restart-max") {
+			return fmt.Errorf("nothing to update")
+		}
+
+		// Limits of a stopped container are only persisted and applied by
+		// the next start. A frozen cgroup takes them like a running one.
+		if isLive(info.State) && processExists(info.PID) {
+			if err := cgroups.ApplyResources(info.ID, res); err != nil {
+				return fmt.Errorf("update rejected, no limits changed: %w", err)
+			}
+		}
+		if err := st.SaveContainer(info); err != nil {
+			return err
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), info.ID)
+		return nil
+	},
+}
+
+func init() {
+	UpdateCmd.Flags().Int64Var(&updateMemory, "memory", 0, "memory limit in bytes (-1 = unlimited)")
+	UpdateCmd.Flags().Float64Var(&updateCPUs, "cpus", 0, "number of CPUs (-1 = unlimited)")
+	UpdateCmd.Flags().Int64Var(&updatePidsLimit, "pids-limit", 0, "maximum number of processes (-1 = unlimited)")
+	UpdateCmd.Flags().Int64Var(&updateCPUShares, "cpu-shares", 0, "CPU weight 1–10000 (-1 = default)")
+	UpdateCmd.Flags().IntVar(&updateRestartMax, "restart-max", 0, "max restarts (0 = no restarts, −1 = unlimited)")
+}
@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
+	"github.com/denysk0/pocketDocker/internal/store"
+)
+
+func TestUpdateCmdWritesCgroupAndStore(t *testing.T) {
+	tmp := t.TempDir()
+	st, err := store.NewStore(filepath.Join(tmp, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	if err := st.Init(); err != nil {
+		t.Fatal(err)
+	}
+	SetStore(st)
+	defer SetStore(nil)
+
+	oldRoot := cgroups.CgroupRoot
+	cgroups.CgroupRoot = filepath.Join(tmp, "cgroup")
+	defer func() { cgroups.CgroupRoot = oldRoot }()
+	dir := filepath.Join(cgroups.CgroupRoot, "ctn")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "memory.max"), []byte("max"), 0644)
+	os.WriteFile(filepath.Join(dir, "pids.max"), []byte("max"), 0644)
+
+	info := store.ContainerInfo{ID: "ctn", State: "Running", PID: os.Getpid(), StartedAt: time.Now()}
+	if err := st.SaveContainer(info); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	UpdateCmd.SetOut(buf)
+	UpdateCmd.SetArgs([]string{"ctn", "--memory", "1048576", "--pids-limit", "32", "--restart-max", "3"})
+	if err := UpdateCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "memory.max")); string(data) != "1048576" {
+		t.Fatalf("memory.max = %q", data)
+	}
+	got, err := st.GetContainer("ctn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.MemoryLimit != 1048576 || got.PidsLimit != 32 || got.RestartMax != 3 {
+		t.Fatalf("limits not persisted: %+v", got)
+	}
+
+	// cpu.max is missing, so the whole update must be rejected.
+	UpdateCmd.SetArgs([]string{"ctn", "--memory", "2097152", "--cpus", "1"})
+	if err := UpdateCmd.Execute(); err == nil {
+		t.Fatal("expected update to fail")
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "memory.max")); string(data) != "1048576" {
+		t.Fatalf("memory.max changed by failed update: %q", data)
+	}
+	if got, _ := st.GetContainer("ctn"); got.MemoryLimit != 1048576 {
+		t.Fatalf("store changed by failed update: %d", got.MemoryLimit)
+	}
+
+	// Zero is no limit to apply; -1 removes it.
+	UpdateCmd.SetArgs([]string{"ctn", "--memory", "0"})
+	if err := UpdateCmd.Execute(); err == nil {
+		t.Fatal("--memory 0 accepted")
+	}
+	if got, _ := st.GetContainer("ctn"); got.MemoryLimit != 1048576 {
+		t.Fatalf("store changed by --memory 0: %d", got.MemoryLimit)
+	}
+
+	// The cgroup of a paused container takes new limits too.
+	os.WriteFile(filepath.Join(dir, "cpu.max"), []byte("max 100000"), 0644)
+	if err := st.UpdateContainerState("ctn", "Paused"); err != nil {
+		t.Fatal(err)
+	}
+	UpdateCmd.SetArgs([]string{"ctn", "--memory", "4194304", "--cpus", "1"})
+	if err := UpdateCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "memory.max")); string(data) != "4194304" {
+		t.Fatalf("memory.max of paused container = %q", data)
+	}
+}
@@ -0,0 +1,115 @@
+//go:build linux
+
+package image
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/util"
+)
+
+// DockerConfig is the Docker client configuration registry credentials are
+// read from: $DOCKER_CONFIG/config.json or ~/.docker/config.json.
+var DockerConfig = dockerConfigPath()
+
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(util.UserHomeDir(), ".docker", "config.json")
+}
+
+// dockerHubServer is the key of Docker Hub credentials.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// Credentials returns the user name and password stored for registry by
+// docker login, either in DockerConfig or with the credential helper it
+// names. Both are empty if there are none.
+func Credentials(registry string) (user, password string, err error) {
+	data, err := os.ReadFile(DockerConfig)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+		CredsStore  string            `json:"credsStore"`
+		CredHelpers map[string]string `json:"credHelpers"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", fmt.Errorf("%s: %w", DockerConfig, err)
+	}
+	server := registry
+	if registry == DockerHub {
+		server = dockerHubServer
+	}
+	if helper := config.CredHelpers[registry]; helper != "" {
+		return helperCredentials(helper, server)
+	}
+	if config.CredsStore != "" {
+		return helperCredentials(config.CredsStore, server)
+	}
+	for key, a := range config.Auths {
+		if serverHost(key) != serverHost(server) {
+			continue
+		}
+		if a.Auth == "" {
+			return a.Username, a.Password, nil
+		}
+		dec, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("%s: auth of %s: %w", DockerConfig, key, err)
+		}
+		user, password, _ = strings.Cut(string(dec), ":")
+		return user, password, nil
+	}
+	return "", "", nil
+}
+
+// serverHost returns the host of a server as docker login stores it, with
+// or without scheme and path.
+func serverHost(server string) string {
+	if _, rest, ok := strings.Cut(server, "://"); ok {
+		server = rest
+	}
+	host, _, _ := strings.Cut(server, "/")
+	return host
+}
+
+// helperCredentials asks docker-credential-<helper> for the credentials of
+// server.
+func helperCredentials(helper, server string) (string, string, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, "credentials not found") {
+			return "", "", nil
+		}
+		return "", "", fmt.Errorf("credential helper %s: %v: %s", helper, err, out)
+	}
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return "", "", fmt.Errorf("credential helper %s: %w", helper, err)
+	}
+	return creds.Username, creds.Secret, nil
+}
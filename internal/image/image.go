@@ -0,0 +1,323 @@
+//go:build linux
+
+// Package image turns saved container images into a root filesystem. It
+// reads archives written by docker save and OCI image layouts, as tarballs
+// or directories, and applies their layers in order.
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/archive"
+)
+
+// Format is the kind of a saved image.
+type Format string
+
+const (
+	// FormatDocker is the archive of docker save, listing its layers in
+	// manifest.json.
+	FormatDocker Format = "docker"
+	// FormatOCI is an OCI image layout: oci-layout, index.json and blobs.
+	FormatOCI Format = "oci"
+)
+
+// maxLinks bounds the links followed to find a file in an archive, and the
+// indexes followed to find a manifest.
+const maxLinks = 16
+
+// maxManifestSize bounds the manifests and indexes read into memory.
+const maxManifestSize = 4 << 20
+
+// Detect returns the format of the image archive or layout directory at
+// path, or "" if it is neither, e.g. a plain rootfs tarball. Only
+// uncompressed archives are recognised, as docker save writes them.
+func Detect(path string) (Format, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	var names map[string]bool
+	if fi.IsDir() {
+		names = make(map[string]bool)
+		for _, name := range []string{"oci-layout", "index.json", "manifest.json"} {
+			if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+				names[name] = true
+			}
+		}
+	} else if names, err = topLevelNames(path); err != nil {
+		return "", err
+	}
+	switch {
+	case names["oci-layout"] && names["index.json"]:
+		return FormatOCI, nil
+	case names["manifest.json"]:
+		return FormatDocker, nil
+	}
+	return "", nil
+}
+
+// topLevelNames returns the names of the files at the top of the tarball
+// at p, or none if it is not an uncompressed tarball.
+func topLevelNames(p string) (map[string]bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names := make(map[string]bool)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, nil
+		}
+		if name := memberName(hdr.Name); !strings.Contains(name, "/") {
+			names[name] = true
+		}
+	}
+}
+
+// Unpack applies the layers of the image at path onto dir, which must
+// exist. Layers stored under their digest are verified against it. From an
+// OCI layout, the first image for the host platform is taken; from a
+// docker save archive, the first image.
+func Unpack(path, dir string) error {
+	format, err := Detect(path)
+	if err != nil {
+		return err
+	}
+	var src source = tarSource(path)
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		src = dirSource(path)
+	}
+	var layers []layer
+	switch format {
+	case FormatDocker:
+		layers, err = dockerLayers(src)
+	case FormatOCI:
+		layers, err = ociLayers(src)
+	default:
+		return fmt.Errorf("%s is not a docker save archive or OCI image layout", path)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, l := range layers {
+		if err := l.apply(src, dir); err != nil {
+			return fmt.Errorf("%s: layer %s: %w", path, l.name, err)
+		}
+	}
+	return nil
+}
+
+// layer is a layer file of an image and, if known, its digest.
+type layer struct {
+	name, digest string
+}
+
+func (l layer) apply(src source, dir string) error {
+	f, err := src.Open(l.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ApplyLayer(f, l.digest, dir)
+}
+
+// ApplyLayer applies the layer r onto dir with whiteouts. Unless digest is
+// empty, r is first stored in a temporary file next to dir and only
+// applied once its content matched digest.
+func ApplyLayer(r io.Reader, digest, dir string) error {
+	if digest == "" {
+		return archive.ApplyLayer(r, dir)
+	}
+	f, err := os.CreateTemp(filepath.Dir(dir), ".layer-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, VerifyReader(r, digest)); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return archive.ApplyLayer(f, dir)
+}
+
+// dockerLayers returns the layers of the first image in the manifest.json
+// of a docker save archive. Layers named after their digest, as written by
+// Docker 25 and later, carry it for verification.
+func dockerLayers(src source) ([]layer, error) {
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := readJSON(src, "manifest.json", "", &manifest); err != nil {
+		return nil, err
+	}
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("manifest.json lists no images")
+	}
+	var layers []layer
+	for _, name := range manifest[0].Layers {
+		l := layer{name: name}
+		if alg, sum, ok := strings.Cut(strings.TrimPrefix(memberName(name), "blobs/"), "/"); ok && ValidDigest(alg+":"+sum) {
+			l.digest = alg + ":" + sum
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+// ociLayers returns the layers of the image index.json of an OCI layout
+// points to, following nested indexes.
+func ociLayers(src source) ([]layer, error) {
+	var m Manifest
+	if err := readJSON(src, "index.json", "", &m); err != nil {
+		return nil, err
+	}
+	for i := 0; m.IsIndex() || i == 0; i++ {
+		if i == maxLinks {
+			return nil, fmt.Errorf("too many nested indexes")
+		}
+		d, err := SelectManifest(m)
+		if err != nil {
+			return nil, err
+		}
+		if !ValidDigest(d.Digest) {
+			return nil, fmt.Errorf("invalid digest %q", d.Digest)
+		}
+		m = Manifest{}
+		if err := readJSON(src, blobPath(d.Digest), d.Digest, &m); err != nil {
+			return nil, err
+		}
+	}
+	var layers []layer
+	for _, d := range m.Layers {
+		if !ValidDigest(d.Digest) {
+			return nil, fmt.Errorf("invalid layer digest %q", d.Digest)
+		}
+		layers = append(layers, layer{blobPath(d.Digest), d.Digest})
+	}
+	return layers, nil
+}
+
+// blobPath returns the name of the blob with digest in an OCI layout.
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// readJSON decodes the file name of src into v, verifying it against
+// digest unless that is empty.
+func readJSON(src source, name, digest string, v any) error {
+	f, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = io.LimitReader(f, maxManifestSize)
+	if digest != "" {
+		r = VerifyReader(r, digest)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// source reads the files of an image archive or layout directory.
+type source interface {
+	Open(name string) (io.ReadCloser, error)
+}
+
+// memberName returns name relative to the top of an archive.
+func memberName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirSource reads files from a directory.
+type dirSource string
+
+func (s dirSource) Open(name string) (io.ReadCloser, error) {
+	if name = path.Clean(name); path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return nil, fmt.Errorf("%s: path escapes the image", name)
+	}
+	return os.Open(filepath.Join(string(s), filepath.FromSlash(name)))
+}
+
+// tarSource reads files from an uncompressed tarball, following links
+// between its members.
+type tarSource string
+
+func (s tarSource) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(string(s))
+	if err != nil {
+		return nil, err
+	}
+	name = memberName(name)
+	for range maxLinks {
+		hdr, tr, err := findMember(f, name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			return struct {
+				io.Reader
+				io.Closer
+			}{tr, f}, nil
+		case tar.TypeSymlink:
+			name = memberName(path.Join(path.Dir(name), hdr.Linkname))
+			if path.IsAbs(hdr.Linkname) {
+				name = memberName(hdr.Linkname)
+			}
+		case tar.TypeLink:
+			name = memberName(hdr.Linkname)
+		default:
+			f.Close()
+			return nil, fmt.Errorf("%s: not a regular file", name)
+		}
+	}
+	f.Close()
+	return nil, fmt.Errorf("%s: too many links", name)
+}
+
+// findMember returns the header of the member name of the tarball f and a
+// reader positioned at its content.
+func findMember(f *os.File, name string) (*tar.Header, *tar.Reader, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if memberName(hdr.Name) == name {
+			return hdr, tr, nil
+		}
+	}
+}
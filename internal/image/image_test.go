@@ -0,0 +1,263 @@
+//go:build linux
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// file is a member of a test archive: a regular file, or a symlink when
+// link is set.
+type file struct {
+	name, body, link string
+}
+
+func makeTar(t *testing.T, files ...file) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), Typeflag: tar.TypeReg}
+		if f.link != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, f.link, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.body))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func digest(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The layers of the test images: the second one deletes and replaces
+// files of the first.
+func testLayers(t *testing.T) [][]byte {
+	base := makeTar(t,
+		file{name: "etc/os-release", body: "base"},
+		file{name: "etc/motd", body: "hello"},
+		file{name: "var/lib/old", body: "old"},
+	)
+	top := makeTar(t,
+		file{name: "etc/.wh.motd"},
+		file{name: "var/lib/.wh..wh..opq"},
+		file{name: "var/lib/new", body: "new"},
+		file{name: "bin/app", body: "app"},
+	)
+	return [][]byte{base, gzipped(t, top)}
+}
+
+func checkRootfs(t *testing.T, dir string) {
+	t.Helper()
+	for name, want := range map[string]string{"etc/os-release": "base", "var/lib/new": "new", "bin/app": "app"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v; want %q", name, data, err, want)
+		}
+	}
+	for _, name := range []string{"etc/motd", "etc/.wh.motd", "var/lib/old", "var/lib/.wh..wh..opq"} {
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s exists: %v", name, err)
+		}
+	}
+}
+
+// dockerSave returns the files of a docker save archive in the layout of
+// Docker before 25, with a duplicate layer stored as a symlink.
+func dockerSave(t *testing.T) []file {
+	layers := testLayers(t)
+	return []file{
+		{name: "1111/layer.tar", body: string(layers[0])},
+		{name: "2222/layer.tar", body: string(layers[1])},
+		{name: "3333/layer.tar", link: "../1111/layer.tar"},
+		{name: "config.json", body: "{}"},
+		{name: "manifest.json", body: string(mustJSON(t, []map[string]any{{
+			"Config":   "config.json",
+			"RepoTags": []string{"app:latest"},
+			"Layers":   []string{"1111/layer.tar", "3333/layer.tar", "2222/layer.tar"},
+		}}))},
+		{name: "repositories", body: "{}"},
+	}
+}
+
+// ociLayout returns the files of an OCI image layout whose index holds a
+// multi-platform index, with the host image between two others.
+func ociLayout(t *testing.T) []file {
+	var files []file
+	blob := func(data []byte) Descriptor {
+		d := Descriptor{Digest: digest(data), Size: int64(len(data))}
+		files = append(files, file{name: blobPath(d.Digest), body: string(data)})
+		return d
+	}
+	manifest := Manifest{MediaType: MediaTypeOCIManifest, Config: blob([]byte("{}"))}
+	for _, l := range testLayers(t) {
+		manifest.Layers = append(manifest.Layers, blob(l))
+	}
+	host := blob(mustJSON(t, manifest))
+	host.MediaType, host.Platform = MediaTypeOCIManifest, &HostPlatform
+	other := blob(mustJSON(t, Manifest{MediaType: MediaTypeOCIManifest, Layers: []Descriptor{blob(makeTar(t, file{name: "wrong", body: "x"}))}}))
+	other.MediaType, other.Platform = MediaTypeOCIManifest, &Platform{OS: "windows", Architecture: "amd64"}
+	unknown := other
+	unknown.Platform = &Platform{OS: "unknown", Architecture: "unknown"}
+	index := blob(mustJSON(t, Manifest{MediaType: MediaTypeOCIIndex, Manifests: []Descriptor{other, host, unknown}}))
+	index.MediaType = MediaTypeOCIIndex
+	return append(files,
+		file{name: "oci-layout", body: `{"imageLayoutVersion":"1.0.0"}`},
+		file{name: "index.json", body: string(mustJSON(t, Manifest{Manifests: []Descriptor{index}}))},
+	)
+}
+
+func writeTar(t *testing.T, files []file) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(p, makeTar(t, files...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func writeDir(t *testing.T, files []file) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		var err error
+		if f.link != "" {
+			err = os.Symlink(f.link, p)
+		} else {
+			err = os.WriteFile(p, []byte(f.body), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestUnpack(t *testing.T) {
+	images := map[string]struct {
+		path   string
+		format Format
+	}{
+		"docker archive": {writeTar(t, dockerSave(t)), FormatDocker},
+		"docker dir":     {writeDir(t, dockerSave(t)), FormatDocker},
+		"oci archive":    {writeTar(t, ociLayout(t)), FormatOCI},
+		"oci dir":        {writeDir(t, ociLayout(t)), FormatOCI},
+	}
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			if format, err := Detect(img.path); err != nil || format != img.format {
+				t.Fatalf("Detect = %q, %v", format, err)
+			}
+			dir := t.TempDir()
+			if err := Unpack(img.path, dir); err != nil {
+				t.Fatal(err)
+			}
+			checkRootfs(t, dir)
+		})
+	}
+}
+
+func TestDetectRootfs(t *testing.T) {
+	rootfs := writeTar(t, []file{{name: "etc/manifest.json", body: "{}"}, {name: "bin/sh", body: "#!"}})
+	compressed := filepath.Join(t.TempDir(), "rootfs.tar.gz")
+	os.WriteFile(compressed, gzipped(t, makeTar(t, file{name: "manifest.json", body: "[]"})), 0644)
+	for _, p := range []string{rootfs, compressed, t.TempDir()} {
+		if format, err := Detect(p); err != nil || format != "" {
+			t.Errorf("Detect(%s) = %q, %v", p, format, err)
+		}
+	}
+	if err := Unpack(rootfs, t.TempDir()); err == nil {
+		t.Fatal("unpacked a rootfs tarball as an image")
+	}
+}
+
+func TestUnpackVerifiesDigests(t *testing.T) {
+	files := ociLayout(t)
+	for i, f := range files {
+		if strings.Contains(f.body, "\x00") {
+			// Corrupt the first layer blob, keeping its name.
+			files[i].body = string(makeTar(t, file{name: "evil", body: "x"}))
+			break
+		}
+	}
+	dir := t.TempDir()
+	if err := Unpack(writeTar(t, files), dir); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("Unpack = %v", err)
+	}
+	// The layer is verified before anything is unpacked.
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("unverified layer unpacked: %v", entries)
+	}
+}
+
+func TestUnpackRejectsEscapes(t *testing.T) {
+	files := []file{{name: "manifest.json", body: `[{"Layers":["../secret.tar"]}]`}}
+	src := writeDir(t, files)
+	os.WriteFile(filepath.Join(filepath.Dir(src), "secret.tar"), makeTar(t, file{name: "pwned", body: "x"}), 0644)
+	dir := t.TempDir()
+	if err := Unpack(src, dir); err == nil {
+		t.Fatal("layer outside of the image applied")
+	}
+	if err := Unpack(writeTar(t, files), dir); err == nil {
+		t.Fatal("missing layer applied")
+	}
+}
+
+func TestSelectManifest(t *testing.T) {
+	amd64 := Descriptor{Digest: "amd64", Platform: &Platform{OS: "linux", Architecture: "amd64"}}
+	arm64 := Descriptor{Digest: "arm64", Platform: &Platform{OS: "linux", Architecture: "arm64"}}
+	armv7 := Descriptor{Digest: "armv7", Platform: &Platform{OS: "linux", Architecture: "arm", Variant: "v7"}}
+	old := HostPlatform
+	t.Cleanup(func() { HostPlatform = old })
+	for _, tc := range []struct {
+		host Platform
+		want string
+	}{
+		{Platform{OS: "linux", Architecture: "amd64"}, "amd64"},
+		{Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, "arm64"},
+		{Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, "armv7"},
+		{Platform{OS: "linux", Architecture: "arm", Variant: "v6"}, ""},
+	} {
+		HostPlatform = tc.host
+		d, err := SelectManifest(Manifest{Manifests: []Descriptor{amd64, arm64, armv7}})
+		if d.Digest != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("%s: SelectManifest = %q, %v", tc.host, d.Digest, err)
+		}
+	}
+}
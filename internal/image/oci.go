@@ -0,0 +1,143 @@
+//go:build linux
+
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// Media types of manifests and indexes, in their OCI and Docker flavours.
+const (
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	MediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// Descriptor points to a blob by digest.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Platform is the system an image was built for.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is an image manifest or an index of manifests; which one is
+// told by the media type, or by Manifests being set when it is missing.
+type Manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+	Manifests []Descriptor `json:"manifests"`
+}
+
+// IsIndex reports whether m lists manifests rather than layers.
+func (m Manifest) IsIndex() bool {
+	switch m.MediaType {
+	case MediaTypeOCIIndex, MediaTypeDockerList:
+		return true
+	case MediaTypeOCIManifest, MediaTypeDockerManifest:
+		return false
+	}
+	return m.Manifests != nil
+}
+
+// HostPlatform is the platform images are selected for.
+var HostPlatform = Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH, Variant: armVariant()}
+
+func armVariant() string {
+	if runtime.GOARCH == "arm64" {
+		return "v8"
+	}
+	return ""
+}
+
+// Matches reports whether p can run on host. A missing variant matches any.
+func (p Platform) Matches(host Platform) bool {
+	variant := p.Variant
+	if p.Architecture == "arm64" && variant == "" {
+		variant = "v8"
+	}
+	return p.OS == host.OS && p.Architecture == host.Architecture &&
+		(variant == "" || host.Variant == "" || variant == host.Variant)
+}
+
+func (p Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// SelectManifest returns the first manifest of index for HostPlatform.
+// Entries without a platform match any.
+func SelectManifest(index Manifest) (Descriptor, error) {
+	if len(index.Manifests) == 0 {
+		return Descriptor{}, fmt.Errorf("index lists no images")
+	}
+	for _, d := range index.Manifests {
+		if d.Platform == nil || d.Platform.Matches(HostPlatform) {
+			return d, nil
+		}
+	}
+	var have []string
+	for _, d := range index.Manifests {
+		have = append(have, d.Platform.String())
+	}
+	return Descriptor{}, fmt.Errorf("no image for %s, only for %s", HostPlatform, strings.Join(have, ", "))
+}
+
+var digestRE = regexp.MustCompile(`^(sha256:[a-f0-9]{64}|sha512:[a-f0-9]{128})$`)
+
+// ValidDigest reports whether digest is a sha256 or sha512 digest, the
+// algorithms images are verified with.
+func ValidDigest(digest string) bool {
+	return digestRE.MatchString(digest)
+}
+
+// VerifyReader returns a reader yielding the content of r that fails
+// instead of reaching EOF if the content does not match digest, which must
+// be valid.
+func VerifyReader(r io.Reader, digest string) io.Reader {
+	alg, sum, _ := strings.Cut(digest, ":")
+	h := sha256.New()
+	if alg == "sha512" {
+		h = sha512.New()
+	}
+	return &verifyReader{r: r, h: h, digest: digest, sum: sum}
+}
+
+type verifyReader struct {
+	r      io.Reader
+	h      hash.Hash
+	digest string
+	sum    string
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.h.Sum(nil)); got != v.sum {
+			return n, fmt.Errorf("digest mismatch: expected %s, got %s", v.digest, got)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DockerHub is the registry of references without one, as in "alpine:3.20".
+const DockerHub = "docker.io"
+
+// dockerHubAPI serves the registry API of DockerHub.
+const dockerHubAPI = "registry-1.docker.io"
+
+// Reference names an image in a registry.
+type Reference struct {
+	// Registry is the host, and port if any, of the registry.
+	Registry string
+	// Repository is the path of the image, e.g. "library/alpine".
+	Repository string
+	// Tag is empty if Digest is set.
+	Tag    string
+	Digest string
+}
+
+var (
+	repositoryRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRE        = regexp.MustCompile(`^\w[\w.-]{0,127}$`)
+	registryRE   = regexp.MustCompile(`^[a-zA-Z0-9.-]+(?::[0-9]+)?$`)
+)
+
+// ParseReference parses an image reference the way docker pull does:
+// [REGISTRY/]REPOSITORY[:TAG][@DIGEST]. The registry defaults to Docker Hub,
+// where single-component repositories live under "library/", and the tag to
+// "latest".
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !ValidDigest(ref.Digest) {
+			return Reference{}, fmt.Errorf("invalid reference %q: bad digest", s)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRE.MatchString(ref.Tag) {
+			return Reference{}, fmt.Errorf("invalid reference %q: bad tag", s)
+		}
+	}
+	ref.Registry = DockerHub
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		if !registryRE.MatchString(first) {
+			return Reference{}, fmt.Errorf("invalid reference %q: bad registry", s)
+		}
+		ref.Registry, name = first, rest
+	}
+	if ref.Registry == DockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repositoryRE.MatchString(name) {
+		return Reference{}, fmt.Errorf("invalid reference %q", s)
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// apiHost returns the host serving the registry API of r.
+func (r Reference) apiHost() string {
+	if r.Registry == DockerHub {
+		return dockerHubAPI
+	}
+	return r.Registry
+}
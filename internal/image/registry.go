@@ -0,0 +1,267 @@
+//go:build linux
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPClient sends the requests to registries.
+var HTTPClient = http.DefaultClient
+
+// manifestTypes are the manifests accepted from registries.
+var manifestTypes = []string{MediaTypeOCIIndex, MediaTypeDockerList, MediaTypeOCIManifest, MediaTypeDockerManifest}
+
+// Pull downloads the image ref for the host platform from its registry and
+// applies its layers onto dir, which must exist. Manifests and layers are
+// verified against their digests. The registry is spoken to over HTTPS,
+// unless plainHTTP is set. Credentials are looked up with Credentials.
+func Pull(ref Reference, dir string, plainHTTP bool) error {
+	r := registry{ref: ref, base: "https://" + ref.apiHost()}
+	if plainHTTP {
+		r.base = "http://" + ref.apiHost()
+	}
+	name := ref.Digest
+	if name == "" {
+		name = ref.Tag
+	}
+	var m Manifest
+	var err error
+	for i := 0; ; i++ {
+		if i == maxLinks {
+			return fmt.Errorf("%s: too many nested indexes", ref)
+		}
+		if m, err = r.manifest(name); err != nil {
+			return fmt.Errorf("%s: %w", ref, err)
+		}
+		if !m.IsIndex() {
+			break
+		}
+		d, err := SelectManifest(m)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ref, err)
+		}
+		if !ValidDigest(d.Digest) {
+			return fmt.Errorf("%s: invalid digest %q", ref, d.Digest)
+		}
+		name = d.Digest
+	}
+	for _, d := range m.Layers {
+		if !ValidDigest(d.Digest) {
+			return fmt.Errorf("%s: invalid layer digest %q", ref, d.Digest)
+		}
+		if err := r.applyBlob(d.Digest, dir); err != nil {
+			return fmt.Errorf("%s: layer %s: %w", ref, d.Digest, err)
+		}
+	}
+	return nil
+}
+
+// registry speaks the Distribution API for one repository.
+type registry struct {
+	ref  Reference
+	base string
+	// auth is the Authorization header, once a challenge was answered.
+	auth string
+}
+
+// manifest fetches the manifest name, a tag or a digest. It is verified
+// against the digest it is fetched by, or the one the registry reports for
+// a tag.
+func (r *registry) manifest(name string) (Manifest, error) {
+	resp, err := r.get("/manifests/"+name, strings.Join(manifestTypes, ", "))
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer resp.Body.Close()
+	digest := name
+	if !ValidDigest(name) {
+		digest = resp.Header.Get("Docker-Content-Digest")
+	}
+	var body io.Reader = io.LimitReader(resp.Body, maxManifestSize)
+	if ValidDigest(digest) {
+		body = VerifyReader(body, digest)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("manifest %s: %w", name, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Manifest{}, fmt.Errorf("manifest %s: %w", name, err)
+	}
+	if m.MediaType == "" {
+		m.MediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	}
+	return m, nil
+}
+
+// applyBlob downloads the layer with digest and applies it onto dir.
+func (r *registry) applyBlob(digest, dir string) error {
+	resp, err := r.get("/blobs/"+digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return ApplyLayer(resp.Body, digest, dir)
+}
+
+// get requests path below the repository and returns the response if it
+// succeeded. A challenge for authentication is answered once.
+func (r *registry) get(path, accept string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", r.base+"/v2/"+r.ref.Repository+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if r.auth != "" {
+			req.Header.Set("Authorization", r.auth)
+		}
+		resp, err := HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		err = registryError(resp)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return nil, err
+		}
+		if r.auth, err = r.authorize(resp.Header.Get("WWW-Authenticate")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authorize answers the challenge of a WWW-Authenticate header with the
+// credentials for the registry: with a token from the Bearer realm, or
+// with them directly for Basic.
+func (r *registry) authorize(challenge string) (string, error) {
+	user, password, err := Credentials(r.ref.Registry)
+	if err != nil {
+		return "", err
+	}
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if user == "" {
+			return "", fmt.Errorf("authentication required, run docker login %s", r.ref.Registry)
+		}
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(user, password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := r.token(params, user, password)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported authentication %q", challenge)
+}
+
+// token fetches a bearer token from the realm of a challenge.
+func (r *registry) token(params map[string]string, user, password string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + r.ref.Repository + ":pull"
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token: %w", registryError(resp))
+	}
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&t); err != nil {
+		return "", fmt.Errorf("token: %w", err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return "", fmt.Errorf("token: empty response")
+	}
+	return t.Token, nil
+}
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters, such as realm, service and scope for Bearer.
+func parseChallenge(h string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, after = after[1:end+1], after[end+2:]
+		} else {
+			value, after, _ = strings.Cut(after, ",")
+			after = "," + after
+		}
+		params[key] = value
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(after), ","))
+	}
+	return scheme, params
+}
+
+// registryError describes a failed response, with the messages of the
+// errors the registry reports in its body.
+func registryError(resp *http.Response) error {
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body)
+	var msgs []string
+	for _, e := range body.Errors {
+		msgs = append(msgs, strings.ToLower(e.Code)+": "+e.Message)
+	}
+	if len(msgs) == 0 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.Join(msgs, "; "))
+}
@@ -0,0 +1,207 @@
+//go:build linux
+
+package image
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry serves the image of ociLayout as app:1.0 under the
+// repository team/app, behind a token server accepting user:secret. Blobs
+// are served through a redirect, as registries backed by object storage do.
+// It returns the server, the requests it received and its blobs by digest.
+func fakeRegistry(t *testing.T) (*httptest.Server, *[]string, map[string]string) {
+	t.Helper()
+	blobs := make(map[string]string)
+	var index string
+	for _, f := range ociLayout(t) {
+		if sum, ok := strings.CutPrefix(f.name, "blobs/sha256/"); ok {
+			blobs["sha256:"+sum] = f.body
+		}
+		if f.name == "index.json" {
+			index = f.body
+		}
+	}
+	var log []string
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log = append(log, req.Method+" "+req.URL.Path)
+		if req.URL.Path == "/token" {
+			if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.URL.Query().Get("scope") != "repository:team/app:pull" || req.URL.Query().Get("service") != "fake" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token":"t0ken"}`))
+			return
+		}
+		if blob, ok := strings.CutPrefix(req.URL.Path, "/storage/"); ok {
+			w.Write([]byte(blobs[blob]))
+			return
+		}
+		if req.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+srv.URL+`/token",service="fake",scope="repository:team/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path, ok := strings.CutPrefix(req.URL.Path, "/v2/team/app/")
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		switch kind, name, _ := strings.Cut(path, "/"); {
+		case kind == "manifests" && name == "1.0":
+			// The layout index, without a media type, stands for the tag.
+			w.Header().Set("Content-Type", MediaTypeOCIIndex)
+			w.Header().Set("Docker-Content-Digest", digest([]byte(index)))
+			w.Write([]byte(index))
+		case kind == "manifests" && blobs[name] != "":
+			w.Header().Set("Content-Type", MediaTypeOCIManifest)
+			w.Write([]byte(blobs[name]))
+		case kind == "blobs" && blobs[name] != "":
+			http.Redirect(w, req, srv.URL+"/storage/"+name, http.StatusTemporaryRedirect)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	oldClient := HTTPClient
+	HTTPClient = srv.Client()
+	t.Cleanup(func() { HTTPClient = oldClient })
+	return srv, &log, blobs
+}
+
+func writeDockerConfig(t *testing.T, config string) {
+	t.Helper()
+	old := DockerConfig
+	DockerConfig = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() { DockerConfig = old })
+	if err := os.WriteFile(DockerConfig, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPull(t *testing.T) {
+	srv, log, _ := fakeRegistry(t)
+	host := strings.TrimPrefix(srv.URL, "https://")
+	writeDockerConfig(t, `{"auths":{"https://`+host+`":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("user:secret"))+`"}}}`)
+	ref, err := ParseReference(host + "/team/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := Pull(ref, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	checkRootfs(t, dir)
+	// One challenge is answered; the token is reused afterwards.
+	if (*log)[0] != "GET /v2/team/app/manifests/1.0" || (*log)[1] != "GET /token" || strings.Count(strings.Join(*log, "\n"), "/token") != 1 {
+		t.Fatalf("requests = %q", *log)
+	}
+
+	ref.Tag = "2.0"
+	if err := Pull(ref, t.TempDir(), false); err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Fatalf("Pull of a missing tag = %v", err)
+	}
+	ref.Tag, ref.Digest = "", digest([]byte("tampered"))
+	if err := Pull(ref, t.TempDir(), false); err == nil {
+		t.Fatal("pulled a missing digest")
+	}
+}
+
+func TestPullUnauthorized(t *testing.T) {
+	srv, _, _ := fakeRegistry(t)
+	writeDockerConfig(t, `{}`)
+	ref, _ := ParseReference(strings.TrimPrefix(srv.URL, "https://") + "/team/app:1.0")
+	if err := Pull(ref, t.TempDir(), false); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("Pull without credentials = %v", err)
+	}
+}
+
+func TestPullVerifiesLayers(t *testing.T) {
+	srv, _, blobs := fakeRegistry(t)
+	writeDockerConfig(t, `{"auths":{"`+strings.TrimPrefix(srv.URL, "https://")+`":{"username":"user","password":"secret"}}}`)
+	for d, body := range blobs {
+		if strings.Contains(body, "\x00") {
+			blobs[d] = string(makeTar(t, file{name: "pwned", body: "x"}))
+		}
+	}
+	ref, _ := ParseReference(strings.TrimPrefix(srv.URL, "https://") + "/team/app:1.0")
+	dir := t.TempDir()
+	if err := Pull(ref, dir, false); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("Pull of a tampered layer = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("unverified layer unpacked: %v", entries)
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	for in, want := range map[string]string{
+		"alpine":           "docker.io/library/alpine:latest",
+		"alpine:3.20":      "docker.io/library/alpine:3.20",
+		"bitnami/redis":    "docker.io/bitnami/redis:latest",
+		"docker.io/alpine": "docker.io/library/alpine:latest",
+		"registry.example.com/library/alpine:3.20":        "registry.example.com/library/alpine:3.20",
+		"localhost:5000/app":                              "localhost:5000/app:latest",
+		"localhost/app:v1":                                "localhost/app:v1",
+		"ghcr.io/a/b/c@sha256:" + strings.Repeat("a", 64): "ghcr.io/a/b/c@sha256:" + strings.Repeat("a", 64),
+	} {
+		ref, err := ParseReference(in)
+		if err != nil || ref.String() != want {
+			t.Errorf("ParseReference(%q) = %v, %v; want %s", in, ref, err, want)
+		}
+	}
+	for _, in := range []string{"", "Alpine", "alpine:", "alpine@sha256:abc", "ex ample.com/app", "/app", "app//x", "app:t@g"} {
+		if ref, err := ParseReference(in); err == nil {
+			t.Errorf("ParseReference(%q) = %v", in, ref)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	bin := t.TempDir()
+	helper := "#!/bin/sh\nread server\n[ \"$server\" = https://index.docker.io/v1/ ] || { echo credentials not found; exit 1; }\n" +
+		"echo '{\"Username\":\"hub\",\"Secret\":\"pw\"}'\n"
+	os.WriteFile(filepath.Join(bin, "docker-credential-fake"), []byte(helper), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	writeDockerConfig(t, `{
+		"auths": {
+			"https://ghcr.io/v1/": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("gh:token:with:colons"))+`"},
+			"quay.io": {"username": "q", "password": "p"}
+		},
+		"credHelpers": {"docker.io": "fake", "example.com": "fake"}
+	}`)
+	for registry, want := range map[string][2]string{
+		"ghcr.io":     {"gh", "token:with:colons"},
+		"quay.io":     {"q", "p"},
+		"docker.io":   {"hub", "pw"},
+		"example.com": {"", ""},
+		"other.io":    {"", ""},
+	} {
+		user, password, err := Credentials(registry)
+		if err != nil || user != want[0] || password != want[1] {
+			t.Errorf("Credentials(%s) = %q, %q, %v", registry, user, password, err)
+		}
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:a/b:pull,push"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:a/b:pull,push" {
+		t.Fatalf("parseChallenge = %q, %v", scheme, params)
+	}
+	if scheme, params := parseChallenge(`Basic realm=registry`); scheme != "Basic" || params["realm"] != "registry" {
+		t.Fatalf("parseChallenge = %q, %v", scheme, params)
+	}
+}
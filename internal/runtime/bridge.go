@@ -0,0 +1,406 @@
+//go:build linux
+
+package runtime
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/store"
+)
+
+// keepBridgeEnv, when set to "1", leaves the bridge (and forwarding) in
+// place after the last container attached to it has been removed.
+const keepBridgeEnv = "POCKET_DOCKER_KEEP_BRIDGE"
+
+// bridgeAliasTag marks bridges created by pocket-docker. The alias also
+// remembers the forwarding sysctls found before the bridge was created and
+// the firewall backend that installed the bridge rules.
+const bridgeAliasTag = "pocket-docker"
+
+// bridgeWildcard matches the bridges of all networks in iptables rules.
+const bridgeWildcard = "pd+"
+
+// ipForwardPath is the sysctl enabled while a bridge is in use.
+var ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// ip6ForwardPath is the sysctl enabled while a dual-stack bridge is in use.
+var ip6ForwardPath = "/proc/sys/net/ipv6/conf/all/forwarding"
+
+// Network describes a bridge network containers are attached to. The
+// bridge owns the gateway address; every container gets a veth whose host
+// end is enslaved to the bridge.
+type Network struct {
+	Name    string
+	Bridge  string
+	Subnet  string
+	Gateway string
+	// Subnet6 is the IPv6 subnet of a dual-stack network, "" for an
+	// IPv4-only one. Gateway6 and the IPv6 addresses of containers lie at
+	// the same offset into Subnet6 as their IPv4 addresses into Subnet.
+	Subnet6  string
+	Gateway6 string
+	// Isolated networks (--icc=false) keep containers from reaching each
+	// other; they still reach the gateway and, unless Internal, the
+	// outside world. Internal networks forward nothing off the bridge.
+	Isolated bool
+	Internal bool
+}
+
+// DefaultNetwork is the network used by `run --network` without a name.
+// It always exists and is not stored in the networks table.
+var DefaultNetwork = Network{Name: "bridge", Bridge: "pd0", Subnet: "10.42.0.0/24", Gateway: "10.42.0.1"}
+
+// BridgeName returns the bridge used for the user-defined network name.
+func BridgeName(name string) string {
+	return "pd-" + name
+}
+
+// NetworkFromInfo converts a stored network.
+func NetworkFromInfo(ni store.NetworkInfo) Network {
+	return Network{Name: ni.Name, Bridge: ni.Bridge, Subnet: ni.Subnet, Gateway: ni.Gateway, Subnet6: ni.Subnet6, Gateway6: ni.Gateway6,
+		Isolated: ni.Isolated, Internal: ni.Internal}
+}
+
+// NetworkLookup resolves user-defined networks. *store.Store implements it.
+type NetworkLookup interface {
+	GetNetwork(name string) (store.NetworkInfo, error)
+}
+
+// LookupNetwork returns the network called name. An empty name refers to
+// DefaultNetwork, which is resolved without l.
+func LookupNetwork(l NetworkLookup, name string) (Network, error) {
+	if name == "" || name == DefaultNetwork.Name {
+		return DefaultNetwork, nil
+	}
+	if l == nil {
+		return Network{}, fmt.Errorf("unknown network %s", name)
+	}
+	ni, err := l.GetNetwork(name)
+	if err != nil {
+		return Network{}, fmt.Errorf("unknown network %s: %w", name, err)
+	}
+	return NetworkFromInfo(ni), nil
+}
+
+// gatewayCIDR returns the gateway address with the prefix length of the subnet.
+func (n Network) gatewayCIDR() string {
+	return n.hostCIDR(n.Gateway)
+}
+
+// hostCIDR returns ip with the prefix length of the subnet.
+func (n Network) hostCIDR(ip string) string {
+	_, bits, _ := strings.Cut(n.Subnet, "/")
+	return ip + "/" + bits
+}
+
+// hostCIDR6 returns ip6 with the prefix length of the IPv6 subnet.
+func (n Network) hostCIDR6(ip6 string) string {
+	_, bits, _ := strings.Cut(n.Subnet6, "/")
+	return ip6 + "/" + bits
+}
+
+// IPv6Address returns the IPv6 address matching the IPv4 address ip on a
+// dual-stack network, or "" if n has no IPv6 subnet.
+func (n Network) IPv6Address(ip string) string {
+	if n.Subnet6 == "" {
+		return ""
+	}
+	return MapIPv6(n.Subnet, n.Subnet6, ip)
+}
+
+// MapIPv6 returns the address at the offset of ip into subnet within
+// subnet6, or "" if an argument does not parse or subnet6 has fewer host
+// addresses than subnet.
+func MapIPv6(subnet, subnet6, ip string) string {
+	p4, err4 := netip.ParsePrefix(subnet)
+	p6, err6 := netip.ParsePrefix(subnet6)
+	a, err := netip.ParseAddr(ip)
+	if err4 != nil || err6 != nil || err != nil || !p4.Contains(a) || !p6.Addr().Is6() || 128-p6.Bits() < 32-p4.Bits() {
+		return ""
+	}
+	base4, host := p4.Masked().Addr().As4(), a.As4()
+	offset := binary.BigEndian.Uint32(host[:]) - binary.BigEndian.Uint32(base4[:])
+	b := p6.Masked().Addr().As16()
+	binary.BigEndian.PutUint32(b[12:], binary.BigEndian.Uint32(b[12:])+offset)
+	return netip.AddrFrom16(b).String()
+}
+
+// vethNames returns the host and container side names of the veth pair
+// attaching container id to n. DefaultNetwork keeps the historical
+// "veth<id>" names; other networks add a hash of the network name so a
+// container can be attached to several networks at once.
+func (n Network) vethNames(id string) (string, string) {
+	host := hostVethName(id)
+	if n.Name != DefaultNetwork.Name {
+		short := id
+		if len(short) > 5 {
+			short = short[:5]
+		}
+		h := fnv.New32a()
+		h.Write([]byte(n.Name))
+		host = fmt.Sprintf("pdv%s%04x", short, h.Sum32()&0xffff)
+	}
+	return host, host + "_c"
+}
+
+// HostVeth returns the name of the host side veth attaching container id
+// to n.
+func (n Network) HostVeth(id string) string {
+	host, _ := n.vethNames(id)
+	return host
+}
+
+// bridgeRules returns the iptables rules installed once per bridge: forward
+// traffic from and to the bridge and masquerade outbound container traffic.
+// Traffic to the bridges of other networks is dropped; both -I rules end up
+// above the ACCEPT rules of every bridge, the DROP just below the ACCEPT for
+// traffic staying on the bridge.
+//
+// Isolated networks lack the ACCEPT for traffic staying on the bridge, so a
+// container cannot reach another one by routing through the gateway either.
+// Internal networks drop what is forwarded from or to the bridge instead of
+// accepting and masquerading it; these DROPs are inserted first, below the
+// DROP for other bridges.
+func (n Network) bridgeRules() [][]string {
+	return n.bridgeRulesFor(n.Subnet)
+}
+
+// bridgeRules6 returns the ip6tables rules of a dual-stack bridge. They
+// match bridgeRules; the ULA subnets are not routed on the internet, so
+// outbound traffic is masqueraded as well.
+func (n Network) bridgeRules6() [][]string {
+	return n.bridgeRulesFor(n.Subnet6)
+}
+
+func (n Network) bridgeRulesFor(subnet string) [][]string {
+	var rules [][]string
+	if n.Internal {
+		rules = append(rules,
+			[]string{"-I", "FORWARD", "-i", n.Bridge, "-j", "DROP"},
+			[]string{"-I", "FORWARD", "-o", n.Bridge, "-j", "DROP"})
+	}
+	rules = append(rules, []string{"-I", "FORWARD", "-i", n.Bridge, "-o", bridgeWildcard, "-j", "DROP"})
+	if !n.Isolated {
+		rules = append(rules, []string{"-I", "FORWARD", "-i", n.Bridge, "-o", n.Bridge, "-j", "ACCEPT"})
+	}
+	if n.Internal {
+		return rules
+	}
+	return append(rules,
+		[]string{"-A", "FORWARD", "-i", n.Bridge, "-j", "ACCEPT"},
+		[]string{"-A", "FORWARD", "-o", n.Bridge, "-j", "ACCEPT"},
+		[]string{"-t", "nat", "-A", "POSTROUTING", "-s", subnet, "!", "-o", n.Bridge, "-j", "MASQUERADE"})
+}
+
+type quietRunner struct{}
+
+func (quietRunner) Run(cmd string, args ...string) error {
+	_, err := exec.Command(cmd, args...).CombinedOutput()
+	return err
+}
+
+func linkExists(name string) bool {
+	_, err := os.Stat(filepath.Join(SysClassNet, name))
+	return err == nil
+}
+
+func readSysctl(path string) string {
+	data, _ := os.ReadFile(path)
+	return strings.TrimSpace(string(data))
+}
+
+// bridgeState holds the values recorded in the alias of a bridge.
+type bridgeState struct {
+	ipForward string
+	// ip6Forward is only recorded on dual-stack bridges.
+	ip6Forward string
+	firewall   string
+}
+
+// bridgeAlias returns the alias ensureBridge sets on a new bridge.
+func bridgeAlias(s bridgeState) string {
+	alias := fmt.Sprintf("%s ip_forward=%s", bridgeAliasTag, s.ipForward)
+	if s.ip6Forward != "" {
+		alias += " ip6_forward=" + s.ip6Forward
+	}
+	return alias + " firewall=" + s.firewall
+}
+
+// parseBridgeAlias returns the values recorded by bridgeAlias. ok is false
+// for bridges not created by pocket-docker. Bridges created before the
+// firewall was recorded report an empty firewall.
+func parseBridgeAlias(alias string) (s bridgeState, ok bool) {
+	fields := strings.Fields(alias)
+	if len(fields) == 0 || fields[0] != bridgeAliasTag {
+		return bridgeState{}, false
+	}
+	for _, f := range fields[1:] {
+		k, v, _ := strings.Cut(f, "=")
+		switch k {
+		case "ip_forward":
+			s.ipForward = v
+		case "ip6_forward":
+			s.ip6Forward = v
+		case "firewall":
+			s.firewall = v
+		}
+	}
+	return s, true
+}
+
+// readBridgeAlias parses the alias of bridge.
+func readBridgeAlias(bridge string) (bridgeState, bool) {
+	data, err := os.ReadFile(filepath.Join(SysClassNet, bridge, "ifalias"))
+	if err != nil {
+		return bridgeState{}, false
+	}
+	return parseBridgeAlias(string(data))
+}
+
+// otherBridgeIPForwardOrig returns the ip_forward value recorded by any
+// pocket-docker bridge other than except. Bridges of all networks share the
+// sysctl, so it must only be restored together with the last of them.
+func otherBridgeIPForwardOrig(except string) (string, bool) {
+	return otherBridgeState(except, func(s bridgeState) (string, bool) { return s.ipForward, true })
+}
+
+// otherBridgeIP6ForwardOrig is otherBridgeIPForwardOrig for the IPv6
+// forwarding sysctl, which only dual-stack bridges record.
+func otherBridgeIP6ForwardOrig(except string) (string, bool) {
+	return otherBridgeState(except, func(s bridgeState) (string, bool) { return s.ip6Forward, s.ip6Forward != "" })
+}
+
+// otherBridgeState returns the first value get reports for a pocket-docker
+// bridge other than except.
+func otherBridgeState(except string, get func(bridgeState) (string, bool)) (string, bool) {
+	entries, err := os.ReadDir(SysClassNet)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if e.Name() == except {
+			continue
+		}
+		if s, ok := readBridgeAlias(e.Name()); ok {
+			if v, ok := get(s); ok {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// ensureBridge creates the bridge of n with its gateway addresses and the
+// rules of fw unless it already exists. It returns the forwarding sysctls
+// from before the bridge was created; ip6Forward is "" unless n is
+// dual-stack.
+func ensureBridge(n Network, links LinkOps, fw Firewall) (ipForward, ip6Forward string, err error) {
+	if linkExists(n.Bridge) {
+		s, _ := readBridgeAlias(n.Bridge)
+		return s.ipForward, s.ip6Forward, nil
+	}
+	s := bridgeState{ipForward: readSysctl(ipForwardPath), firewall: fw.Name()}
+	if other, ok := otherBridgeIPForwardOrig(n.Bridge); ok {
+		s.ipForward = other
+	}
+	if n.Subnet6 != "" {
+		s.ip6Forward = readSysctl(ip6ForwardPath)
+		if other, ok := otherBridgeIP6ForwardOrig(n.Bridge); ok {
+			s.ip6Forward = other
+		}
+	}
+	if err := links.AddBridge(n.Bridge); err != nil {
+		// Another run may have created it concurrently.
+		if linkExists(n.Bridge) {
+			s, _ := readBridgeAlias(n.Bridge)
+			return s.ipForward, s.ip6Forward, nil
+		}
+		return "", "", err
+	}
+	_ = links.SetAlias(n.Bridge, bridgeAlias(s))
+	if err := links.AddAddr(0, n.Bridge, n.gatewayCIDR()); err != nil {
+		return "", "", err
+	}
+	if n.Subnet6 != "" {
+		if err := links.AddAddr(0, n.Bridge, n.hostCIDR6(n.Gateway6)); err != nil {
+			return "", "", err
+		}
+	}
+	if err := links.SetUp(0, n.Bridge); err != nil {
+		return "", "", err
+	}
+	if err := fw.AddBridge(n); err != nil {
+		return "", "", err
+	}
+	return s.ipForward, s.ip6Forward, nil
+}
+
+// bridgeInUse reports whether any interface is still enslaved to bridge.
+func bridgeInUse(bridge string) bool {
+	entries, err := os.ReadDir(filepath.Join(SysClassNet, bridge, "brif"))
+	return err == nil && len(entries) > 0
+}
+
+// removeBridgeIfUnused deletes the bridge of n, its rules and restores
+// forwarding once no container is attached any more, unless keepBridgeEnv
+// is set. ipForwardOrig and ip6ForwardOrig are used when the bridge alias
+// holds no value.
+func removeBridgeIfUnused(n Network, r CmdRunner, links LinkOps, ipForwardOrig, ip6ForwardOrig string) {
+	if os.Getenv(keepBridgeEnv) == "1" {
+		return
+	}
+	removeBridge(n, r, links, ipForwardOrig, ip6ForwardOrig)
+}
+
+// removeBridge deletes the bridge of n and its rules unless containers are
+// still attached. ip_forward is restored once no pocket-docker bridge is
+// left, IPv6 forwarding once no dual-stack bridge is.
+func removeBridge(n Network, r CmdRunner, links LinkOps, ipForwardOrig, ip6ForwardOrig string) {
+	if n.Bridge == "" || !linkExists(n.Bridge) || bridgeInUse(n.Bridge) {
+		return
+	}
+	s, _ := readBridgeAlias(n.Bridge)
+	if s.ipForward != "" {
+		ipForwardOrig = s.ipForward
+	}
+	if s.ip6Forward != "" {
+		ip6ForwardOrig = s.ip6Forward
+	}
+	_ = newFirewall(s.firewall, r).RemoveBridge(n)
+	_ = links.DeleteLink(n.Bridge)
+	if _, ok := otherBridgeIP6ForwardOrig(n.Bridge); !ok && ip6ForwardOrig != "" {
+		_ = os.WriteFile(ip6ForwardPath, []byte(ip6ForwardOrig), 0644)
+	}
+	if _, ok := otherBridgeIPForwardOrig(n.Bridge); ok {
+		return
+	}
+	if ipForwardOrig != "" {
+		_ = os.WriteFile(ipForwardPath, []byte(ipForwardOrig), 0644)
+	}
+}
+
+// deleteRule turns an iptables append or insert rule into the matching
+// delete rule.
+func deleteRule(rule []string) []string {
+	return ruleWithOp(rule, "-D")
+}
+
+// ruleWithOp replaces the -A or -I command of an iptables rule with op.
+func ruleWithOp(rule []string, op string) []string {
+	out := make([]string, len(rule))
+	copy(out, rule)
+	for i, arg := range out {
+		if arg == "-A" || arg == "-I" {
+			out[i] = op
+			break
+		}
+	}
+	return out
+}
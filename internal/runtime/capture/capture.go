@@ -0,0 +1,90 @@
+//go:build linux
+
+// Package capture records the frames of a network interface with an
+// AF_PACKET socket and writes them as pcap or pcapng, selected by a subset
+// of the tcpdump filter syntax. It needs no libpcap.
+package capture
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSnaplen is the number of bytes kept of each frame.
+const DefaultSnaplen = 262144
+
+// pollInterval bounds how long Next waits before checking its context.
+const pollInterval = 200 * time.Millisecond
+
+// Packet is a captured frame.
+type Packet struct {
+	Time time.Time
+	// Data holds at most the snaplen first bytes of the frame.
+	Data []byte
+	// Length is the length of the frame on the wire.
+	Length int
+}
+
+// Capture receives the frames sent and received on one interface.
+type Capture struct {
+	fd  int
+	buf []byte
+}
+
+// Open starts capturing on the interface name, keeping snaplen bytes of
+// each frame.
+func Open(name string, snaplen int) (*Capture, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	proto := htons(unix.ETH_P_ALL)
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(proto))
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &Capture{fd: fd, buf: make([]byte, snaplen)}, nil
+}
+
+// Next returns the next frame, waiting until one arrives or ctx is done.
+func (c *Capture) Next(ctx context.Context) (Packet, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return Packet{}, err
+		}
+		fds := []unix.PollFd{{Fd: int32(c.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(pollInterval/time.Millisecond))
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		// With MSG_TRUNC the length of the whole frame is returned.
+		length, _, err := unix.Recvfrom(c.fd, c.buf, unix.MSG_TRUNC|unix.MSG_DONTWAIT)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		data := append([]byte(nil), c.buf[:min(length, len(c.buf))]...)
+		return Packet{Time: time.Now(), Data: data, Length: length}, nil
+	}
+}
+
+// Close stops the capture.
+func (c *Capture) Close() error {
+	return unix.Close(c.fd)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package capture
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCaptureLoopback(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("AF_PACKET sockets need root")
+	}
+	c, err := Open("lo", 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	f, err := ParseFilter("udp and dst port 47123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", "127.0.0.1:47123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := make([]byte, 200)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		p, err := c.Next(ctx)
+		if err != nil {
+			t.Fatalf("no packet captured: %v", err)
+		}
+		if !f.Match(p.Data) {
+			continue
+		}
+		if len(p.Data) != 128 || p.Length != 14+20+8+200 {
+			t.Fatalf("captured %d of %d bytes", len(p.Data), p.Length)
+		}
+		return
+	}
+}
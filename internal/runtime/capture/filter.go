@@ -0,0 +1,299 @@
+//go:build linux
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Filter selects frames with a subset of the tcpdump filter syntax:
+//
+//	ip, ip6, arp, tcp, udp, sctp, icmp, icmp6
+//	[src|dst] host ADDR
+//	[src|dst] net CIDR
+//	[src|dst] port PORT
+//	[src|dst] portrange START-END
+//
+// joined with and (&&), or (||), not (!) and parentheses. Adjacent
+// primitives are joined with and, so "tcp port 80" works as in tcpdump.
+type Filter struct {
+	root node
+}
+
+// ParseFilter compiles expr. An empty expr matches every frame.
+func ParseFilter(expr string) (*Filter, error) {
+	p := &parser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return &Filter{}, nil
+	}
+	n, err := p.or()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", expr, err)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", expr, p.tokens[p.pos])
+	}
+	return &Filter{root: n}, nil
+}
+
+// Match reports whether the Ethernet frame data passes f.
+func (f *Filter) Match(data []byte) bool {
+	if f.root == nil {
+		return true
+	}
+	return f.root.match(decode(data))
+}
+
+// frame holds the parts of a frame filters look at.
+type frame struct {
+	// l3 is "ip", "ip6", "arp" or "" for other frames.
+	l3       string
+	proto    uint8
+	src, dst netip.Addr
+	// ports is set for the first fragment of TCP, UDP and SCTP packets.
+	ports        bool
+	sport, dport int
+}
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+	protoSCTP   = 132
+)
+
+func decode(b []byte) frame {
+	var f frame
+	if len(b) < 14 {
+		return f
+	}
+	p := b[14:]
+	var l4 []byte
+	switch binary.BigEndian.Uint16(b[12:]) {
+	case 0x0800:
+		if len(p) < 20 || int(p[0]&0x0f)*4 > len(p) {
+			return f
+		}
+		f.l3, f.proto = "ip", p[9]
+		f.src = netip.AddrFrom4([4]byte(p[12:16]))
+		f.dst = netip.AddrFrom4([4]byte(p[16:20]))
+		if binary.BigEndian.Uint16(p[6:])&0x1fff == 0 {
+			l4 = p[int(p[0]&0x0f)*4:]
+		}
+	case 0x86dd:
+		if len(p) < 40 {
+			return f
+		}
+		f.l3 = "ip6"
+		f.src = netip.AddrFrom16([16]byte(p[8:24]))
+		f.dst = netip.AddrFrom16([16]byte(p[24:40]))
+		next, rest := p[6], p[40:]
+		// Skip hop-by-hop, routing and destination options headers; a
+		// fragment header ends the search for ports unless it starts the
+		// packet.
+		for (next == 0 || next == 43 || next == 60 || next == 44) && len(rest) >= 8 {
+			hdrLen := (int(rest[1]) + 1) * 8
+			if next == 44 {
+				if binary.BigEndian.Uint16(rest[2:])&0xfff8 != 0 {
+					f.proto = rest[0]
+					return f
+				}
+				hdrLen = 8
+			}
+			if hdrLen > len(rest) {
+				return f
+			}
+			next, rest = rest[0], rest[hdrLen:]
+		}
+		f.proto, l4 = next, rest
+	case 0x0806:
+		f.l3 = "arp"
+		if len(p) >= 28 && binary.BigEndian.Uint16(p[2:]) == 0x0800 {
+			f.src = netip.AddrFrom4([4]byte(p[14:18]))
+			f.dst = netip.AddrFrom4([4]byte(p[24:28]))
+		}
+		return f
+	default:
+		return f
+	}
+	switch f.proto {
+	case protoTCP, protoUDP, protoSCTP:
+		if len(l4) >= 4 {
+			f.ports = true
+			f.sport = int(binary.BigEndian.Uint16(l4[0:]))
+			f.dport = int(binary.BigEndian.Uint16(l4[2:]))
+		}
+	}
+	return f
+}
+
+type node interface {
+	match(f frame) bool
+}
+
+type andNode struct{ a, b node }
+type orNode struct{ a, b node }
+type notNode struct{ a node }
+
+func (n andNode) match(f frame) bool { return n.a.match(f) && n.b.match(f) }
+func (n orNode) match(f frame) bool  { return n.a.match(f) || n.b.match(f) }
+func (n notNode) match(f frame) bool { return !n.a.match(f) }
+
+// matchFunc is a primitive.
+type matchFunc func(f frame) bool
+
+func (m matchFunc) match(f frame) bool { return m(f) }
+
+// protoNames maps protocol primitives to their test.
+var protoNames = map[string]matchFunc{
+	"ip":    func(f frame) bool { return f.l3 == "ip" },
+	"ip6":   func(f frame) bool { return f.l3 == "ip6" },
+	"arp":   func(f frame) bool { return f.l3 == "arp" },
+	"tcp":   func(f frame) bool { return f.l3 != "arp" && f.proto == protoTCP },
+	"udp":   func(f frame) bool { return f.l3 != "arp" && f.proto == protoUDP },
+	"sctp":  func(f frame) bool { return f.l3 != "arp" && f.proto == protoSCTP },
+	"icmp":  func(f frame) bool { return f.l3 == "ip" && f.proto == protoICMP },
+	"icmp6": func(f frame) bool { return f.l3 == "ip6" && f.proto == protoICMPv6 },
+}
+
+func tokenize(expr string) []string {
+	r := strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ")
+	tokens := strings.Fields(r.Replace(expr))
+	for i, t := range tokens {
+		switch t {
+		case "&&":
+			tokens[i] = "and"
+		case "||":
+			tokens[i] = "or"
+		case "!":
+			tokens[i] = "not"
+		}
+	}
+	return tokens
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) or() (node, error) {
+	n, err := p.and()
+	for err == nil && p.peek() == "or" {
+		p.pos++
+		var b node
+		if b, err = p.and(); err == nil {
+			n = orNode{n, b}
+		}
+	}
+	return n, err
+}
+
+func (p *parser) and() (node, error) {
+	n, err := p.unary()
+	for err == nil {
+		switch p.peek() {
+		case "and":
+			p.pos++
+		case "", "or", ")":
+			return n, nil
+		}
+		var b node
+		if b, err = p.unary(); err == nil {
+			n = andNode{n, b}
+		}
+	}
+	return n, err
+}
+
+func (p *parser) unary() (node, error) {
+	switch t := p.next(); t {
+	case "not":
+		n, err := p.unary()
+		return notNode{n}, err
+	case "(":
+		n, err := p.or()
+		if err == nil && p.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		return n, err
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	default:
+		if m, ok := protoNames[t]; ok {
+			return m, nil
+		}
+		p.pos--
+		return p.primitive()
+	}
+}
+
+// primitive parses [src|dst] host|net|port|portrange VALUE.
+func (p *parser) primitive() (node, error) {
+	dir := ""
+	if t := p.peek(); t == "src" || t == "dst" {
+		dir = p.next()
+	}
+	kind, value := p.next(), p.next()
+	if value == "" {
+		return nil, fmt.Errorf("%s needs a value", kind)
+	}
+	switch kind {
+	case "host", "net":
+		prefix, err := netip.ParsePrefix(value)
+		if kind == "host" {
+			var a netip.Addr
+			a, err = netip.ParseAddr(value)
+			prefix = netip.PrefixFrom(a, a.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", kind, value)
+		}
+		prefix = prefix.Masked()
+		return byDir(dir, func(a netip.Addr, _ int, _ frame) bool { return prefix.Contains(a) }), nil
+	case "port", "portrange":
+		first, last, isRange := strings.Cut(value, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || isRange != (kind == "portrange") || start < 0 || end < start || end > 65535 {
+			return nil, fmt.Errorf("invalid %s %q", kind, value)
+		}
+		return byDir(dir, func(_ netip.Addr, port int, f frame) bool { return f.ports && port >= start && port <= end }), nil
+	}
+	return nil, fmt.Errorf("unknown primitive %q", kind)
+}
+
+// byDir applies test to the source, the destination or, without a
+// direction, either end of a frame.
+func byDir(dir string, test func(a netip.Addr, port int, f frame) bool) matchFunc {
+	src := func(f frame) bool { return test(f.src, f.sport, f) }
+	dst := func(f frame) bool { return test(f.dst, f.dport, f) }
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	}
+	return func(f frame) bool { return src(f) || dst(f) }
+}
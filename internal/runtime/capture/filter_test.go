@@ -0,0 +1,113 @@
+//go:build linux
+
+package capture
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// ipv4Frame builds an Ethernet frame carrying an IPv4 packet of proto from
+// src to dst with the given ports.
+func ipv4Frame(proto uint8, src, dst string, sport, dport uint16) []byte {
+	b := make([]byte, 14+20+8)
+	binary.BigEndian.PutUint16(b[12:], 0x0800)
+	ip := b[14:]
+	ip[0] = 0x45
+	ip[9] = proto
+	s, d := netip.MustParseAddr(src).As4(), netip.MustParseAddr(dst).As4()
+	copy(ip[12:], s[:])
+	copy(ip[16:], d[:])
+	binary.BigEndian.PutUint16(ip[20:], sport)
+	binary.BigEndian.PutUint16(ip[22:], dport)
+	return b
+}
+
+func ipv6Frame(proto uint8, src, dst string, sport, dport uint16) []byte {
+	b := make([]byte, 14+40+8)
+	binary.BigEndian.PutUint16(b[12:], 0x86dd)
+	ip := b[14:]
+	ip[0] = 0x60
+	ip[6] = proto
+	s, d := netip.MustParseAddr(src).As16(), netip.MustParseAddr(dst).As16()
+	copy(ip[8:], s[:])
+	copy(ip[24:], d[:])
+	binary.BigEndian.PutUint16(ip[40:], sport)
+	binary.BigEndian.PutUint16(ip[42:], dport)
+	return b
+}
+
+func TestFilter(t *testing.T) {
+	tcp := ipv4Frame(protoTCP, "172.18.0.2", "1.1.1.1", 40000, 443)
+	udp := ipv4Frame(protoUDP, "172.18.0.1", "172.18.0.2", 53, 33000)
+	icmp := ipv4Frame(protoICMP, "172.18.0.2", "172.18.0.1", 0, 0)
+	tcp6 := ipv6Frame(protoTCP, "fd00::2", "fd00::1", 40000, 80)
+	arp := make([]byte, 14+28)
+	binary.BigEndian.PutUint16(arp[12:], 0x0806)
+	binary.BigEndian.PutUint16(arp[16:], 0x0800)
+	copy(arp[14+14:], []byte{172, 18, 0, 2})
+	copy(arp[14+24:], []byte{172, 18, 0, 1})
+
+	cases := []struct {
+		expr string
+		want [5]bool // tcp, udp, icmp, tcp6, arp
+	}{
+		{"", [5]bool{true, true, true, true, true}},
+		{"tcp", [5]bool{true, false, false, true, false}},
+		{"ip and tcp", [5]bool{true, false, false, false, false}},
+		{"ip6", [5]bool{false, false, false, true, false}},
+		{"icmp or arp", [5]bool{false, false, true, false, true}},
+		{"port 443", [5]bool{true, false, false, false, false}},
+		{"tcp port 80", [5]bool{false, false, false, true, false}},
+		{"udp and src port 53", [5]bool{false, true, false, false, false}},
+		{"dst port 53", [5]bool{false, false, false, false, false}},
+		{"portrange 30000-40000", [5]bool{true, true, false, true, false}},
+		{"host 172.18.0.1", [5]bool{false, true, true, false, true}},
+		{"src host 172.18.0.2", [5]bool{true, false, true, false, true}},
+		{"dst net 172.18.0.0/16", [5]bool{false, true, true, false, true}},
+		{"net fd00::/64", [5]bool{false, false, false, true, false}},
+		{"not arp && !(tcp || udp)", [5]bool{false, false, true, false, false}},
+		{"not port 443 and not icmp", [5]bool{false, true, false, true, true}},
+	}
+	frames := [][]byte{tcp, udp, icmp, tcp6, arp}
+	for _, c := range cases {
+		f, err := ParseFilter(c.expr)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q): %v", c.expr, err)
+		}
+		for i, fr := range frames {
+			if got := f.Match(fr); got != c.want[i] {
+				t.Errorf("%q on frame %d = %v, want %v", c.expr, i, got, c.want[i])
+			}
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"tcp and", "(tcp", "tcp)", "port", "port http", "port 1-2", "portrange 5",
+		"portrange 9-1", "host 10.0.0", "net 10.0.0.1", "src tcp", "or tcp", "bogus",
+	} {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("ParseFilter(%q) accepted", expr)
+		}
+	}
+}
+
+func TestFilterShortFrames(t *testing.T) {
+	f, err := ParseFilter("tcp port 80 or host 10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := ipv4Frame(protoTCP, "10.0.0.1", "10.0.0.2", 1, 80)
+	for i := range full {
+		f.Match(full[:i])
+	}
+	// A later fragment carries no ports.
+	frag := ipv4Frame(protoTCP, "10.0.0.3", "10.0.0.2", 1, 80)
+	binary.BigEndian.PutUint16(frag[14+6:], 100)
+	if f.Match(frag) {
+		t.Fatal("port matched a non-first fragment")
+	}
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Output formats of a Writer.
+const (
+	FormatPcap   = "pcap"
+	FormatPcapng = "pcapng"
+)
+
+// linktypeEthernet is LINKTYPE_ETHERNET, the link type of veth frames.
+const linktypeEthernet = 1
+
+// Writer writes Ethernet frames as a pcap or pcapng capture. Both formats
+// use microsecond timestamps, which every reader supports.
+type Writer struct {
+	w      io.Writer
+	format string
+}
+
+// NewWriter writes the file header of format to w. iface names the
+// captured interface in pcapng files.
+func NewWriter(w io.Writer, format, iface string, snaplen int) (*Writer, error) {
+	var hdr []byte
+	switch format {
+	case FormatPcap:
+		hdr = make([]byte, 24)
+		le.PutUint32(hdr[0:], 0xa1b2c3d4)
+		le.PutUint16(hdr[4:], 2)
+		le.PutUint16(hdr[6:], 4)
+		le.PutUint32(hdr[16:], uint32(snaplen))
+		le.PutUint32(hdr[20:], linktypeEthernet)
+	case FormatPcapng:
+		// Section header block: byte-order magic, version 1.0 and an
+		// unspecified section length.
+		shb := make([]byte, 16)
+		le.PutUint32(shb[0:], 0x1a2b3c4d)
+		le.PutUint16(shb[4:], 1)
+		le.PutUint64(shb[8:], ^uint64(0))
+		hdr = block(0x0a0d0d0a, shb)
+		// Interface description block with the if_name option.
+		idb := make([]byte, 8)
+		le.PutUint16(idb[0:], linktypeEthernet)
+		le.PutUint32(idb[4:], uint32(snaplen))
+		idb = append(idb, option(2, []byte(iface))...)
+		idb = append(idb, 0, 0, 0, 0)
+		hdr = append(hdr, block(1, idb)...)
+	default:
+		return nil, fmt.Errorf("unknown capture format %q (use %s or %s)", format, FormatPcap, FormatPcapng)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, format: format}, nil
+}
+
+// WritePacket writes p.
+func (w *Writer) WritePacket(p Packet) error {
+	var rec []byte
+	if w.format == FormatPcap {
+		rec = make([]byte, 16, 16+len(p.Data))
+		le.PutUint32(rec[0:], uint32(p.Time.Unix()))
+		le.PutUint32(rec[4:], uint32(p.Time.Nanosecond()/1000))
+		le.PutUint32(rec[8:], uint32(len(p.Data)))
+		le.PutUint32(rec[12:], uint32(p.Length))
+		rec = append(rec, p.Data...)
+	} else {
+		// Enhanced packet block on interface 0.
+		epb := make([]byte, 20, 20+len(p.Data)+3)
+		us := uint64(p.Time.UnixNano() / int64(time.Microsecond))
+		le.PutUint32(epb[4:], uint32(us>>32))
+		le.PutUint32(epb[8:], uint32(us))
+		le.PutUint32(epb[12:], uint32(len(p.Data)))
+		le.PutUint32(epb[16:], uint32(p.Length))
+		rec = block(6, pad(append(epb, p.Data...)))
+	}
+	_, err := w.w.Write(rec)
+	return err
+}
+
+var le = binary.LittleEndian
+
+// block frames body, whose length is a multiple of 4, as a pcapng block.
+func block(typ uint32, body []byte) []byte {
+	b := make([]byte, 8, 12+len(body))
+	le.PutUint32(b[0:], typ)
+	le.PutUint32(b[4:], uint32(12+len(body)))
+	b = append(b, body...)
+	return le.AppendUint32(b, uint32(12+len(body)))
+}
+
+// option encodes a pcapng option.
+func option(code uint16, value []byte) []byte {
+	b := make([]byte, 4)
+	le.PutUint16(b[0:], code)
+	le.PutUint16(b[2:], uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatPcap, "veth1", 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 123456789)
+	if err := w.WritePacket(Packet{Time: at, Data: []byte{1, 2, 3}, Length: 60}); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if len(b) != 24+16+3 {
+		t.Fatalf("wrote %d bytes", len(b))
+	}
+	le := binary.LittleEndian
+	if le.Uint32(b) != 0xa1b2c3d4 || le.Uint16(b[4:]) != 2 || le.Uint16(b[6:]) != 4 ||
+		le.Uint32(b[16:]) != 65535 || le.Uint32(b[20:]) != 1 {
+		t.Fatalf("bad header % x", b[:24])
+	}
+	rec := b[24:]
+	if le.Uint32(rec) != 1700000000 || le.Uint32(rec[4:]) != 123456 ||
+		le.Uint32(rec[8:]) != 3 || le.Uint32(rec[12:]) != 60 || !bytes.Equal(rec[16:], []byte{1, 2, 3}) {
+		t.Fatalf("bad record % x", rec)
+	}
+}
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, FormatPcapng, "veth1", 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 123456789)
+	if err := w.WritePacket(Packet{Time: at, Data: []byte{1, 2, 3}, Length: 3}); err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	var blocks []uint32
+	b := buf.Bytes()
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block % x", b)
+		}
+		typ, n := le.Uint32(b), int(le.Uint32(b[4:]))
+		if n%4 != 0 || n > len(b) || int(le.Uint32(b[n-4:])) != n {
+			t.Fatalf("block %#x has bad length %d", typ, n)
+		}
+		switch typ {
+		case 1:
+			if le.Uint16(b[8:]) != 1 || le.Uint16(b[16:]) != 2 || string(b[20:25]) != "veth1" {
+				t.Fatalf("bad interface block % x", b[:n])
+			}
+		case 6:
+			us := uint64(le.Uint32(b[12:]))<<32 | uint64(le.Uint32(b[16:]))
+			if us != 1700000000123456 || le.Uint32(b[20:]) != 3 || !bytes.Equal(b[28:31], []byte{1, 2, 3}) {
+				t.Fatalf("bad packet block % x", b[:n])
+			}
+		}
+		blocks = append(blocks, typ)
+		b = b[n:]
+	}
+	if len(blocks) != 3 || blocks[0] != 0x0a0d0d0a || blocks[1] != 1 || blocks[2] != 6 {
+		t.Fatalf("blocks = %#x", blocks)
+	}
+	if _, err := NewWriter(&buf, "erf", "veth1", 65535); err == nil {
+		t.Fatal("unknown format accepted")
+	}
+}
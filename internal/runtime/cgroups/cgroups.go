@@ -1,16 +1,18 @@
+//go:build linux
+
 package cgroups
 
 import (
-	"bufio"
 	"context"
 	"log"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func ensureCgroupDir(containerID string) (string, error) {
@@ -26,8 +28,9 @@ var CgroupRoot = "/sys/fs/cgroup"
 
 // Global map to track OOM monitor cancellation functions and completion
 type oomMonitorInfo struct {
-	cancel context.CancelFunc
-	done   chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+	killedAt time.Time
 }
 
 var oomMonitors = make(map[string]*oomMonitorInfo)
@@ -50,18 +53,28 @@ func ApplyMemoryLimit(containerID string, pid int, limitBytes int64) error {
 
 	// Start OOM monitor with cancellable context
 	ctx, cancel := context.WithCancel(context.Background())
-	done := make(chan struct{})
-	oomMonitorsMutex.Lock()
-	oomMonitors[containerID] = &oomMonitorInfo{
+	info := &oomMonitorInfo{
 		cancel: cancel,
-		done:   done,
+		done:   make(chan struct{}),
 	}
+	oomMonitorsMutex.Lock()
+	oomMonitors[containerID] = info
 	oomMonitorsMutex.Unlock()
-	
-	go monitorOOM(ctx, containerID, dir, pid, done)
+
+	go monitorOOM(ctx, info, dir, pid)
 	return nil
 }
 
+// AddProcess places pid into the cgroup of containerID, creating the
+// cgroup if it does not exist yet.
+func AddProcess(containerID string, pid int) error {
+	dir, err := ensureCgroupDir(containerID)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
 // ApplyCPUShares sets CPU weight for containerID cgroup
 func ApplyCPUShares(containerID string, pid int, shares int64) error {
 	dir, err := ensureCgroupDir(containerID)
@@ -77,6 +90,28 @@ func ApplyCPUShares(containerID string, pid int, shares int64) error {
 	return nil
 }
 
+// OOMKilled reports whether containerID was terminated because of an OOM
+// event and when it was first observed. It must be called before
+// RemoveCgroup, which discards the monitor state and memory.events.
+func OOMKilled(containerID string) (time.Time, bool) {
+	oomMonitorsMutex.Lock()
+	defer oomMonitorsMutex.Unlock()
+	info, exists := oomMonitors[containerID]
+	if exists && !info.killedAt.IsZero() {
+		return info.killedAt, true
+	}
+	// The kernel may have killed the process before the monitor goroutine
+	// got to read the event, so fall back to the counters themselves.
+	if !oomTriggered(filepath.Join(CgroupRoot, containerID, "memory.events")) {
+		return time.Time{}, false
+	}
+	at := time.Now().UTC()
+	if exists {
+		info.killedAt = at
+	}
+	return at, true
+}
+
 // RemoveCgroup removes cgroup directory for given containerID and stops OOM monitor
 func RemoveCgroup(containerID string) error {
 	oomMonitorsMutex.Lock()
@@ -88,40 +123,80 @@ func RemoveCgroup(containerID string) error {
 	} else {
 		oomMonitorsMutex.Unlock()
 	}
-	
+
 	dir := filepath.Join(CgroupRoot, containerID)
 	return os.RemoveAll(dir)
 }
 
-func monitorOOM(ctx context.Context, containerID, dir string, pid int, done chan struct{}) {
-	defer close(done)
-	
-	f, err := os.Open(filepath.Join(dir, "memory.events"))
+// oomTriggered reports whether memory.events at path has a non-zero
+// oom or oom_kill counter.
+func oomTriggered(path string) bool {
+	kv, err := readFlatKeyed(path)
 	if err != nil {
-		return
+		return false
 	}
-	defer f.Close()
+	return kv["oom"] > 0 || kv["oom_kill"] > 0
+}
 
-	scanner := bufio.NewScanner(f)
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	
-	for {
+// monitorOOM waits for modification events on memory.events instead of
+// polling it. cgroup v2 raises an inotify IN_MODIFY event whenever one of
+// the counters changes, so the container is killed as soon as the kernel
+// reports an OOM. An eventfd is used to wake the poll when ctx is cancelled.
+func monitorOOM(ctx context.Context, info *oomMonitorInfo, dir string, pid int) {
+	defer close(info.done)
+
+	path := filepath.Join(dir, "memory.events")
+	ino, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return
+	}
+	defer unix.Close(ino)
+	if _, err := unix.InotifyAddWatch(ino, path, unix.IN_MODIFY); err != nil {
+		return
+	}
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return
+	}
+	defer unix.Close(wake)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
 		select {
 		case <-ctx.Done():
+			unix.Write(wake, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		case <-stop:
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		if oomTriggered(path) {
+			oomMonitorsMutex.Lock()
+			if info.killedAt.IsZero() {
+				info.killedAt = time.Now().UTC()
+			}
+			oomMonitorsMutex.Unlock()
+			syscall.Kill(pid, syscall.SIGKILL)
+			return
+		}
+		fds := []unix.PollFd{
+			{Fd: int32(ino), Events: unix.POLLIN},
+			{Fd: int32(wake), Events: unix.POLLIN},
+		}
+		if _, err := unix.Poll(fds, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
 			return
-		case <-ticker.C:
-			f.Seek(0, 0)
-			scanner = bufio.NewScanner(f)
-			for scanner.Scan() {
-				line := scanner.Text()
-				if strings.HasPrefix(line, "oom ") || strings.HasPrefix(line, "oom_kill ") {
-					fields := strings.Fields(line)
-					if len(fields) == 2 && fields[1] != "0" {
-						syscall.Kill(pid, syscall.SIGKILL)
-						return
-					}
-				}
+		}
+		if fds[1].Revents != 0 {
+			return
+		}
+		// Drain queued events; the counters are re-read on the next iteration.
+		for {
+			if _, err := unix.Read(ino, buf); err != nil {
+				break
 			}
 		}
 	}
@@ -2,8 +2,10 @@ package cgroups
 
 import (
 	"os"
+	"os/exec"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestApplyMemoryAndCPU(t *testing.T) {
@@ -47,3 +49,53 @@ func TestApplyMemoryAndCPU(t *testing.T) {
 		t.Fatalf("cgroup dir still exists")
 	}
 }
+
+func TestOOMMonitorKillsOnEvent(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldRoot := CgroupRoot
+	CgroupRoot = tmpDir
+	defer func() { CgroupRoot = oldRoot }()
+
+	id := "oomctn"
+	if err := os.MkdirAll(filepath.Join(tmpDir, id), 0755); err != nil {
+		t.Fatal(err)
+	}
+	eventsPath := filepath.Join(tmpDir, id, "memory.events")
+	if err := os.WriteFile(eventsPath, []byte("low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start sleep: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	if err := ApplyMemoryLimit(id, cmd.Process.Pid, 5000); err != nil {
+		t.Fatalf("memory limit: %v", err)
+	}
+	if _, ok := OOMKilled(id); ok {
+		t.Fatal("OOMKilled reported before any event")
+	}
+
+	if err := os.WriteFile(eventsPath, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("process was not killed after OOM event")
+	}
+	if at, ok := OOMKilled(id); !ok || at.IsZero() {
+		t.Fatalf("OOMKilled = %v, %v; want true with timestamp", at, ok)
+	}
+
+	if err := RemoveCgroup(id); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+}
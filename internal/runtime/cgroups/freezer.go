@@ -0,0 +1,95 @@
+//go:build linux
+
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// FreezeTimeout bounds how long Freeze and Thaw wait for cgroup.events to
+// confirm the new state.
+var FreezeTimeout = 10 * time.Second
+
+// Freeze stops all processes of containerID using the cgroup v2 freezer and
+// waits until the kernel reports the cgroup as frozen. If that does not
+// happen within FreezeTimeout the cgroup is thawed again.
+func Freeze(containerID string) error {
+	if err := setFrozen(containerID, true); err != nil {
+		_ = os.WriteFile(filepath.Join(CgroupRoot, containerID, "cgroup.freeze"), []byte("0"), 0644)
+		return err
+	}
+	return nil
+}
+
+// Thaw resumes the processes of containerID frozen by Freeze.
+func Thaw(containerID string) error {
+	return setFrozen(containerID, false)
+}
+
+// Frozen reports whether the cgroup of containerID is currently frozen.
+func Frozen(containerID string) bool {
+	kv, err := readFlatKeyed(filepath.Join(CgroupRoot, containerID, "cgroup.events"))
+	return err == nil && kv["frozen"] == 1
+}
+
+func setFrozen(containerID string, frozen bool) error {
+	dir := filepath.Join(CgroupRoot, containerID)
+	want, value := uint64(0), "0"
+	if frozen {
+		want, value = 1, "1"
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.freeze"), []byte(value), 0644); err != nil {
+		return err
+	}
+	err := waitEvents(dir, FreezeTimeout, func(kv map[string]uint64) bool {
+		return kv["frozen"] == want
+	})
+	if err != nil {
+		return fmt.Errorf("cgroup.events did not report frozen %d: %w", want, err)
+	}
+	return nil
+}
+
+// waitEvents blocks until cond holds for the contents of cgroup.events in
+// dir. The file is re-read whenever the kernel signals a modification.
+func waitEvents(dir string, timeout time.Duration, cond func(map[string]uint64) bool) error {
+	path := filepath.Join(dir, "cgroup.events")
+	ino, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(ino)
+	if _, err := unix.InotifyAddWatch(ino, path, unix.IN_MODIFY); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 4096)
+	for {
+		kv, err := readFlatKeyed(path)
+		if err != nil {
+			return err
+		}
+		if cond(kv) {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		fds := []unix.PollFd{{Fd: int32(ino), Events: unix.POLLIN}}
+		if _, err := unix.Poll(fds, int(remaining.Milliseconds())+1); err != nil && err != unix.EINTR {
+			return err
+		}
+		for {
+			if _, err := unix.Read(ino, buf); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFreezeWaitsForEvents(t *testing.T) {
+	dir := setupFakeCgroup(t, "ctn")
+	eventsPath := filepath.Join(dir, "cgroup.events")
+	if err := os.WriteFile(eventsPath, []byte("populated 1\nfrozen 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Emulate the kernel finishing the freeze a little later.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.WriteFile(eventsPath, []byte("populated 1\nfrozen 1\n"), 0644)
+	}()
+	if err := Freeze("ctn"); err != nil {
+		t.Fatalf("freeze: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dir, "cgroup.freeze")); got != "1" {
+		t.Fatalf("cgroup.freeze = %q", got)
+	}
+	if !Frozen("ctn") {
+		t.Fatal("Frozen = false after freeze")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.WriteFile(eventsPath, []byte("populated 1\nfrozen 0\n"), 0644)
+	}()
+	if err := Thaw("ctn"); err != nil {
+		t.Fatalf("thaw: %v", err)
+	}
+	if Frozen("ctn") {
+		t.Fatal("Frozen = true after thaw")
+	}
+}
+
+func TestFreezeTimeoutThaws(t *testing.T) {
+	dir := setupFakeCgroup(t, "ctn")
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.events"), []byte("populated 1\nfrozen 0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := FreezeTimeout
+	FreezeTimeout = 100 * time.Millisecond
+	defer func() { FreezeTimeout = old }()
+
+	if err := Freeze("ctn"); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if got := readFile(t, filepath.Join(dir, "cgroup.freeze")); got != "0" {
+		t.Fatalf("cgroup not thawed after failed freeze: %q", got)
+	}
+}
@@ -0,0 +1,180 @@
+//go:build linux
+
+package cgroups
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PSILine holds one line ("some" or "full") of a pressure file.
+type PSILine struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	Total  uint64  `json:"total"`
+}
+
+// Pressure is the content of cpu.pressure, memory.pressure or io.pressure.
+type Pressure struct {
+	Some PSILine `json:"some"`
+	Full PSILine `json:"full"`
+}
+
+// ReadPressure reads <resource>.pressure of containerID, where resource is
+// one of cpu, memory or io.
+func ReadPressure(containerID, resource string) (Pressure, error) {
+	f, err := os.Open(filepath.Join(CgroupRoot, containerID, resource+".pressure"))
+	if err != nil {
+		return Pressure{}, err
+	}
+	defer f.Close()
+	return parsePressure(f)
+}
+
+// parsePressure parses lines like
+// "some avg10=0.00 avg60=0.00 avg300=0.00 total=0".
+func parsePressure(r io.Reader) (Pressure, error) {
+	var p Pressure
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var line *PSILine
+		switch fields[0] {
+		case "some":
+			line = &p.Some
+		case "full":
+			line = &p.Full
+		default:
+			continue
+		}
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return Pressure{}, fmt.Errorf("malformed pressure field %q", kv)
+			}
+			var err error
+			switch k {
+			case "avg10":
+				line.Avg10, err = strconv.ParseFloat(v, 64)
+			case "avg60":
+				line.Avg60, err = strconv.ParseFloat(v, 64)
+			case "avg300":
+				line.Avg300, err = strconv.ParseFloat(v, 64)
+			case "total":
+				line.Total, err = strconv.ParseUint(v, 10, 64)
+			}
+			if err != nil {
+				return Pressure{}, fmt.Errorf("malformed pressure field %q: %w", kv, err)
+			}
+		}
+	}
+	return p, scanner.Err()
+}
+
+// PSIThreshold is a health rule such as "memory.some.avg10>40": the
+// container is unhealthy while the selected PSI average exceeds Value.
+type PSIThreshold struct {
+	Resource string
+	Kind     string
+	Window   string
+	OrEqual  bool
+	Value    float64
+}
+
+// ParsePSIThreshold parses "<cpu|memory|io>.<some|full>.<avg10|avg60|avg300>>N",
+// where the operator may also be ">=".
+func ParsePSIThreshold(s string) (PSIThreshold, error) {
+	var t PSIThreshold
+	expr, value, ok := strings.Cut(s, ">")
+	if !ok {
+		return t, fmt.Errorf("invalid PSI threshold %q: expected resource.kind.window>value", s)
+	}
+	if strings.HasPrefix(value, "=") {
+		t.OrEqual = true
+		value = value[1:]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return t, fmt.Errorf("invalid PSI threshold %q: %w", s, err)
+	}
+	t.Value = v
+	parts := strings.Split(strings.TrimSpace(expr), ".")
+	if len(parts) != 3 {
+		return t, fmt.Errorf("invalid PSI threshold %q: expected resource.kind.window>value", s)
+	}
+	t.Resource, t.Kind, t.Window = parts[0], parts[1], parts[2]
+	switch t.Resource {
+	case "cpu", "memory", "io":
+	default:
+		return t, fmt.Errorf("invalid PSI resource %q (cpu, memory or io)", t.Resource)
+	}
+	if t.Kind != "some" && t.Kind != "full" {
+		return t, fmt.Errorf("invalid PSI kind %q (some or full)", t.Kind)
+	}
+	switch t.Window {
+	case "avg10", "avg60", "avg300":
+	default:
+		return t, fmt.Errorf("invalid PSI window %q (avg10, avg60 or avg300)", t.Window)
+	}
+	return t, nil
+}
+
+// String formats t the way ParsePSIThreshold accepts it.
+func (t PSIThreshold) String() string {
+	op := ">"
+	if t.OrEqual {
+		op = ">="
+	}
+	return fmt.Sprintf("%s.%s.%s%s%s", t.Resource, t.Kind, t.Window, op, strconv.FormatFloat(t.Value, 'f', -1, 64))
+}
+
+// Exceeded reports whether p breaks the threshold.
+func (t PSIThreshold) Exceeded(p Pressure) bool {
+	line := p.Some
+	if t.Kind == "full" {
+		line = p.Full
+	}
+	var v float64
+	switch t.Window {
+	case "avg10":
+		v = line.Avg10
+	case "avg60":
+		v = line.Avg60
+	case "avg300":
+		v = line.Avg300
+	}
+	if t.OrEqual {
+		return v >= t.Value
+	}
+	return v > t.Value
+}
+
+// CheckPressure returns the first threshold that containerID currently
+// exceeds. Missing pressure files (PSI disabled) never trigger a threshold.
+func CheckPressure(containerID string, thresholds []PSIThreshold) (PSIThreshold, Pressure, bool) {
+	cache := map[string]Pressure{}
+	for _, t := range thresholds {
+		p, ok := cache[t.Resource]
+		if !ok {
+			var err error
+			p, err = ReadPressure(containerID, t.Resource)
+			if err != nil {
+				continue
+			}
+			cache[t.Resource] = p
+		}
+		if t.Exceeded(p) {
+			return t, p, true
+		}
+	}
+	return PSIThreshold{}, Pressure{}, false
+}
@@ -0,0 +1,81 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePressureFixture(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "statsctn", "memory.pressure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, err := parsePressure(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Pressure{
+		Some: PSILine{Avg10: 45.12, Avg60: 30, Avg300: 10.5, Total: 9876543},
+		Full: PSILine{Avg10: 40.02, Avg60: 25.1, Avg300: 8.75, Total: 8765432},
+	}
+	if p != want {
+		t.Fatalf("parsePressure = %+v, want %+v", p, want)
+	}
+}
+
+func TestParsePressureMalformed(t *testing.T) {
+	if _, err := parsePressure(strings.NewReader("some avg10=x avg60=0 avg300=0 total=0\n")); err == nil {
+		t.Fatal("expected error for malformed value")
+	}
+}
+
+func TestParsePSIThreshold(t *testing.T) {
+	th, err := ParsePSIThreshold("memory.some.avg10>40")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if th != (PSIThreshold{Resource: "memory", Kind: "some", Window: "avg10", Value: 40}) {
+		t.Fatalf("unexpected threshold %+v", th)
+	}
+	if th.String() != "memory.some.avg10>40" {
+		t.Fatalf("String() = %q", th.String())
+	}
+	th, err = ParsePSIThreshold("io.full.avg60>=12.5")
+	if err != nil || !th.OrEqual || th.Value != 12.5 || th.String() != "io.full.avg60>=12.5" {
+		t.Fatalf("unexpected threshold %+v, %v", th, err)
+	}
+	for _, bad := range []string{"memory.some.avg10", "disk.some.avg10>1", "cpu.most.avg10>1", "cpu.some.avg5>1", "cpu.some>1", "cpu.some.avg10>x"} {
+		if _, err := ParsePSIThreshold(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestCheckPressureFixture(t *testing.T) {
+	oldRoot := CgroupRoot
+	CgroupRoot = "testdata"
+	defer func() { CgroupRoot = oldRoot }()
+
+	mustParse := func(s string) PSIThreshold {
+		th, err := ParsePSIThreshold(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return th
+	}
+	ok := []PSIThreshold{mustParse("memory.some.avg10>50"), mustParse("cpu.some.avg10>20"), mustParse("io.full.avg300>1")}
+	if th, _, bad := CheckPressure("statsctn", ok); bad {
+		t.Fatalf("unexpected breach of %s", th)
+	}
+	breach := append(ok, mustParse("memory.full.avg10>40"))
+	th, p, bad := CheckPressure("statsctn", breach)
+	if !bad || th.String() != "memory.full.avg10>40" || p.Full.Avg10 != 40.02 {
+		t.Fatalf("expected memory.full breach, got %v %+v %v", th, p, bad)
+	}
+	if _, _, bad := CheckPressure("missing", breach); bad {
+		t.Fatal("missing pressure files must not trigger thresholds")
+	}
+}
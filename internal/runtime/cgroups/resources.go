@@ -0,0 +1,83 @@
+//go:build linux
+
+package cgroups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// cpuPeriod is the cpu.max period in microseconds used for --cpus.
+const cpuPeriod = 100000
+
+// Resources describes cgroup limits of a container. A zero value leaves the
+// corresponding controller untouched, -1 removes the limit.
+type Resources struct {
+	MemoryMax int64
+	CPUs      float64
+	PidsMax   int64
+	CPUWeight int64
+}
+
+type cgroupWrite struct {
+	file  string
+	value string
+}
+
+func (r Resources) writes() []cgroupWrite {
+	var out []cgroupWrite
+	switch {
+	case r.MemoryMax > 0:
+		out = append(out, cgroupWrite{"memory.max", strconv.FormatInt(r.MemoryMax, 10)})
+	case r.MemoryMax < 0:
+		out = append(out, cgroupWrite{"memory.max", "max"})
+	}
+	switch {
+	case r.CPUs > 0:
+		quota := int64(r.CPUs * cpuPeriod)
+		out = append(out, cgroupWrite{"cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)})
+	case r.CPUs < 0:
+		out = append(out, cgroupWrite{"cpu.max", fmt.Sprintf("max %d", cpuPeriod)})
+	}
+	switch {
+	case r.PidsMax > 0:
+		out = append(out, cgroupWrite{"pids.max", strconv.FormatInt(r.PidsMax, 10)})
+	case r.PidsMax < 0:
+		out = append(out, cgroupWrite{"pids.max", "max"})
+	}
+	switch {
+	case r.CPUWeight > 0:
+		out = append(out, cgroupWrite{"cpu.weight", strconv.FormatInt(r.CPUWeight, 10)})
+	case r.CPUWeight < 0:
+		out = append(out, cgroupWrite{"cpu.weight", "100"})
+	}
+	return out
+}
+
+// ApplyResources writes r to the existing cgroup of containerID. Either all
+// controller writes succeed or the files already written are restored to
+// their previous values and the first error is returned.
+func ApplyResources(containerID string, r Resources) error {
+	dir := filepath.Join(CgroupRoot, containerID)
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("cgroup for %s: %w", containerID, err)
+	}
+	var done []cgroupWrite
+	for _, w := range r.writes() {
+		path := filepath.Join(dir, w.file)
+		prev, err := os.ReadFile(path)
+		if err == nil {
+			err = os.WriteFile(path, []byte(w.value), 0644)
+		}
+		if err != nil {
+			for i := len(done) - 1; i >= 0; i-- {
+				_ = os.WriteFile(filepath.Join(dir, done[i].file), []byte(done[i].value), 0644)
+			}
+			return fmt.Errorf("set %s: %w", w.file, err)
+		}
+		done = append(done, cgroupWrite{w.file, string(prev)})
+	}
+	return nil
+}
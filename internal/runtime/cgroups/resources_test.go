@@ -0,0 +1,95 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupFakeCgroup(t *testing.T, id string) string {
+	t.Helper()
+	tmp := t.TempDir()
+	oldRoot := CgroupRoot
+	CgroupRoot = tmp
+	t.Cleanup(func() { CgroupRoot = oldRoot })
+	dir := filepath.Join(tmp, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for file, v := range map[string]string{
+		"memory.max": "max",
+		"cpu.max":    "max 100000",
+		"pids.max":   "max",
+		"cpu.weight": "100",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(v), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestApplyResources(t *testing.T) {
+	dir := setupFakeCgroup(t, "ctn")
+	err := ApplyResources("ctn", Resources{MemoryMax: 1 << 20, CPUs: 1.5, PidsMax: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "memory.max")); got != "1048576" {
+		t.Fatalf("memory.max = %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "cpu.max")); got != "150000 100000" {
+		t.Fatalf("cpu.max = %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "pids.max")); got != "64" {
+		t.Fatalf("pids.max = %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "cpu.weight")); got != "100" {
+		t.Fatalf("cpu.weight changed: %q", got)
+	}
+
+	if err := ApplyResources("ctn", Resources{MemoryMax: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "memory.max")); got != "max" {
+		t.Fatalf("memory.max after reset = %q", got)
+	}
+}
+
+func TestApplyResourcesRollsBackOnFailure(t *testing.T) {
+	dir := setupFakeCgroup(t, "ctn")
+	// A directory in place of pids.max makes that write fail after
+	// memory.max and cpu.max were already changed.
+	if err := os.Remove(filepath.Join(dir, "pids.max")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "pids.max"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := ApplyResources("ctn", Resources{MemoryMax: 4096, CPUs: 2, PidsMax: 10})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if got := readFile(t, filepath.Join(dir, "memory.max")); got != "max" {
+		t.Fatalf("memory.max not rolled back: %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "cpu.max")); got != "max 100000" {
+		t.Fatalf("cpu.max not rolled back: %q", got)
+	}
+}
+
+func TestApplyResourcesMissingCgroup(t *testing.T) {
+	setupFakeCgroup(t, "ctn")
+	if err := ApplyResources("other", Resources{PidsMax: 1}); err == nil {
+		t.Fatal("expected error for missing cgroup")
+	}
+}
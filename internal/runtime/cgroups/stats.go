@@ -0,0 +1,143 @@
+//go:build linux
+
+package cgroups
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Stats is a snapshot of the cgroup v2 counters of a single container.
+// Limits of 0 mean "max" (no limit configured).
+type Stats struct {
+	CPUUsageUsec  uint64
+	MemoryCurrent uint64
+	MemoryLimit   uint64
+	MemoryStat    map[string]uint64
+	PidsCurrent   uint64
+	PidsLimit     uint64
+	IOReadBytes   uint64
+	IOWriteBytes  uint64
+
+	CPUPressure    Pressure
+	MemoryPressure Pressure
+	IOPressure     Pressure
+}
+
+// MemoryUsage returns the memory usage without the inactive page cache,
+// which the kernel can reclaim at any time.
+func (s Stats) MemoryUsage() uint64 {
+	inactive := s.MemoryStat["inactive_file"]
+	if inactive > s.MemoryCurrent {
+		return 0
+	}
+	return s.MemoryCurrent - inactive
+}
+
+// ReadStats collects the counters of containerID from its cgroup directory.
+// Files that are missing because a controller is not enabled are skipped.
+func ReadStats(containerID string) (Stats, error) {
+	dir := filepath.Join(CgroupRoot, containerID)
+	if _, err := os.Stat(dir); err != nil {
+		return Stats{}, err
+	}
+	var st Stats
+	if kv, err := readFlatKeyed(filepath.Join(dir, "cpu.stat")); err == nil {
+		st.CPUUsageUsec = kv["usage_usec"]
+	}
+	st.MemoryCurrent, _ = readSingleValue(filepath.Join(dir, "memory.current"))
+	st.MemoryLimit, _ = readSingleValue(filepath.Join(dir, "memory.max"))
+	if kv, err := readFlatKeyed(filepath.Join(dir, "memory.stat")); err == nil {
+		st.MemoryStat = kv
+	}
+	st.PidsCurrent, _ = readSingleValue(filepath.Join(dir, "pids.current"))
+	st.PidsLimit, _ = readSingleValue(filepath.Join(dir, "pids.max"))
+	if f, err := os.Open(filepath.Join(dir, "io.stat")); err == nil {
+		st.IOReadBytes, st.IOWriteBytes, _ = parseIOStat(f)
+		f.Close()
+	}
+	st.CPUPressure, _ = ReadPressure(containerID, "cpu")
+	st.MemoryPressure, _ = ReadPressure(containerID, "memory")
+	st.IOPressure, _ = ReadPressure(containerID, "io")
+	return st, nil
+}
+
+func readFlatKeyed(path string) (map[string]uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFlatKeyed(f)
+}
+
+func readSingleValue(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return parseSingleValue(string(data))
+}
+
+// parseFlatKeyed parses files made of "key value" lines such as cpu.stat,
+// memory.stat and memory.events.
+func parseFlatKeyed(r io.Reader) (map[string]uint64, error) {
+	out := map[string]uint64{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		out[fields[0]] = v
+	}
+	return out, scanner.Err()
+}
+
+// parseSingleValue parses single value files such as memory.current or
+// pids.max. The literal "max" is returned as 0.
+func parseSingleValue(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if s == "max" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// parseIOStat sums rbytes and wbytes over all devices listed in io.stat,
+// whose lines look like "8:0 rbytes=1459200 wbytes=314773504 rios=192 ...".
+func parseIOStat(r io.Reader) (uint64, uint64, error) {
+	var rbytes, wbytes uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				continue
+			}
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch k {
+			case "rbytes":
+				rbytes += n
+			case "wbytes":
+				wbytes += n
+			}
+		}
+	}
+	return rbytes, wbytes, scanner.Err()
+}
@@ -0,0 +1,95 @@
+package cgroups
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFlatKeyedCPUStat(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "statsctn", "cpu.stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	kv, err := parseFlatKeyed(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kv["usage_usec"] != 8821347 || kv["user_usec"] != 5012345 || kv["system_usec"] != 3809002 {
+		t.Fatalf("unexpected cpu.stat values: %v", kv)
+	}
+}
+
+func TestParseIOStat(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "statsctn", "io.stat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, w, err := parseIOStat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 1459200+1024 || w != 314773504+4096 {
+		t.Fatalf("unexpected io.stat totals: read=%d write=%d", r, w)
+	}
+}
+
+func TestParseSingleValue(t *testing.T) {
+	cases := map[string]uint64{"max\n": 0, "104857600\n": 104857600, "3": 3}
+	for in, want := range cases {
+		got, err := parseSingleValue(in)
+		if err != nil || got != want {
+			t.Fatalf("parseSingleValue(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := parseSingleValue("garbage"); err == nil {
+		t.Fatal("expected error for malformed value")
+	}
+}
+
+func TestParseFlatKeyedSkipsMalformedLines(t *testing.T) {
+	kv, err := parseFlatKeyed(strings.NewReader("oom 1\nbroken\noom_kill x\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kv) != 1 || kv["oom"] != 1 {
+		t.Fatalf("unexpected result: %v", kv)
+	}
+}
+
+func TestReadStatsFixture(t *testing.T) {
+	oldRoot := CgroupRoot
+	CgroupRoot = "testdata"
+	defer func() { CgroupRoot = oldRoot }()
+
+	st, err := ReadStats("statsctn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.CPUUsageUsec != 8821347 {
+		t.Fatalf("cpu usage = %d", st.CPUUsageUsec)
+	}
+	if st.MemoryCurrent != 52428800 || st.MemoryLimit != 104857600 {
+		t.Fatalf("memory = %d / %d", st.MemoryCurrent, st.MemoryLimit)
+	}
+	if st.MemoryUsage() != 52428800-10485760 {
+		t.Fatalf("memory usage without cache = %d", st.MemoryUsage())
+	}
+	if st.PidsCurrent != 3 || st.PidsLimit != 0 {
+		t.Fatalf("pids = %d / %d", st.PidsCurrent, st.PidsLimit)
+	}
+	if st.IOReadBytes != 1460224 || st.IOWriteBytes != 314777600 {
+		t.Fatalf("io = %d / %d", st.IOReadBytes, st.IOWriteBytes)
+	}
+
+	if st.CPUPressure.Some.Avg10 != 12.5 || st.MemoryPressure.Full.Avg60 != 25.1 || st.IOPressure.Some.Total != 120034 {
+		t.Fatalf("pressure = %+v %+v %+v", st.CPUPressure, st.MemoryPressure, st.IOPressure)
+	}
+
+	if _, err := ReadStats("missing"); err == nil {
+		t.Fatal("expected error for missing cgroup")
+	}
+}
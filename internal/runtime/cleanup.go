@@ -1,6 +1,8 @@
 package runtime
 
 import (
+	"bytes"
+	"fmt"
 	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
 	"github.com/denysk0/pocketDocker/internal/store"
 	"os"
@@ -12,8 +14,34 @@ import (
 	"time"
 )
 
-// Cleanup stops the container process and removes its resources.
-func Cleanup(info store.ContainerInfo) {
+// NetworkStore resolves the networks of a container and releases its
+// addresses and host ports. *store.Store implements it.
+type NetworkStore interface {
+	NetworkLookup
+	ContainerAddresses(containerID string) ([]store.IPAllocation, error)
+	ReleaseIP(network, containerID string) error
+	ReleasePorts(containerID string) error
+}
+
+// Cleanup stops the container process and removes its resources. ns, if
+// not nil, resolves the network records the rules were created from. If
+// release is set the container is also detached from networks joined with
+// `network connect` and all its addresses and host ports are released;
+// a restart keeps them.
+func Cleanup(info store.ContainerInfo, ns NetworkStore, release bool) {
+	// A frozen process cannot act on SIGTERM, so resume it first.
+	if info.State == "Paused" {
+		_ = cgroups.Thaw(info.ID)
+	}
+	cniNetns := ""
+	if strings.HasPrefix(info.Network, CNIPrefix) {
+		// The namespace goes away with the process, but the plugins tear
+		// the interface down inside it; an open descriptor keeps it alive.
+		if f := openNetns(info); f != nil {
+			defer f.Close()
+			cniNetns = fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), f.Fd())
+		}
+	}
 	if proc, err := os.FindProcess(info.PID); err == nil {
 		if err := proc.Signal(syscall.SIGTERM); err != nil && err != syscall.ESRCH {
 		}
@@ -22,21 +50,48 @@ func Cleanup(info store.ContainerInfo) {
 		}
 	}
 	_ = cgroups.RemoveCgroup(info.ID)
+	if info.ProxyPID > 0 {
+		// A restart publishes the same ports again, so the proxy must have
+		// released them.
+		stopHelper(info.ProxyPID, info.PID)
+	}
+	if info.SlirpPID > 0 {
+		stopHelper(info.SlirpPID, info.PID)
+	}
+	var primary string
 	if info.NetworkSetup {
-		var pm []PortMap
-		if info.Ports != "" {
-			for _, p := range strings.Split(info.Ports, ",") {
-				parts := strings.SplitN(p, ":", 2)
-				if len(parts) == 2 {
-					hostPort, err1 := strconv.Atoi(parts[0])
-					contPort, err2 := strconv.Atoi(parts[1])
-					if err1 == nil && err2 == nil {
-						pm = append(pm, PortMap{Host: hostPort, Container: contPort})
+		var lookup NetworkLookup
+		if ns != nil {
+			lookup = ns
+		}
+		n, err := LookupNetwork(lookup, info.Network)
+		if err != nil {
+			// Only the port rules can be removed without the network
+			// record; the veth goes away with the network namespace.
+			n = Network{Name: info.Network}
+		}
+		// run validated the values before recording them.
+		egress, _ := ParseEgressRules(info.EgressAllow)
+		_ = CleanupNetworkingWithIP(n, info.ID, info.IPAddress, info.Ports, egress, info.IpForwardOrig, info.Ip6ForwardOrig, info.Firewall)
+		primary = n.Name
+	}
+	if strings.HasPrefix(info.Network, CNIPrefix) {
+		if c, err := LoadCNIConfig(strings.TrimPrefix(info.Network, CNIPrefix)); err == nil {
+			_ = CNIDel(c, info.ID, cniNetns, info.CNIResult, info.Ports)
+		}
+	}
+	if ns != nil && release {
+		if addrs, err := ns.ContainerAddresses(info.ID); err == nil {
+			for _, a := range addrs {
+				if a.Network != primary {
+					if m, err := LookupNetwork(ns, a.Network); err == nil {
+						DisconnectNetwork(m, info.ID, nil)
 					}
 				}
+				_ = ns.ReleaseIP(a.Network, info.ID)
 			}
 		}
-		_ = CleanupNetworkingWithIPSuffix(info.ID, info.IPSuffix, pm, info.IpForwardOrig)
+		_ = ns.ReleasePorts(info.ID)
 	}
 	if info.RootfsDir != "" {
 		_ = syscall.Unmount(filepath.Join(info.RootfsDir, "proc"), syscall.MNT_DETACH)
@@ -60,3 +115,72 @@ func Cleanup(info store.ContainerInfo) {
 		_ = os.Remove(filepath.Join(home, ".pocket-docker", "logs", info.ID+".log"))
 	}
 }
+
+// openNetns opens the network namespace of the running container info. It
+// returns nil if the container is not running or its PID was reused by a
+// process in the namespace of the caller.
+func openNetns(info store.ContainerInfo) *os.File {
+	if info.State != "Running" && info.State != "Paused" {
+		return nil
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", info.PID))
+	if err != nil {
+		return nil
+	}
+	var ours, theirs syscall.Stat_t
+	if syscall.Stat("/proc/self/ns/net", &ours) != nil || syscall.Fstat(int(f.Fd()), &theirs) != nil || ours.Ino == theirs.Ino {
+		f.Close()
+		return nil
+	}
+	return f
+}
+
+// stopHelper terminates the port proxy or slirp helper pid started for the
+// container process containerPID and waits for it to exit. The helper may
+// have exited long ago and its PID been reused, so pid is only signalled
+// while its command line still names such a helper for that container.
+func stopHelper(pid, containerPID int) {
+	if !isHelperOf(pid, containerPID) {
+		return
+	}
+	_ = syscall.Kill(pid, syscall.SIGTERM)
+	waitExited(pid, 2*time.Second)
+}
+
+// isHelperOf reports whether pid runs `port-proxy --pid containerPID`,
+// `slirp --pid containerPID` or slirp4netns for containerPID.
+func isHelperOf(pid, containerPID int) bool {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline")
+	if err != nil {
+		return false
+	}
+	args := strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+	helper := filepath.Base(args[0]) == "slirp4netns" ||
+		(len(args) > 1 && (args[1] == "port-proxy" || args[1] == "slirp"))
+	if !helper {
+		return false
+	}
+	for _, a := range args[1:] {
+		if a == strconv.Itoa(containerPID) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitExited waits up to timeout for pid to exit. An unreaped child counts
+// as exited.
+func waitExited(pid int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+		if err != nil {
+			return
+		}
+		// The state follows the parenthesised command name.
+		if i := bytes.LastIndexByte(stat, ')'); i >= 0 && i+2 < len(stat) && stat[i+2] == 'Z' {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,39 @@
+package runtime
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStopHelperChecksCommandLine(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	start := func(args ...string) *exec.Cmd {
+		c := &exec.Cmd{Path: sh, Args: args}
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Process.Kill(); c.Wait() })
+		return c
+	}
+	// A process that took over the PID of a helper is left alone.
+	other := start("sh", "-c", "sleep 10; :", "4242")
+	helper := start("/usr/bin/slirp4netns", "-c", "sleep 10; :", "4242")
+	time.Sleep(100 * time.Millisecond)
+	if isHelperOf(helper.Process.Pid, 4243) {
+		t.Fatal("helper of another container matched")
+	}
+	stopHelper(other.Process.Pid, 4242)
+	stopHelper(helper.Process.Pid, 4242)
+	if err := syscall.Kill(other.Process.Pid, 0); err != nil {
+		t.Fatalf("unrelated process signalled: %v", err)
+	}
+	var ws syscall.WaitStatus
+	if _, err := syscall.Wait4(helper.Process.Pid, &ws, syscall.WNOHANG, nil); err != nil || !ws.Signaled() {
+		t.Fatalf("helper not stopped: %v, %v", ws, err)
+	}
+}
@@ -0,0 +1,270 @@
+//go:build linux
+
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/util"
+)
+
+// CNIPrefix selects a network defined by a CNI config list, as in
+// --network cni:<name>.
+const CNIPrefix = "cni:"
+
+// cniIfName is the interface the plugins create inside the container.
+const cniIfName = "eth0"
+
+// CNIConfDirs are searched in order for CNI config lists.
+var CNIConfDirs = []string{
+	filepath.Join(util.UserHomeDir(), ".pocket-docker", "cni"),
+	"/etc/cni/net.d",
+}
+
+// CNIBinDirs are searched for plugin binaries. CNI_PATH overrides the
+// default /opt/cni/bin.
+var CNIBinDirs = cniBinDirs()
+
+func cniBinDirs() []string {
+	if p := os.Getenv("CNI_PATH"); p != "" {
+		return filepath.SplitList(p)
+	}
+	return []string{"/opt/cni/bin"}
+}
+
+// CNIConfig is a CNI network configuration list.
+type CNIConfig struct {
+	Name       string
+	CNIVersion string
+	// Plugins holds the configuration of each plugin, in invocation order.
+	Plugins []map[string]any
+}
+
+// LoadCNIConfig returns the config list named name from the first file in
+// CNIConfDirs that defines it. Files are read in lexical order; besides
+// .conflist files, .conf and .json files holding a single plugin
+// configuration are accepted as a list of one.
+func LoadCNIConfig(name string) (CNIConfig, error) {
+	for _, dir := range CNIConfDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if e.IsDir() || (ext != ".conflist" && ext != ".conf" && ext != ".json") {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			if err != nil {
+				continue
+			}
+			c, err := parseCNIConfig(data, ext == ".conflist")
+			if err != nil {
+				if c.Name == name {
+					return CNIConfig{}, fmt.Errorf("CNI network %s: %s: %w", name, filepath.Join(dir, e.Name()), err)
+				}
+				continue
+			}
+			if c.Name == name {
+				return c, nil
+			}
+		}
+	}
+	return CNIConfig{}, fmt.Errorf("CNI network %s not found in %s", name, strings.Join(CNIConfDirs, " or "))
+}
+
+// parseCNIConfig parses a config list or, unless list is set, a single
+// plugin configuration. The name is returned with errors about the rest.
+func parseCNIConfig(data []byte, list bool) (CNIConfig, error) {
+	var raw struct {
+		CNIVersion string           `json:"cniVersion"`
+		Name       string           `json:"name"`
+		Plugins    []map[string]any `json:"plugins"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return CNIConfig{}, err
+	}
+	c := CNIConfig{Name: raw.Name, CNIVersion: raw.CNIVersion, Plugins: raw.Plugins}
+	if raw.Plugins == nil && !list {
+		var plugin map[string]any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&plugin); err != nil {
+			return c, err
+		}
+		c.Plugins = []map[string]any{plugin}
+	}
+	if c.Name == "" {
+		return c, fmt.Errorf("missing name")
+	}
+	if len(c.Plugins) == 0 {
+		return c, fmt.Errorf("no plugins")
+	}
+	for _, p := range c.Plugins {
+		if typ, _ := p["type"].(string); typ == "" || strings.ContainsRune(typ, '/') {
+			return c, fmt.Errorf("invalid plugin type %v", p["type"])
+		}
+	}
+	return c, nil
+}
+
+// SupportsPorts reports whether a plugin of c publishes ports, i.e. has the
+// portMappings capability like the portmap plugin.
+func (c CNIConfig) SupportsPorts() bool {
+	for _, p := range c.Plugins {
+		if caps, ok := p["capabilities"].(map[string]any); ok && caps["portMappings"] == true {
+			return true
+		}
+	}
+	return false
+}
+
+// CNIAdd runs the ADD command of every plugin of c, in order, for the
+// network namespace of container pid and returns the result of the last
+// one. ports are handed to plugins with the portMappings capability. If a
+// plugin fails, DEL is run for the whole list.
+func CNIAdd(c CNIConfig, id string, pid int, ports []PortMap) (string, error) {
+	netns := fmt.Sprintf("/proc/%d/ns/net", pid)
+	var result []byte
+	for i := range c.Plugins {
+		out, err := c.invoke("ADD", i, id, netns, result, ports)
+		if err != nil {
+			_ = CNIDel(c, id, netns, string(result), ports)
+			return "", err
+		}
+		result = out
+	}
+	return string(result), nil
+}
+
+// CNIDel runs the DEL command of every plugin of c in reverse order. netns
+// may be empty once the namespace is gone; plugins then only release what
+// they hold outside of it, such as addresses and host rules. result is the
+// one returned by CNIAdd. All plugins are run; the first error is returned.
+func CNIDel(c CNIConfig, id, netns, result string, ports []PortMap) error {
+	var prev []byte
+	if result != "" {
+		prev = []byte(result)
+	}
+	var err error
+	for i := len(c.Plugins) - 1; i >= 0; i-- {
+		if _, perr := c.invoke("DEL", i, id, netns, prev, ports); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// invoke runs command for plugin i of c, passing its configuration with the
+// previous result on stdin as the CNI specification describes.
+func (c CNIConfig) invoke(command string, i int, id, netns string, prev []byte, ports []PortMap) ([]byte, error) {
+	conf := maps.Clone(c.Plugins[i])
+	conf["name"] = c.Name
+	conf["cniVersion"] = c.CNIVersion
+	if prev != nil {
+		conf["prevResult"] = json.RawMessage(prev)
+	}
+	if caps, ok := conf["capabilities"].(map[string]any); ok && caps["portMappings"] == true && len(ports) > 0 {
+		conf["runtimeConfig"] = map[string]any{"portMappings": cniPortMappings(ports)}
+	}
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	typ := conf["type"].(string)
+	bin, err := findCNIPlugin(typ)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(bin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+id,
+		"CNI_NETNS="+netns,
+		"CNI_IFNAME="+cniIfName,
+		"CNI_PATH="+strings.Join(CNIBinDirs, string(filepath.ListSeparator)),
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Plugins report errors as JSON on stdout.
+		var perr struct {
+			Msg     string `json:"msg"`
+			Details string `json:"details"`
+		}
+		if json.Unmarshal(stdout.Bytes(), &perr) == nil && perr.Msg != "" {
+			if perr.Details != "" {
+				perr.Msg += ": " + perr.Details
+			}
+			return nil, fmt.Errorf("CNI plugin %s %s: %s", typ, command, perr.Msg)
+		}
+		return nil, fmt.Errorf("CNI plugin %s %s: %v: %s", typ, command, err, strings.TrimSpace(stderr.String()))
+	}
+	if command != "ADD" {
+		return nil, nil
+	}
+	result := bytes.TrimSpace(stdout.Bytes())
+	if !json.Valid(result) {
+		return nil, fmt.Errorf("CNI plugin %s %s: invalid result %q", typ, command, result)
+	}
+	return result, nil
+}
+
+func findCNIPlugin(typ string) (string, error) {
+	for _, dir := range CNIBinDirs {
+		path := filepath.Join(dir, typ)
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("CNI plugin %s not found in %s", typ, strings.Join(CNIBinDirs, " or "))
+}
+
+// cniPortMappings converts ports to the portMappings runtime config, one
+// entry per port of a range.
+func cniPortMappings(ports []PortMap) []map[string]any {
+	var out []map[string]any
+	for _, pm := range ports {
+		for _, p := range portPairs(pm) {
+			m := map[string]any{"hostPort": p[0], "containerPort": p[1], "protocol": pm.Protocol()}
+			if pm.HostIP != "" {
+				m["hostIP"] = pm.HostIP
+			}
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// CNIAddresses returns the first IPv4 and IPv6 address of the container
+// interface in a CNI result, without prefix length.
+func CNIAddresses(result string) (ip, ip6 string) {
+	var r struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+	}
+	_ = json.Unmarshal([]byte(result), &r)
+	for _, a := range r.IPs {
+		addr, _, _ := strings.Cut(a.Address, "/")
+		switch {
+		case isIPv6(addr) && ip6 == "":
+			ip6 = addr
+		case !isIPv6(addr) && ip == "":
+			ip = addr
+		}
+	}
+	return ip, ip6
+}
@@ -0,0 +1,182 @@
+package runtime
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeCNI installs plugin scripts that log each call and points the CNI
+// directories at temporary ones. It returns the config directory and a
+// function reading the log, one line per call.
+func fakeCNI(t *testing.T) (string, func() []string) {
+	t.Helper()
+	confDir, binDir := t.TempDir(), t.TempDir()
+	log := filepath.Join(t.TempDir(), "calls")
+	plugins := map[string]string{
+		"fake-bridge": `{"cniVersion":"1.0.0","ips":[{"address":"10.88.0.5/16"},{"address":"fd00::5/64"}]}`,
+		"fake-ports":  `{"cniVersion":"1.0.0","ips":[{"address":"10.88.0.5/16"}],"ports":true}`,
+	}
+	for name, result := range plugins {
+		script := "#!/bin/sh\necho \"$CNI_COMMAND $CNI_CONTAINERID $CNI_NETNS $CNI_IFNAME $(cat)\" >> " + log + "\n" +
+			"[ \"$CNI_COMMAND\" = ADD ] && echo '" + result + "'\nexit 0\n"
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fail := "#!/bin/sh\ncat >/dev/null\necho \"$CNI_COMMAND fail\" >> " + log + "\n" +
+		"[ \"$CNI_COMMAND\" = DEL ] && exit 0\necho '{\"code\":11,\"msg\":\"no addresses left\"}'\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(binDir, "fake-fail"), []byte(fail), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldConf, oldBin := CNIConfDirs, CNIBinDirs
+	CNIConfDirs, CNIBinDirs = []string{confDir}, []string{binDir}
+	t.Cleanup(func() { CNIConfDirs, CNIBinDirs = oldConf, oldBin })
+	return confDir, func() []string {
+		data, _ := os.ReadFile(log)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestLoadCNIConfig(t *testing.T) {
+	confDir, _ := fakeCNI(t)
+	other := t.TempDir()
+	CNIConfDirs = append(CNIConfDirs, other)
+	files := map[string]string{
+		filepath.Join(confDir, "10-web.conflist"): `{"cniVersion":"1.0.0","name":"web","plugins":[{"type":"fake-bridge","mtu":1500},{"type":"fake-ports","capabilities":{"portMappings":true}}]}`,
+		filepath.Join(confDir, "20-single.conf"):  `{"cniVersion":"0.4.0","name":"single","type":"fake-bridge"}`,
+		filepath.Join(confDir, "30-broken.json"):  `{"name":`,
+		filepath.Join(confDir, "40-bad.conflist"): `{"cniVersion":"1.0.0","name":"bad","plugins":[{"type":"../sh"}]}`,
+		filepath.Join(confDir, "README"):          `{"name":"readme","type":"fake-bridge"}`,
+		filepath.Join(other, "10-web.conflist"):   `{"cniVersion":"1.0.0","name":"web","plugins":[{"type":"shadowed"}]}`,
+		filepath.Join(other, "10-later.conflist"): `{"cniVersion":"1.0.0","name":"later","plugins":[{"type":"fake-bridge"}]}`,
+		filepath.Join(other, "20-empty.conflist"): `{"cniVersion":"1.0.0","name":"empty"}`,
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := LoadCNIConfig("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CNIVersion != "1.0.0" || len(c.Plugins) != 2 || c.Plugins[0]["type"] != "fake-bridge" || !c.SupportsPorts() {
+		t.Fatalf("web = %+v", c)
+	}
+	if c, err := LoadCNIConfig("single"); err != nil || len(c.Plugins) != 1 || c.SupportsPorts() {
+		t.Fatalf("single = %+v, %v", c, err)
+	}
+	if _, err := LoadCNIConfig("later"); err != nil {
+		t.Fatalf("later: %v", err)
+	}
+	for _, name := range []string{"bad", "empty", "readme", "missing"} {
+		if _, err := LoadCNIConfig(name); err == nil {
+			t.Errorf("LoadCNIConfig(%q) succeeded", name)
+		}
+	}
+}
+
+func TestCNIAddDel(t *testing.T) {
+	_, calls := fakeCNI(t)
+	c := CNIConfig{Name: "web", CNIVersion: "1.0.0", Plugins: []map[string]any{
+		{"type": "fake-bridge", "bridge": "cni0"},
+		{"type": "fake-ports", "capabilities": map[string]any{"portMappings": true}},
+	}}
+	ports := []PortMap{{Host: 8080, HostEnd: 8081, Container: 80, ContainerEnd: 81}, {HostIP: "127.0.0.1", Host: 5353, Container: 53, Proto: "udp"}}
+	result, err := CNIAdd(c, "abc123", 4242, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(result, `"ports":true`) {
+		t.Fatalf("result %s is not the one of the last plugin", result)
+	}
+	if ip, ip6 := CNIAddresses(result); ip != "10.88.0.5" || ip6 != "" {
+		t.Fatalf("CNIAddresses = %q, %q", ip, ip6)
+	}
+	if err := CNIDel(c, "abc123", "", result, ports); err != nil {
+		t.Fatal(err)
+	}
+
+	log := calls()
+	if len(log) != 4 {
+		t.Fatalf("calls = %q", log)
+	}
+	type call struct {
+		env  string
+		conf map[string]any
+	}
+	var got []call
+	for _, l := range log {
+		i := strings.Index(l, "{")
+		var conf map[string]any
+		if err := json.Unmarshal([]byte(l[i:]), &conf); err != nil {
+			t.Fatalf("stdin of %q: %v", l, err)
+		}
+		got = append(got, call{strings.TrimSpace(l[:i]), conf})
+	}
+	wantEnv := []string{"ADD abc123 /proc/4242/ns/net eth0", "ADD abc123 /proc/4242/ns/net eth0", "DEL abc123  eth0", "DEL abc123  eth0"}
+	wantType := []string{"fake-bridge", "fake-ports", "fake-ports", "fake-bridge"}
+	for i, g := range got {
+		if g.env != wantEnv[i] || g.conf["type"] != wantType[i] || g.conf["name"] != "web" || g.conf["cniVersion"] != "1.0.0" {
+			t.Fatalf("call %d = %q %v", i, g.env, g.conf)
+		}
+	}
+	if _, ok := got[0].conf["prevResult"]; ok || got[0].conf["bridge"] != "cni0" {
+		t.Fatalf("first ADD got %v", got[0].conf)
+	}
+	if prev, _ := got[1].conf["prevResult"].(map[string]any); prev == nil || prev["ports"] != nil {
+		t.Fatalf("second ADD got prevResult %v", got[1].conf["prevResult"])
+	}
+	if prev, _ := got[3].conf["prevResult"].(map[string]any); prev == nil || prev["ports"] != true {
+		t.Fatalf("DEL got prevResult %v", got[3].conf["prevResult"])
+	}
+	if _, ok := got[0].conf["runtimeConfig"]; ok {
+		t.Fatalf("plugin without the capability got %v", got[0].conf["runtimeConfig"])
+	}
+	mappings := got[1].conf["runtimeConfig"].(map[string]any)["portMappings"]
+	want := []any{
+		map[string]any{"hostPort": 8080.0, "containerPort": 80.0, "protocol": "tcp"},
+		map[string]any{"hostPort": 8081.0, "containerPort": 81.0, "protocol": "tcp"},
+		map[string]any{"hostPort": 5353.0, "containerPort": 53.0, "protocol": "udp", "hostIP": "127.0.0.1"},
+	}
+	if !reflect.DeepEqual(mappings, want) {
+		t.Fatalf("portMappings = %v, want %v", mappings, want)
+	}
+}
+
+func TestCNIAddFailureRunsDel(t *testing.T) {
+	_, calls := fakeCNI(t)
+	c := CNIConfig{Name: "web", CNIVersion: "1.0.0", Plugins: []map[string]any{{"type": "fake-bridge"}, {"type": "fake-fail"}}}
+	_, err := CNIAdd(c, "abc123", 4242, nil)
+	if err == nil || !strings.Contains(err.Error(), "fake-fail ADD: no addresses left") {
+		t.Fatalf("CNIAdd error = %v", err)
+	}
+	log := calls()
+	var cmds []string
+	for _, l := range log {
+		cmds = append(cmds, strings.Join(strings.Fields(l)[:2], " "))
+	}
+	want := []string{"ADD abc123", "ADD fail", "DEL fail", "DEL abc123"}
+	if !reflect.DeepEqual(cmds, want) {
+		t.Fatalf("calls = %q, want %q", cmds, want)
+	}
+
+	c.Plugins = []map[string]any{{"type": "not-installed"}}
+	if _, err := CNIAdd(c, "abc123", 4242, nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("missing plugin: %v", err)
+	}
+}
+
+func TestCNIAddresses(t *testing.T) {
+	ip, ip6 := CNIAddresses(`{"ips":[{"address":"fd00::5/64"},{"address":"10.88.0.5/16"},{"address":"10.88.0.6/16"}]}`)
+	if ip != "10.88.0.5" || ip6 != "fd00::5" {
+		t.Fatalf("CNIAddresses = %q, %q", ip, ip6)
+	}
+	if ip, ip6 := CNIAddresses(""); ip != "" || ip6 != "" {
+		t.Fatalf("empty result = %q, %q", ip, ip6)
+	}
+}
@@ -0,0 +1,231 @@
+//go:build linux
+
+package runtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// DNS record types and classes answered by the embedded server.
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+
+	dnsHeaderLen = 12
+	// dnsTTL is short since addresses change when containers restart.
+	dnsTTL = 10
+)
+
+// DNS response codes.
+const (
+	dnsFormErr  = 1
+	dnsServFail = 2
+	dnsNotImp   = 4
+)
+
+// DNSServer is the embedded DNS server of a network. It answers A and AAAA
+// queries for container names and aliases and forwards everything else to
+// the host resolvers.
+type DNSServer struct {
+	// Lookup returns the addresses of a container name or alias, or none
+	// if the name is not a container on the network.
+	Lookup func(name string) []netip.Addr
+	// Resolvers are the servers, as ip:port, other queries go to. They
+	// default to the nameservers of the host.
+	Resolvers []string
+	// Timeout bounds a forwarded query.
+	Timeout time.Duration
+}
+
+// NewDNSServer returns a server resolving names with lookup.
+func NewDNSServer(lookup func(name string) []netip.Addr) *DNSServer {
+	return &DNSServer{Lookup: lookup, Resolvers: hostResolvers(), Timeout: 5 * time.Second}
+}
+
+// ServeUDP answers the queries received on pc until it is closed.
+func (d *DNSServer) ServeUDP(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if reply := d.answer(query, "udp"); reply != nil {
+				pc.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// ServeTCP answers the queries of the connections accepted on l until it
+// is closed. Messages carry a two byte length prefix.
+func (d *DNSServer) ServeTCP(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetDeadline(time.Now().Add(d.Timeout + 5*time.Second))
+				query, err := readDNSStream(c)
+				if err != nil {
+					return
+				}
+				reply := d.answer(query, "tcp")
+				if reply == nil || writeDNSStream(c, reply) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func readDNSStream(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeDNSStream(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// answer returns the reply to query, or nil if there is none to send.
+func (d *DNSServer) answer(query []byte, network string) []byte {
+	if len(query) < dnsHeaderLen || query[2]&0x80 != 0 {
+		// Too short to reply to, or a response.
+		return nil
+	}
+	if opcode := query[2] >> 3 & 0x0f; opcode != 0 {
+		return dnsError(query, dnsNotImp)
+	}
+	if binary.BigEndian.Uint16(query[4:6]) != 1 {
+		return d.forward(query, network)
+	}
+	name, end, ok := parseDNSName(query, dnsHeaderLen)
+	if !ok || end+4 > len(query) {
+		return dnsError(query, dnsFormErr)
+	}
+	qtype := binary.BigEndian.Uint16(query[end : end+2])
+	qclass := binary.BigEndian.Uint16(query[end+2 : end+4])
+	var addrs []netip.Addr
+	if qclass == dnsClassIN && d.Lookup != nil {
+		addrs = d.Lookup(strings.ToLower(strings.TrimSuffix(name, ".")))
+	}
+	if len(addrs) == 0 {
+		return d.forward(query, network)
+	}
+
+	reply := make([]byte, dnsHeaderLen, end+4+len(addrs)*28)
+	copy(reply, query[:4])
+	reply[2] = 0x80 | 0x04 | query[2]&0x01 // response, authoritative, RD copied
+	reply[3] = 0x80                        // recursion available
+	binary.BigEndian.PutUint16(reply[4:6], 1)
+	reply = append(reply, query[dnsHeaderLen:end+4]...)
+	var count uint16
+	for _, a := range addrs {
+		typ := uint16(dnsTypeA)
+		if !a.Is4() {
+			typ = dnsTypeAAAA
+		}
+		if qtype != typ && qtype != dnsTypeANY {
+			continue
+		}
+		reply = append(reply, 0xc0, dnsHeaderLen) // the name of the question
+		reply = binary.BigEndian.AppendUint16(reply, typ)
+		reply = binary.BigEndian.AppendUint16(reply, dnsClassIN)
+		reply = binary.BigEndian.AppendUint32(reply, dnsTTL)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(a.BitLen()/8))
+		reply = append(reply, a.AsSlice()...)
+		count++
+	}
+	binary.BigEndian.PutUint16(reply[6:8], count)
+	return reply
+}
+
+// forward relays query to the first resolver that answers.
+func (d *DNSServer) forward(query []byte, network string) []byte {
+	for _, r := range d.Resolvers {
+		c, err := net.DialTimeout(network, r, d.Timeout)
+		if err != nil {
+			continue
+		}
+		c.SetDeadline(time.Now().Add(d.Timeout))
+		var reply []byte
+		if network == "tcp" {
+			if err = writeDNSStream(c, query); err == nil {
+				reply, err = readDNSStream(c)
+			}
+		} else if _, err = c.Write(query); err == nil {
+			buf := make([]byte, 65535)
+			var n int
+			n, err = c.Read(buf)
+			reply = buf[:n]
+		}
+		c.Close()
+		if err == nil && len(reply) >= dnsHeaderLen {
+			return reply
+		}
+	}
+	return dnsError(query, dnsServFail)
+}
+
+// dnsError returns a reply to query with rcode, its question and no
+// records.
+func dnsError(query []byte, rcode byte) []byte {
+	reply := make([]byte, dnsHeaderLen)
+	copy(reply, query[:4])
+	reply[2] = 0x80 | query[2]&0x79 // response; opcode and RD copied
+	reply[3] = 0x80 | rcode
+	if binary.BigEndian.Uint16(query[4:6]) == 1 {
+		if _, end, ok := parseDNSName(query, dnsHeaderLen); ok && end+4 <= len(query) {
+			binary.BigEndian.PutUint16(reply[4:6], 1)
+			reply = append(reply, query[dnsHeaderLen:end+4]...)
+		}
+	}
+	return reply
+}
+
+// parseDNSName reads the uncompressed name at off of msg and returns it
+// with the offset following it.
+func parseDNSName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	for {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			return strings.Join(labels, ".") + ".", off, true
+		}
+		if l > 63 || off+l > len(msg) {
+			return "", 0, false
+		}
+		labels = append(labels, string(msg[off:off+l]))
+		off += l
+	}
+}
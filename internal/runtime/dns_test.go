@@ -0,0 +1,126 @@
+package runtime
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsQuery encodes a query for name and qtype with id 0x1234 and RD set.
+func dnsQuery(name string, qtype uint16) []byte {
+	q := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, l := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+// dnsAnswers returns the rcode and the addresses in the answers of reply.
+func dnsAnswers(t *testing.T, reply []byte) (int, []netip.Addr) {
+	t.Helper()
+	if len(reply) < dnsHeaderLen || reply[0] != 0x12 || reply[1] != 0x34 || reply[2]&0x80 == 0 {
+		t.Fatalf("not a reply to the query: % x", reply)
+	}
+	_, off, ok := parseDNSName(reply, dnsHeaderLen)
+	if !ok {
+		t.Fatal("reply without question")
+	}
+	off += 4
+	var addrs []netip.Addr
+	for i := 0; i < int(binary.BigEndian.Uint16(reply[6:8])); i++ {
+		off += 2 // compressed name
+		l := int(binary.BigEndian.Uint16(reply[off+8 : off+10]))
+		a, _ := netip.AddrFromSlice(reply[off+10 : off+10+l])
+		addrs = append(addrs, a)
+		off += 10 + l
+	}
+	return int(reply[3] & 0x0f), addrs
+}
+
+func TestDNSServerAnswersContainers(t *testing.T) {
+	upstream, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	forwarded := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := upstream.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		name, _, _ := parseDNSName(buf[:n], dnsHeaderLen)
+		forwarded <- name
+		upstream.WriteTo(dnsError(buf[:n], 3), addr) // NXDOMAIN
+	}()
+
+	srv := &DNSServer{
+		Lookup: func(name string) []netip.Addr {
+			if name == "web" {
+				return []netip.Addr{netip.MustParseAddr("10.42.0.2"), netip.MustParseAddr("10.42.0.3")}
+			}
+			return nil
+		},
+		Resolvers: []string{upstream.LocalAddr().String()},
+		Timeout:   2 * time.Second,
+	}
+
+	rcode, addrs := dnsAnswers(t, srv.answer(dnsQuery("WEB.", dnsTypeA), "udp"))
+	if rcode != 0 || len(addrs) != 2 || addrs[0].String() != "10.42.0.2" || addrs[1].String() != "10.42.0.3" {
+		t.Fatalf("A web = %d %v", rcode, addrs)
+	}
+	// Known names without IPv6 addresses have no AAAA records.
+	if rcode, addrs := dnsAnswers(t, srv.answer(dnsQuery("web", dnsTypeAAAA), "udp")); rcode != 0 || len(addrs) != 0 {
+		t.Fatalf("AAAA web = %d %v", rcode, addrs)
+	}
+
+	rcode, _ = dnsAnswers(t, srv.answer(dnsQuery("example.org", dnsTypeA), "udp"))
+	if rcode != 3 {
+		t.Fatalf("forwarded query rcode = %d, want the upstream NXDOMAIN", rcode)
+	}
+	if got := <-forwarded; got != "example.org." {
+		t.Fatalf("forwarded %q", got)
+	}
+
+	srv.Resolvers = nil
+	if rcode, _ := dnsAnswers(t, srv.answer(dnsQuery("example.org", dnsTypeA), "udp")); rcode != dnsServFail {
+		t.Fatalf("rcode without resolvers = %d", rcode)
+	}
+	if srv.answer([]byte{1, 2, 3}, "udp") != nil {
+		t.Fatal("replied to a truncated message")
+	}
+}
+
+func TestDNSServerTCP(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := &DNSServer{Lookup: func(string) []netip.Addr { return []netip.Addr{netip.MustParseAddr("10.42.0.9")} }, Timeout: time.Second}
+	go srv.ServeTCP(l)
+
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := writeDNSStream(c, dnsQuery("db", dnsTypeA)); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := readDNSStream(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, addrs := dnsAnswers(t, reply); len(addrs) != 1 || addrs[0].String() != "10.42.0.9" {
+		t.Fatalf("answers = %v", addrs)
+	}
+}
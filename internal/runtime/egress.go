@@ -0,0 +1,122 @@
+package runtime
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// EgressRule is a destination a container with an egress allowlist may send
+// to: a network and, optionally, a port range of one protocol.
+type EgressRule struct {
+	Net netip.Prefix
+	// Proto is "" for rules allowing every protocol, which have no ports.
+	Proto   string
+	Port    int
+	PortEnd int
+}
+
+// ParseEgressRule parses an --egress-allow value of the form
+// ADDR[/BITS][:PORT[-END]][/tcp|udp|sctp]. IPv6 addresses followed by a port
+// are written in brackets, e.g. [fd00::/64]:443. A port without a protocol
+// means tcp.
+func ParseEgressRule(spec string) (EgressRule, error) {
+	var r EgressRule
+	s := spec
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		switch s[i+1:] {
+		case "tcp", "udp", "sctp":
+			r.Proto, s = s[i+1:], s[:i]
+		}
+	}
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: missing ]", spec)
+		}
+		host = s[1:end]
+		if rest := s[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return EgressRule{}, fmt.Errorf("invalid egress rule %q: want [ADDR]:PORT", spec)
+			}
+			port = rest[1:]
+		}
+	} else if strings.Count(s, ":") == 1 {
+		host, port, _ = strings.Cut(s, ":")
+	}
+
+	var err error
+	if strings.Contains(host, "/") {
+		if r.Net, err = netip.ParsePrefix(host); err != nil {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: %q is not a CIDR", spec, host)
+		}
+		r.Net = r.Net.Masked()
+	} else {
+		a, err := netip.ParseAddr(host)
+		if err != nil {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: %q is not an address", spec, host)
+		}
+		r.Net = netip.PrefixFrom(a, a.BitLen())
+	}
+	if r.Net.Addr().Is4In6() {
+		return EgressRule{}, fmt.Errorf("invalid egress rule %q: use the IPv4 form of %s", spec, r.Net.Addr())
+	}
+
+	if port == "" {
+		if r.Proto != "" {
+			return EgressRule{}, fmt.Errorf("invalid egress rule %q: a protocol needs a port", spec)
+		}
+		return r, nil
+	}
+	if r.Port, r.PortEnd, err = parsePortRange(port); err != nil {
+		return EgressRule{}, fmt.Errorf("invalid egress rule %q: %w", spec, err)
+	}
+	if r.Proto == "" {
+		r.Proto = "tcp"
+	}
+	return r, nil
+}
+
+// ParseEgressRules parses the --egress-allow values recorded with a
+// container.
+func ParseEgressRules(specs []string) ([]EgressRule, error) {
+	var rules []EgressRule
+	for _, s := range specs {
+		r, err := ParseEgressRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// String formats r in the form accepted by ParseEgressRule.
+func (r EgressRule) String() string {
+	host := r.Net.String()
+	if r.Net.IsSingleIP() {
+		host = r.Net.Addr().String()
+	}
+	if r.Port == 0 {
+		return host
+	}
+	if r.Is6() {
+		host = "[" + host + "]"
+	}
+	return host + ":" + r.ports("-") + "/" + r.Proto
+}
+
+// Is6 reports whether r is about IPv6 destinations.
+func (r EgressRule) Is6() bool {
+	return r.Net.Addr().Is6()
+}
+
+// ports returns the port range of r with sep between start and end.
+func (r EgressRule) ports(sep string) string {
+	if r.PortEnd > r.Port {
+		return strconv.Itoa(r.Port) + sep + strconv.Itoa(r.PortEnd)
+	}
+	return strconv.Itoa(r.Port)
+}
@@ -0,0 +1,38 @@
+package runtime
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestParseEgressRule(t *testing.T) {
+	cases := []struct {
+		spec      string
+		want      EgressRule
+		canonical string
+	}{
+		{"10.0.0.0/8", EgressRule{Net: netip.MustParsePrefix("10.0.0.0/8")}, "10.0.0.0/8"},
+		{"10.1.2.3/8", EgressRule{Net: netip.MustParsePrefix("10.0.0.0/8")}, "10.0.0.0/8"},
+		{"1.1.1.1:53/udp", EgressRule{Net: netip.MustParsePrefix("1.1.1.1/32"), Proto: "udp", Port: 53}, "1.1.1.1:53/udp"},
+		{"192.168.0.0/16:8000-8100", EgressRule{Net: netip.MustParsePrefix("192.168.0.0/16"), Proto: "tcp", Port: 8000, PortEnd: 8100}, "192.168.0.0/16:8000-8100/tcp"},
+		{"fd00::1", EgressRule{Net: netip.MustParsePrefix("fd00::1/128")}, "fd00::1"},
+		{"[2001:db8::/32]:443", EgressRule{Net: netip.MustParsePrefix("2001:db8::/32"), Proto: "tcp", Port: 443}, "[2001:db8::/32]:443/tcp"},
+	}
+	for _, c := range cases {
+		got, err := ParseEgressRule(c.spec)
+		if err != nil {
+			t.Fatalf("ParseEgressRule(%q): %v", c.spec, err)
+		}
+		if got != c.want {
+			t.Fatalf("ParseEgressRule(%q) = %+v, want %+v", c.spec, got, c.want)
+		}
+		if got.String() != c.canonical {
+			t.Fatalf("ParseEgressRule(%q).String() = %q, want %q", c.spec, got.String(), c.canonical)
+		}
+	}
+	for _, spec := range []string{"", "example.com", "1.1.1.1/udp", "1.1.1.1:0", "1.1.1.1:53/icmp", "10.0.0.0/33", "[fd00::1", "[fd00::1]53", "::ffff:1.2.3.4", "1.1.1.1:90-80"} {
+		if _, err := ParseEgressRule(spec); err == nil {
+			t.Fatalf("ParseEgressRule(%q) accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+//go:build linux
+
+package runtime
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Firewall backends selectable with `run --firewall-backend`.
+const (
+	FirewallIptables = "iptables"
+	FirewallNft      = "nft"
+	// FirewallNone installs no rules; ports are published by a PortProxy.
+	FirewallNone = "none"
+)
+
+// Firewall installs the forwarding and NAT rules of bridges and the port
+// publishing rules of containers. Dual-stack bridges get rules for both
+// families; container rules are those of the family of ip, so a
+// dual-stack container is added once per address.
+type Firewall interface {
+	Name() string
+	AddBridge(n Network) error
+	RemoveBridge(n Network) error
+	AddContainer(id, ip string, ports []PortMap) error
+	RemoveContainer(id, ip string, ports []PortMap) error
+	// AddEgress drops what the container sends through its host veth on
+	// the bridge unless it is a reply or addressed to a destination in
+	// allow. It is installed before the veth exists.
+	AddEgress(id, veth string, allow []EgressRule) error
+	RemoveEgress(id, veth string) error
+}
+
+// ResolveFirewall validates a backend name. An empty name picks iptables
+// when the binary is installed, nftables otherwise and none if neither is.
+func ResolveFirewall(name string) (string, error) {
+	switch name {
+	case FirewallIptables, FirewallNft, FirewallNone:
+		return name, nil
+	case "":
+		if _, err := exec.LookPath("iptables"); err == nil {
+			return FirewallIptables, nil
+		}
+		if _, err := exec.LookPath("nft"); err == nil {
+			return FirewallNft, nil
+		}
+		return FirewallNone, nil
+	}
+	return "", fmt.Errorf("unknown firewall backend %q (use %s, %s or %s)", name, FirewallNft, FirewallIptables, FirewallNone)
+}
+
+// newFirewall returns the backend called name, running its commands with r.
+// Unknown names, including the empty name of records written before the
+// backend was stored, fall back to iptables.
+func newFirewall(name string, r CmdRunner) Firewall {
+	switch name {
+	case FirewallNft:
+		return &nftFirewall{r: r, list: listNftTable}
+	case FirewallNone:
+		return noFirewall{}
+	}
+	return iptablesFirewall{r: r, checker: realIptablesChecker{"iptables"}, checker6: realIptablesChecker{"ip6tables"}}
+}
+
+// noFirewall leaves the host firewall alone. Containers reach each other
+// and the host over their bridge but are not masqueraded.
+type noFirewall struct{}
+
+func (noFirewall) Name() string                                         { return FirewallNone }
+func (noFirewall) AddBridge(n Network) error                            { return nil }
+func (noFirewall) RemoveBridge(n Network) error                         { return nil }
+func (noFirewall) AddContainer(id, ip string, ports []PortMap) error    { return nil }
+func (noFirewall) RemoveContainer(id, ip string, ports []PortMap) error { return nil }
+func (noFirewall) RemoveEgress(id, veth string) error                   { return nil }
+
+func (noFirewall) AddEgress(id, veth string, allow []EgressRule) error {
+	return fmt.Errorf("--egress-allow needs the %s or %s firewall backend", FirewallIptables, FirewallNft)
+}
+
+// iptablesFirewall appends rules with iptables, or ip6tables for IPv6, and
+// removes them with the matching -D command.
+type iptablesFirewall struct {
+	r        CmdRunner
+	checker  IptablesChecker
+	checker6 IptablesChecker
+}
+
+func (iptablesFirewall) Name() string { return FirewallIptables }
+
+func (f iptablesFirewall) AddBridge(n Network) error {
+	if err := f.add("iptables", f.checker, n.bridgeRules()); err != nil {
+		return err
+	}
+	if n.Subnet6 != "" {
+		return f.add("ip6tables", f.checker6, n.bridgeRules6())
+	}
+	return nil
+}
+
+func (f iptablesFirewall) RemoveBridge(n Network) error {
+	f.remove("iptables", n.bridgeRules())
+	if n.Subnet6 != "" {
+		f.remove("ip6tables", n.bridgeRules6())
+	}
+	return nil
+}
+
+func (f iptablesFirewall) AddContainer(id, ip string, ports []PortMap) error {
+	if isIPv6(ip) {
+		return f.add("ip6tables", f.checker6, portRules(ip, ports))
+	}
+	return f.add("iptables", f.checker, portRules(ip, ports))
+}
+
+func (f iptablesFirewall) RemoveContainer(id, ip string, ports []PortMap) error {
+	if isIPv6(ip) {
+		f.remove("ip6tables", portRules(ip, ports))
+	} else {
+		f.remove("iptables", portRules(ip, ports))
+	}
+	return nil
+}
+
+func (f iptablesFirewall) add(bin string, checker IptablesChecker, rules [][]string) error {
+	for _, rule := range rules {
+		if checker == nil || !checker.CheckRule(rule...) {
+			if err := f.r.Run(bin, rule...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f iptablesFirewall) remove(bin string, rules [][]string) {
+	for _, rule := range rules {
+		_ = f.r.Run(bin, deleteRule(rule)...)
+	}
+}
+
+// brNetfilterPaths are the sysctls that make bridged traffic pass through
+// iptables and ip6tables. Without them the physdev matches of the egress
+// rules never see traffic between containers or to the gateway.
+var brNetfilterPaths = []string{
+	"/proc/sys/net/bridge/bridge-nf-call-iptables",
+	"/proc/sys/net/bridge/bridge-nf-call-ip6tables",
+}
+
+// AddEgress sends everything entering the bridge through veth, forwarded or
+// addressed to the host, to a chain of the container in both families. It
+// fails rather than install rules bridged traffic would bypass.
+func (f iptablesFirewall) AddEgress(id, veth string, allow []EgressRule) error {
+	for _, p := range brNetfilterPaths {
+		if readSysctl(p) != "1" {
+			return fmt.Errorf("%s is not enabled; run `modprobe br_netfilter` or use --firewall-backend %s", p, FirewallNft)
+		}
+	}
+	for _, fam := range []struct {
+		bin string
+		v6  bool
+	}{{"iptables", false}, {"ip6tables", true}} {
+		_ = f.r.Run(fam.bin, "-N", egressChain(id))
+		if err := f.r.Run(fam.bin, "-F", egressChain(id)); err != nil {
+			return err
+		}
+		for _, rule := range egressRules(id, allow, fam.v6) {
+			if err := f.r.Run(fam.bin, rule...); err != nil {
+				return err
+			}
+		}
+		checker := f.checker
+		if fam.v6 {
+			checker = f.checker6
+		}
+		if err := f.add(fam.bin, checker, egressJumps(id, veth)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f iptablesFirewall) RemoveEgress(id, veth string) error {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		f.remove(bin, egressJumps(id, veth))
+		_ = f.r.Run(bin, "-F", egressChain(id))
+		_ = f.r.Run(bin, "-X", egressChain(id))
+	}
+	return nil
+}
+
+// egressChain is the iptables chain of the egress rules of container id.
+func egressChain(id string) string { return "PDE-" + shortID(id) }
+
+// egressRules returns the rules of the egress chain of container id for
+// iptables or, with v6, ip6tables: replies and destinations in allow
+// return, anything else is dropped. IPv6 neighbour discovery is always
+// allowed.
+func egressRules(id string, allow []EgressRule, v6 bool) [][]string {
+	chain := egressChain(id)
+	rules := [][]string{{"-A", chain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"}}
+	if v6 {
+		for _, typ := range []string{"router-solicitation", "neighbour-solicitation", "neighbour-advertisement"} {
+			rules = append(rules, []string{"-A", chain, "-p", "ipv6-icmp", "--icmpv6-type", typ, "-j", "RETURN"})
+		}
+	}
+	for _, r := range allow {
+		if r.Is6() != v6 {
+			continue
+		}
+		rule := []string{"-A", chain, "-d", r.Net.String()}
+		if r.Port != 0 {
+			rule = append(rule, "-p", r.Proto, "-m", r.Proto, "--dport", r.ports(":"))
+		}
+		rules = append(rules, append(rule, "-j", "RETURN"))
+	}
+	return append(rules, []string{"-A", chain, "-j", "DROP"})
+}
+
+// egressJumps returns the rules sending traffic that entered the bridge
+// through veth to the egress chain of id.
+func egressJumps(id, veth string) [][]string {
+	var rules [][]string
+	for _, hook := range []string{"FORWARD", "INPUT"} {
+		rules = append(rules, []string{"-I", hook, "-m", "physdev", "--physdev-in", veth, "-j", egressChain(id)})
+	}
+	return rules
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"path/filepath"
 	"syscall"
+	"unsafe"
 )
 
 type pipePair struct {
@@ -68,9 +69,63 @@ func SetupContainerRoot(rootfsPath string) error {
 	return nil
 }
 
+// NetNamespace selects the network namespace of a container. The zero
+// value creates a new one.
+type NetNamespace struct {
+	// Host shares the network namespace of the host.
+	Host bool
+	// JoinPID joins the network namespace of that process, typically
+	// another container.
+	JoinPID int
+}
+
+// loopbackUp brings up lo in the network namespace of the calling process.
+// It runs in the cloned child, so it only makes raw system calls.
+func loopbackUp() {
+	fd, _, errno := unix.RawSyscall(unix.SYS_SOCKET, unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if errno != 0 {
+		return
+	}
+	var ifr [unix.IFNAMSIZ + 24]byte
+	copy(ifr[:], "lo")
+	if _, _, errno := unix.RawSyscall(unix.SYS_IOCTL, fd, unix.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno == 0 {
+		*(*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ])) |= unix.IFF_UP
+		unix.RawSyscall(unix.SYS_IOCTL, fd, unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0])))
+	}
+	unix.RawSyscall(unix.SYS_CLOSE, fd, 0, 0)
+}
+
 // CloneAndRun clones the current process into new namespaces
 // then runs cmdPath with args inside the isolated environment
-func CloneAndRun(cmdPath string, args []string, rootfsPath string, interactive bool, withTTY bool) (int, io.ReadWriteCloser, error) {
+func CloneAndRun(cmdPath string, args []string, rootfsPath string, interactive bool, withTTY bool, netns NetNamespace) (int, io.ReadWriteCloser, error) {
+	if netns.JoinPID == 0 {
+		return cloneAndRun(cmdPath, args, rootfsPath, interactive, withTTY, !netns.Host)
+	}
+	// The child inherits the namespace of the cloning thread. Clone on a
+	// goroutine of its own: if the thread cannot be switched back, leave
+	// keeps it locked and it exits with the goroutine instead of running
+	// the rest of the caller in the namespace of the other container.
+	type result struct {
+		pid    int
+		master io.ReadWriteCloser
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		leave, err := enterNetns(netns.JoinPID)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer leave()
+		pid, master, err := cloneAndRun(cmdPath, args, rootfsPath, interactive, withTTY, false)
+		done <- result{pid, master, err}
+	}()
+	r := <-done
+	return r.pid, r.master, r.err
+}
+
+func cloneAndRun(cmdPath string, args []string, rootfsPath string, interactive bool, withTTY bool, newNet bool) (int, io.ReadWriteCloser, error) {
 	skipSetup := os.Getenv("SKIP_SETUP") == "1"
 	pr, pw, err := os.Pipe()
 	if err != nil {
@@ -113,7 +168,10 @@ func CloneAndRun(cmdPath string, args []string, rootfsPath string, interactive b
 		}
 	}
 
-	flags := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET | syscall.CLONE_NEWUSER | syscall.SIGCHLD)
+	flags := uintptr(syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUSER | syscall.SIGCHLD)
+	if newNet {
+		flags |= syscall.CLONE_NEWNET
+	}
 	pid, _, errno := syscall.RawSyscall(syscall.SYS_CLONE, flags, 0, 0)
 	if errno != 0 {
 		if master != nil {
@@ -183,6 +241,9 @@ func CloneAndRun(cmdPath string, args []string, rootfsPath string, interactive b
 			unix.Close(int(stdoutW.Fd()))
 		}
 
+		if newNet {
+			loopbackUp()
+		}
 		if !skipSetup {
 			if err := SetupContainerRoot(rootfsPath); err != nil {
 				msg := fmt.Sprintf("setup error: %v\n", err)
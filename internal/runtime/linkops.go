@@ -0,0 +1,147 @@
+//go:build linux
+
+package runtime
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// netBackendEnv selects how links, addresses and routes are configured:
+// "netlink" (the default) talks to the kernel directly, "cmd" runs ip and
+// nsenter.
+const netBackendEnv = "POCKET_DOCKER_NET_BACKEND"
+
+// LinkOps performs the link, address and route operations of network
+// setup. Operations taking ns act in the network namespace of that pid, or
+// in the host namespace when ns is 0.
+type LinkOps interface {
+	AddBridge(name string) error
+	AddVeth(name, peer string) error
+	DeleteLink(name string) error
+	SetAlias(name, alias string) error
+	SetMaster(name, master string) error
+	// SetIsolated makes the bridge port name isolated: it exchanges no
+	// frames with other isolated ports, only with the bridge itself.
+	SetIsolated(name string) error
+	SetNetns(name string, pid int) error
+	SetUp(ns int, name string) error
+	AddAddr(ns int, name, cidr string) error
+	AddDefaultRoute(ns int, gateway string) error
+	// Shape replaces the root qdisc of name: netem delays and drops
+	// packets, a token bucket below it limits the rate.
+	Shape(ns int, name string, s NetShape) error
+}
+
+// backends returns the runner used for iptables and the link backend. An
+// explicit runner also drives the links through ip commands, which keeps the
+// command sequence observable in tests; otherwise netlink is used when
+// available. quiet selects a runner that does not print command output.
+func backends(r CmdRunner, quiet bool) (CmdRunner, LinkOps) {
+	if r != nil {
+		return r, cmdLinkOps{r}
+	}
+	if quiet {
+		r = quietRunner{}
+	} else {
+		r = defaultRunner()
+	}
+	if os.Getenv(netBackendEnv) != "cmd" && netlinkAvailable() {
+		return r, netlinkOps{}
+	}
+	return r, cmdLinkOps{r}
+}
+
+// cmdLinkOps implements LinkOps with the ip and nsenter commands.
+type cmdLinkOps struct {
+	r CmdRunner
+}
+
+// ip runs `ip args...`, inside the network namespace of ns if it is not 0.
+func (c cmdLinkOps) ip(ns int, args ...string) error {
+	if ns == 0 {
+		return c.r.Run("ip", args...)
+	}
+	return c.r.Run("nsenter", append([]string{"--target", strconv.Itoa(ns), "--net", "ip"}, args...)...)
+}
+
+func (c cmdLinkOps) AddBridge(name string) error {
+	return c.ip(0, "link", "add", name, "type", "bridge")
+}
+
+func (c cmdLinkOps) AddVeth(name, peer string) error {
+	return c.ip(0, "link", "add", name, "type", "veth", "peer", "name", peer)
+}
+
+func (c cmdLinkOps) DeleteLink(name string) error {
+	return c.ip(0, "link", "del", name)
+}
+
+func (c cmdLinkOps) SetAlias(name, alias string) error {
+	return c.ip(0, "link", "set", "dev", name, "alias", alias)
+}
+
+func (c cmdLinkOps) SetMaster(name, master string) error {
+	return c.ip(0, "link", "set", name, "master", master)
+}
+
+func (c cmdLinkOps) SetIsolated(name string) error {
+	return c.ip(0, "link", "set", "dev", name, "type", "bridge_slave", "isolated", "on")
+}
+
+func (c cmdLinkOps) SetNetns(name string, pid int) error {
+	return c.ip(0, "link", "set", name, "netns", strconv.Itoa(pid))
+}
+
+func (c cmdLinkOps) SetUp(ns int, name string) error {
+	return c.ip(ns, "link", "set", name, "up")
+}
+
+func (c cmdLinkOps) AddAddr(ns int, name, cidr string) error {
+	if isIPv6(cidr) {
+		return c.ip(ns, "addr", "add", cidr, "dev", name, "nodad")
+	}
+	return c.ip(ns, "addr", "add", cidr, "dev", name)
+}
+
+func (c cmdLinkOps) AddDefaultRoute(ns int, gateway string) error {
+	if isIPv6(gateway) {
+		return c.ip(ns, "-6", "route", "add", "default", "via", gateway)
+	}
+	return c.ip(ns, "route", "add", "default", "via", gateway)
+}
+
+func (c cmdLinkOps) Shape(ns int, name string, s NetShape) error {
+	parent := []string{"root", "handle", "1:"}
+	if s.Delay > 0 || s.Loss > 0 {
+		args := append([]string{"qdisc", "add", "dev", name}, parent...)
+		args = append(args, "netem")
+		if s.Delay > 0 {
+			args = append(args, "delay", strconv.FormatInt(int64(s.Delay/time.Microsecond), 10)+"us")
+		}
+		if s.Loss > 0 {
+			args = append(args, "loss", s.LossString())
+		}
+		if err := c.tc(ns, args...); err != nil {
+			return err
+		}
+		parent = []string{"parent", "1:", "handle", "2:"}
+	}
+	if s.Rate > 0 {
+		burst, limit := tbfParams(s.Rate)
+		args := append([]string{"qdisc", "add", "dev", name}, parent...)
+		args = append(args, "tbf", "rate", strconv.FormatUint(s.Rate, 10)+"bit",
+			"burst", strconv.FormatUint(burst, 10), "limit", strconv.FormatUint(limit, 10))
+		return c.tc(ns, args...)
+	}
+	return nil
+}
+
+// tc runs `tc args...`, inside the network namespace of ns if it is not 0.
+func (c cmdLinkOps) tc(ns int, args ...string) error {
+	if ns == 0 {
+		return c.r.Run("tc", args...)
+	}
+	return c.r.Run("nsenter", append([]string{"--target", strconv.Itoa(ns), "--net", "tc"}, args...)...)
+}
@@ -0,0 +1,439 @@
+//go:build linux
+
+package runtime
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	goruntime "runtime"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// vethInfoPeer is VETH_INFO_PEER from linux/veth.h.
+const vethInfoPeer = 1
+
+// Traffic control constants from linux/rtnetlink.h and linux/pkt_sched.h.
+const (
+	tcaKind             = 1
+	tcaOptions          = 2
+	tcaTbfParms         = 1
+	tcaTbfRate64        = 4
+	tcaTbfBurst         = 6
+	tcHRoot             = 0xffffffff
+	tcLinklayerEthernet = 1
+	// psched ticks are 64ns.
+	pschedShift = 6
+)
+
+// netlinkOps implements LinkOps over rtnetlink sockets, so no ip, nsenter or
+// iproute2 binaries are needed. Operations in a container namespace open
+// their socket inside that namespace.
+type netlinkOps struct{}
+
+// netlinkAvailable reports whether rtnetlink sockets can be opened.
+func netlinkAvailable() bool {
+	c, err := openNetlink()
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func (netlinkOps) AddBridge(name string) error {
+	return newLink(name, attr(unix.IFLA_LINKINFO, attr(unix.IFLA_INFO_KIND, cstring("bridge"))))
+}
+
+func (netlinkOps) AddVeth(name, peer string) error {
+	peerInfo := concat(ifInfomsg(0, 0, 0), attr(unix.IFLA_IFNAME, cstring(peer)))
+	return newLink(name, attr(unix.IFLA_LINKINFO,
+		attr(unix.IFLA_INFO_KIND, cstring("veth")),
+		attr(unix.IFLA_INFO_DATA, attr(vethInfoPeer, peerInfo))))
+}
+
+func (netlinkOps) DeleteLink(name string) error {
+	err := withNetlink(0, func(c *nlConn) error {
+		_, err := c.execute(unix.RTM_DELLINK, 0, concat(ifInfomsg(0, 0, 0), attr(unix.IFLA_IFNAME, cstring(name))))
+		return err
+	})
+	if errors.Is(err, unix.ENODEV) {
+		return nil
+	}
+	return err
+}
+
+func (netlinkOps) SetAlias(name, alias string) error {
+	return setLink(0, name, 0, 0, attr(unix.IFLA_IFALIAS, []byte(alias)))
+}
+
+func (netlinkOps) SetMaster(name, master string) error {
+	return withNetlink(0, func(c *nlConn) error {
+		idx, err := c.linkIndex(master)
+		if err != nil {
+			return err
+		}
+		return c.setLink(name, 0, 0, attr(unix.IFLA_MASTER, u32(uint32(idx))))
+	})
+}
+
+// SetIsolated sets the port attribute through the slave data of the link
+// info, which the kernel hands to the bridge the port belongs to.
+func (netlinkOps) SetIsolated(name string) error {
+	return setLink(0, name, 0, 0, attr(unix.IFLA_LINKINFO,
+		attr(unix.IFLA_INFO_SLAVE_KIND, cstring("bridge")),
+		attr(unix.IFLA_INFO_SLAVE_DATA, attr(unix.IFLA_BRPORT_ISOLATED, []byte{1}))))
+}
+
+func (netlinkOps) SetNetns(name string, pid int) error {
+	return setLink(0, name, 0, 0, attr(unix.IFLA_NET_NS_PID, u32(uint32(pid))))
+}
+
+func (netlinkOps) SetUp(ns int, name string) error {
+	return setLink(ns, name, unix.IFF_UP, unix.IFF_UP)
+}
+
+func (netlinkOps) AddAddr(ns int, name, cidr string) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return err
+	}
+	ip := prefix.Addr().AsSlice()
+	return withNetlink(ns, func(c *nlConn) error {
+		idx, err := c.linkIndex(name)
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, unix.SizeofIfAddrmsg)
+		msg[0] = unix.AF_INET
+		if prefix.Addr().Is6() {
+			msg[0] = unix.AF_INET6
+			// Addresses are unique by construction; skipping duplicate
+			// address detection makes them usable right away.
+			msg[2] = unix.IFA_F_NODAD
+		}
+		msg[1] = byte(prefix.Bits())
+		binary.NativeEndian.PutUint32(msg[4:], uint32(idx))
+		_, err = c.execute(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL,
+			concat(msg, attr(unix.IFA_LOCAL, ip), attr(unix.IFA_ADDRESS, ip)))
+		return err
+	})
+}
+
+func (netlinkOps) AddDefaultRoute(ns int, gateway string) error {
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = unix.AF_INET
+	if gw.Is6() {
+		msg[0] = unix.AF_INET6
+	}
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_BOOT
+	msg[6] = unix.RT_SCOPE_UNIVERSE
+	msg[7] = unix.RTN_UNICAST
+	return withNetlink(ns, func(c *nlConn) error {
+		_, err := c.execute(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, concat(msg, attr(unix.RTA_GATEWAY, gw.AsSlice())))
+		return err
+	})
+}
+
+func (netlinkOps) Shape(ns int, name string, s NetShape) error {
+	return withNetlink(ns, func(c *nlConn) error {
+		idx, err := c.linkIndex(name)
+		if err != nil {
+			return err
+		}
+		parent, handle := uint32(tcHRoot), uint32(1<<16)
+		if s.Delay > 0 || s.Loss > 0 {
+			if err := c.addQdisc(idx, parent, handle, "netem", netemOptions(s)); err != nil {
+				return fmt.Errorf("netem on %s: %w", name, err)
+			}
+			parent, handle = handle, 2<<16
+		}
+		if s.Rate > 0 {
+			if err := c.addQdisc(idx, parent, handle, "tbf", tbfOptions(s.Rate)); err != nil {
+				return fmt.Errorf("tbf on %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// netemOptions encodes a struct tc_netem_qopt, which netem takes as the
+// payload of TCA_OPTIONS rather than as attributes.
+func netemOptions(s NetShape) []byte {
+	b := make([]byte, 24)
+	binary.NativeEndian.PutUint32(b[0:], uint32(min(uint64(s.Delay)>>pschedShift, math.MaxUint32)))
+	binary.NativeEndian.PutUint32(b[4:], 1000)
+	binary.NativeEndian.PutUint32(b[8:], uint32(s.Loss/100*math.MaxUint32))
+	return attr(tcaOptions, b)
+}
+
+// tbfOptions encodes the token bucket parameters for rate bits per second.
+// The rate is declared as an Ethernet one so no rate table is needed, and
+// the bucket is given in bytes with TCA_TBF_BURST.
+func tbfOptions(rate uint64) []byte {
+	burst, limit := tbfParams(rate)
+	bytes := rate / 8
+	// struct tc_tbf_qopt: rate and peakrate tc_ratespecs, limit, buffer, mtu.
+	qopt := make([]byte, 36)
+	qopt[1] = tcLinklayerEthernet
+	binary.NativeEndian.PutUint32(qopt[8:], uint32(min(bytes, math.MaxUint32)))
+	binary.NativeEndian.PutUint32(qopt[24:], uint32(min(limit, math.MaxUint32)))
+	binary.NativeEndian.PutUint32(qopt[28:], uint32(min(burst*uint64(time.Second)/bytes>>pschedShift, math.MaxUint32)))
+	opts := [][]byte{attr(tcaTbfParms, qopt), attr(tcaTbfBurst, u32(uint32(burst)))}
+	if bytes > math.MaxUint32 {
+		opts = append(opts, attr(tcaTbfRate64, u64(bytes)))
+	}
+	return attr(tcaOptions, opts...)
+}
+
+// addQdisc creates the qdisc kind with handle below parent on link idx.
+func (c *nlConn) addQdisc(idx int32, parent, handle uint32, kind string, options []byte) error {
+	// struct tcmsg: family, padding, ifindex, handle, parent, info.
+	msg := make([]byte, 20)
+	msg[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(msg[4:], uint32(idx))
+	binary.NativeEndian.PutUint32(msg[8:], handle)
+	binary.NativeEndian.PutUint32(msg[12:], parent)
+	_, err := c.execute(unix.RTM_NEWQDISC, unix.NLM_F_CREATE|unix.NLM_F_EXCL, concat(msg, attr(tcaKind, cstring(kind)), options))
+	if errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("the kernel does not support the %s qdisc (module sch_%s)", kind, kind)
+	}
+	return err
+}
+
+// newLink creates the link name in the host namespace.
+func newLink(name string, attrs ...[]byte) error {
+	return withNetlink(0, func(c *nlConn) error {
+		payload := concat(ifInfomsg(0, 0, 0), attr(unix.IFLA_IFNAME, cstring(name)))
+		_, err := c.execute(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, concat(payload, concat(attrs...)))
+		return err
+	})
+}
+
+// setLink changes flags and attributes of the existing link name.
+func setLink(ns int, name string, flags, change uint32, attrs ...[]byte) error {
+	return withNetlink(ns, func(c *nlConn) error {
+		return c.setLink(name, flags, change, attrs...)
+	})
+}
+
+// nlConn is an rtnetlink socket bound to the namespace it was opened in.
+type nlConn struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlink() (*nlConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	return &nlConn{fd: fd}, nil
+}
+
+func (c *nlConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// withNetlink runs fn with a socket opened in the network namespace of ns,
+// or the current one when ns is 0.
+func withNetlink(ns int, fn func(*nlConn) error) error {
+	var c *nlConn
+	var err error
+	if ns == 0 {
+		c, err = openNetlink()
+	} else {
+		err = inNetns(ns, func() error {
+			c, err = openNetlink()
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return fn(c)
+}
+
+// inNetns runs fn on a thread switched to the network namespace of pid. A
+// socket keeps the namespace it was created in, so fn only needs to open
+// sockets there; the thread is switched back before returning.
+func inNetns(pid int, fn func() error) error {
+	leave, err := enterNetns(pid)
+	if err != nil {
+		return err
+	}
+	fnErr := fn()
+	if err := leave(); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// enterNetns locks the calling goroutine to its thread and switches the
+// thread to the network namespace of pid until leave is called.
+func enterNetns(pid int) (leave func() error, err error) {
+	goruntime.LockOSThread()
+	orig, err := unix.Open("/proc/thread-self/ns/net", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		goruntime.UnlockOSThread()
+		return nil, err
+	}
+	target, err := unix.Open(fmt.Sprintf("/proc/%d/ns/net", pid), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(orig)
+		goruntime.UnlockOSThread()
+		return nil, err
+	}
+	defer unix.Close(target)
+	if err := unix.Setns(target, unix.CLONE_NEWNET); err != nil {
+		unix.Close(orig)
+		goruntime.UnlockOSThread()
+		return nil, fmt.Errorf("enter netns of %d: %w", pid, err)
+	}
+	return func() error {
+		defer unix.Close(orig)
+		if err := unix.Setns(orig, unix.CLONE_NEWNET); err != nil {
+			// Leave the thread locked so it exits with the goroutine
+			// instead of running other code in the container namespace.
+			return fmt.Errorf("restore netns: %w", err)
+		}
+		goruntime.UnlockOSThread()
+		return nil
+	}, nil
+}
+
+func (c *nlConn) setLink(name string, flags, change uint32, attrs ...[]byte) error {
+	payload := concat(ifInfomsg(0, flags, change), attr(unix.IFLA_IFNAME, cstring(name)))
+	_, err := c.execute(unix.RTM_NEWLINK, 0, concat(payload, concat(attrs...)))
+	return err
+}
+
+// linkIndex returns the interface index of name.
+func (c *nlConn) linkIndex(name string) (int32, error) {
+	msgs, err := c.execute(unix.RTM_GETLINK, 0, concat(ifInfomsg(0, 0, 0), attr(unix.IFLA_IFNAME, cstring(name))))
+	if err != nil {
+		return 0, fmt.Errorf("link %s: %w", name, err)
+	}
+	for _, m := range msgs {
+		if len(m) >= unix.SizeofIfInfomsg {
+			return int32(binary.NativeEndian.Uint32(m[4:8])), nil
+		}
+	}
+	return 0, fmt.Errorf("link %s: no reply", name)
+}
+
+// execute sends a request and waits for its acknowledgement. It returns the
+// payloads of the replies received before the acknowledgement.
+func (c *nlConn) execute(typ, flags uint16, payload []byte) ([][]byte, error) {
+	c.seq++
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(payload))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(unix.SizeofNlMsghdr+len(payload)))
+	binary.NativeEndian.PutUint16(msg[4:], typ)
+	binary.NativeEndian.PutUint16(msg[6:], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:], c.seq)
+	msg = append(msg, payload...)
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var replies [][]byte
+	buf := make([]byte, 32*1024)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		data := buf[:n]
+		for len(data) >= unix.SizeofNlMsghdr {
+			l := int(binary.NativeEndian.Uint32(data[0:4]))
+			if l < unix.SizeofNlMsghdr || l > len(data) {
+				return nil, fmt.Errorf("netlink: malformed message")
+			}
+			mtype := binary.NativeEndian.Uint16(data[4:6])
+			seq := binary.NativeEndian.Uint32(data[8:12])
+			body := data[unix.SizeofNlMsghdr:l]
+			data = data[nlAlign(l):]
+			if seq != c.seq {
+				continue
+			}
+			switch mtype {
+			case unix.NLMSG_ERROR:
+				if len(body) < 4 {
+					return nil, fmt.Errorf("netlink: short error message")
+				}
+				if code := int32(binary.NativeEndian.Uint32(body[0:4])); code != 0 {
+					return nil, unix.Errno(-code)
+				}
+				return replies, nil
+			case unix.NLMSG_DONE:
+				return replies, nil
+			default:
+				replies = append(replies, append([]byte(nil), body...))
+			}
+		}
+	}
+}
+
+// ifInfomsg encodes a struct ifinfomsg for index.
+func ifInfomsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:], flags)
+	binary.NativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// attr encodes a netlink attribute whose payload is the concatenation of
+// data, padded to the netlink alignment.
+func attr(typ uint16, data ...[]byte) []byte {
+	payload := concat(data...)
+	l := unix.SizeofRtAttr + len(payload)
+	b := make([]byte, nlAlign(l))
+	binary.NativeEndian.PutUint16(b[0:], uint16(l))
+	binary.NativeEndian.PutUint16(b[2:], typ)
+	copy(b[unix.SizeofRtAttr:], payload)
+	return b
+}
+
+func nlAlign(l int) int {
+	return (l + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.NativeEndian.PutUint64(b, v)
+	return b
+}
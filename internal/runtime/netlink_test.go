@@ -0,0 +1,181 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"os/exec"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNetlinkAttrAlignment(t *testing.T) {
+	a := attr(unix.IFLA_IFNAME, cstring("veth1"))
+	if len(a) != 12 {
+		t.Fatalf("attribute not padded to 4 bytes: %d", len(a))
+	}
+	if l := binary.NativeEndian.Uint16(a); l != 10 {
+		t.Fatalf("attribute length = %d, want unpadded 10", l)
+	}
+	nested := attr(unix.IFLA_LINKINFO, attr(unix.IFLA_INFO_KIND, cstring("veth")), a)
+	if len(nested) != 4+12+12 || !bytes.Equal(nested[16:], a) {
+		t.Fatalf("unexpected nested attribute % x", nested)
+	}
+}
+
+func TestNetlinkOpsAttach(t *testing.T) {
+	if os.Geteuid() != 0 || !netlinkAvailable() {
+		t.Skip("requires root and rtnetlink")
+	}
+	for _, bin := range []string{"unshare", "nsenter", "ip"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found", bin)
+		}
+	}
+	// The container: a process in its own network namespace.
+	ctn := exec.Command("unshare", "-n", "sleep", "30")
+	if err := ctn.Start(); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	defer func() { ctn.Process.Kill(); ctn.Wait() }()
+	pid := ctn.Process.Pid
+	waitNetns(t, pid)
+
+	// The host: this thread, moved to a scratch namespace. It stays locked
+	// so the thread is discarded with the test goroutine.
+	goruntime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare netns: %v", err)
+	}
+
+	ops := netlinkOps{}
+	n := Network{Name: "nltest", Bridge: "pdnl0", Subnet: "10.99.0.0/24", Gateway: "10.99.0.1", Subnet6: "fd99::/64", Gateway6: "fd99::1", Isolated: true}
+	if err := ops.AddBridge(n.Bridge); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.SetAlias(n.Bridge, bridgeAlias(bridgeState{ipForward: "0", firewall: FirewallIptables})); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.AddAddr(0, n.Bridge, n.gatewayCIDR()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.AddAddr(0, n.Bridge, n.hostCIDR6(n.Gateway6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.SetUp(0, n.Bridge); err != nil {
+		t.Fatal(err)
+	}
+	if err := attach(n, pid, "abcdef0123456789", "10.99.0.2", ops, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ns := strconv.Itoa(pid)
+	_, cont := n.vethNames("abcdef0123456789")
+	addr, _ := exec.Command("nsenter", "--target", ns, "--net", "ip", "-o", "addr", "show", "dev", cont).CombinedOutput()
+	if !bytes.Contains(addr, []byte("10.99.0.2/24")) || !bytes.Contains(addr, []byte("fd99::2/64")) {
+		t.Fatalf("address missing in container: %s", addr)
+	}
+	route, _ := exec.Command("nsenter", "--target", ns, "--net", "ip", "route").CombinedOutput()
+	if !bytes.Contains(route, []byte("default via 10.99.0.1")) {
+		t.Fatalf("default route missing in container: %s", route)
+	}
+	route6, _ := exec.Command("nsenter", "--target", ns, "--net", "ip", "-6", "route").CombinedOutput()
+	if !bytes.Contains(route6, []byte("default via fd99::1")) {
+		t.Fatalf("IPv6 default route missing in container: %s", route6)
+	}
+
+	host, _ := n.vethNames("abcdef0123456789")
+	port, _ := exec.Command("ip", "-d", "link", "show", "dev", host).CombinedOutput()
+	if !bytes.Contains(port, []byte("isolated on")) {
+		t.Fatalf("bridge port not isolated: %s", port)
+	}
+	if err := ops.DeleteLink(host); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.DeleteLink(host); err != nil {
+		t.Fatalf("deleting a missing link must succeed: %v", err)
+	}
+	if err := ops.DeleteLink(n.Bridge); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNetlinkShape(t *testing.T) {
+	if os.Geteuid() != 0 || !netlinkAvailable() {
+		t.Skip("requires root and rtnetlink")
+	}
+	if _, err := exec.LookPath("tc"); err != nil {
+		t.Skip("tc not found")
+	}
+	// Stays locked so the thread is discarded with the test goroutine.
+	goruntime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare netns: %v", err)
+	}
+	ops := netlinkOps{}
+	if err := ops.AddVeth("pdshape0", "pdshape1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ops.Shape(0, "pdshape0", NetShape{Rate: 10e6}); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := exec.Command("tc", "qdisc", "show", "dev", "pdshape0").CombinedOutput()
+	if !bytes.Contains(out, []byte("tbf 1: root")) || !bytes.Contains(out, []byte("rate 10Mbit burst 12500b")) {
+		t.Fatalf("unexpected qdisc: %s", out)
+	}
+
+	err := ops.Shape(0, "pdshape1", NetShape{Rate: 1e6, Delay: 50 * time.Millisecond, Loss: 1})
+	if err != nil && strings.Contains(err.Error(), "does not support the netem qdisc") {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = exec.Command("tc", "qdisc", "show", "dev", "pdshape1").CombinedOutput()
+	for _, want := range []string{"netem 1: root", "delay 50ms", "loss 1%", "tbf 2: parent 1:", "rate 1Mbit"} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Fatalf("qdiscs lack %q: %s", want, out)
+		}
+	}
+}
+
+func TestLoopbackUp(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	// Stays locked so the thread is discarded with the test goroutine.
+	goruntime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("unshare netns: %v", err)
+	}
+	if lo, err := net.InterfaceByName("lo"); err != nil || lo.Flags&net.FlagUp != 0 {
+		t.Fatalf("lo in a new namespace: %+v, %v", lo, err)
+	}
+	loopbackUp()
+	if lo, err := net.InterfaceByName("lo"); err != nil || lo.Flags&net.FlagUp == 0 {
+		t.Fatalf("lo after loopbackUp: %+v, %v", lo, err)
+	}
+}
+
+// waitNetns waits until pid has left the network namespace of the test.
+// The namespace is read from the current thread: the main thread may have
+// been left in a scratch namespace by a test that ran on it.
+func waitNetns(t *testing.T, pid int) {
+	t.Helper()
+	goruntime.LockOSThread()
+	self, _ := os.Readlink("/proc/thread-self/ns/net")
+	goruntime.UnlockOSThread()
+	for i := 0; i < 100; i++ {
+		if ns, err := os.Readlink("/proc/" + strconv.Itoa(pid) + "/ns/net"); err == nil && ns != self {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("container did not enter its network namespace")
+}
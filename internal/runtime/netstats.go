@@ -0,0 +1,44 @@
+//go:build linux
+
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysClassNet points to the sysfs directory listing network interfaces.
+var SysClassNet = "/sys/class/net"
+
+// NetStats holds the traffic counters of a container as seen from inside it.
+type NetStats struct {
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// ReadNetStats returns the traffic counters of the veth pair attaching
+// container id to n.
+// The host end is read, so its rx/tx counters are swapped.
+func ReadNetStats(n Network, id string) (NetStats, error) {
+	host, _ := n.vethNames(id)
+	dir := filepath.Join(SysClassNet, host, "statistics")
+	rx, err := readCounter(filepath.Join(dir, "tx_bytes"))
+	if err != nil {
+		return NetStats{}, err
+	}
+	tx, err := readCounter(filepath.Join(dir, "rx_bytes"))
+	if err != nil {
+		return NetStats{}, err
+	}
+	return NetStats{RxBytes: rx, TxBytes: tx}, nil
+}
+
+func readCounter(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -4,11 +4,12 @@ package runtime
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
-	"bytes"
 	"strings"
+	"bytes"
 )
 
 type CmdRunner interface {
@@ -33,230 +34,283 @@ type IptablesChecker interface {
 	CheckRule(args ...string) bool
 }
 
-type realIptablesChecker struct{}
+// realIptablesChecker checks rules with bin, iptables or ip6tables.
+type realIptablesChecker struct{ bin string }
 
-func (realIptablesChecker) CheckRule(args ...string) bool {
-	return checkIptablesRuleReal(args...)
+func (c realIptablesChecker) CheckRule(args ...string) bool {
+	return checkIptablesRuleReal(c.bin, args...)
 }
 
-func checkIptablesRuleReal(args ...string) bool {
-	checkArgs := make([]string, len(args))
-	copy(checkArgs, args)
-	for i, arg := range checkArgs {
-		if arg == "-A" {
-			checkArgs[i] = "-C"
-			break
-		}
-	}
-	
-	cmd := exec.Command("iptables", checkArgs...)
+func checkIptablesRuleReal(bin string, args ...string) bool {
+	cmd := exec.Command(bin, ruleWithOp(args, "-C")...)
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	err := cmd.Run()
 	return err == nil
 }
 
-func ipSuffixFromID(id string) int {
-	return ipSuffixFromIDWithCollisionCheck(id, nil)
+// hostVethName returns the name of the host side veth of container id.
+func hostVethName(id string) string {
+	short := id
+	if len(short) > 8 {
+		short = id[:8]
+	}
+	hostVeth := "veth" + short
+	if len(hostVeth) > 13 {
+		hostVeth = hostVeth[:13]
+	}
+	return hostVeth
+}
+
+// SetupNetworking attaches the container to n with address ip, makes n its
+// default route and publishes ports using the firewall backend of that name.
+// With egress rules, everything else the container sends is dropped.
+// On a dual-stack network the container also gets n.IPv6Address(ip).
+// Returns the original ip_forward and, for dual-stack networks, IPv6
+// forwarding values.
+func SetupNetworking(n Network, pid int, id, ip string, ports []PortMap, egress []EgressRule, firewall string, r CmdRunner) (string, string, error) {
+	r, links := backends(r, false)
+	return setupNetworking(n, pid, id, ip, ports, egress, r, links, newFirewall(firewall, r))
+}
+
+// SetupNetworkingWithChecker configures veth pair and iptables rules for the container with custom checker
+// Returns the original ip_forward and IPv6 forwarding values
+func SetupNetworkingWithChecker(n Network, pid int, id, ip string, ports []PortMap, egress []EgressRule, r CmdRunner, checker IptablesChecker) (string, string, error) {
+	r, links := backends(r, false)
+	return setupNetworking(n, pid, id, ip, ports, egress, r, links, iptablesFirewall{r: r, checker: checker, checker6: checker})
 }
 
-func ipSuffixFromIDWithCollisionCheck(id string, checker func(int) bool) int {
-	if len(id) < 6 {
-		id = id + "000000"
+func setupNetworking(n Network, pid int, id, ip string, ports []PortMap, egress []EgressRule, r CmdRunner, links LinkOps, fw Firewall) (string, string, error) {
+	origValue := readSysctl(ipForwardPath)
+	var orig6Value string
+	if n.Subnet6 != "" {
+		orig6Value = readSysctl(ip6ForwardPath)
 	}
-	v, err := strconv.ParseUint(id[:6], 16, 32)
+
+	success := false
+	defer func() {
+		if !success {
+			cleanupNetworking(n, id, ip, ports, egress, origValue, orig6Value, r, links, fw)
+		}
+	}()
+
+	orig, orig6, err := ensureBridge(n, links, fw)
 	if err != nil {
-		return 2
+		return "", "", err
 	}
-	suffix := int(v%250) + 2
-	
-	if checker == nil {
-		return suffix
+	if orig != "" {
+		origValue = orig
 	}
-	
-	for i := 0; i < 250; i++ {
-		candidate := suffix + i
-		if candidate > 254 {
-			candidate = (candidate % 253) + 2
+	if orig6 != "" {
+		orig6Value = orig6
+	}
+	if len(egress) > 0 {
+		// The rules match the host veth by name, so they are in place
+		// before the container can send anything through it.
+		host, _ := n.vethNames(id)
+		if err := fw.AddEgress(id, host, egress); err != nil {
+			return "", "", err
 		}
-		if !checker(candidate) {
-			return candidate
+	}
+	if err := attach(n, pid, id, ip, links, true); err != nil {
+		return "", "", err
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.WriteFile(ipForwardPath, []byte("1"), 0644); err != nil {
+			return "", "", fmt.Errorf("enable ip_forward: %w", err)
+		}
+		if n.Subnet6 != "" {
+			if err := os.WriteFile(ip6ForwardPath, []byte("1"), 0644); err != nil {
+				return "", "", fmt.Errorf("enable IPv6 forwarding: %w", err)
+			}
 		}
 	}
-	
-	return 2
-}
 
-// checkIPInUse checks if a given IP suffix is already assigned to a veth interface
-func checkIPInUse(suffix int) bool {
-	targetIP := fmt.Sprintf("10.42.0.%d", suffix)
-	cmd := exec.Command("ip", "addr", "show")
-	output, err := cmd.Output()
-	if err != nil {
-		return false
+	if err := fw.AddContainer(id, ip, ports); err != nil {
+		return "", "", err
+	}
+	if ip6 := n.IPv6Address(ip); ip6 != "" {
+		if err := fw.AddContainer(id, ip6, ports); err != nil {
+			return "", "", err
+		}
 	}
-	return strings.Contains(string(output), targetIP)
+	success = true
+	return origValue, orig6Value, nil
 }
 
-// PortMap represents a published port mapping
-type PortMap struct {
-	Host      int
-	Container int
+// ConnectNetwork adds an interface with address ip on n to the running
+// container. Unlike SetupNetworking it leaves the default route alone. The
+// firewall backend is only used if the bridge of n has to be created.
+func ConnectNetwork(n Network, pid int, id, ip, firewall string, r CmdRunner) error {
+	r, links := backends(r, false)
+	return connectNetwork(n, pid, id, ip, r, links, newFirewall(firewall, r))
 }
 
-// SetupNetworking configures veth pair and iptables rules for the container
-// Returns the original ip_forward value and actual IP suffix used
-func SetupNetworking(pid int, id string, ports []PortMap, r CmdRunner) (string, int, error) {
-	return SetupNetworkingWithChecker(pid, id, ports, r, realIptablesChecker{})
+func connectNetworkWithChecker(n Network, pid int, id, ip string, r CmdRunner, checker IptablesChecker) error {
+	r, links := backends(r, false)
+	return connectNetwork(n, pid, id, ip, r, links, iptablesFirewall{r: r, checker: checker, checker6: checker})
 }
 
-// SetupNetworkingWithChecker configures veth pair and iptables rules for the container with custom checker
-// Returns the original ip_forward value and actual IP suffix used
-func SetupNetworkingWithChecker(pid int, id string, ports []PortMap, r CmdRunner, checker IptablesChecker) (string, int, error) {
-	origBytes, _ := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
-	origValue := strings.TrimSpace(string(origBytes))
-	
-	success := false
-	ipSuffix := ipSuffixFromIDWithCollisionCheck(id, checkIPInUse)
-	defer func() {
-		if !success {
-			_ = CleanupNetworkingWithIPSuffix(id, ipSuffix, ports, origValue)
-		}
-	}()
-	if r == nil {
-		r = defaultRunner()
+func connectNetwork(n Network, pid int, id, ip string, r CmdRunner, links LinkOps, fw Firewall) error {
+	if _, _, err := ensureBridge(n, links, fw); err != nil {
+		return err
 	}
-	short := id
-	if len(short) > 8 {
-		short = id[:8]
+	if err := attach(n, pid, id, ip, links, false); err != nil {
+		disconnect(n, id, r, links)
+		return err
 	}
-	hostVeth := "veth" + short
-	if len(hostVeth) > 13 {
-		hostVeth = hostVeth[:13]
+	return nil
+}
+
+// ShapeNetwork applies s to both ends of the veth of container pid on n:
+// the host end shapes what the container receives, the container end what
+// it sends. The qdiscs go away with the veth.
+func ShapeNetwork(n Network, pid int, id string, s NetShape, r CmdRunner) error {
+	_, links := backends(r, false)
+	host, cont := n.vethNames(id)
+	if err := links.Shape(0, host, s); err != nil {
+		return err
 	}
-	contVeth := hostVeth + "_c"
-	
-	if err := r.Run("ip", "link", "add", hostVeth, "type", "veth", "peer", "name", contVeth); err != nil {
-		return "", 0, err
+	return links.Shape(pid, cont, s)
+}
+
+// DisconnectNetwork removes the interface of the container on n and the
+// bridge of n once nothing is attached to it any more.
+func DisconnectNetwork(n Network, id string, r CmdRunner) error {
+	r, links := backends(r, true)
+	return disconnect(n, id, r, links)
+}
+
+func disconnect(n Network, id string, r CmdRunner, links LinkOps) error {
+	host, _ := n.vethNames(id)
+	err := links.DeleteLink(host)
+	removeBridgeIfUnused(n, r, links, "", "")
+	return err
+}
+
+// RemoveNetwork deletes the bridge of n and its rules if no container is
+// attached, regardless of POCKET_DOCKER_KEEP_BRIDGE.
+func RemoveNetwork(n Network) {
+	r, links := backends(nil, true)
+	removeBridge(n, r, links, "", "")
+}
+
+// attach creates the veth pair of container pid on n, enslaves the host end
+// to the bridge and configures ip, and its IPv6 counterpart on dual-stack
+// networks, inside the container.
+func attach(n Network, pid int, id, ip string, links LinkOps, defaultRoute bool) error {
+	hostVeth, contVeth := n.vethNames(id)
+
+	if err := links.AddVeth(hostVeth, contVeth); err != nil {
+		return err
 	}
-	_ = r.Run("ip", "addr", "add", "10.42.0.1/24", "dev", hostVeth)
-	if err := r.Run("ip", "link", "set", hostVeth, "up"); err != nil {
-		return "", 0, err
+	if err := links.SetMaster(hostVeth, n.Bridge); err != nil {
+		return err
 	}
-	if err := r.Run("ip", "link", "set", contVeth, "netns", strconv.Itoa(pid)); err != nil {
-		return "", 0, err
+	if n.Isolated {
+		if err := links.SetIsolated(hostVeth); err != nil {
+			return err
+		}
 	}
-	if err := r.Run("nsenter", "--target", strconv.Itoa(pid), "--net", "ip", "link", "set", "lo", "up"); err != nil {
-		return "", 0, err
+	if err := links.SetUp(0, hostVeth); err != nil {
+		return err
 	}
-	if err := r.Run("nsenter", "--target", strconv.Itoa(pid), "--net", "ip", "link", "set", contVeth, "up"); err != nil {
-		return "", 0, err
+	if err := links.SetNetns(contVeth, pid); err != nil {
+		return err
 	}
-	addr := fmt.Sprintf("10.42.0.%d/24", ipSuffix)
-	if err := r.Run("nsenter", "--target", strconv.Itoa(pid), "--net", "ip", "addr", "add", addr, "dev", contVeth); err != nil {
-		return "", 0, err
+	if err := links.SetUp(pid, "lo"); err != nil {
+		return err
 	}
-	if err := r.Run("nsenter", "--target", strconv.Itoa(pid), "--net", "ip", "route", "add", "default", "via", "10.42.0.1"); err != nil {
-		return "", 0, err
+	if err := links.SetUp(pid, contVeth); err != nil {
+		return err
 	}
-	
-	if os.Geteuid() == 0 {
-		if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
-			return "", 0, fmt.Errorf("enable ip_forward: %w", err)
-		}
+	if err := links.AddAddr(pid, contVeth, n.hostCIDR(ip)); err != nil {
+		return err
 	}
-	
-	forwardOutArgs := []string{"-A", "FORWARD", "-o", hostVeth, "-j", "ACCEPT"}
-	if !checker.CheckRule(forwardOutArgs...) {
-		if err := r.Run("iptables", forwardOutArgs...); err != nil {
-			return "", 0, err
+	ip6 := n.IPv6Address(ip)
+	if ip6 != "" {
+		if err := links.AddAddr(pid, contVeth, n.hostCIDR6(ip6)); err != nil {
+			return err
 		}
 	}
-	
-	forwardInArgs := []string{"-A", "FORWARD", "-i", hostVeth, "-j", "ACCEPT"}
-	if !checker.CheckRule(forwardInArgs...) {
-		if err := r.Run("iptables", forwardInArgs...); err != nil {
-			return "", 0, err
+	if defaultRoute {
+		if err := links.AddDefaultRoute(pid, n.Gateway); err != nil {
+			return err
+		}
+		if ip6 != "" {
+			if err := links.AddDefaultRoute(pid, n.Gateway6); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
+// portRules returns the iptables or, for an IPv6 ip, ip6tables rules
+// publishing ports of the container with address ip. Ranges get one DNAT
+// rule per port; ports bound to a host IP of the other family are skipped.
+func portRules(ip string, ports []PortMap) [][]string {
+	hostBits := "/32"
+	if isIPv6(ip) {
+		hostBits = "/128"
+	}
+	var rules [][]string
 	for _, pm := range ports {
-		h := strconv.Itoa(pm.Host)
-		c := strconv.Itoa(pm.Container)
-		dest := fmt.Sprintf("10.42.0.%d:%s", ipSuffix, c)
-		
-		preroutingArgs := []string{"-t", "nat", "-A", "PREROUTING",
-			"-p", "tcp", "-m", "tcp", "--dport", h,
-			"-j", "DNAT", "--to-destination", dest}
-		if !checker.CheckRule(preroutingArgs...) {
-			if err := r.Run("iptables", preroutingArgs...); err != nil {
-				return "", 0, err
-			}
+		if pm.HostIP != "" && isIPv6(pm.HostIP) != isIPv6(ip) {
+			continue
 		}
-		
-		outputArgs := []string{"-t", "nat", "-A", "OUTPUT",
-			"-p", "tcp", "-m", "tcp", "--dport", h,
-			"-j", "DNAT", "--to-destination", dest}
-		if !checker.CheckRule(outputArgs...) {
-			if err := r.Run("iptables", outputArgs...); err != nil {
-				return "", 0, err
-			}
-		}
-		
-		postroutingArgs := []string{"-t", "nat", "-A", "POSTROUTING", 
-			"-s", fmt.Sprintf("10.42.0.%d/32", ipSuffix), "-j", "MASQUERADE"}
-		if !checker.CheckRule(postroutingArgs...) {
-			if err := r.Run("iptables", postroutingArgs...); err != nil {
-				return "", 0, err
+		proto := pm.Protocol()
+		for _, p := range portPairs(pm) {
+			match := []string{"-p", proto}
+			if pm.HostIP != "" {
+				match = append(match, "-d", pm.HostIP+hostBits)
 			}
+			match = append(match, "-m", proto, "--dport", strconv.Itoa(p[0]),
+				"-j", "DNAT", "--to-destination", net.JoinHostPort(ip, strconv.Itoa(p[1])))
+			rules = append(rules,
+				append([]string{"-t", "nat", "-A", "PREROUTING"}, match...),
+				append([]string{"-t", "nat", "-A", "OUTPUT"}, match...),
+			)
 		}
 	}
-	success = true
-	return origValue, ipSuffix, nil
+	if len(rules) > 0 {
+		rules = append(rules, []string{"-t", "nat", "-A", "POSTROUTING",
+			"-s", ip + hostBits, "-j", "MASQUERADE"})
+	}
+	return rules
 }
 
-// CleanupNetworking removes veth interface and iptables rules for the container.
-func CleanupNetworking(id string, ports []PortMap) error {
-	ipSuffix := ipSuffixFromID(id)
-	return CleanupNetworkingWithIPSuffix(id, ipSuffix, ports, "")
+func isIPv6(ip string) bool {
+	return strings.Contains(ip, ":")
 }
 
-// CleanupNetworkingWithRestore removes networking resources and restores ip_forward
-func CleanupNetworkingWithRestore(id string, ports []PortMap, ipForwardOrig string) error {
-	ipSuffix := ipSuffixFromID(id)
-	return CleanupNetworkingWithIPSuffix(id, ipSuffix, ports, ipForwardOrig)
+// CleanupNetworkingWithIP removes the veth and firewall rules of the
+// container with address ip on n. Forwarding is restored only when the last
+// bridge is removed together with the last container attached to it. The
+// returned error reports a veth or firewall rules that could not be
+// removed; what is already gone is not an error.
+func CleanupNetworkingWithIP(n Network, id, ip string, ports []PortMap, egress []EgressRule, ipForwardOrig, ip6ForwardOrig, firewall string) error {
+	r, links := backends(nil, true)
+	return cleanupNetworking(n, id, ip, ports, egress, ipForwardOrig, ip6ForwardOrig, r, links, newFirewall(firewall, r))
 }
 
-// CleanupNetworkingWithIPSuffix removes networking resources using specific IP suffix
-func CleanupNetworkingWithIPSuffix(id string, ipSuffix int, ports []PortMap, ipForwardOrig string) error {
-	short := id
-	if len(short) > 8 {
-		short = id[:8]
+func cleanupNetworking(n Network, id, ip string, ports []PortMap, egress []EgressRule, ipForwardOrig, ip6ForwardOrig string, r CmdRunner, links LinkOps, fw Firewall) error {
+	host, _ := n.vethNames(id)
+	err := links.DeleteLink(host)
+	if ferr := fw.RemoveContainer(id, ip, ports); err == nil {
+		err = ferr
 	}
-	hostVeth := "veth" + short
-
-	_, _ = exec.Command("ip", "link", "del", hostVeth).CombinedOutput()
-
-	_, _ = exec.Command("iptables", "-D", "FORWARD", "-o", hostVeth, "-j", "ACCEPT").CombinedOutput()
-	_, _ = exec.Command("iptables", "-D", "FORWARD", "-i", hostVeth, "-j", "ACCEPT").CombinedOutput()
-
-	for _, pm := range ports {
-		h := strconv.Itoa(pm.Host)
-		dest := fmt.Sprintf("10.42.0.%d:%d", ipSuffix, pm.Container)
-		_, _ = exec.Command("iptables", "-t", "nat", "-D", "PREROUTING",
-			"-p", "tcp", "-m", "tcp", "--dport", h,
-			"-j", "DNAT", "--to-destination", dest).CombinedOutput()
-		_, _ = exec.Command("iptables", "-t", "nat", "-D", "OUTPUT",
-			"-p", "tcp", "-m", "tcp", "--dport", h,
-			"-j", "DNAT", "--to-destination", dest).CombinedOutput()
-		_, _ = exec.Command("iptables", "-t", "nat", "-D", "POSTROUTING",
-			"-s", fmt.Sprintf("10.42.0.%d/32", ipSuffix),
-			"-j", "MASQUERADE").CombinedOutput()
+	if ip6 := n.IPv6Address(ip); ip6 != "" {
+		if ferr := fw.RemoveContainer(id, ip6, ports); err == nil {
+			err = ferr
+		}
 	}
-	
-	if ipForwardOrig != "" {
-		_ = os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte(ipForwardOrig), 0644)
+	if len(egress) > 0 {
+		if ferr := fw.RemoveEgress(id, host); err == nil {
+			err = ferr
+		}
 	}
-	
-	return nil
+	removeBridgeIfUnused(n, r, links, ipForwardOrig, ip6ForwardOrig)
+	return err
 }
@@ -1,9 +1,13 @@
 package runtime
 
 import (
+	"net/netip"
+	"os"
+	"path/filepath"
 	"reflect"
-	"strconv"
+	"slices"
 	"testing"
+	"time"
 )
 
 type fakeNetRunner struct{ cmds [][]string }
@@ -20,30 +24,453 @@ func (mockIptablesChecker) CheckRule(args ...string) bool {
 	return false
 }
 
+// fakeSysfs points SysClassNet and the forwarding sysctls at a temporary
+// directory.
+func fakeSysfs(t *testing.T) string {
+	t.Helper()
+	tmp := t.TempDir()
+	oldNet, oldFwd, oldFwd6 := SysClassNet, ipForwardPath, ip6ForwardPath
+	SysClassNet = tmp
+	ipForwardPath = filepath.Join(tmp, "ip_forward")
+	ip6ForwardPath = filepath.Join(tmp, "forwarding")
+	t.Cleanup(func() { SysClassNet, ipForwardPath, ip6ForwardPath = oldNet, oldFwd, oldFwd6 })
+	if err := os.WriteFile(ipForwardPath, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ip6ForwardPath, []byte("0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
 func TestSetupNetworkingCommands(t *testing.T) {
+	fakeSysfs(t)
 	f := &fakeNetRunner{}
 	ports := []PortMap{{Host: 8080, Container: 80}}
-	_, _, err := SetupNetworkingWithChecker(123, "abcdef0123456789", ports, f, mockIptablesChecker{})
+	orig, orig6, err := SetupNetworkingWithChecker(DefaultNetwork, 123, "abcdef0123456789", "10.42.0.7", ports, nil, f, mockIptablesChecker{})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if orig != "0" || orig6 != "" {
+		t.Fatalf("forwarding orig = %q, %q, want 0 and none for IPv4 only", orig, orig6)
+	}
 	want := [][]string{
+		{"ip", "link", "add", "pd0", "type", "bridge"},
+		{"ip", "link", "set", "dev", "pd0", "alias", "pocket-docker ip_forward=0 firewall=iptables"},
+		{"ip", "addr", "add", "10.42.0.1/24", "dev", "pd0"},
+		{"ip", "link", "set", "pd0", "up"},
+		{"iptables", "-I", "FORWARD", "-i", "pd0", "-o", "pd+", "-j", "DROP"},
+		{"iptables", "-I", "FORWARD", "-i", "pd0", "-o", "pd0", "-j", "ACCEPT"},
+		{"iptables", "-A", "FORWARD", "-i", "pd0", "-j", "ACCEPT"},
+		{"iptables", "-A", "FORWARD", "-o", "pd0", "-j", "ACCEPT"},
+		{"iptables", "-t", "nat", "-A", "POSTROUTING", "-s", "10.42.0.0/24", "!", "-o", "pd0", "-j", "MASQUERADE"},
 		{"ip", "link", "add", "vethabcdef01", "type", "veth", "peer", "name", "vethabcdef01_c"},
-		{"ip", "addr", "add", "10.42.0.1/24", "dev", "vethabcdef01"},
+		{"ip", "link", "set", "vethabcdef01", "master", "pd0"},
 		{"ip", "link", "set", "vethabcdef01", "up"},
 		{"ip", "link", "set", "vethabcdef01_c", "netns", "123"},
 		{"nsenter", "--target", "123", "--net", "ip", "link", "set", "lo", "up"},
 		{"nsenter", "--target", "123", "--net", "ip", "link", "set", "vethabcdef01_c", "up"},
-		{"nsenter", "--target", "123", "--net", "ip", "addr", "add", "10.42.0." +
-			strconv.Itoa(ipSuffixFromID("abcdef0123456789")) + "/24", "dev", "vethabcdef01_c"},
+		{"nsenter", "--target", "123", "--net", "ip", "addr", "add", "10.42.0.7/24", "dev", "vethabcdef01_c"},
 		{"nsenter", "--target", "123", "--net", "ip", "route", "add", "default", "via", "10.42.0.1"},
-		{"iptables", "-A", "FORWARD", "-o", "vethabcdef01", "-j", "ACCEPT"},
-		{"iptables", "-A", "FORWARD", "-i", "vethabcdef01", "-j", "ACCEPT"},
-		{"iptables", "-t", "nat", "-A", "PREROUTING", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.42.0." + strconv.Itoa(ipSuffixFromID("abcdef0123456789")) + ":80"},
-		{"iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.42.0." + strconv.Itoa(ipSuffixFromID("abcdef0123456789")) + ":80"},
-		{"iptables", "-t", "nat", "-A", "POSTROUTING", "-s", "10.42.0." + strconv.Itoa(ipSuffixFromID("abcdef0123456789")) + "/32", "-j", "MASQUERADE"},
+		{"iptables", "-t", "nat", "-A", "PREROUTING", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.42.0.7:80"},
+		{"iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "10.42.0.7:80"},
+		{"iptables", "-t", "nat", "-A", "POSTROUTING", "-s", "10.42.0.7/32", "-j", "MASQUERADE"},
+	}
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Fatalf("commands mismatch\nwant=%v\n got=%v", want, f.cmds)
+	}
+}
+
+func TestSetupNetworkingReusesBridge(t *testing.T) {
+	sys := fakeSysfs(t)
+	// The bridge was created by an earlier container while ip_forward was 0.
+	if err := os.MkdirAll(filepath.Join(sys, "pd0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(sys, "pd0", "ifalias"), []byte("pocket-docker ip_forward=0\n"), 0644)
+	os.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+
+	f := &fakeNetRunner{}
+	orig, _, err := SetupNetworkingWithChecker(DefaultNetwork, 123, "abcdef0123456789", "10.42.0.7", nil, nil, f, mockIptablesChecker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "0" {
+		t.Fatalf("ip_forward orig = %q, want value recorded on the bridge", orig)
+	}
+	for _, c := range f.cmds {
+		if c[0] == "ip" && len(c) > 3 && c[3] == "pd0" {
+			t.Fatalf("bridge recreated: %v", c)
+		}
+		if c[0] == "ip" && c[1] == "addr" {
+			t.Fatalf("address added on the host: %v", c)
+		}
+	}
+}
+
+func TestCleanupNetworkingRemovesUnusedBridge(t *testing.T) {
+	sys := fakeSysfs(t)
+	brif := filepath.Join(sys, "pd0", "brif")
+	if err := os.MkdirAll(brif, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(sys, "pd0", "ifalias"), []byte("pocket-docker ip_forward=0\n"), 0644)
+	os.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+	// Another container is still attached.
+	os.WriteFile(filepath.Join(brif, "veth11111111"), nil, 0644)
+
+	f := &fakeNetRunner{}
+	cleanupNetworking(DefaultNetwork, "abcdef0123456789", "10.42.0.5", nil, nil, "", "", f, cmdLinkOps{f}, iptablesFirewall{r: f})
+	want := [][]string{{"ip", "link", "del", "vethabcdef01"}}
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Fatalf("bridge touched while in use: %v", f.cmds)
+	}
+
+	os.Remove(filepath.Join(brif, "veth11111111"))
+	f = &fakeNetRunner{}
+	cleanupNetworking(DefaultNetwork, "11111111", "10.42.0.6", nil, nil, "", "", f, cmdLinkOps{f}, iptablesFirewall{r: f})
+	want = [][]string{
+		{"ip", "link", "del", "veth11111111"},
+		{"iptables", "-D", "FORWARD", "-i", "pd0", "-o", "pd+", "-j", "DROP"},
+		{"iptables", "-D", "FORWARD", "-i", "pd0", "-o", "pd0", "-j", "ACCEPT"},
+		{"iptables", "-D", "FORWARD", "-i", "pd0", "-j", "ACCEPT"},
+		{"iptables", "-D", "FORWARD", "-o", "pd0", "-j", "ACCEPT"},
+		{"iptables", "-t", "nat", "-D", "POSTROUTING", "-s", "10.42.0.0/24", "!", "-o", "pd0", "-j", "MASQUERADE"},
+		{"ip", "link", "del", "pd0"},
+	}
+	if !reflect.DeepEqual(f.cmds, want) {
+		t.Fatalf("commands mismatch\nwant=%v\n got=%v", want, f.cmds)
+	}
+	if data, _ := os.ReadFile(ipForwardPath); string(data) != "0" {
+		t.Fatalf("ip_forward not restored: %q", data)
+	}
+}
+
+func TestCleanupNetworkingKeepsBridgeWhenConfigured(t *testing.T) {
+	sys := fakeSysfs(t)
+	os.MkdirAll(filepath.Join(sys, "pd0", "brif"), 0755)
+	t.Setenv(keepBridgeEnv, "1")
+
+	f := &fakeNetRunner{}
+	cleanupNetworking(DefaultNetwork, "abcdef0123456789", "10.42.0.5", nil, nil, "0", "", f, cmdLinkOps{f}, iptablesFirewall{r: f})
+	if len(f.cmds) != 1 {
+		t.Fatalf("bridge removed despite %s=1: %v", keepBridgeEnv, f.cmds)
+	}
+}
+
+func TestConnectNetworkUserDefined(t *testing.T) {
+	fakeSysfs(t)
+	n := Network{Name: "web", Bridge: "pd-web", Subnet: "10.50.0.0/24", Gateway: "10.50.0.1"}
+	host, cont := n.vethNames("abcdef0123456789")
+	if host == hostVethName("abcdef0123456789") || len(cont) > 15 {
+		t.Fatalf("unexpected veth names %q/%q", host, cont)
+	}
+
+	f := &fakeNetRunner{}
+	if err := connectNetworkWithChecker(n, 123, "abcdef0123456789", "10.50.0.2", f, mockIptablesChecker{}); err != nil {
+		t.Fatal(err)
+	}
+	wantPrefix := [][]string{
+		{"ip", "link", "add", "pd-web", "type", "bridge"},
+		{"ip", "link", "set", "dev", "pd-web", "alias", "pocket-docker ip_forward=0 firewall=iptables"},
+		{"ip", "addr", "add", "10.50.0.1/24", "dev", "pd-web"},
+		{"ip", "link", "set", "pd-web", "up"},
+		{"iptables", "-I", "FORWARD", "-i", "pd-web", "-o", "pd+", "-j", "DROP"},
+		{"iptables", "-I", "FORWARD", "-i", "pd-web", "-o", "pd-web", "-j", "ACCEPT"},
+	}
+	if !reflect.DeepEqual(f.cmds[:len(wantPrefix)], wantPrefix) {
+		t.Fatalf("bridge setup mismatch\nwant=%v\n got=%v", wantPrefix, f.cmds[:len(wantPrefix)])
+	}
+	last := f.cmds[len(f.cmds)-1]
+	want := []string{"nsenter", "--target", "123", "--net", "ip", "addr", "add", "10.50.0.2/24", "dev", cont}
+	if !reflect.DeepEqual(last, want) {
+		t.Fatalf("connect must not touch the default route, last command %v", last)
+	}
+}
+
+func TestRemoveBridgeKeepsIPForwardForOtherBridges(t *testing.T) {
+	sys := fakeSysfs(t)
+	for _, br := range []string{"pd0", "pd-web"} {
+		os.MkdirAll(filepath.Join(sys, br, "brif"), 0755)
+		os.WriteFile(filepath.Join(sys, br, "ifalias"), []byte("pocket-docker ip_forward=0\n"), 0644)
+	}
+	os.WriteFile(ipForwardPath, []byte("1\n"), 0644)
+
+	f := &fakeNetRunner{}
+	removeBridge(DefaultNetwork, f, cmdLinkOps{f}, "", "")
+	// The fake runner does not delete anything, so pd0 is still listed;
+	// drop it the way `ip link del` would.
+	os.RemoveAll(filepath.Join(sys, "pd0"))
+	if data, _ := os.ReadFile(ipForwardPath); string(data) != "1\n" {
+		t.Fatalf("ip_forward restored while pd-web exists: %q", data)
+	}
+	removeBridge(Network{Name: "web", Bridge: "pd-web"}, f, cmdLinkOps{f}, "", "")
+	if data, _ := os.ReadFile(ipForwardPath); string(data) != "0" {
+		t.Fatalf("ip_forward not restored with the last bridge: %q", data)
+	}
+}
+
+func TestMapIPv6(t *testing.T) {
+	cases := []struct{ subnet, subnet6, ip, want string }{
+		{"10.50.0.0/24", "fd00:50::/64", "10.50.0.2", "fd00:50::2"},
+		{"10.50.0.0/16", "fd00:50::/64", "10.50.1.2", "fd00:50::102"},
+		{"10.50.0.0/24", "fd00:50::/120", "10.50.0.254", "fd00:50::fe"},
+		{"10.50.0.0/16", "fd00:50::/120", "10.50.1.2", ""},
+		{"10.50.0.0/24", "fd00:50::/64", "10.51.0.2", ""},
+	}
+	for _, c := range cases {
+		if got := MapIPv6(c.subnet, c.subnet6, c.ip); got != c.want {
+			t.Errorf("MapIPv6(%s, %s, %s) = %q, want %q", c.subnet, c.subnet6, c.ip, got, c.want)
+		}
+	}
+	if DefaultNetwork.IPv6Address("10.42.0.2") != "" {
+		t.Fatal("IPv4-only network has IPv6 addresses")
+	}
+}
+
+func TestSetupNetworkingDualStack(t *testing.T) {
+	fakeSysfs(t)
+	n := Network{Name: "v6", Bridge: "pd-v6", Subnet: "10.50.0.0/24", Gateway: "10.50.0.1", Subnet6: "fd00:50::/64", Gateway6: "fd00:50::1"}
+	_, cont := n.vethNames("abcdef0123456789")
+	f := &fakeNetRunner{}
+	ports := []PortMap{{Host: 8080, Container: 80}, {HostIP: "127.0.0.1", Host: 9090, Container: 90}}
+	orig, orig6, err := SetupNetworkingWithChecker(n, 123, "abcdef0123456789", "10.50.0.7", ports, nil, f, mockIptablesChecker{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "0" || orig6 != "0" {
+		t.Fatalf("forwarding orig = %q, %q, want 0 and 0", orig, orig6)
+	}
+	for _, want := range [][]string{
+		{"ip", "link", "set", "dev", "pd-v6", "alias", "pocket-docker ip_forward=0 ip6_forward=0 firewall=iptables"},
+		{"ip", "addr", "add", "fd00:50::1/64", "dev", "pd-v6", "nodad"},
+		{"ip6tables", "-t", "nat", "-A", "POSTROUTING", "-s", "fd00:50::/64", "!", "-o", "pd-v6", "-j", "MASQUERADE"},
+		{"nsenter", "--target", "123", "--net", "ip", "addr", "add", "fd00:50::7/64", "dev", cont, "nodad"},
+		{"nsenter", "--target", "123", "--net", "ip", "-6", "route", "add", "default", "via", "fd00:50::1"},
+		{"ip6tables", "-t", "nat", "-A", "PREROUTING", "-p", "tcp", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "[fd00:50::7]:80"},
+		{"ip6tables", "-t", "nat", "-A", "POSTROUTING", "-s", "fd00:50::7/128", "-j", "MASQUERADE"},
+	} {
+		if !hasCmd(f.cmds, want) {
+			t.Fatalf("missing %v in\n%v", want, f.cmds)
+		}
+	}
+	for _, c := range f.cmds {
+		if c[0] == "ip6tables" && len(c) > 9 && c[9] == "9090" {
+			t.Fatalf("IPv4 host address published over IPv6: %v", c)
+		}
+	}
+	if data, _ := os.ReadFile(ip6ForwardPath); os.Geteuid() == 0 && string(data) != "1" {
+		t.Fatalf("IPv6 forwarding not enabled: %q", data)
+	}
+
+	// The bridge records the original values; removing it restores them.
+	os.WriteFile(ip6ForwardPath, []byte("1"), 0644)
+	os.MkdirAll(filepath.Join(SysClassNet, "pd-v6", "brif"), 0755)
+	os.WriteFile(filepath.Join(SysClassNet, "pd-v6", "ifalias"), []byte("pocket-docker ip_forward=0 ip6_forward=0 firewall=iptables\n"), 0644)
+	f = &fakeNetRunner{}
+	cleanupNetworking(n, "abcdef0123456789", "10.50.0.7", ports, nil, "", "", f, cmdLinkOps{f}, iptablesFirewall{r: f})
+	if !hasCmd(f.cmds, []string{"ip6tables", "-t", "nat", "-D", "POSTROUTING", "-s", "fd00:50::7/128", "-j", "MASQUERADE"}) {
+		t.Fatalf("IPv6 port rules not removed: %v", f.cmds)
+	}
+	if data, _ := os.ReadFile(ip6ForwardPath); string(data) != "0" {
+		t.Fatalf("IPv6 forwarding not restored: %q", data)
+	}
+}
+
+func TestSetupNetworkingIsolatedInternal(t *testing.T) {
+	fakeSysfs(t)
+	n := Network{Name: "ctf", Bridge: "pd-ctf", Subnet: "10.53.0.0/24", Gateway: "10.53.0.1", Isolated: true}
+	host, _ := n.vethNames("abcdef0123456789")
+	f := &fakeNetRunner{}
+	if _, _, err := SetupNetworkingWithChecker(n, 123, "abcdef0123456789", "10.53.0.7", nil, nil, f, mockIptablesChecker{}); err != nil {
+		t.Fatal(err)
+	}
+	master := slices.IndexFunc(f.cmds, func(c []string) bool { return slices.Contains(c, "master") })
+	isolated := slices.IndexFunc(f.cmds, func(c []string) bool {
+		return reflect.DeepEqual(c, []string{"ip", "link", "set", "dev", host, "type", "bridge_slave", "isolated", "on"})
+	})
+	if master < 0 || isolated < master {
+		t.Fatalf("port not isolated after joining the bridge: %v", f.cmds)
+	}
+	if hasCmd(f.cmds, []string{"iptables", "-I", "FORWARD", "-i", "pd-ctf", "-o", "pd-ctf", "-j", "ACCEPT"}) {
+		t.Fatalf("traffic between containers accepted: %v", f.cmds)
+	}
+	if !hasCmd(f.cmds, []string{"iptables", "-t", "nat", "-A", "POSTROUTING", "-s", "10.53.0.0/24", "!", "-o", "pd-ctf", "-j", "MASQUERADE"}) {
+		t.Fatalf("outbound traffic of an isolated network not masqueraded: %v", f.cmds)
+	}
+
+	n.Isolated = false
+	n.Internal = true
+	want := [][]string{
+		{"-I", "FORWARD", "-i", "pd-ctf", "-j", "DROP"},
+		{"-I", "FORWARD", "-o", "pd-ctf", "-j", "DROP"},
+		{"-I", "FORWARD", "-i", "pd-ctf", "-o", "pd+", "-j", "DROP"},
+		{"-I", "FORWARD", "-i", "pd-ctf", "-o", "pd-ctf", "-j", "ACCEPT"},
+	}
+	if got := n.bridgeRules(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("internal bridge rules\nwant=%v\n got=%v", want, got)
+	}
+}
+
+func TestShapeNetworkCommands(t *testing.T) {
+	f := &fakeNetRunner{}
+	s := NetShape{Rate: 10e6, Delay: 50 * time.Millisecond, Loss: 1}
+	if err := ShapeNetwork(DefaultNetwork, 123, "abcdef0123456789", s, f); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"tc", "qdisc", "add", "dev", "vethabcdef01", "root", "handle", "1:", "netem", "delay", "50000us", "loss", "1%"},
+		{"tc", "qdisc", "add", "dev", "vethabcdef01", "parent", "1:", "handle", "2:", "tbf", "rate", "10000000bit", "burst", "12500", "limit", "75000"},
+		{"nsenter", "--target", "123", "--net", "tc", "qdisc", "add", "dev", "vethabcdef01_c", "root", "handle", "1:", "netem", "delay", "50000us", "loss", "1%"},
+		{"nsenter", "--target", "123", "--net", "tc", "qdisc", "add", "dev", "vethabcdef01_c", "parent", "1:", "handle", "2:", "tbf", "rate", "10000000bit", "burst", "12500", "limit", "75000"},
 	}
 	if !reflect.DeepEqual(f.cmds, want) {
 		t.Fatalf("commands mismatch\nwant=%v\n got=%v", want, f.cmds)
 	}
+
+	f = &fakeNetRunner{}
+	if err := ShapeNetwork(DefaultNetwork, 123, "abcdef0123456789", NetShape{Rate: 1e6}, f); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.cmds) != 2 || !slices.Equal(f.cmds[0][5:9], []string{"root", "handle", "1:", "tbf"}) {
+		t.Fatalf("rate alone must be a root tbf: %v", f.cmds)
+	}
+}
+
+func TestSetupNetworkingEgress(t *testing.T) {
+	sys := fakeSysfs(t)
+	old := brNetfilterPaths
+	brNetfilterPaths = []string{filepath.Join(sys, "bridge-nf-call-iptables"), filepath.Join(sys, "bridge-nf-call-ip6tables")}
+	t.Cleanup(func() { brNetfilterPaths = old })
+	egress := []EgressRule{
+		{Net: netip.MustParsePrefix("1.1.1.1/32"), Proto: "udp", Port: 53},
+		{Net: netip.MustParsePrefix("10.0.0.0/8")},
+	}
+
+	// Without br_netfilter the rules would not see bridged traffic.
+	f := &fakeNetRunner{}
+	if _, _, err := SetupNetworkingWithChecker(DefaultNetwork, 123, "abcdef0123456789", "10.42.0.7", nil, egress, f, mockIptablesChecker{}); err == nil {
+		t.Fatal("egress rules installed without br_netfilter")
+	}
+	if hasCmd(f.cmds, []string{"ip", "link", "add", "vethabcdef01", "type", "veth", "peer", "name", "vethabcdef01_c"}) {
+		t.Fatalf("container attached although its egress rules failed: %v", f.cmds)
+	}
+
+	for _, p := range brNetfilterPaths {
+		os.WriteFile(p, []byte("1\n"), 0644)
+	}
+	f = &fakeNetRunner{}
+	if _, _, err := SetupNetworkingWithChecker(DefaultNetwork, 123, "abcdef0123456789", "10.42.0.7", nil, egress, f, mockIptablesChecker{}); err != nil {
+		t.Fatal(err)
+	}
+	var chain [][]string
+	veth := -1
+	for i, c := range f.cmds {
+		if c[0] == "iptables" && len(c) > 2 && c[2] == "PDE-abcdef012345" {
+			chain = append(chain, c)
+		}
+		if veth < 0 && c[0] == "ip" && c[2] == "add" && c[3] == "vethabcdef01" {
+			veth = i
+		}
+	}
+	want := [][]string{
+		{"iptables", "-N", "PDE-abcdef012345"},
+		{"iptables", "-F", "PDE-abcdef012345"},
+		{"iptables", "-A", "PDE-abcdef012345", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+		{"iptables", "-A", "PDE-abcdef012345", "-d", "1.1.1.1/32", "-p", "udp", "-m", "udp", "--dport", "53", "-j", "RETURN"},
+		{"iptables", "-A", "PDE-abcdef012345", "-d", "10.0.0.0/8", "-j", "RETURN"},
+		{"iptables", "-A", "PDE-abcdef012345", "-j", "DROP"},
+	}
+	if !reflect.DeepEqual(chain, want) {
+		t.Fatalf("egress chain mismatch\nwant=%v\n got=%v", want, chain)
+	}
+	for _, want := range [][]string{
+		{"iptables", "-I", "FORWARD", "-m", "physdev", "--physdev-in", "vethabcdef01", "-j", "PDE-abcdef012345"},
+		{"iptables", "-I", "INPUT", "-m", "physdev", "--physdev-in", "vethabcdef01", "-j", "PDE-abcdef012345"},
+		{"ip6tables", "-A", "PDE-abcdef012345", "-j", "DROP"},
+	} {
+		i := slices.IndexFunc(f.cmds, func(c []string) bool { return reflect.DeepEqual(c, want) })
+		if i < 0 || i > veth {
+			t.Fatalf("%v missing or after the veth was created: %v", want, f.cmds)
+		}
+	}
+
+	f = &fakeNetRunner{}
+	cleanupNetworking(DefaultNetwork, "abcdef0123456789", "10.42.0.7", nil, egress, "", "", f, cmdLinkOps{f}, iptablesFirewall{r: f})
+	for _, want := range [][]string{
+		{"iptables", "-D", "FORWARD", "-m", "physdev", "--physdev-in", "vethabcdef01", "-j", "PDE-abcdef012345"},
+		{"iptables", "-X", "PDE-abcdef012345"},
+		{"ip6tables", "-X", "PDE-abcdef012345"},
+	} {
+		if !hasCmd(f.cmds, want) {
+			t.Fatalf("missing %v in\n%v", want, f.cmds)
+		}
+	}
+}
+
+// ruleTable is an IptablesChecker reporting the rules f ran with bin.
+type ruleTable struct {
+	f   *fakeNetRunner
+	bin string
+}
+
+func (t ruleTable) CheckRule(args ...string) bool {
+	return hasCmd(t.f.cmds, append([]string{t.bin}, args...))
+}
+
+func TestIptablesAddEgressJumpsBothFamilies(t *testing.T) {
+	sys := t.TempDir()
+	old := brNetfilterPaths
+	brNetfilterPaths = []string{filepath.Join(sys, "bridge-nf-call-iptables"), filepath.Join(sys, "bridge-nf-call-ip6tables")}
+	t.Cleanup(func() { brNetfilterPaths = old })
+	for _, p := range brNetfilterPaths {
+		os.WriteFile(p, []byte("1\n"), 0644)
+	}
+	f := &fakeNetRunner{}
+	fw := iptablesFirewall{r: f, checker: ruleTable{f, "iptables"}, checker6: ruleTable{f, "ip6tables"}}
+	if err := fw.AddEgress("abcdef0123456789", "vethabcdef01", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, hook := range []string{"FORWARD", "INPUT"} {
+			want := []string{bin, "-I", hook, "-m", "physdev", "--physdev-in", "vethabcdef01", "-j", "PDE-abcdef012345"}
+			if !hasCmd(f.cmds, want) {
+				t.Errorf("missing %v in\n%v", want, f.cmds)
+			}
+		}
+	}
+}
+
+func hasCmd(cmds [][]string, want []string) bool {
+	for _, c := range cmds {
+		if reflect.DeepEqual(c, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReadNetStatsSwapsHostCounters(t *testing.T) {
+	tmp := t.TempDir()
+	old := SysClassNet
+	SysClassNet = tmp
+	defer func() { SysClassNet = old }()
+
+	dir := filepath.Join(tmp, "vethabcdef01", "statistics")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "rx_bytes"), []byte("1200\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "tx_bytes"), []byte("3400\n"), 0644)
+
+	ns, err := ReadNetStats(DefaultNetwork, "abcdef0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns.RxBytes != 3400 || ns.TxBytes != 1200 {
+		t.Fatalf("unexpected counters: %+v", ns)
+	}
+	if _, err := ReadNetStats(DefaultNetwork, "ffffffff"); err == nil {
+		t.Fatal("expected error for missing interface")
+	}
 }
@@ -0,0 +1,307 @@
+//go:build linux
+
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nftTable is the table holding all IPv4 rules of the nftables backend.
+const nftTable = "ip pocket-docker"
+
+// nftTable6 holds the IPv6 rules of dual-stack networks in chains named
+// like those of nftTable.
+const nftTable6 = "ip6 pocket-docker"
+
+// nftBase declares the table and its base chains. Declarations only create
+// what is missing, so the block is prepended to every script.
+const nftBase = `table ip pocket-docker {
+	chain prerouting { type nat hook prerouting priority dstnat; policy accept; }
+	chain output { type nat hook output priority -100; policy accept; }
+	chain postrouting { type nat hook postrouting priority srcnat; policy accept; }
+	chain forward { type filter hook forward priority filter; policy accept; }
+}
+`
+
+// nftBase6 declares nftTable6 like nftBase declares nftTable.
+var nftBase6 = strings.Replace(nftBase, "table ip ", "table ip6 ", 1)
+
+// nftTableBridge holds the egress rules of containers. They filter frames
+// as they enter the bridge from the host veth, which also covers traffic
+// between containers and to the gateway that the ip tables never see.
+const nftTableBridge = "bridge pocket-docker"
+
+// nftBaseBridge declares nftTableBridge and its base chains.
+const nftBaseBridge = `table bridge pocket-docker {
+	chain input { type filter hook input priority filter; policy accept; }
+	chain forward { type filter hook forward priority filter; policy accept; }
+}
+`
+
+// nftFirewall keeps the rules of every bridge and container in a chain of
+// their own. Rules in the base chains jump to it and carry a comment naming
+// their owner, so removal deletes exactly the owner's rules by handle in a
+// single transaction.
+type nftFirewall struct {
+	r CmdRunner
+	// list returns `nft -a list table` output of nftTable or nftTable6.
+	list func(table string) (string, error)
+}
+
+func (*nftFirewall) Name() string { return FirewallNft }
+
+func bridgeOwner(n Network) string    { return "bridge:" + n.Bridge }
+func containerOwner(id string) string { return "container:" + shortID(id) }
+func bridgeChain(n Network) string    { return "b-" + n.Bridge }
+func containerChain(id string) string { return "c-" + shortID(id) }
+func egressOwner(id string) string    { return "egress:" + shortID(id) }
+func egressNftChain(id string) string { return "e-" + shortID(id) }
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// AddBridge sends traffic entering the bridge through its chain, where
+// traffic to other bridges is dropped, and masquerades outbound traffic.
+// Rules left over from an earlier run are replaced in the same transaction,
+// which covers both tables for a dual-stack bridge.
+func (f *nftFirewall) AddBridge(n Network) error {
+	script, err := f.bridgeScript(n, nftTable, "ip", n.Subnet)
+	if err != nil {
+		return err
+	}
+	if n.Subnet6 == "" {
+		return f.apply(nftBase, script)
+	}
+	script6, err := f.bridgeScript(n, nftTable6, "ip6", n.Subnet6)
+	if err != nil {
+		return err
+	}
+	return f.apply(nftBase+nftBase6, script+script6)
+}
+
+// bridgeScript returns the commands replacing the rules of n in table,
+// whose addresses are matched by the family keyword fam.
+func (f *nftFirewall) bridgeScript(n Network, table, fam, subnet string) (string, error) {
+	del, err := f.removal(table, bridgeOwner(n), bridgeChain(n))
+	if err != nil {
+		return "", err
+	}
+	c, tag := bridgeChain(n), nftComment(bridgeOwner(n))
+	// Isolated networks drop traffic staying on the bridge with that to
+	// other bridges; internal ones drop everything leaving or entering it.
+	verdict := "accept"
+	if n.Internal {
+		verdict = "drop"
+	}
+	lines := []string{fmt.Sprintf("add chain %s %s", table, c)}
+	if !n.Isolated {
+		lines = append(lines, fmt.Sprintf("add rule %s %s oifname %q accept", table, c, n.Bridge))
+	}
+	lines = append(lines,
+		fmt.Sprintf("add rule %s %s oifname \"pd*\" drop", table, c),
+		fmt.Sprintf("add rule %s %s %s", table, c, verdict),
+		fmt.Sprintf("insert rule %s forward iifname %q jump %s %s", table, n.Bridge, c, tag),
+		fmt.Sprintf("add rule %s forward oifname %q %s %s", table, n.Bridge, verdict, tag),
+	)
+	if !n.Internal {
+		lines = append(lines, fmt.Sprintf("add rule %s postrouting %s saddr %s oifname != %q masquerade %s", table, fam, subnet, n.Bridge, tag))
+	}
+	return del + strings.Join(lines, "\n") + "\n", nil
+}
+
+func (f *nftFirewall) RemoveBridge(n Network) error {
+	del, err := f.removal(nftTable, bridgeOwner(n), bridgeChain(n))
+	if err != nil {
+		return err
+	}
+	base := nftBase
+	if n.Subnet6 != "" {
+		del6, err := f.removal(nftTable6, bridgeOwner(n), bridgeChain(n))
+		if err != nil {
+			return err
+		}
+		del += del6
+		base += nftBase6
+	}
+	if del == "" {
+		return nil
+	}
+	return f.apply(base, del)
+}
+
+// AddContainer puts the DNAT rules of the published ports into the chain of
+// the container in the table of the family of ip.
+func (f *nftFirewall) AddContainer(id, ip string, ports []PortMap) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	table, base, fam := nftFamily(ip)
+	del, err := f.removal(table, containerOwner(id), containerChain(id))
+	if err != nil {
+		return err
+	}
+	c, tag := containerChain(id), nftComment(containerOwner(id))
+	lines := []string{fmt.Sprintf("add chain %s %s", table, c)}
+	for _, pm := range ports {
+		if pm.HostIP != "" && isIPv6(pm.HostIP) != isIPv6(ip) {
+			continue
+		}
+		var daddr string
+		if pm.HostIP != "" {
+			daddr = fam + " daddr " + pm.HostIP + " "
+		}
+		for _, p := range portPairs(pm) {
+			lines = append(lines, fmt.Sprintf("add rule %s %s %s%s dport %d dnat to %s", table, c, daddr, pm.Protocol(), p[0], net.JoinHostPort(ip, strconv.Itoa(p[1]))))
+		}
+	}
+	lines = append(lines,
+		fmt.Sprintf("add rule %s prerouting jump %s %s", table, c, tag),
+		fmt.Sprintf("add rule %s output jump %s %s", table, c, tag),
+		fmt.Sprintf("add rule %s postrouting %s saddr %s masquerade %s", table, fam, ip, tag),
+	)
+	return f.apply(base, del+strings.Join(lines, "\n")+"\n")
+}
+
+func (f *nftFirewall) RemoveContainer(id, ip string, ports []PortMap) error {
+	table, base, _ := nftFamily(ip)
+	del, err := f.removal(table, containerOwner(id), containerChain(id))
+	if err != nil || del == "" {
+		return err
+	}
+	return f.apply(base, del)
+}
+
+// AddEgress jumps from the bridge table to the egress chain of the
+// container for frames entering the bridge through veth, whether they are
+// forwarded to another port or delivered to the host.
+func (f *nftFirewall) AddEgress(id, veth string, allow []EgressRule) error {
+	del, err := f.removal(nftTableBridge, egressOwner(id), egressNftChain(id))
+	if err != nil {
+		return err
+	}
+	t, c, tag := nftTableBridge, egressNftChain(id), nftComment(egressOwner(id))
+	lines := []string{
+		fmt.Sprintf("add chain %s %s", t, c),
+		fmt.Sprintf("add rule %s %s ether type arp accept", t, c),
+		fmt.Sprintf("add rule %s %s ct state established,related accept", t, c),
+		fmt.Sprintf("add rule %s %s icmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept", t, c),
+	}
+	for _, r := range allow {
+		fam := "ip"
+		if r.Is6() {
+			fam = "ip6"
+		}
+		var dport string
+		if r.Port != 0 {
+			dport = fmt.Sprintf(" %s dport %s", r.Proto, r.ports("-"))
+		}
+		lines = append(lines, fmt.Sprintf("add rule %s %s %s daddr %s%s accept", t, c, fam, r.Net, dport))
+	}
+	lines = append(lines,
+		fmt.Sprintf("add rule %s %s drop", t, c),
+		fmt.Sprintf("add rule %s input iifname %q jump %s %s", t, veth, c, tag),
+		fmt.Sprintf("add rule %s forward iifname %q jump %s %s", t, veth, c, tag),
+	)
+	return f.apply(nftBaseBridge, del+strings.Join(lines, "\n")+"\n")
+}
+
+func (f *nftFirewall) RemoveEgress(id, veth string) error {
+	del, err := f.removal(nftTableBridge, egressOwner(id), egressNftChain(id))
+	if err != nil || del == "" {
+		return err
+	}
+	return f.apply(nftBaseBridge, del)
+}
+
+// nftFamily returns the table, its declaration and the address family
+// keyword for rules about ip.
+func nftFamily(ip string) (table, base, fam string) {
+	if isIPv6(ip) {
+		return nftTable6, nftBase6, "ip6"
+	}
+	return nftTable, nftBase, "ip"
+}
+
+var (
+	nftChainLine = regexp.MustCompile(`^\s*chain (\S+) \{`)
+	nftRuleLine  = regexp.MustCompile(`comment "([^"]*)" # handle (\d+)\s*$`)
+)
+
+// removal returns the commands deleting the rules of table tagged with
+// owner and the chain, or "" if none of them exist.
+func (f *nftFirewall) removal(table, owner, chain string) (string, error) {
+	out, err := f.list(table)
+	if err != nil {
+		return "", err
+	}
+	var cmds []string
+	var current string
+	hasChain := false
+	sc := bufio.NewScanner(strings.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if m := nftChainLine.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			hasChain = hasChain || current == chain
+			continue
+		}
+		if m := nftRuleLine.FindStringSubmatch(line); m != nil && m[1] == owner {
+			cmds = append(cmds, fmt.Sprintf("delete rule %s %s handle %s", table, current, m[2]))
+		}
+	}
+	if hasChain {
+		cmds = append(cmds,
+			fmt.Sprintf("flush chain %s %s", table, chain),
+			fmt.Sprintf("delete chain %s %s", table, chain))
+	}
+	if len(cmds) == 0 {
+		return "", nil
+	}
+	return strings.Join(cmds, "\n") + "\n", nil
+}
+
+// apply runs script with `nft -f` as one transaction after base, the
+// declaration of the tables it uses.
+func (f *nftFirewall) apply(base, script string) error {
+	tmp, err := os.CreateTemp("", "pocket-docker-*.nft")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(base + script); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return f.r.Run("nft", "-f", tmp.Name())
+}
+
+func nftComment(owner string) string {
+	return fmt.Sprintf("comment %q", owner)
+}
+
+// listNftTable returns the rules of table with their handles, or "" if the
+// table does not exist yet.
+func listNftTable(table string) (string, error) {
+	out, err := exec.Command("nft", append([]string{"-a", "list", "table"}, strings.Fields(table)...)...).Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", nil
+		}
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,270 @@
+package runtime
+
+import (
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+)
+
+// nftScripts records the scripts passed to `nft -f`.
+type nftScripts struct{ scripts []string }
+
+func (n *nftScripts) Run(cmd string, args ...string) error {
+	if cmd == "nft" && len(args) == 2 && args[0] == "-f" {
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		script := strings.TrimPrefix(string(data), nftBase)
+		script = strings.TrimPrefix(script, nftBaseBridge)
+		n.scripts = append(n.scripts, strings.TrimPrefix(script, nftBase6))
+	}
+	return nil
+}
+
+const nftListing = `table ip pocket-docker {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		jump c-abcdef012345 comment "container:abcdef012345" # handle 11
+		jump c-111111111111 comment "container:111111111111" # handle 15
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		jump c-abcdef012345 comment "container:abcdef012345" # handle 12
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 10.42.0.0/24 oifname != "pd0" masquerade comment "bridge:pd0" # handle 8
+		ip saddr 10.42.0.5 masquerade comment "container:abcdef012345" # handle 13
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		iifname "pd0" jump b-pd0 comment "bridge:pd0" # handle 6
+		oifname "pd0" accept comment "bridge:pd0" # handle 7
+	}
+	chain b-pd0 {
+		oifname "pd0" accept # handle 3
+		oifname "pd*" drop # handle 4
+		accept # handle 5
+	}
+	chain c-abcdef012345 {
+		tcp dport 8080 dnat to 10.42.0.5:80 # handle 10
+	}
+	chain c-111111111111 {
+		tcp dport 9090 dnat to 10.42.0.6:80 # handle 14
+	}
+}
+`
+
+func TestNftRemoveContainerDeletesOnlyItsRules(t *testing.T) {
+	r := &nftScripts{}
+	fw := &nftFirewall{r: r, list: func(string) (string, error) { return nftListing, nil }}
+	if err := fw.RemoveContainer("abcdef0123456789", "10.42.0.5", nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `delete rule ip pocket-docker prerouting handle 11
+delete rule ip pocket-docker output handle 12
+delete rule ip pocket-docker postrouting handle 13
+flush chain ip pocket-docker c-abcdef012345
+delete chain ip pocket-docker c-abcdef012345
+`
+	if len(r.scripts) != 1 || r.scripts[0] != want {
+		t.Fatalf("unexpected removal script:\n%v", r.scripts)
+	}
+}
+
+func TestNftRemoveMissingIsNoop(t *testing.T) {
+	r := &nftScripts{}
+	fw := &nftFirewall{r: r, list: func(string) (string, error) { return "", nil }}
+	if err := fw.RemoveContainer("ffffffffffff", "10.42.0.9", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.RemoveBridge(Network{Bridge: "pd-web"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.scripts) != 0 {
+		t.Fatalf("nft run without anything to remove: %v", r.scripts)
+	}
+}
+
+func TestNftAddBridgeAndContainer(t *testing.T) {
+	r := &nftScripts{}
+	fw := &nftFirewall{r: r, list: func(string) (string, error) { return "", nil }}
+	if err := fw.AddBridge(DefaultNetwork); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.AddContainer("abcdef0123456789", "10.42.0.5", []PortMap{{Host: 8080, Container: 80}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.AddContainer("abcdef0123456789", "10.42.0.5", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.scripts) != 2 {
+		t.Fatalf("expected one transaction per call with rules, got %d", len(r.scripts))
+	}
+	bridge := r.scripts[0]
+	for _, want := range []string{
+		`insert rule ip pocket-docker forward iifname "pd0" jump b-pd0 comment "bridge:pd0"`,
+		`add rule ip pocket-docker b-pd0 oifname "pd*" drop`,
+		`add rule ip pocket-docker postrouting ip saddr 10.42.0.0/24 oifname != "pd0" masquerade comment "bridge:pd0"`,
+	} {
+		if !strings.Contains(bridge, want) {
+			t.Fatalf("bridge script lacks %q:\n%s", want, bridge)
+		}
+	}
+	ctn := r.scripts[1]
+	for _, want := range []string{
+		`add rule ip pocket-docker c-abcdef012345 tcp dport 8080 dnat to 10.42.0.5:80`,
+		`add rule ip pocket-docker prerouting jump c-abcdef012345 comment "container:abcdef012345"`,
+		`add rule ip pocket-docker output jump c-abcdef012345 comment "container:abcdef012345"`,
+	} {
+		if !strings.Contains(ctn, want) {
+			t.Fatalf("container script lacks %q:\n%s", want, ctn)
+		}
+	}
+}
+
+func TestNftDualStack(t *testing.T) {
+	r := &nftScripts{}
+	var listed []string
+	fw := &nftFirewall{r: r, list: func(table string) (string, error) {
+		listed = append(listed, table)
+		return "", nil
+	}}
+	n := Network{Name: "v6", Bridge: "pd-v6", Subnet: "10.50.0.0/24", Gateway: "10.50.0.1", Subnet6: "fd00:50::/64", Gateway6: "fd00:50::1"}
+	if err := fw.AddBridge(n); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.AddContainer("abcdef0123456789", "fd00:50::5", []PortMap{{Host: 8080, Container: 80}, {HostIP: "127.0.0.1", Host: 9090, Container: 90}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.scripts) != 2 {
+		t.Fatalf("expected one transaction per call, got %d", len(r.scripts))
+	}
+	for _, want := range []string{
+		`add rule ip pocket-docker postrouting ip saddr 10.50.0.0/24 oifname != "pd-v6" masquerade comment "bridge:pd-v6"`,
+		`add rule ip6 pocket-docker postrouting ip6 saddr fd00:50::/64 oifname != "pd-v6" masquerade comment "bridge:pd-v6"`,
+		`insert rule ip6 pocket-docker forward iifname "pd-v6" jump b-pd-v6 comment "bridge:pd-v6"`,
+	} {
+		if !strings.Contains(r.scripts[0], want) {
+			t.Fatalf("bridge script lacks %q:\n%s", want, r.scripts[0])
+		}
+	}
+	ctn := r.scripts[1]
+	for _, want := range []string{
+		`add rule ip6 pocket-docker c-abcdef012345 tcp dport 8080 dnat to [fd00:50::5]:80`,
+		`add rule ip6 pocket-docker postrouting ip6 saddr fd00:50::5 masquerade comment "container:abcdef012345"`,
+	} {
+		if !strings.Contains(ctn, want) {
+			t.Fatalf("container script lacks %q:\n%s", want, ctn)
+		}
+	}
+	if strings.Contains(ctn, "9090") || strings.Contains(ctn, "ip pocket-docker") {
+		t.Fatalf("IPv4 rules in the IPv6 container script:\n%s", ctn)
+	}
+	if listed[len(listed)-1] != nftTable6 {
+		t.Fatalf("container rules looked up in %v", listed)
+	}
+}
+
+func TestNftIsolatedInternal(t *testing.T) {
+	r := &nftScripts{}
+	fw := &nftFirewall{r: r, list: func(string) (string, error) { return "", nil }}
+	n := Network{Name: "ctf", Bridge: "pd-ctf", Subnet: "10.53.0.0/24", Gateway: "10.53.0.1", Isolated: true, Internal: true}
+	if err := fw.AddBridge(n); err != nil {
+		t.Fatal(err)
+	}
+	want := `add chain ip pocket-docker b-pd-ctf
+add rule ip pocket-docker b-pd-ctf oifname "pd*" drop
+add rule ip pocket-docker b-pd-ctf drop
+insert rule ip pocket-docker forward iifname "pd-ctf" jump b-pd-ctf comment "bridge:pd-ctf"
+add rule ip pocket-docker forward oifname "pd-ctf" drop comment "bridge:pd-ctf"
+`
+	if len(r.scripts) != 1 || r.scripts[0] != want {
+		t.Fatalf("unexpected bridge script:\n%v", r.scripts)
+	}
+}
+
+func TestNftEgress(t *testing.T) {
+	r := &nftScripts{}
+	listing := ""
+	fw := &nftFirewall{r: r, list: func(table string) (string, error) {
+		if table != nftTableBridge {
+			t.Fatalf("egress rules looked up in %s", table)
+		}
+		return listing, nil
+	}}
+	egress := []EgressRule{
+		{Net: netip.MustParsePrefix("1.1.1.1/32"), Proto: "udp", Port: 53},
+		{Net: netip.MustParsePrefix("2001:db8::/32"), Proto: "tcp", Port: 8000, PortEnd: 8100},
+	}
+	if err := fw.AddEgress("abcdef0123456789", "vethabcdef01", egress); err != nil {
+		t.Fatal(err)
+	}
+	want := `add chain bridge pocket-docker e-abcdef012345
+add rule bridge pocket-docker e-abcdef012345 ether type arp accept
+add rule bridge pocket-docker e-abcdef012345 ct state established,related accept
+add rule bridge pocket-docker e-abcdef012345 icmpv6 type { nd-router-solicit, nd-neighbor-solicit, nd-neighbor-advert } accept
+add rule bridge pocket-docker e-abcdef012345 ip daddr 1.1.1.1/32 udp dport 53 accept
+add rule bridge pocket-docker e-abcdef012345 ip6 daddr 2001:db8::/32 tcp dport 8000-8100 accept
+add rule bridge pocket-docker e-abcdef012345 drop
+add rule bridge pocket-docker input iifname "vethabcdef01" jump e-abcdef012345 comment "egress:abcdef012345"
+add rule bridge pocket-docker forward iifname "vethabcdef01" jump e-abcdef012345 comment "egress:abcdef012345"
+`
+	if len(r.scripts) != 1 || r.scripts[0] != want {
+		t.Fatalf("unexpected egress script:\n%v", r.scripts)
+	}
+
+	listing = `table bridge pocket-docker {
+	chain input {
+		type filter hook input priority filter; policy accept;
+		iifname "vethabcdef01" jump e-abcdef012345 comment "egress:abcdef012345" # handle 9
+	}
+	chain forward {
+		type filter hook forward priority filter; policy accept;
+		iifname "vethabcdef01" jump e-abcdef012345 comment "egress:abcdef012345" # handle 10
+	}
+	chain e-abcdef012345 {
+		drop # handle 8
+	}
+}
+`
+	if err := fw.RemoveEgress("abcdef0123456789", "vethabcdef01"); err != nil {
+		t.Fatal(err)
+	}
+	want = `delete rule bridge pocket-docker input handle 9
+delete rule bridge pocket-docker forward handle 10
+flush chain bridge pocket-docker e-abcdef012345
+delete chain bridge pocket-docker e-abcdef012345
+`
+	if len(r.scripts) != 2 || r.scripts[1] != want {
+		t.Fatalf("unexpected removal script:\n%v", r.scripts[1:])
+	}
+}
+
+func TestParseBridgeAlias(t *testing.T) {
+	cases := []struct {
+		alias string
+		want  bridgeState
+	}{
+		{"pocket-docker ip_forward=0 firewall=nft\n", bridgeState{ipForward: "0", firewall: "nft"}},
+		{"pocket-docker ip_forward=1", bridgeState{ipForward: "1"}},
+		{"pocket-docker ip_forward= firewall=iptables", bridgeState{firewall: "iptables"}},
+		{"pocket-docker ip_forward=1 ip6_forward=0 firewall=nft", bridgeState{ipForward: "1", ip6Forward: "0", firewall: "nft"}},
+	}
+	for _, c := range cases {
+		s, ok := parseBridgeAlias(c.alias)
+		if !ok || s != c.want {
+			t.Fatalf("parseBridgeAlias(%q) = %+v, %v", c.alias, s, ok)
+		}
+		if c.want.firewall != "" {
+			if again, _ := parseBridgeAlias(bridgeAlias(s)); again != s {
+				t.Fatalf("bridgeAlias(%+v) does not round-trip: %+v", s, again)
+			}
+		}
+	}
+	if _, ok := parseBridgeAlias("docker0"); ok {
+		t.Fatal("foreign alias accepted")
+	}
+}
@@ -0,0 +1,260 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/denysk0/pocketDocker/internal/store"
+)
+
+// PortMap is a published port or port range, in the form it is recorded
+// with the container.
+type PortMap = store.PortMapping
+
+// ParsePortMap parses a --publish value of the form
+// [[hostIP:][hostPort[-end]]:]containerPort[-end][/tcp|udp|sctp], where an
+// IPv6 hostIP is written in brackets as in [::1]:8080:80. Host and
+// container ranges must have the same size. Without a host port Host is
+// zero and AssignHostPorts picks one.
+func ParsePortMap(spec string) (PortMap, error) {
+	var pm PortMap
+	addr, proto, hasProto := strings.Cut(spec, "/")
+	if hasProto {
+		switch proto {
+		case "tcp", "udp", "sctp":
+			pm.Proto = proto
+		default:
+			return PortMap{}, fmt.Errorf("invalid publish %q: unknown protocol %q", spec, proto)
+		}
+	}
+	var parts []string
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]")
+		if end < 0 {
+			return PortMap{}, fmt.Errorf("invalid publish %q: missing ]", spec)
+		}
+		ip := net.ParseIP(addr[1:end])
+		if ip == nil || ip.To4() != nil {
+			return PortMap{}, fmt.Errorf("invalid publish %q: %q is not an IPv6 address", spec, addr[1:end])
+		}
+		if !ip.IsUnspecified() {
+			pm.HostIP = ip.String()
+		}
+		rest, ok := strings.CutPrefix(addr[end+1:], ":")
+		if parts = strings.Split(rest, ":"); !ok || len(parts) != 2 {
+			return PortMap{}, fmt.Errorf("invalid publish %q: want [hostIP]:hostPort:containerPort[/proto]", spec)
+		}
+	} else {
+		parts = strings.Split(addr, ":")
+		switch len(parts) {
+		case 1:
+			parts = []string{"", parts[0]}
+		case 2:
+		case 3:
+			ip := net.ParseIP(parts[0]).To4()
+			if ip == nil {
+				return PortMap{}, fmt.Errorf("invalid publish %q: %q is not an IPv4 address; write IPv6 addresses in brackets", spec, parts[0])
+			}
+			if !ip.IsUnspecified() {
+				pm.HostIP = ip.String()
+			}
+			parts = parts[1:]
+		default:
+			return PortMap{}, fmt.Errorf("invalid publish %q: want [hostIP:]hostPort:containerPort[/proto]", spec)
+		}
+	}
+	var err error
+	if pm.Container, pm.ContainerEnd, err = parsePortRange(parts[1]); err != nil {
+		return PortMap{}, fmt.Errorf("invalid publish %q: %w", spec, err)
+	}
+	if parts[0] == "" {
+		return pm, nil
+	}
+	if pm.Host, pm.HostEnd, err = parsePortRange(parts[0]); err != nil {
+		return PortMap{}, fmt.Errorf("invalid publish %q: %w", spec, err)
+	}
+	if rangeSize(pm.Host, pm.HostEnd) != rangeSize(pm.Container, pm.ContainerEnd) {
+		return PortMap{}, fmt.Errorf("invalid publish %q: host and container port ranges differ in size", spec)
+	}
+	return pm, nil
+}
+
+// parsePortRange parses "port" or "start-end". end is zero for a single port.
+func parsePortRange(s string) (start, end int, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if start, err = parsePort(first); err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return start, 0, nil
+	}
+	if end, err = parsePort(last); err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("port range %s ends before it starts", s)
+	}
+	if end == start {
+		end = 0
+	}
+	return start, end, nil
+}
+
+func rangeSize(start, end int) int {
+	if end > start {
+		return end - start + 1
+	}
+	return 1
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil || p < 1 || p > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return p, nil
+}
+
+// portPairs returns the host and container port of every port in pm.
+func portPairs(pm PortMap) [][2]int {
+	pairs := make([][2]int, rangeSize(pm.Host, pm.HostEnd))
+	for i := range pairs {
+		pairs[i] = [2]int{pm.Host + i, pm.Container + i}
+	}
+	return pairs
+}
+
+// lastHost returns the last host port published by pm.
+func lastHost(pm PortMap) int {
+	return pm.Host + rangeSize(pm.Host, pm.HostEnd) - 1
+}
+
+// portsOverlap reports whether a and b publish a common host port. An empty
+// host IP binds every address and so overlaps any other.
+func portsOverlap(a, b PortMap) bool {
+	if a.Protocol() != b.Protocol() {
+		return false
+	}
+	if a.HostIP != "" && b.HostIP != "" && a.HostIP != b.HostIP {
+		return false
+	}
+	return a.Host <= lastHost(b) && b.Host <= lastHost(a)
+}
+
+// hostPortFree reports whether no socket on the host is bound to port. It is
+// a variable so tests can avoid binding real ports.
+var hostPortFree = func(proto, hostIP string, port int) bool {
+	addr := net.JoinHostPort(hostIP, strconv.Itoa(port))
+	var err error
+	switch proto {
+	case "tcp":
+		var l net.Listener
+		if l, err = net.Listen(ipNetwork("tcp", hostIP), addr); err == nil {
+			l.Close()
+		}
+	case "udp":
+		var c net.PacketConn
+		if c, err = net.ListenPacket(ipNetwork("udp", hostIP), addr); err == nil {
+			c.Close()
+		}
+	}
+	// Other errors, such as EACCES for privileged ports when not root, say
+	// nothing about the port being taken.
+	return !errors.Is(err, syscall.EADDRINUSE)
+}
+
+// ipNetwork returns the network of proto to listen on hostIP with: IPv6
+// for an IPv6 address and IPv4 otherwise, as published ports without an
+// address are forwarded for IPv4.
+func ipNetwork(proto, hostIP string) string {
+	if isIPv6(hostIP) {
+		return proto + "6"
+	}
+	return proto + "4"
+}
+
+// localPortRangePath holds the ephemeral port range of the host.
+var localPortRangePath = "/proc/sys/net/ipv4/ip_local_port_range"
+
+// localPortRange returns the ephemeral port range of the host.
+func localPortRange() (int, int) {
+	lo, hi := 32768, 60999
+	data, err := os.ReadFile(localPortRangePath)
+	if err != nil {
+		return lo, hi
+	}
+	f := strings.Fields(string(data))
+	if len(f) == 2 {
+		a, err1 := strconv.Atoi(f[0])
+		b, err2 := strconv.Atoi(f[1])
+		if err1 == nil && err2 == nil && a > 0 && a <= b {
+			return a, b
+		}
+	}
+	return lo, hi
+}
+
+// AssignHostPorts picks free ephemeral host ports for mappings without a
+// host port and checks that no mapping collides with used, the mappings of
+// other containers, with another mapping in ports or with a socket already
+// bound on the host. It returns ports with every host port filled in.
+func AssignHostPorts(ports, used []PortMap) ([]PortMap, error) {
+	taken := append([]PortMap(nil), used...)
+	out := make([]PortMap, 0, len(ports))
+	for _, pm := range ports {
+		if pm.Host == 0 {
+			var err error
+			if pm, err = pickHostPorts(pm, taken); err != nil {
+				return nil, err
+			}
+		} else if err := checkHostPorts(pm, taken); err != nil {
+			return nil, err
+		}
+		taken = append(taken, pm)
+		out = append(out, pm)
+	}
+	return out, nil
+}
+
+// checkHostPorts returns an error if a host port of pm is taken.
+func checkHostPorts(pm PortMap, taken []PortMap) error {
+	for _, t := range taken {
+		if portsOverlap(pm, t) {
+			return fmt.Errorf("port conflict: %s is already published as %s", pm.HostString(), t.HostString())
+		}
+	}
+	for port := pm.Host; port <= lastHost(pm); port++ {
+		if !hostPortFree(pm.Protocol(), pm.HostIP, port) {
+			return fmt.Errorf("port conflict: %s is already in use on the host", PortMap{HostIP: pm.HostIP, Host: port, Proto: pm.Proto}.HostString())
+		}
+	}
+	return nil
+}
+
+// pickHostPorts assigns pm a run of free host ports from the ephemeral
+// range, starting the search at a random port.
+func pickHostPorts(pm PortMap, taken []PortMap) (PortMap, error) {
+	lo, hi := localPortRange()
+	size := rangeSize(pm.Container, pm.ContainerEnd)
+	span := hi - lo + 2 - size
+	if span > 0 {
+		offset := rand.Intn(span)
+		for i := 0; i < span; i++ {
+			pm.Host = lo + (offset+i)%span
+			pm.HostEnd = 0
+			if size > 1 {
+				pm.HostEnd = pm.Host + size - 1
+			}
+			if checkHostPorts(pm, taken) == nil {
+				return pm, nil
+			}
+		}
+	}
+	return PortMap{}, fmt.Errorf("no free host port for %s", pm.ContainerString())
+}
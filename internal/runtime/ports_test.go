@@ -0,0 +1,144 @@
+package runtime
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePortMap(t *testing.T) {
+	cases := []struct {
+		spec string
+		want PortMap
+	}{
+		{"8080:80", PortMap{Host: 8080, Container: 80}},
+		{"53:53/udp", PortMap{Host: 53, Container: 53, Proto: "udp"}},
+		{"127.0.0.1:8000-8002:80-82/sctp", PortMap{HostIP: "127.0.0.1", Host: 8000, HostEnd: 8002, Container: 80, ContainerEnd: 82, Proto: "sctp"}},
+		{"0.0.0.0:9000-9000:90", PortMap{Host: 9000, Container: 90}},
+		{"80", PortMap{Container: 80}},
+		{"127.0.0.1::80-81/udp", PortMap{HostIP: "127.0.0.1", Container: 80, ContainerEnd: 81, Proto: "udp"}},
+		{"[fd00:0::1]:8080:80", PortMap{HostIP: "fd00::1", Host: 8080, Container: 80}},
+		{"[::]:8080:80/udp", PortMap{Host: 8080, Container: 80, Proto: "udp"}},
+		{"[::1]::80", PortMap{HostIP: "::1", Container: 80}},
+	}
+	for _, c := range cases {
+		got, err := ParsePortMap(c.spec)
+		if err != nil {
+			t.Fatalf("ParsePortMap(%q): %v", c.spec, err)
+		}
+		if got != c.want {
+			t.Fatalf("ParsePortMap(%q) = %+v, want %+v", c.spec, got, c.want)
+		}
+	}
+	for _, spec := range []string{"http", ":", "8080:80/icmp", "8000-8001:80", "::1:80:80", "host:80:80", "0:80", "90-80:90-80", "8080:70000", "[::1:80:80", "[::1]:80", "[::1]8080:80", "[127.0.0.1]:80:80", "[::1]:80:80:80"} {
+		if _, err := ParsePortMap(spec); err == nil {
+			t.Fatalf("ParsePortMap(%q) accepted", spec)
+		}
+	}
+}
+
+func TestPortRulesRangeAndProto(t *testing.T) {
+	pm, err := ParsePortMap("127.0.0.1:5000-5001:6000-6001/udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := portRules("10.42.0.7", []PortMap{pm})
+	want := [][]string{
+		{"-t", "nat", "-A", "PREROUTING", "-p", "udp", "-d", "127.0.0.1/32", "-m", "udp", "--dport", "5000", "-j", "DNAT", "--to-destination", "10.42.0.7:6000"},
+		{"-t", "nat", "-A", "OUTPUT", "-p", "udp", "-d", "127.0.0.1/32", "-m", "udp", "--dport", "5000", "-j", "DNAT", "--to-destination", "10.42.0.7:6000"},
+		{"-t", "nat", "-A", "PREROUTING", "-p", "udp", "-d", "127.0.0.1/32", "-m", "udp", "--dport", "5001", "-j", "DNAT", "--to-destination", "10.42.0.7:6001"},
+		{"-t", "nat", "-A", "OUTPUT", "-p", "udp", "-d", "127.0.0.1/32", "-m", "udp", "--dport", "5001", "-j", "DNAT", "--to-destination", "10.42.0.7:6001"},
+		{"-t", "nat", "-A", "POSTROUTING", "-s", "10.42.0.7/32", "-j", "MASQUERADE"},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("portRules:\n%v\nwant\n%v", rules, want)
+	}
+
+	r := &nftScripts{}
+	fw := &nftFirewall{r: r, list: func(string) (string, error) { return "", nil }}
+	if err := fw.AddContainer("abcdef0123456789", "10.42.0.7", []PortMap{pm}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{
+		"c-abcdef012345 ip daddr 127.0.0.1 udp dport 5000 dnat to 10.42.0.7:6000",
+		"c-abcdef012345 ip daddr 127.0.0.1 udp dport 5001 dnat to 10.42.0.7:6001",
+	} {
+		if !strings.Contains(r.scripts[0], rule) {
+			t.Fatalf("nft script lacks %q:\n%s", rule, r.scripts[0])
+		}
+	}
+}
+
+func TestPortRulesIPv6HostIP(t *testing.T) {
+	pm, err := ParsePortMap("[fd00::1]:8080:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.HostString(); got != "[fd00::1]:8080/tcp" {
+		t.Fatalf("HostString = %s", got)
+	}
+	// Only the IPv6 address of the container is published on it.
+	if rules := portRules("10.42.0.7", []PortMap{pm}); len(rules) != 0 {
+		t.Fatalf("IPv4 rules for an IPv6 host IP: %v", rules)
+	}
+	want := []string{"-t", "nat", "-A", "PREROUTING", "-p", "tcp", "-d", "fd00::1/128", "-m", "tcp", "--dport", "8080", "-j", "DNAT", "--to-destination", "[fd00:42::7]:80"}
+	if rules := portRules("fd00:42::7", []PortMap{pm}); len(rules) != 3 || !reflect.DeepEqual(rules[0], want) {
+		t.Fatalf("portRules = %v", rules)
+	}
+	r := &nftScripts{}
+	fw := &nftFirewall{r: r, list: func(string) (string, error) { return "", nil }}
+	if err := fw.AddContainer("abcdef0123456789", "fd00:42::7", []PortMap{pm}); err != nil {
+		t.Fatal(err)
+	}
+	if rule := "c-abcdef012345 ip6 daddr fd00::1 tcp dport 8080 dnat to [fd00:42::7]:80"; !strings.Contains(r.scripts[0], rule) {
+		t.Fatalf("nft script lacks %q:\n%s", rule, r.scripts[0])
+	}
+}
+
+func TestAssignHostPorts(t *testing.T) {
+	busy := map[int]bool{40001: true}
+	oldFree, oldRange := hostPortFree, localPortRangePath
+	defer func() { hostPortFree, localPortRangePath = oldFree, oldRange }()
+	hostPortFree = func(proto, hostIP string, port int) bool { return !busy[port] }
+	localPortRangePath = filepath.Join(t.TempDir(), "range")
+	if err := os.WriteFile(localPortRangePath, []byte("40000\t40003\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	used := []PortMap{{Host: 8080, Container: 80}, {HostIP: "127.0.0.1", Host: 40000, Container: 80, Proto: "udp"}}
+
+	for _, spec := range []string{"8080:8080", "127.0.0.1:8079-8080:79-80", "40001:80"} {
+		pm, _ := ParsePortMap(spec)
+		if _, err := AssignHostPorts([]PortMap{pm}, used); err == nil || !strings.Contains(err.Error(), "port conflict") {
+			t.Fatalf("%s: expected port conflict, got %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"8080:80/udp", "10.0.0.1:40000:80/udp", "8081:80"} {
+		pm, _ := ParsePortMap(spec)
+		if _, err := AssignHostPorts([]PortMap{pm}, used); err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+	}
+
+	// Only 40001 is taken for tcp, so the automatic ports come from 40000,
+	// 40002 and 40003 and must differ.
+	a, _ := ParsePortMap("80")
+	b, _ := ParsePortMap("81")
+	got, err := AssignHostPorts([]PortMap{a, b}, used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].Host == got[1].Host || got[0].Host == 40001 || got[1].Host == 40001 {
+		t.Fatalf("bad assignment: %+v", got)
+	}
+	for _, pm := range got {
+		if pm.Host < 40000 || pm.Host > 40003 {
+			t.Fatalf("host port %d outside the ephemeral range", pm.Host)
+		}
+	}
+	r, _ := ParsePortMap("80-83")
+	if _, err := AssignHostPorts([]PortMap{r}, used); err == nil {
+		t.Fatal("expected no free range of four ports")
+	}
+}
@@ -0,0 +1,370 @@
+//go:build linux
+
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// udpIdleTimeout is how long a UDP client keeps its socket to the container
+// without traffic.
+const udpIdleTimeout = 90 * time.Second
+
+// PortProxy publishes ports by accepting connections on the host and
+// forwarding them from userspace to sockets in the network namespace of the
+// container. It needs neither root nor a firewall.
+type PortProxy struct {
+	sockets   netnsSockets
+	target    net.IP
+	listeners []io.Closer
+	wg        sync.WaitGroup
+}
+
+// netnsSockets creates sockets in the network namespace of the container.
+type netnsSockets interface {
+	socket(typ int) (int, error)
+	Close() error
+}
+
+// StartPortProxy listens on the host ports of ports and forwards them to ip
+// inside the network namespace of pid, or to its loopback if ip is empty.
+// Root enters the namespace itself; other users cannot, so the sockets are
+// created by helper, a command run in the namespaces of pid with nsenter.
+func StartPortProxy(pid int, ip string, ports []PortMap, helper []string) (*PortProxy, error) {
+	target := net.IPv4(127, 0, 0, 1)
+	if ip != "" {
+		if target = net.ParseIP(ip).To4(); target == nil {
+			return nil, fmt.Errorf("invalid container address %q", ip)
+		}
+	}
+	for _, pm := range ports {
+		if pm.Protocol() == "sctp" {
+			return nil, fmt.Errorf("%s: sctp ports cannot be proxied", pm.ContainerString())
+		}
+	}
+	var sockets netnsSockets
+	if os.Geteuid() == 0 {
+		// Services bound to localhost are only reachable with lo up.
+		_ = netlinkOps{}.SetUp(pid, "lo")
+		sockets = setnsSockets(pid)
+	} else {
+		var err error
+		if sockets, err = startSocketHelper(pid, helper); err != nil {
+			return nil, err
+		}
+	}
+	p := &PortProxy{sockets: sockets, target: target}
+	for _, pm := range ports {
+		for _, pair := range portPairs(pm) {
+			addr := net.JoinHostPort(pm.HostIP, strconv.Itoa(pair[0]))
+			if err := p.listen(pm.Protocol(), addr, pair[1]); err != nil {
+				p.Close()
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+func (p *PortProxy) listen(proto, addr string, port int) error {
+	host, _, _ := net.SplitHostPort(addr)
+	switch proto {
+	case "tcp":
+		l, err := net.Listen(ipNetwork("tcp", host), addr)
+		if err != nil {
+			return err
+		}
+		p.listeners = append(p.listeners, l)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			proxyTCP(l, func() (net.Conn, error) { return p.dial(unix.SOCK_STREAM, port) })
+		}()
+	case "udp":
+		pc, err := net.ListenPacket(ipNetwork("udp", host), addr)
+		if err != nil {
+			return err
+		}
+		p.listeners = append(p.listeners, pc)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			proxyUDP(pc, func() (net.Conn, error) { return p.dial(unix.SOCK_DGRAM, port) })
+		}()
+	}
+	return nil
+}
+
+// dial connects a socket created in the container namespace to port of the
+// target address. Connecting uses the namespace of the socket, not the one
+// of the calling thread.
+func (p *PortProxy) dial(typ, port int) (net.Conn, error) {
+	fd, err := p.sockets.socket(typ)
+	if err != nil {
+		return nil, err
+	}
+	sa := &unix.SockaddrInet4{Port: port}
+	copy(sa.Addr[:], p.target.To4())
+	if err := unix.Connect(fd, sa); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "netns-socket")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// Close stops listening and waits for the listeners to shut down. Open TCP
+// connections are left to finish.
+func (p *PortProxy) Close() error {
+	for _, l := range p.listeners {
+		l.Close()
+	}
+	p.wg.Wait()
+	return p.sockets.Close()
+}
+
+func proxyTCP(l net.Listener, dial func() (net.Conn, error)) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			backend, err := dial()
+			if err != nil {
+				return
+			}
+			defer backend.Close()
+			done := make(chan struct{})
+			go func() {
+				copyAndCloseWrite(backend, c)
+				close(done)
+			}()
+			copyAndCloseWrite(c, backend)
+			<-done
+		}()
+	}
+}
+
+// copyAndCloseWrite copies src to dst and then half-closes dst so the peer
+// sees the end of the stream while the other direction continues.
+func copyAndCloseWrite(dst, src net.Conn) {
+	_, _ = io.Copy(dst, src)
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// proxyUDP forwards datagrams of every client through a socket of its own,
+// so replies can be sent back to the right client.
+func proxyUDP(pc net.PacketConn, dial func() (net.Conn, error)) {
+	var mu sync.Mutex
+	sessions := map[string]net.Conn{}
+	defer func() {
+		mu.Lock()
+		for _, c := range sessions {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := client.String()
+		mu.Lock()
+		backend, ok := sessions[key]
+		if !ok {
+			if backend, err = dial(); err != nil {
+				mu.Unlock()
+				continue
+			}
+			sessions[key] = backend
+			go func() {
+				reply := make([]byte, 65535)
+				for {
+					backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+					n, err := backend.Read(reply)
+					if err != nil {
+						break
+					}
+					if _, err := pc.WriteTo(reply[:n], client); err != nil {
+						break
+					}
+				}
+				mu.Lock()
+				if sessions[key] == backend {
+					delete(sessions, key)
+				}
+				mu.Unlock()
+				backend.Close()
+			}()
+		}
+		mu.Unlock()
+		backend.Write(buf[:n])
+	}
+}
+
+// setnsSockets creates sockets on a thread switched to the namespace of a
+// pid, which requires CAP_SYS_ADMIN on the host.
+type setnsSockets int
+
+func (s setnsSockets) socket(typ int) (int, error) {
+	var fd int
+	err := inNetns(int(s), func() error {
+		var err error
+		fd, err = unix.Socket(unix.AF_INET, typ|unix.SOCK_CLOEXEC, 0)
+		return err
+	})
+	return fd, err
+}
+
+func (setnsSockets) Close() error { return nil }
+
+// helperSockets asks a helper process running inside the user and network
+// namespaces of the container for file descriptors. A request is one byte:
+// 's' or 'd' for a stream or datagram socket, 't' for the configured slirp
+// tap device. The reply is a zero byte carrying the descriptor as
+// SCM_RIGHTS, or a one byte followed by an error message.
+type helperSockets struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+	cmd  *exec.Cmd
+}
+
+// startSocketHelper runs helper in the namespaces of pid with the other end
+// of a socket pair as file descriptor 3.
+func startSocketHelper(pid int, helper []string) (*helperSockets, error) {
+	if len(helper) == 0 {
+		return nil, errors.New("rootless port publishing needs a socket helper")
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "socket-helper")
+	remote := os.NewFile(uintptr(fds[1]), "socket-helper")
+	defer local.Close()
+	defer remote.Close()
+	args := append([]string{"--preserve-credentials", "--user", "--net", "--target", strconv.Itoa(pid), "--"}, helper...)
+	cmd := exec.Command("nsenter", args...)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start socket helper: %w", err)
+	}
+	c, err := net.FileConn(local)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	return &helperSockets{conn: c.(*net.UnixConn), cmd: cmd}, nil
+}
+
+func (h *helperSockets) socket(typ int) (int, error) {
+	if typ == unix.SOCK_DGRAM {
+		return h.request('d')
+	}
+	return h.request('s')
+}
+
+func (h *helperSockets) request(req byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.conn.Write([]byte{req}); err != nil {
+		return -1, err
+	}
+	buf := make([]byte, 512)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := h.conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, io.ErrUnexpectedEOF
+	}
+	if buf[0] != 0 {
+		return -1, fmt.Errorf("socket helper: %s", buf[1:n])
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return -1, errors.New("socket helper: no descriptor in reply")
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return -1, errors.New("socket helper: no descriptor in reply")
+	}
+	unix.CloseOnExec(fds[0])
+	return fds[0], nil
+}
+
+func (h *helperSockets) Close() error {
+	h.conn.Close()
+	return h.cmd.Wait()
+}
+
+// ServeNetnsSockets is the socket helper: it brings up lo and answers the
+// requests of a PortProxy or StartSlirp on conn until it is closed. It must
+// run inside the namespaces of the container.
+func ServeNetnsSockets(conn *os.File) error {
+	_ = netlinkOps{}.SetUp(0, "lo")
+	c, err := net.FileConn(conn)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return errors.New("socket helper: not a unix socket")
+	}
+	req := make([]byte, 1)
+	for {
+		if _, err := uc.Read(req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var fd int
+		switch req[0] {
+		case 't':
+			if fd, err = openTap(slirpTap); err == nil {
+				if err = configureTap(0); err != nil {
+					unix.Close(fd)
+				}
+			}
+		case 'd':
+			fd, err = unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+		default:
+			fd, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		}
+		if err != nil {
+			if _, err := uc.Write(append([]byte{1}, err.Error()...)); err != nil {
+				return err
+			}
+			continue
+		}
+		_, _, err = uc.WriteMsgUnix([]byte{0}, unix.UnixRights(fd), nil)
+		unix.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+}
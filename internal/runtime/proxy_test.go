@@ -0,0 +1,159 @@
+package runtime
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// echoTCP serves l by echoing every line.
+func echoTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+func roundTrip(t *testing.T, network, addr, msg string) {
+	t.Helper()
+	c, err := net.DialTimeout(network, addr, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Write([]byte(msg + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || got != msg+"\n" {
+		t.Fatalf("%s echo = %q, %v", network, got, err)
+	}
+}
+
+func TestProxyTCPAndUDP(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go echoTCP(backend)
+	front, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	go proxyTCP(front, func() (net.Conn, error) { return net.Dial("tcp4", backend.Addr().String()) })
+	roundTrip(t, "tcp4", front.Addr().String(), "hello")
+
+	udpBackend, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpBackend.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpBackend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpBackend.WriteTo(buf[:n], addr)
+		}
+	}()
+	udpFront, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpFront.Close()
+	go proxyUDP(udpFront, func() (net.Conn, error) { return net.Dial("udp4", udpBackend.LocalAddr().String()) })
+	roundTrip(t, "udp4", udpFront.LocalAddr().String(), "ping")
+	roundTrip(t, "udp4", udpFront.LocalAddr().String(), "pong")
+}
+
+func TestSocketHelperPassesSockets(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ServeNetnsSockets(os.NewFile(uintptr(fds[1]), "helper")) }()
+	local := os.NewFile(uintptr(fds[0]), "client")
+	c, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &helperSockets{conn: c.(*net.UnixConn)}
+	for _, typ := range []int{unix.SOCK_STREAM, unix.SOCK_DGRAM} {
+		fd, err := h.socket(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+		unix.Close(fd)
+		if err != nil || got != typ {
+			t.Fatalf("received socket of type %d, want %d (%v)", got, typ, err)
+		}
+	}
+	h.conn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("helper: %v", err)
+	}
+}
+
+func TestStartPortProxyNetns(t *testing.T) {
+	if os.Geteuid() != 0 || !netlinkAvailable() {
+		t.Skip("requires root and rtnetlink")
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not found")
+	}
+	ctn := exec.Command("unshare", "-n", "sleep", "30")
+	if err := ctn.Start(); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	defer func() { ctn.Process.Kill(); ctn.Wait() }()
+	pid := ctn.Process.Pid
+	waitNetns(t, pid)
+
+	free, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	p, err := StartPortProxy(pid, "", []PortMap{{HostIP: "127.0.0.1", Host: hostPort, Container: 8080}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The service only exists inside the container namespace, on its
+	// loopback which the proxy brought up.
+	var srv net.Listener
+	if err := inNetns(pid, func() error {
+		var err error
+		srv, err = net.Listen("tcp4", "127.0.0.1:8080")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go echoTCP(srv)
+	roundTrip(t, "tcp4", "127.0.0.1:"+strconv.Itoa(hostPort), "through the namespace")
+}
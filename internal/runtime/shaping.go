@@ -0,0 +1,119 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NetShape is the traffic shaping of the network interface of a container.
+// It applies to each direction separately: with a Delay of 50ms a round
+// trip takes 100ms longer. Zero fields leave that aspect alone.
+type NetShape struct {
+	// Rate is the bandwidth in bits per second.
+	Rate  uint64
+	Delay time.Duration
+	// Loss is the percentage of packets dropped.
+	Loss float64
+}
+
+// rateUnits are the units accepted by ParseRate, as used by tc, with their
+// value in bits per second.
+var rateUnits = []struct {
+	suffix string
+	bits   uint64
+}{
+	{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// ParseNetShape parses the --net-rate, --net-delay and --net-loss values of
+// run; empty values are not shaped.
+func ParseNetShape(rate, delay, loss string) (NetShape, error) {
+	var s NetShape
+	var err error
+	if rate != "" {
+		if s.Rate, err = ParseRate(rate); err != nil {
+			return NetShape{}, err
+		}
+	}
+	if delay != "" {
+		if s.Delay, err = time.ParseDuration(delay); err != nil || s.Delay < 0 {
+			return NetShape{}, fmt.Errorf("invalid delay %q: want a duration such as 50ms", delay)
+		}
+	}
+	if loss != "" {
+		s.Loss, err = strconv.ParseFloat(strings.TrimSuffix(loss, "%"), 64)
+		if err != nil || s.Loss < 0 || s.Loss > 100 {
+			return NetShape{}, fmt.Errorf("invalid loss %q: want a percentage such as 1%%", loss)
+		}
+	}
+	return s, nil
+}
+
+// ParseRate parses a bandwidth with a tc unit, e.g. 10mbit or 500kbps.
+// Units are decimal and case-insensitive; bit units count bits, bps units
+// bytes.
+func ParseRate(s string) (uint64, error) {
+	lower := strings.ToLower(s)
+	for _, u := range rateUnits {
+		num, ok := strings.CutSuffix(lower, u.suffix)
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(num, 64)
+		if err != nil || v <= 0 {
+			break
+		}
+		if bits := v * float64(u.bits); bits >= 8 && bits < 1<<63 {
+			return uint64(bits), nil
+		}
+		break
+	}
+	return 0, fmt.Errorf("invalid rate %q: want a number with a unit such as 10mbit or 500kbps", s)
+}
+
+// IsZero reports whether s shapes nothing.
+func (s NetShape) IsZero() bool {
+	return s == NetShape{}
+}
+
+// RateString formats the rate with the largest bit unit that divides it,
+// or "" if the rate is not limited.
+func (s NetShape) RateString() string {
+	if s.Rate == 0 {
+		return ""
+	}
+	for _, u := range rateUnits[:5] {
+		if s.Rate%u.bits == 0 {
+			return strconv.FormatUint(s.Rate/u.bits, 10) + u.suffix
+		}
+	}
+	return ""
+}
+
+// DelayString formats the delay, or "" if there is none.
+func (s NetShape) DelayString() string {
+	if s.Delay == 0 {
+		return ""
+	}
+	return s.Delay.String()
+}
+
+// LossString formats the loss as a percentage, or "" if there is none.
+func (s NetShape) LossString() string {
+	if s.Loss == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(s.Loss, 'g', -1, 64) + "%"
+}
+
+// tbfParams returns the bucket size and the queue limit in bytes of the
+// token bucket for rate bits per second: the bucket holds 10ms of traffic
+// but at least two full frames, the queue another 50ms.
+func tbfParams(rate uint64) (burst, limit uint64) {
+	bytes := rate / 8
+	burst = max(bytes/100, 2*1514)
+	return burst, bytes/20 + burst
+}
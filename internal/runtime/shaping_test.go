@@ -0,0 +1,39 @@
+package runtime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNetShape(t *testing.T) {
+	cases := []struct {
+		rate, delay, loss string
+		want              NetShape
+		rateStr, lossStr  string
+	}{
+		{"10mbit", "50ms", "1%", NetShape{Rate: 10e6, Delay: 50 * time.Millisecond, Loss: 1}, "10mbit", "1%"},
+		{"500kbps", "", "", NetShape{Rate: 4e6}, "4mbit", ""},
+		{"1.5Mbit", "", "0.5", NetShape{Rate: 1.5e6, Loss: 0.5}, "1500kbit", "0.5%"},
+		{"", "1s", "", NetShape{Delay: time.Second}, "", ""},
+	}
+	for _, c := range cases {
+		got, err := ParseNetShape(c.rate, c.delay, c.loss)
+		if err != nil {
+			t.Fatalf("ParseNetShape(%q, %q, %q): %v", c.rate, c.delay, c.loss, err)
+		}
+		if got != c.want {
+			t.Fatalf("ParseNetShape(%q, %q, %q) = %+v, want %+v", c.rate, c.delay, c.loss, got, c.want)
+		}
+		if got.RateString() != c.rateStr || got.LossString() != c.lossStr {
+			t.Fatalf("%+v formatted as %q, %q", got, got.RateString(), got.LossString())
+		}
+	}
+	for _, bad := range [][3]string{{"10", "", ""}, {"fast", "", ""}, {"0mbit", "", ""}, {"", "50", ""}, {"", "-1ms", ""}, {"", "", "101%"}, {"", "", "x"}} {
+		if _, err := ParseNetShape(bad[0], bad[1], bad[2]); err == nil {
+			t.Fatalf("ParseNetShape(%q) accepted", bad)
+		}
+	}
+	if s, _ := ParseNetShape("", "", ""); !s.IsZero() {
+		t.Fatalf("empty flags shape %+v", s)
+	}
+}
@@ -0,0 +1,205 @@
+//go:build linux
+
+package slirp
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+const (
+	etherHeaderLen = 14
+	ipv4HeaderLen  = 20
+	udpHeaderLen   = 8
+	tcpHeaderLen   = 20
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+
+	protoICMP = 1
+	protoTCP  = 6
+	protoUDP  = 17
+)
+
+// TCP flags.
+const (
+	flagFIN = 0x01
+	flagSYN = 0x02
+	flagRST = 0x04
+	flagPSH = 0x08
+	flagACK = 0x10
+)
+
+// ipv4 is a parsed IPv4 packet.
+type ipv4 struct {
+	proto    uint8
+	src, dst netip.Addr
+	payload  []byte
+}
+
+// parseIPv4 parses the IPv4 packet b. Fragments and packets with options
+// that do not fit are rejected.
+func parseIPv4(b []byte) (ipv4, bool) {
+	if len(b) < ipv4HeaderLen || b[0]>>4 != 4 {
+		return ipv4{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < ipv4HeaderLen || total < ihl || total > len(b) {
+		return ipv4{}, false
+	}
+	// More fragments set or a fragment offset: reassembly is not supported.
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return ipv4{}, false
+	}
+	return ipv4{
+		proto:   b[9],
+		src:     netip.AddrFrom4([4]byte(b[12:16])),
+		dst:     netip.AddrFrom4([4]byte(b[16:20])),
+		payload: b[ihl:total],
+	}, true
+}
+
+// tcpSegment is a parsed TCP segment.
+type tcpSegment struct {
+	srcPort, dstPort uint16
+	seq, ack         uint32
+	flags            uint8
+	window           uint16
+	mss              uint16
+	payload          []byte
+}
+
+func parseTCP(b []byte) (tcpSegment, bool) {
+	if len(b) < tcpHeaderLen {
+		return tcpSegment{}, false
+	}
+	off := int(b[12]>>4) * 4
+	if off < tcpHeaderLen || off > len(b) {
+		return tcpSegment{}, false
+	}
+	seg := tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		payload: b[off:],
+	}
+	opts := b[tcpHeaderLen:off]
+	for len(opts) > 0 {
+		kind := opts[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) < 2 || int(opts[1]) > len(opts) {
+			break
+		}
+		if kind == 2 && opts[1] == 4 {
+			seg.mss = binary.BigEndian.Uint16(opts[2:4])
+		}
+		opts = opts[opts[1]:]
+	}
+	return seg, true
+}
+
+// checksum returns the internet checksum of b added to the partial sum.
+func checksum(b []byte, sum uint32) uint16 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum is the partial checksum of the IPv4 pseudo header of a
+// TCP or UDP packet of length bytes.
+func pseudoHeaderSum(src, dst netip.Addr, proto uint8, length int) uint32 {
+	s, d := src.As4(), dst.As4()
+	return uint32(binary.BigEndian.Uint16(s[0:2])) + uint32(binary.BigEndian.Uint16(s[2:4])) +
+		uint32(binary.BigEndian.Uint16(d[0:2])) + uint32(binary.BigEndian.Uint16(d[2:4])) +
+		uint32(proto) + uint32(length)
+}
+
+// buildTCP encodes a TCP segment from src to dst. A non-zero mss adds the
+// MSS option.
+func buildTCP(src, dst netip.AddrPort, seq, ack uint32, flags uint8, window uint16, mss uint16, payload []byte) []byte {
+	hl := tcpHeaderLen
+	if mss != 0 {
+		hl += 4
+	}
+	b := make([]byte, hl+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], src.Port())
+	binary.BigEndian.PutUint16(b[2:4], dst.Port())
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	binary.BigEndian.PutUint32(b[8:12], ack)
+	b[12] = byte(hl/4) << 4
+	b[13] = flags
+	binary.BigEndian.PutUint16(b[14:16], window)
+	if mss != 0 {
+		b[20], b[21] = 2, 4
+		binary.BigEndian.PutUint16(b[22:24], mss)
+	}
+	copy(b[hl:], payload)
+	binary.BigEndian.PutUint16(b[16:18], checksum(b, pseudoHeaderSum(src.Addr(), dst.Addr(), protoTCP, len(b))))
+	return b
+}
+
+// buildUDP encodes a UDP datagram from src to dst.
+func buildUDP(src, dst netip.AddrPort, payload []byte) []byte {
+	b := make([]byte, udpHeaderLen+len(payload))
+	binary.BigEndian.PutUint16(b[0:2], src.Port())
+	binary.BigEndian.PutUint16(b[2:4], dst.Port())
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)))
+	copy(b[udpHeaderLen:], payload)
+	sum := checksum(b, pseudoHeaderSum(src.Addr(), dst.Addr(), protoUDP, len(b)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return b
+}
+
+// buildIPv4 wraps payload in an IPv4 header.
+func buildIPv4(id uint16, proto uint8, src, dst netip.Addr, payload []byte) []byte {
+	b := make([]byte, ipv4HeaderLen+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:6], id)
+	b[6] = 0x40 // don't fragment
+	b[8] = 64
+	b[9] = proto
+	s, d := src.As4(), dst.As4()
+	copy(b[12:16], s[:])
+	copy(b[16:20], d[:])
+	binary.BigEndian.PutUint16(b[10:12], checksum(b[:ipv4HeaderLen], 0))
+	copy(b[ipv4HeaderLen:], payload)
+	return b
+}
+
+// buildEther wraps payload in an Ethernet header.
+func buildEther(dst, src [6]byte, etherType uint16, payload []byte) []byte {
+	b := make([]byte, etherHeaderLen+len(payload))
+	copy(b[0:6], dst[:])
+	copy(b[6:12], src[:])
+	binary.BigEndian.PutUint16(b[12:14], etherType)
+	copy(b[etherHeaderLen:], payload)
+	return b
+}
+
+// seqLT reports whether sequence number a comes before b.
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+
+// seqLE reports whether sequence number a does not come after b.
+func seqLE(a, b uint32) bool { return int32(a-b) <= 0 }
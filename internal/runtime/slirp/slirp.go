@@ -0,0 +1,259 @@
+//go:build linux
+
+// Package slirp is a user-mode network stack: it terminates the TCP and UDP
+// traffic a container sends to a tap device and replays it with ordinary
+// host sockets, so containers get outbound connectivity without any
+// privileges on the host. It uses the addresses of slirp4netns.
+package slirp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Subnet is the network between the container and the stack.
+	Subnet = netip.MustParsePrefix("10.0.2.0/24")
+	// Gateway is the default route of the container.
+	Gateway = netip.MustParseAddr("10.0.2.2")
+	// DNS is the address forwarding queries to the host resolvers.
+	DNS = netip.MustParseAddr("10.0.2.3")
+	// Guest is the address of the container.
+	Guest = netip.MustParseAddr("10.0.2.100")
+)
+
+// MTU is the MTU of the tap device.
+const MTU = 1500
+
+// udpIdleTimeout is how long a UDP flow is kept without replies.
+const udpIdleTimeout = 60 * time.Second
+
+// stackMAC is the hardware address the gateway and DNS answer with.
+var stackMAC = [6]byte{0x52, 0x55, 0x0a, 0x00, 0x02, 0x02}
+
+// Stack forwards the frames of one tap device.
+type Stack struct {
+	// Dial opens host connections on behalf of the container. It defaults
+	// to net.Dial with a timeout.
+	Dial func(network, address string) (net.Conn, error)
+	// Resolvers are the host DNS servers, as ip:port, that queries to DNS
+	// are forwarded to.
+	Resolvers []string
+
+	dev io.ReadWriter
+	wmu sync.Mutex
+	id  atomic.Uint32
+
+	mu       sync.Mutex
+	guestMAC [6]byte
+	tcp      map[flowKey]*tcpConn
+	udp      map[flowKey]net.Conn
+	closed   bool
+}
+
+// flowKey identifies a flow by the port of the container and the address
+// it talks to.
+type flowKey struct {
+	guestPort uint16
+	remote    netip.AddrPort
+}
+
+// New returns a stack for dev, which must read and write one Ethernet frame
+// per call, like a tap device without packet information.
+func New(dev io.ReadWriter) *Stack {
+	return &Stack{
+		dev: dev,
+		tcp: map[flowKey]*tcpConn{},
+		udp: map[flowKey]net.Conn{},
+	}
+}
+
+// Run processes frames until dev fails or the stack is closed.
+func (s *Stack) Run() error {
+	buf := make([]byte, 65536)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			s.Close()
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.handleFrame(buf[:n])
+	}
+}
+
+// Close drops all flows.
+func (s *Stack) Close() {
+	s.mu.Lock()
+	s.closed = true
+	tcp, udp := s.tcp, s.udp
+	s.tcp, s.udp = map[flowKey]*tcpConn{}, map[flowKey]net.Conn{}
+	s.mu.Unlock()
+	for _, c := range tcp {
+		c.abort(false)
+	}
+	for _, c := range udp {
+		c.Close()
+	}
+}
+
+func (s *Stack) dial(network, address string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(network, address)
+	}
+	return net.DialTimeout(network, address, 10*time.Second)
+}
+
+// remoteAddress returns the host address traffic to dst is sent to. The
+// gateway is not the host: reaching host services on loopback is refused.
+func (s *Stack) remoteAddress(dst netip.AddrPort) (string, bool) {
+	if dst.Addr() == DNS && dst.Port() == 53 {
+		if len(s.Resolvers) == 0 {
+			return "", false
+		}
+		return s.Resolvers[0], true
+	}
+	if Subnet.Contains(dst.Addr()) || !dst.Addr().IsGlobalUnicast() {
+		return "", false
+	}
+	return dst.String(), true
+}
+
+func (s *Stack) handleFrame(f []byte) {
+	if len(f) < etherHeaderLen {
+		return
+	}
+	s.mu.Lock()
+	copy(s.guestMAC[:], f[6:12])
+	s.mu.Unlock()
+	switch binary.BigEndian.Uint16(f[12:14]) {
+	case etherTypeARP:
+		s.handleARP(f[etherHeaderLen:])
+	case etherTypeIPv4:
+		p, ok := parseIPv4(f[etherHeaderLen:])
+		if !ok || p.src != Guest {
+			return
+		}
+		switch p.proto {
+		case protoICMP:
+			s.handleICMP(p)
+		case protoUDP:
+			s.handleUDP(p)
+		case protoTCP:
+			s.handleTCP(p)
+		}
+	}
+}
+
+// handleARP answers requests for the gateway and DNS addresses.
+func (s *Stack) handleARP(b []byte) {
+	if len(b) < 28 || binary.BigEndian.Uint16(b[6:8]) != 1 {
+		return
+	}
+	target := netip.AddrFrom4([4]byte(b[24:28]))
+	if target != Gateway && target != DNS {
+		return
+	}
+	reply := make([]byte, 28)
+	copy(reply[0:6], b[0:6]) // hardware and protocol type and sizes
+	binary.BigEndian.PutUint16(reply[6:8], 2)
+	copy(reply[8:14], stackMAC[:])
+	copy(reply[14:18], b[24:28])
+	copy(reply[18:24], b[8:14])
+	copy(reply[24:28], b[14:18])
+	s.writeFrame(buildEther([6]byte(b[8:14]), stackMAC, etherTypeARP, reply))
+}
+
+// handleICMP answers echo requests to the gateway and DNS addresses.
+func (s *Stack) handleICMP(p ipv4) {
+	if (p.dst != Gateway && p.dst != DNS) || len(p.payload) < 8 || p.payload[0] != 8 {
+		return
+	}
+	reply := append([]byte(nil), p.payload...)
+	reply[0] = 0
+	reply[2], reply[3] = 0, 0
+	binary.BigEndian.PutUint16(reply[2:4], checksum(reply, 0))
+	s.writeIP(protoICMP, p.dst, p.src, reply)
+}
+
+func (s *Stack) handleUDP(p ipv4) {
+	if len(p.payload) < udpHeaderLen {
+		return
+	}
+	guestPort := binary.BigEndian.Uint16(p.payload[0:2])
+	dst := netip.AddrPortFrom(p.dst, binary.BigEndian.Uint16(p.payload[2:4]))
+	l := int(binary.BigEndian.Uint16(p.payload[4:6]))
+	if l < udpHeaderLen || l > len(p.payload) {
+		return
+	}
+	data := p.payload[udpHeaderLen:l]
+	key := flowKey{guestPort, dst}
+
+	s.mu.Lock()
+	c, ok := s.udp[key]
+	if !ok && !s.closed {
+		addr, allowed := s.remoteAddress(dst)
+		if !allowed {
+			s.mu.Unlock()
+			return
+		}
+		var err error
+		if c, err = s.dial("udp", addr); err != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.udp[key] = c
+		go s.udpReplies(key, c)
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.Write(data)
+	}
+}
+
+// udpReplies sends the datagrams received on c to the container until the
+// flow is idle for udpIdleTimeout.
+func (s *Stack) udpReplies(key flowKey, c net.Conn) {
+	buf := make([]byte, 65535)
+	guest := netip.AddrPortFrom(Guest, key.guestPort)
+	for {
+		c.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := c.Read(buf)
+		if err != nil {
+			break
+		}
+		if n > MTU-ipv4HeaderLen-udpHeaderLen {
+			continue
+		}
+		s.writeIP(protoUDP, key.remote.Addr(), Guest, buildUDP(key.remote, guest, buf[:n]))
+	}
+	s.mu.Lock()
+	if s.udp[key] == c {
+		delete(s.udp, key)
+	}
+	s.mu.Unlock()
+	c.Close()
+}
+
+// writeIP sends an IPv4 packet to the container.
+func (s *Stack) writeIP(proto uint8, src, dst netip.Addr, payload []byte) {
+	pkt := buildIPv4(uint16(s.id.Add(1)), proto, src, dst, payload)
+	s.mu.Lock()
+	mac := s.guestMAC
+	s.mu.Unlock()
+	s.writeFrame(buildEther(mac, stackMAC, etherTypeIPv4, pkt))
+}
+
+func (s *Stack) writeFrame(f []byte) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.dev.Write(f)
+}
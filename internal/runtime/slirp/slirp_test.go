@@ -0,0 +1,239 @@
+//go:build linux
+
+package slirp
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var guestMAC = [6]byte{0x02, 0, 0, 0, 0, 1}
+
+// tapPipe stands in for a tap device: the test writes the frames of the
+// container to in and reads what the stack sends from out.
+type tapPipe struct {
+	in     chan []byte
+	out    chan []byte
+	closed chan struct{}
+}
+
+func newTapPipe() *tapPipe {
+	return &tapPipe{in: make(chan []byte, 16), out: make(chan []byte, 256), closed: make(chan struct{})}
+}
+
+func (p *tapPipe) Read(b []byte) (int, error) {
+	select {
+	case f := <-p.in:
+		return copy(b, f), nil
+	case <-p.closed:
+		return 0, io.EOF
+	}
+}
+
+func (p *tapPipe) Write(b []byte) (int, error) {
+	p.out <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func startStack(t *testing.T, setup func(*Stack)) *tapPipe {
+	t.Helper()
+	dev := newTapPipe()
+	s := New(dev)
+	if setup != nil {
+		setup(s)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(dev.closed)
+		<-done
+	})
+	return dev
+}
+
+func (p *tapPipe) sendIP(proto uint8, dst netip.Addr, payload []byte) {
+	p.in <- buildEther(stackMAC, guestMAC, etherTypeIPv4, buildIPv4(1, proto, Guest, dst, payload))
+}
+
+// nextIP returns the next IPv4 packet the stack sends.
+func (p *tapPipe) nextIP(t *testing.T) ipv4 {
+	t.Helper()
+	for {
+		select {
+		case f := <-p.out:
+			if [6]byte(f[0:6]) != guestMAC {
+				t.Fatalf("frame sent to %x", f[0:6])
+			}
+			if binary.BigEndian.Uint16(f[12:14]) != etherTypeIPv4 {
+				continue
+			}
+			ip, ok := parseIPv4(f[etherHeaderLen:])
+			if !ok {
+				t.Fatal("stack sent an invalid packet")
+			}
+			if checksum(f[etherHeaderLen:etherHeaderLen+ipv4HeaderLen], 0) != 0 {
+				t.Fatal("bad IPv4 header checksum")
+			}
+			return ip
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for a packet")
+		}
+	}
+}
+
+func (p *tapPipe) nextTCP(t *testing.T) tcpSegment {
+	t.Helper()
+	ip := p.nextIP(t)
+	if ip.proto != protoTCP {
+		t.Fatalf("got protocol %d, want tcp", ip.proto)
+	}
+	if checksum(ip.payload, pseudoHeaderSum(ip.src, ip.dst, protoTCP, len(ip.payload))) != 0 {
+		t.Fatal("bad TCP checksum")
+	}
+	seg, _ := parseTCP(ip.payload)
+	return seg
+}
+
+func TestARP(t *testing.T) {
+	dev := startStack(t, nil)
+	req := make([]byte, 28)
+	binary.BigEndian.PutUint16(req[0:2], 1)
+	binary.BigEndian.PutUint16(req[2:4], etherTypeIPv4)
+	req[4], req[5] = 6, 4
+	binary.BigEndian.PutUint16(req[6:8], 1)
+	copy(req[8:14], guestMAC[:])
+	g, gw := Guest.As4(), Gateway.As4()
+	copy(req[14:18], g[:])
+	copy(req[24:28], gw[:])
+	dev.in <- buildEther([6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, guestMAC, etherTypeARP, req)
+
+	f := <-dev.out
+	arp := f[etherHeaderLen:]
+	if binary.BigEndian.Uint16(arp[6:8]) != 2 || [6]byte(arp[8:14]) != stackMAC || [4]byte(arp[14:18]) != gw {
+		t.Fatalf("unexpected ARP reply % x", arp)
+	}
+}
+
+func TestUDPForwardsDNS(t *testing.T) {
+	resolver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := resolver.ReadFrom(buf)
+		if err == nil {
+			resolver.WriteTo(append([]byte("answer:"), buf[:n]...), addr)
+		}
+	}()
+	dev := startStack(t, func(s *Stack) { s.Resolvers = []string{resolver.LocalAddr().String()} })
+
+	guest := netip.AddrPortFrom(Guest, 40000)
+	dns := netip.AddrPortFrom(DNS, 53)
+	dev.sendIP(protoUDP, DNS, buildUDP(guest, dns, []byte("query")))
+
+	ip := dev.nextIP(t)
+	if ip.proto != protoUDP || ip.src != DNS || ip.dst != Guest {
+		t.Fatalf("reply %v -> %v proto %d", ip.src, ip.dst, ip.proto)
+	}
+	if got := string(ip.payload[udpHeaderLen:]); got != "answer:query" {
+		t.Fatalf("reply = %q", got)
+	}
+	if binary.BigEndian.Uint16(ip.payload[0:2]) != 53 || binary.BigEndian.Uint16(ip.payload[2:4]) != 40000 {
+		t.Fatal("reply has wrong ports")
+	}
+}
+
+func TestTCPConnection(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	remote := netip.MustParseAddrPort("93.184.216.34:80")
+	dialed := make(chan string, 1)
+	dev := startStack(t, func(s *Stack) {
+		s.Dial = func(network, address string) (net.Conn, error) {
+			dialed <- address
+			return net.Dial(network, backend.Addr().String())
+		}
+	})
+
+	guest := netip.AddrPortFrom(Guest, 50000)
+	send := func(seq, ack uint32, flags uint8, payload string) {
+		dev.sendIP(protoTCP, remote.Addr(), buildTCP(guest, remote, seq, ack, flags, 65535, 0, []byte(payload)))
+	}
+	send(1000, 0, flagSYN, "")
+	synAck := dev.nextTCP(t)
+	if synAck.flags != flagSYN|flagACK || synAck.ack != 1001 || synAck.mss != tcpMSS {
+		t.Fatalf("handshake reply flags %#x ack %d mss %d", synAck.flags, synAck.ack, synAck.mss)
+	}
+	if got := <-dialed; got != remote.String() {
+		t.Fatalf("dialed %s, want %s", got, remote)
+	}
+	seq, ack := uint32(1001), synAck.seq+1
+	send(seq, ack, flagACK, "")
+	send(seq, ack, flagACK|flagPSH, "hello")
+	seq += 5
+
+	var echoed []byte
+	for len(echoed) < 5 {
+		seg := dev.nextTCP(t)
+		if seg.ack != seq {
+			continue
+		}
+		if seg.seq == ack && len(seg.payload) > 0 {
+			echoed = append(echoed, seg.payload...)
+			ack += uint32(len(seg.payload))
+			send(seq, ack, flagACK, "")
+		}
+	}
+	if string(echoed) != "hello" {
+		t.Fatalf("echo = %q", echoed)
+	}
+
+	// Closing our side makes the backend close, which arrives as a FIN.
+	send(seq, ack, flagFIN|flagACK, "")
+	seq++
+	for {
+		seg := dev.nextTCP(t)
+		if seg.flags&flagRST != 0 {
+			t.Fatal("connection was reset")
+		}
+		if seg.flags&flagFIN != 0 {
+			if seg.ack != seq {
+				t.Fatalf("FIN acknowledges %d, want %d", seg.ack, seq)
+			}
+			send(seq, seg.seq+1, flagACK, "")
+			break
+		}
+	}
+}
+
+func TestTCPRefused(t *testing.T) {
+	dev := startStack(t, nil)
+	guest := netip.AddrPortFrom(Guest, 50001)
+	// Host loopback is not reachable from the container.
+	remote := netip.MustParseAddrPort("127.0.0.1:22")
+	dev.sendIP(protoTCP, remote.Addr(), buildTCP(guest, remote, 7, 0, flagSYN, 65535, 0, nil))
+	seg := dev.nextTCP(t)
+	if seg.flags != flagRST|flagACK || seg.ack != 8 {
+		t.Fatalf("reply flags %#x ack %d, want a reset", seg.flags, seg.ack)
+	}
+}
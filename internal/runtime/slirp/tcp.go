@@ -0,0 +1,484 @@
+//go:build linux
+
+package slirp
+
+import (
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	tcpMSS = MTU - ipv4HeaderLen - tcpHeaderLen
+	// tcpQueue is the number of segments buffered towards the host; it
+	// bounds the window advertised to the container.
+	tcpQueue   = 64
+	minRTO     = 200 * time.Millisecond
+	maxRTO     = 10 * time.Second
+	maxRetries = 12
+)
+
+type tcpState int
+
+const (
+	tcpDialing     tcpState = iota // SYN received, host connection pending
+	tcpSynReceived                 // SYN-ACK sent
+	tcpEstablished
+	tcpClosed
+)
+
+// tcpConn splices a TCP connection of the container to a host connection.
+// The container side is a minimal TCP: in-order receive only, cumulative
+// acknowledgements, retransmission with exponential backoff and no
+// options besides MSS.
+type tcpConn struct {
+	s             *Stack
+	key           flowKey
+	guest, remote netip.AddrPort
+
+	mu     sync.Mutex
+	cond   *sync.Cond // window opened or connection closed
+	state  tcpState
+	host   net.Conn
+	toHost chan []byte
+
+	rcvNxt     uint32
+	rcvWnd     uint16 // last advertised window
+	guestFin   bool
+	toHostDone bool // toHost closed
+	hostDone   bool // everything queued for the host was written
+
+	sndUna, sndNxt uint32
+	sndWnd         uint32
+	mss            int
+	unacked        []byte // data from sndUna on
+	finSent        bool
+	finAcked       bool
+
+	rto     time.Duration
+	retries int
+	timer   *time.Timer
+	dupAcks int
+}
+
+func (s *Stack) handleTCP(p ipv4) {
+	seg, ok := parseTCP(p.payload)
+	if !ok {
+		return
+	}
+	remote := netip.AddrPortFrom(p.dst, seg.dstPort)
+	key := flowKey{seg.srcPort, remote}
+
+	s.mu.Lock()
+	c := s.tcp[key]
+	if c == nil {
+		s.mu.Unlock()
+		if seg.flags&flagRST != 0 || s.isClosed() {
+			return
+		}
+		addr, allowed := s.remoteAddress(remote)
+		if seg.flags&(flagSYN|flagACK) != flagSYN || !allowed {
+			s.sendReset(key, seg)
+			return
+		}
+		c = newTCPConn(s, key, seg)
+		s.mu.Lock()
+		if s.tcp[key] != nil {
+			s.mu.Unlock()
+			return
+		}
+		s.tcp[key] = c
+		s.mu.Unlock()
+		go c.connect(addr)
+		return
+	}
+	s.mu.Unlock()
+	c.handle(seg)
+}
+
+func (s *Stack) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// sendReset answers seg, which belongs to no connection, with a reset.
+func (s *Stack) sendReset(key flowKey, seg tcpSegment) {
+	guest := netip.AddrPortFrom(Guest, key.guestPort)
+	if seg.flags&flagACK != 0 {
+		s.writeIP(protoTCP, key.remote.Addr(), Guest, buildTCP(key.remote, guest, seg.ack, 0, flagRST, 0, 0, nil))
+		return
+	}
+	ack := seg.seq + uint32(len(seg.payload))
+	if seg.flags&flagSYN != 0 {
+		ack++
+	}
+	if seg.flags&flagFIN != 0 {
+		ack++
+	}
+	s.writeIP(protoTCP, key.remote.Addr(), Guest, buildTCP(key.remote, guest, 0, ack, flagRST|flagACK, 0, 0, nil))
+}
+
+func newTCPConn(s *Stack, key flowKey, syn tcpSegment) *tcpConn {
+	iss := rand.Uint32()
+	c := &tcpConn{
+		s:      s,
+		key:    key,
+		guest:  netip.AddrPortFrom(Guest, key.guestPort),
+		remote: key.remote,
+		state:  tcpDialing,
+		toHost: make(chan []byte, tcpQueue),
+		rcvNxt: syn.seq + 1,
+		sndUna: iss,
+		sndNxt: iss + 1,
+		sndWnd: uint32(syn.window),
+		mss:    536,
+		rto:    minRTO,
+	}
+	if syn.mss != 0 {
+		c.mss = min(int(syn.mss), tcpMSS)
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// connect opens the host connection and completes the handshake with the
+// container, or refuses the connection if the host connection fails.
+func (c *tcpConn) connect(addr string) {
+	conn, err := c.s.dial("tcp", addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == tcpClosed {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		c.send(c.sndUna+1, flagRST|flagACK, nil)
+		c.closeLocked()
+		return
+	}
+	c.host = conn
+	c.state = tcpSynReceived
+	c.sendSynAck()
+	c.restartTimer()
+}
+
+func (c *tcpConn) handle(seg tcpSegment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if seg.flags&flagRST != 0 {
+		c.closeLocked()
+		return
+	}
+	switch c.state {
+	case tcpDialing, tcpClosed:
+		return
+	case tcpSynReceived:
+		if seg.flags&flagSYN != 0 {
+			c.sendSynAck()
+			return
+		}
+		if seg.flags&flagACK == 0 || seg.ack != c.sndNxt {
+			return
+		}
+		c.sndUna = c.sndNxt
+		c.state = tcpEstablished
+		c.stopTimer()
+		c.rto, c.retries = minRTO, 0
+		go c.readHost()
+		go c.writeHost()
+	}
+	if seg.flags&flagSYN != 0 {
+		c.sendAck()
+		return
+	}
+	if seg.flags&flagACK != 0 {
+		c.processAck(seg)
+	}
+	if len(seg.payload) > 0 || seg.flags&flagFIN != 0 {
+		c.receive(seg)
+	} else if seg.seq != c.rcvNxt {
+		// A window probe: answer with the current window.
+		c.sendAck()
+	}
+	c.maybeFinish()
+}
+
+// processAck releases acknowledged data and tracks the window.
+func (c *tcpConn) processAck(seg tcpSegment) {
+	c.sndWnd = uint32(seg.window)
+	switch {
+	case seqLT(c.sndUna, seg.ack) && seqLE(seg.ack, c.sndNxt):
+		n := int(seg.ack - c.sndUna)
+		data := min(n, len(c.unacked))
+		c.unacked = c.unacked[data:]
+		if n > data {
+			c.finAcked = true
+		}
+		c.sndUna = seg.ack
+		c.rto, c.retries, c.dupAcks = minRTO, 0, 0
+		if c.sndUna == c.sndNxt {
+			c.stopTimer()
+		} else {
+			c.restartTimer()
+		}
+	case seg.ack == c.sndUna && c.sndUna != c.sndNxt && len(seg.payload) == 0 && seg.flags&flagFIN == 0:
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			c.retransmit()
+		}
+	}
+	c.cond.Broadcast()
+}
+
+// receive queues the in-order data of seg for the host. Anything else is
+// answered with the current acknowledgement so the container retransmits.
+func (c *tcpConn) receive(seg tcpSegment) {
+	data, seq := seg.payload, seg.seq
+	if seqLT(seq, c.rcvNxt) {
+		old := c.rcvNxt - seq
+		if old >= uint32(len(data)) {
+			c.sendAck()
+			return
+		}
+		data, seq = data[old:], c.rcvNxt
+	}
+	if seq != c.rcvNxt || c.guestFin {
+		c.sendAck()
+		return
+	}
+	if len(data) > 0 {
+		select {
+		case c.toHost <- append([]byte(nil), data...):
+			c.rcvNxt += uint32(len(data))
+		default:
+			// The host is slower than the container; it retransmits.
+			c.sendAck()
+			return
+		}
+	}
+	if seg.flags&flagFIN != 0 {
+		c.rcvNxt++
+		c.guestFin = true
+		c.toHostDone = true
+		close(c.toHost)
+	}
+	c.sendAck()
+}
+
+// window returns how many more bytes the container accepts.
+func (c *tcpConn) window() int {
+	inflight := c.sndNxt - c.sndUna
+	if c.sndWnd <= inflight {
+		return 0
+	}
+	return int(c.sndWnd - inflight)
+}
+
+// readHost sends what the host connection delivers to the container within
+// its window, and a FIN at the end of the stream.
+func (c *tcpConn) readHost() {
+	buf := make([]byte, 32*1024)
+	for {
+		c.mu.Lock()
+		for c.state == tcpEstablished && !c.finSent && c.window() == 0 {
+			if c.sndUna == c.sndNxt {
+				// Nothing in flight: probe until the window opens.
+				c.restartTimer()
+			}
+			c.cond.Wait()
+		}
+		if c.state != tcpEstablished || c.finSent {
+			c.mu.Unlock()
+			return
+		}
+		space := min(c.window(), len(buf))
+		c.mu.Unlock()
+
+		n, err := c.host.Read(buf[:space])
+
+		c.mu.Lock()
+		if c.state != tcpEstablished {
+			c.mu.Unlock()
+			return
+		}
+		if n > 0 {
+			c.sendData(buf[:n])
+		}
+		if err == io.EOF {
+			c.send(c.sndNxt, flagFIN|flagACK, nil)
+			c.sndNxt++
+			c.finSent = true
+			c.restartTimer()
+		} else if err != nil {
+			c.send(c.sndNxt, flagRST|flagACK, nil)
+			c.closeLocked()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeHost writes the data of the container to the host connection and
+// half-closes it after the FIN of the container.
+func (c *tcpConn) writeHost() {
+	for b := range c.toHost {
+		if _, err := c.host.Write(b); err != nil {
+			c.mu.Lock()
+			c.send(c.sndNxt, flagRST|flagACK, nil)
+			c.closeLocked()
+			c.mu.Unlock()
+			for range c.toHost {
+			}
+			return
+		}
+		c.mu.Lock()
+		if c.state == tcpEstablished && int(c.rcvWnd) < c.mss && int(c.rcvWindow()) >= c.mss {
+			// The container stopped at a closed window; reopen it.
+			c.sendAck()
+		}
+		c.mu.Unlock()
+	}
+	if cw, ok := c.host.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	c.mu.Lock()
+	c.hostDone = true
+	c.maybeFinish()
+	c.mu.Unlock()
+}
+
+// maybeFinish drops the connection once both directions are closed and
+// acknowledged.
+func (c *tcpConn) maybeFinish() {
+	if c.state == tcpEstablished && c.guestFin && c.hostDone && c.finAcked {
+		c.closeLocked()
+	}
+}
+
+func (c *tcpConn) sendData(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), c.mss)
+		c.send(c.sndNxt, flagACK|flagPSH, data[:n])
+		c.unacked = append(c.unacked, data[:n]...)
+		c.sndNxt += uint32(n)
+		data = data[n:]
+	}
+	if c.timer == nil {
+		c.restartTimer()
+	}
+}
+
+func (c *tcpConn) sendSynAck() {
+	c.s.writeIP(protoTCP, c.remote.Addr(), Guest,
+		buildTCP(c.remote, c.guest, c.sndUna, c.rcvNxt, flagSYN|flagACK, c.rcvWindow(), tcpMSS, nil))
+}
+
+func (c *tcpConn) sendAck() {
+	c.send(c.sndNxt, flagACK, nil)
+}
+
+func (c *tcpConn) send(seq uint32, flags uint8, payload []byte) {
+	c.rcvWnd = c.rcvWindow()
+	c.s.writeIP(protoTCP, c.remote.Addr(), Guest,
+		buildTCP(c.remote, c.guest, seq, c.rcvNxt, flags, c.rcvWnd, 0, payload))
+}
+
+// rcvWindow is the free space of the queue towards the host.
+func (c *tcpConn) rcvWindow() uint16 {
+	if c.toHostDone {
+		return 0
+	}
+	return uint16(min((tcpQueue-len(c.toHost))*tcpMSS, 65535))
+}
+
+// retransmit resends the oldest unacknowledged segment.
+func (c *tcpConn) retransmit() {
+	switch {
+	case c.state == tcpSynReceived:
+		c.sendSynAck()
+	case len(c.unacked) > 0:
+		c.send(c.sndUna, flagACK|flagPSH, c.unacked[:min(len(c.unacked), c.mss)])
+	case c.finSent && !c.finAcked:
+		c.send(c.sndNxt-1, flagFIN|flagACK, nil)
+	}
+}
+
+func (c *tcpConn) onTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	if c.state != tcpSynReceived && c.state != tcpEstablished {
+		return
+	}
+	if c.state == tcpEstablished && c.sndUna == c.sndNxt {
+		if c.window() == 0 {
+			// An old sequence number makes the container answer with
+			// its current window.
+			c.send(c.sndNxt-1, flagACK, nil)
+			c.rto = min(2*c.rto, maxRTO)
+			c.restartTimer()
+		}
+		return
+	}
+	c.retries++
+	if c.retries > maxRetries {
+		c.send(c.sndNxt, flagRST|flagACK, nil)
+		c.closeLocked()
+		return
+	}
+	c.rto = min(2*c.rto, maxRTO)
+	c.retransmit()
+	c.restartTimer()
+}
+
+func (c *tcpConn) restartTimer() {
+	c.stopTimer()
+	c.timer = time.AfterFunc(c.rto, c.onTimer)
+}
+
+func (c *tcpConn) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// abort drops the connection, resetting it in the container if rst is set.
+func (c *tcpConn) abort(rst bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rst && c.state != tcpClosed {
+		c.send(c.sndNxt, flagRST|flagACK, nil)
+	}
+	c.closeLocked()
+}
+
+// closeLocked releases the connection without telling the container.
+func (c *tcpConn) closeLocked() {
+	if c.state == tcpClosed {
+		return
+	}
+	c.state = tcpClosed
+	c.stopTimer()
+	if c.host != nil {
+		c.host.Close()
+	}
+	if !c.toHostDone {
+		c.toHostDone = true
+		close(c.toHost)
+	}
+	c.cond.Broadcast()
+	c.s.mu.Lock()
+	if c.s.tcp[c.key] == c {
+		delete(c.s.tcp, c.key)
+	}
+	c.s.mu.Unlock()
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/denysk0/pocketDocker/internal/runtime/slirp"
+	"golang.org/x/sys/unix"
+)
+
+// SlirpNetwork is the --network mode that connects a container through a
+// user-mode network stack instead of a bridge, which works without root.
+const SlirpNetwork = "slirp"
+
+// slirpTap is the name of the tap device inside the container.
+const slirpTap = "tap0"
+
+// resolvConfPath is read for the DNS servers queries of slirp containers
+// are forwarded to.
+var resolvConfPath = "/etc/resolv.conf"
+
+// slirpResolvers returns the servers DNS queries are forwarded to.
+var slirpResolvers = hostResolvers
+
+// Slirp forwards the traffic of a container from a tap device in its
+// network namespace through host sockets.
+type Slirp struct {
+	stack *slirp.Stack
+	tap   *os.File
+	done  chan error
+}
+
+// StartSlirp creates and configures the tap device in the network namespace
+// of pid and starts forwarding its traffic. Without root the device is
+// created by helper, as in StartPortProxy.
+func StartSlirp(pid int, helper []string) (*Slirp, error) {
+	var fd int
+	if os.Geteuid() == 0 {
+		if err := inNetns(pid, func() error {
+			var err error
+			fd, err = openTap(slirpTap)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if err := configureTap(pid); err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+	} else {
+		h, err := startSocketHelper(pid, helper)
+		if err != nil {
+			return nil, err
+		}
+		fd, err = h.request('t')
+		h.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Non-blocking so that Close interrupts a pending read.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	s := &Slirp{tap: os.NewFile(uintptr(fd), slirpTap), done: make(chan error, 1)}
+	s.stack = slirp.New(s.tap)
+	s.stack.Resolvers = slirpResolvers()
+	go func() { s.done <- s.stack.Run() }()
+	return s, nil
+}
+
+// Done receives the result of the stack once the tap device goes away with
+// the network namespace.
+func (s *Slirp) Done() <-chan error { return s.done }
+
+// Close stops forwarding.
+func (s *Slirp) Close() error {
+	s.stack.Close()
+	return s.tap.Close()
+}
+
+// openTap creates the tap device name in the current network namespace.
+func openTap(name string) (int, error) {
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open /dev/net/tun: %w", err)
+	}
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	ifr.SetUint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("create %s: %w", name, err)
+	}
+	return fd, nil
+}
+
+// configureTap gives the tap device in the namespace of ns, or the current
+// one if ns is 0, the container address and routes through the stack.
+func configureTap(ns int) error {
+	links := netlinkOps{}
+	_ = links.SetUp(ns, "lo")
+	if err := links.SetUp(ns, slirpTap); err != nil {
+		return err
+	}
+	if err := links.AddAddr(ns, slirpTap, netip.PrefixFrom(slirp.Guest, slirp.Subnet.Bits()).String()); err != nil {
+		return err
+	}
+	return links.AddDefaultRoute(ns, slirp.Gateway.String())
+}
+
+// hostResolvers returns the nameservers of the host as ip:port.
+func hostResolvers() []string {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return []string{"127.0.0.1:53"}
+	}
+	defer f.Close()
+	var servers []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil {
+				servers = append(servers, net.JoinHostPort(ip.String(), "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+// SlirpResolvConf is the resolv.conf of containers on the slirp network.
+func SlirpResolvConf() string {
+	return "nameserver " + slirp.DNS.String() + "\n"
+}
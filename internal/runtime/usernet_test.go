@@ -0,0 +1,81 @@
+package runtime
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestHostResolvers(t *testing.T) {
+	path := t.TempDir() + "/resolv.conf"
+	os.WriteFile(path, []byte("# local\nnameserver 192.0.2.1\nsearch example.org\nnameserver 2001:db8::1\nnameserver bogus\n"), 0644)
+	old := resolvConfPath
+	resolvConfPath = path
+	defer func() { resolvConfPath = old }()
+	got := hostResolvers()
+	if len(got) != 2 || got[0] != "192.0.2.1:53" || got[1] != "[2001:db8::1]:53" {
+		t.Fatalf("hostResolvers() = %v", got)
+	}
+}
+
+func TestStartSlirpForwardsDNS(t *testing.T) {
+	if os.Geteuid() != 0 || !netlinkAvailable() {
+		t.Skip("requires root and rtnetlink")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("/dev/net/tun not available")
+	}
+	if _, err := exec.LookPath("unshare"); err != nil {
+		t.Skip("unshare not found")
+	}
+	ctn := exec.Command("unshare", "-n", "sleep", "30")
+	if err := ctn.Start(); err != nil {
+		t.Skipf("unshare: %v", err)
+	}
+	defer func() { ctn.Process.Kill(); ctn.Wait() }()
+	pid := ctn.Process.Pid
+	waitNetns(t, pid)
+
+	resolver, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	go func() {
+		buf := make([]byte, 512)
+		n, addr, err := resolver.ReadFrom(buf)
+		if err == nil {
+			resolver.WriteTo(buf[:n], addr)
+		}
+	}()
+	old := slirpResolvers
+	slirpResolvers = func() []string { return []string{resolver.LocalAddr().String()} }
+	defer func() { slirpResolvers = old }()
+
+	s, err := StartSlirp(pid, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var c net.Conn
+	if err := inNetns(pid, func() error {
+		var err error
+		c, err = net.Dial("udp4", "10.0.2.3:53")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("reply = %q, %v", buf[:n], err)
+	}
+}
@@ -31,7 +31,7 @@ func TestCloneAndRunUserNamespace(t *testing.T) {
 	}
 	t.Logf("Found /bin/sh at %s", shPath)
 
-	pid, master, err := CloneAndRun("/bin/sh", []string{"-c", "echo starting; id -u; echo done; sleep 0.5"}, rootfs, false, true)
+	pid, master, err := CloneAndRun("/bin/sh", []string{"-c", "echo starting; id -u; echo done; sleep 0.5"}, rootfs, false, true, NetNamespace{})
 	if err != nil {
 		t.Fatalf("CloneAndRun: %v", err)
 	}
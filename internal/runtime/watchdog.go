@@ -10,12 +10,23 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
 )
 
 // StartWatchdog periodically executes healthCmd (or checks pid liveness if empty).
 // If the check fails, it sends a notification on failCh. The watchdog stops when
 // the provided context is cancelled.
 func StartWatchdog(ctx context.Context, pid int, interval time.Duration, healthCmd string, failCh chan<- struct{}) {
+	StartWatchdogForContainer(ctx, "", pid, interval, healthCmd, nil, failCh)
+}
+
+// StartWatchdogForContainer is like StartWatchdog but skips the checks while
+// the cgroup of containerID is frozen by `pause`, so that a paused container
+// is not reported as unhealthy. The container is also considered unhealthy
+// when its pressure stall information breaks one of the psi thresholds, which
+// catches thrashing before the OOM killer fires.
+func StartWatchdogForContainer(ctx context.Context, containerID string, pid int, interval time.Duration, healthCmd string, psi []cgroups.PSIThreshold, failCh chan<- struct{}) {
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -24,35 +35,17 @@ func StartWatchdog(ctx context.Context, pid int, interval time.Duration, healthC
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				if healthCmd == "" {
-					if err := syscall.Kill(pid, 0); err != nil {
-						failCh <- struct{}{}
-						return
-					}
+				if containerID != "" && cgroups.Frozen(containerID) {
 					continue
 				}
-				var cmd *exec.Cmd
-				needsShell := strings.ContainsAny(healthCmd, "|&;<>()$`\\\"'")
-				
-				if needsShell {
-					cmd = exec.Command("nsenter", "--target", strconv.Itoa(pid),
-						"--pid", "--mount", "--uts", "--ipc", "--net",
-						"--", "sh", "-c", healthCmd)
-				} else {
-					parts := strings.Fields(healthCmd)
-					if len(parts) == 0 {
+				if containerID != "" && len(psi) > 0 {
+					if th, p, bad := cgroups.CheckPressure(containerID, psi); bad {
+						log.Printf("health check failed: pressure threshold %s exceeded (some avg10=%.2f full avg10=%.2f)", th, p.Some.Avg10, p.Full.Avg10)
 						failCh <- struct{}{}
 						return
 					}
-					nsenterArgs := []string{"--target", strconv.Itoa(pid),
-						"--pid", "--mount", "--uts", "--ipc", "--net", "--"}
-					nsenterArgs = append(nsenterArgs, parts...)
-					cmd = exec.Command("nsenter", nsenterArgs...)
 				}
-				
-				out, err := cmd.CombinedOutput()
-				if err != nil {
-					log.Printf("health check failed: %v, output: %s", err, string(out))
+				if !healthy(pid, healthCmd) {
 					failCh <- struct{}{}
 					return
 				}
@@ -60,3 +53,34 @@ func StartWatchdog(ctx context.Context, pid int, interval time.Duration, healthC
 		}
 	}()
 }
+
+// healthy runs a single health check for pid.
+func healthy(pid int, healthCmd string) bool {
+	if healthCmd == "" {
+		return syscall.Kill(pid, 0) == nil
+	}
+	var cmd *exec.Cmd
+	needsShell := strings.ContainsAny(healthCmd, "|&;<>()$`\\\"'")
+
+	if needsShell {
+		cmd = exec.Command("nsenter", "--target", strconv.Itoa(pid),
+			"--pid", "--mount", "--uts", "--ipc", "--net",
+			"--", "sh", "-c", healthCmd)
+	} else {
+		parts := strings.Fields(healthCmd)
+		if len(parts) == 0 {
+			return false
+		}
+		nsenterArgs := []string{"--target", strconv.Itoa(pid),
+			"--pid", "--mount", "--uts", "--ipc", "--net", "--"}
+		nsenterArgs = append(nsenterArgs, parts...)
+		cmd = exec.Command("nsenter", nsenterArgs...)
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("health check failed: %v, output: %s", err, string(out))
+		return false
+	}
+	return true
+}
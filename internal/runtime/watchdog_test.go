@@ -2,12 +2,15 @@ package runtime_test
 
 import (
 	"context"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/denysk0/pocketDocker/internal/runtime"
+	"github.com/denysk0/pocketDocker/internal/runtime/cgroups"
 )
 
 func TestWatchdogDetectsProcessExit(t *testing.T) {
@@ -56,3 +59,62 @@ func TestWatchdogDetectsHealthCmdFailure(t *testing.T) {
 		t.Fatal("timeout waiting for watchdog to detect unhealthy container")
 	}
 }
+
+func TestWatchdogSkipsFrozenContainer(t *testing.T) {
+	tmp := t.TempDir()
+	oldRoot := cgroups.CgroupRoot
+	cgroups.CgroupRoot = tmp
+	defer func() { cgroups.CgroupRoot = oldRoot }()
+	dir := filepath.Join(tmp, "paused")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cgroup.events"), []byte("populated 1\nfrozen 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	failCh := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The health command always fails, but the container is frozen.
+	runtime.StartWatchdogForContainer(ctx, "paused", syscall.Getpid(), 100*time.Millisecond, "/bin/false", nil, failCh)
+
+	select {
+	case <-failCh:
+		t.Fatal("watchdog reported a frozen container as unhealthy")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestWatchdogDetectsPressure(t *testing.T) {
+	tmp := t.TempDir()
+	oldRoot := cgroups.CgroupRoot
+	cgroups.CgroupRoot = tmp
+	defer func() { cgroups.CgroupRoot = oldRoot }()
+	dir := filepath.Join(tmp, "thrashing")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pressure := "some avg10=55.00 avg60=20.00 avg300=5.00 total=123\nfull avg10=30.00 avg60=10.00 avg300=2.00 total=99\n"
+	if err := os.WriteFile(filepath.Join(dir, "memory.pressure"), []byte(pressure), 0644); err != nil {
+		t.Fatal(err)
+	}
+	th, err := cgroups.ParsePSIThreshold("memory.some.avg10>40")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failCh := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The process itself is alive, only the pressure threshold is broken.
+	runtime.StartWatchdogForContainer(ctx, "thrashing", syscall.Getpid(), 100*time.Millisecond, "", []cgroups.PSIThreshold{th}, failCh)
+
+	select {
+	case <-failCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for watchdog to detect memory pressure")
+	}
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+var (
+	// ErrIPInUse is returned when a requested address is already allocated.
+	ErrIPInUse = errors.New("address already in use")
+	// ErrPoolExhausted is returned when a subnet has no free address left.
+	ErrPoolExhausted = errors.New("no free address left in subnet")
+)
+
+// IPAllocation records an address handed out to a container on a network.
+type IPAllocation struct {
+	Network     string
+	IP          string
+	ContainerID string
+}
+
+// AllocateIP reserves an address of subnet for containerID on network inside
+// a single transaction, so concurrent runs never receive the same address.
+// If requested is empty the lowest free host address is chosen, otherwise
+// exactly requested is reserved. The network address, the broadcast address
+// and gateway are never handed out. A container that already holds an
+// address on network gets the same one back.
+func (s *Store) AllocateIP(network, subnet, gateway, containerID, requested string) (string, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	prefix = prefix.Masked()
+	var gw netip.Addr
+	if gateway != "" {
+		if gw, err = netip.ParseAddr(gateway); err != nil {
+			return "", fmt.Errorf("invalid gateway %q: %w", gateway, err)
+		}
+	}
+	var want netip.Addr
+	if requested != "" {
+		if want, err = netip.ParseAddr(requested); err != nil {
+			return "", fmt.Errorf("invalid address %q: %w", requested, err)
+		}
+		if !usableHost(prefix, want) || want == gw {
+			return "", fmt.Errorf("address %s is not a usable host address of %s", want, prefix)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var existing string
+	err = tx.QueryRow(`SELECT ip FROM ip_allocations WHERE network = ? AND container_id = ?`, network, containerID).Scan(&existing)
+	switch {
+	case err == nil:
+		if requested != "" && existing != want.String() {
+			return "", fmt.Errorf("container already has address %s on %s", existing, network)
+		}
+		return existing, tx.Commit()
+	case err != sql.ErrNoRows:
+		return "", err
+	}
+
+	rows, err := tx.Query(`SELECT ip FROM ip_allocations WHERE network = ?`, network)
+	if err != nil {
+		return "", err
+	}
+	used := map[netip.Addr]bool{}
+	for rows.Next() {
+		var ip string
+		if err := rows.Scan(&ip); err != nil {
+			rows.Close()
+			return "", err
+		}
+		if a, err := netip.ParseAddr(ip); err == nil {
+			used[a] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+
+	if requested != "" {
+		if used[want] {
+			return "", fmt.Errorf("%s: %w", want, ErrIPInUse)
+		}
+	} else {
+		want = netip.Addr{}
+		for a := prefix.Addr().Next(); prefix.Contains(a); a = a.Next() {
+			if usableHost(prefix, a) && a != gw && !used[a] {
+				want = a
+				break
+			}
+		}
+		if !want.IsValid() {
+			return "", fmt.Errorf("%s: %w", prefix, ErrPoolExhausted)
+		}
+	}
+
+	if _, err := tx.Exec(`INSERT INTO ip_allocations(network, ip, container_id) VALUES (?, ?, ?)`, network, want.String(), containerID); err != nil {
+		return "", err
+	}
+	return want.String(), tx.Commit()
+}
+
+// ReleaseIP returns the address containerID holds on network to the pool.
+func (s *Store) ReleaseIP(network, containerID string) error {
+	_, err := s.db.Exec(`DELETE FROM ip_allocations WHERE network = ? AND container_id = ?`, network, containerID)
+	return err
+}
+
+// ListIPAllocations returns the addresses allocated on network.
+func (s *Store) ListIPAllocations(network string) ([]IPAllocation, error) {
+	rows, err := s.db.Query(`SELECT network, ip, container_id FROM ip_allocations WHERE network = ? ORDER BY ip`, network)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []IPAllocation
+	for rows.Next() {
+		var a IPAllocation
+		if err := rows.Scan(&a.Network, &a.IP, &a.ContainerID); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// ContainerAddresses returns the addresses allocated to containerID on all
+// networks.
+func (s *Store) ContainerAddresses(containerID string) ([]IPAllocation, error) {
+	rows, err := s.db.Query(`SELECT network, ip, container_id FROM ip_allocations WHERE container_id = ? ORDER BY network`, containerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []IPAllocation
+	for rows.Next() {
+		var a IPAllocation
+		if err := rows.Scan(&a.Network, &a.IP, &a.ContainerID); err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// usableHost reports whether a is a host address of prefix, excluding the
+// network address and, for IPv4, the broadcast address.
+func usableHost(prefix netip.Prefix, a netip.Addr) bool {
+	if !prefix.Contains(a) || a == prefix.Addr() {
+		return false
+	}
+	if a.Is4() && prefix.Bits() < 31 {
+		last := a.Next()
+		return last.IsValid() && prefix.Contains(last)
+	}
+	return true
+}
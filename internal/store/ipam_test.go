@@ -0,0 +1,166 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := NewStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAllocateIPSequentialAndRelease(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+
+	ip1, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip2, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip1 != "10.42.0.2" || ip2 != "10.42.0.3" {
+		t.Fatalf("got %s, %s; want 10.42.0.2, 10.42.0.3", ip1, ip2)
+	}
+	if again, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c1", ""); err != nil || again != ip1 {
+		t.Fatalf("re-allocation for c1 = %s, %v; want %s", again, err, ip1)
+	}
+	if err := s.ReleaseIP("bridge", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	ip3, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c3", "")
+	if err != nil || ip3 != ip1 {
+		t.Fatalf("released address not reused: %s, %v", ip3, err)
+	}
+	// Pools of different networks are independent.
+	other, err := s.AllocateIP("other", "10.42.0.0/24", "10.42.0.1", "c4", "")
+	if err != nil || other != "10.42.0.2" {
+		t.Fatalf("other network = %s, %v", other, err)
+	}
+}
+
+func TestAllocateIPStatic(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+
+	ip, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c1", "10.42.0.12")
+	if err != nil || ip != "10.42.0.12" {
+		t.Fatalf("static = %s, %v", ip, err)
+	}
+	if _, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c2", "10.42.0.12"); !errors.Is(err, ErrIPInUse) {
+		t.Fatalf("expected ErrIPInUse, got %v", err)
+	}
+	// 10.42.0.1 must not be confused with 10.42.0.12.
+	if ip, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c3", "10.42.0.2"); err != nil || ip != "10.42.0.2" {
+		t.Fatalf("static 10.42.0.2 = %s, %v", ip, err)
+	}
+	for _, bad := range []string{"10.42.0.1", "10.42.0.0", "10.42.0.255", "10.43.0.5", "nonsense"} {
+		if _, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "bad", bad); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestAllocateIPExhausted(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	// A /30 has two host addresses, one of which is the gateway.
+	if _, err := s.AllocateIP("tiny", "192.168.5.0/30", "192.168.5.1", "c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AllocateIP("tiny", "192.168.5.0/30", "192.168.5.1", "c2", ""); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("expected ErrPoolExhausted, got %v", err)
+	}
+}
+
+func TestAllocateIPConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	// Several Store instances emulate independent `run` processes.
+	stores := []*Store{newTestStore(t, path), newTestStore(t, path), newTestStore(t, path)}
+
+	const n = 60
+	var wg sync.WaitGroup
+	ips := make([]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := stores[i%len(stores)]
+			ips[i], errs[i] = s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", fmt.Sprintf("c%d", i), "")
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]int{}
+	for i, ip := range ips {
+		if errs[i] != nil {
+			t.Fatalf("allocation %d: %v", i, errs[i])
+		}
+		if j, dup := seen[ip]; dup {
+			t.Fatalf("containers %d and %d both got %s", j, i, ip)
+		}
+		seen[ip] = i
+	}
+	list, err := stores[0].ListIPAllocations("bridge")
+	if err != nil || len(list) != n {
+		t.Fatalf("ListIPAllocations = %d entries, %v", len(list), err)
+	}
+}
+
+func TestDeleteContainerReleasesIP(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	if err := s.SaveContainer(ContainerInfo{ID: "c1", State: "Stopped"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteContainer("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.ListIPAllocations("bridge"); err != nil || len(list) != 0 {
+		t.Fatalf("allocations left after delete: %v, %v", list, err)
+	}
+}
+
+func TestInitReservesLegacyAddresses(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	// Rows of older versions only stored the last octet.
+	for _, c := range []struct {
+		id, state string
+		suffix    int
+	}{{"old", "Running", 2}, {"gone", "Stopped", 3}} {
+		if _, err := s.db.Exec(`INSERT INTO containers (id, state, ip_suffix) VALUES (?, ?, ?)`, c.id, c.state, c.suffix); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.ListIPAllocations("bridge")
+	if err != nil || len(list) != 1 || list[0] != (IPAllocation{Network: "bridge", IP: "10.42.0.2", ContainerID: "old"}) {
+		t.Fatalf("allocations = %v, %v; want 10.42.0.2 for old", list, err)
+	}
+	if ip, err := s.AllocateIP("bridge", "10.42.0.0/24", "10.42.0.1", "new", ""); err != nil || ip != "10.42.0.3" {
+		t.Fatalf("AllocateIP = %s, %v; want 10.42.0.3", ip, err)
+	}
+	// Later runs of the migration leave the reservations alone.
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.ListIPAllocations("bridge"); err != nil || len(list) != 2 {
+		t.Fatalf("allocations after second Init = %v, %v", list, err)
+	}
+}
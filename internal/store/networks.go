@@ -0,0 +1,142 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+var (
+	// ErrNetworkExists is returned when creating a network whose name or
+	// subnet is already taken.
+	ErrNetworkExists = errors.New("network already exists")
+	// ErrNetworkInUse is returned when removing a network that still has
+	// addresses allocated.
+	ErrNetworkInUse = errors.New("network has attached containers")
+)
+
+// NetworkInfo holds a user-defined bridge network. Subnet6 and Gateway6
+// are empty unless the network is dual-stack. Isolated (--icc=false) and
+// Internal are its traffic policies.
+type NetworkInfo struct {
+	Name      string
+	Bridge    string
+	Subnet    string
+	Gateway   string
+	Subnet6   string
+	Gateway6  string
+	Isolated  bool
+	Internal  bool
+	CreatedAt time.Time
+}
+
+// networkColumns lists the columns read by queryNetworks, in order.
+const networkColumns = `name, bridge, subnet, gateway, COALESCE(subnet6, ''), COALESCE(gateway6, ''), COALESCE(isolated, 0), COALESCE(internal, 0), created_at`
+
+// CreateNetwork inserts n unless its name, bridge or an overlapping IPv4
+// or IPv6 subnet is already used by another network.
+func (s *Store) CreateNetwork(n NetworkInfo) error {
+	prefix, err := netip.ParsePrefix(n.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %w", n.Subnet, err)
+	}
+	var prefix6 netip.Prefix
+	if n.Subnet6 != "" {
+		if prefix6, err = netip.ParsePrefix(n.Subnet6); err != nil {
+			return fmt.Errorf("invalid subnet %q: %w", n.Subnet6, err)
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	existing, err := queryNetworks(tx, `SELECT `+networkColumns+` FROM networks`)
+	if err != nil {
+		return err
+	}
+	for _, e := range existing {
+		if e.Name == n.Name || e.Bridge == n.Bridge {
+			return fmt.Errorf("%s: %w", n.Name, ErrNetworkExists)
+		}
+		if other, err := netip.ParsePrefix(e.Subnet); err == nil && other.Overlaps(prefix) {
+			return fmt.Errorf("subnet %s overlaps network %s: %w", n.Subnet, e.Name, ErrNetworkExists)
+		}
+		if other, err := netip.ParsePrefix(e.Subnet6); err == nil && prefix6.IsValid() && other.Overlaps(prefix6) {
+			return fmt.Errorf("subnet %s overlaps network %s: %w", n.Subnet6, e.Name, ErrNetworkExists)
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO networks(name, bridge, subnet, gateway, subnet6, gateway6, isolated, internal, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		n.Name, n.Bridge, n.Subnet, n.Gateway, n.Subnet6, n.Gateway6, n.Isolated, n.Internal, n.CreatedAt.Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetNetwork fetches a network by name.
+func (s *Store) GetNetwork(name string) (NetworkInfo, error) {
+	list, err := queryNetworks(s.db, `SELECT `+networkColumns+` FROM networks WHERE name = ?`, name)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	if len(list) == 0 {
+		return NetworkInfo{}, sql.ErrNoRows
+	}
+	return list[0], nil
+}
+
+// ListNetworks returns all user-defined networks ordered by name.
+func (s *Store) ListNetworks() ([]NetworkInfo, error) {
+	return queryNetworks(s.db, `SELECT `+networkColumns+` FROM networks ORDER BY name`)
+}
+
+// DeleteNetwork removes the network unless addresses are still allocated
+// on it.
+func (s *Store) DeleteNetwork(name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM ip_allocations WHERE network = ?`, name).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%s: %w", name, ErrNetworkInUse)
+	}
+	res, err := tx.Exec(`DELETE FROM networks WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func queryNetworks(q querier, query string, args ...any) ([]NetworkInfo, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []NetworkInfo
+	for rows.Next() {
+		var n NetworkInfo
+		var t sql.NullString
+		if err := rows.Scan(&n.Name, &n.Bridge, &n.Subnet, &n.Gateway, &n.Subnet6, &n.Gateway6, &n.Isolated, &n.Internal, &t); err != nil {
+			return nil, err
+		}
+		n.CreatedAt, _ = time.Parse(time.RFC3339, t.String)
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNetworkLifecycle(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+
+	web := NetworkInfo{Name: "web", Bridge: "pd-web", Subnet: "10.50.0.0/24", Gateway: "10.50.0.1", CreatedAt: time.Now().UTC()}
+	if err := s.CreateNetwork(web); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateNetwork(web); !errors.Is(err, ErrNetworkExists) {
+		t.Fatalf("duplicate name: %v", err)
+	}
+	overlap := NetworkInfo{Name: "db", Bridge: "pd-db", Subnet: "10.50.0.128/25", Gateway: "10.50.0.129"}
+	if err := s.CreateNetwork(overlap); !errors.Is(err, ErrNetworkExists) {
+		t.Fatalf("overlapping subnet: %v", err)
+	}
+
+	got, err := s.GetNetwork("web")
+	if err != nil || got.Bridge != "pd-web" || got.Subnet != web.Subnet || got.Gateway != web.Gateway {
+		t.Fatalf("GetNetwork = %+v, %v", got, err)
+	}
+	if _, err := s.GetNetwork("missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("missing network: %v", err)
+	}
+
+	if _, err := s.AllocateIP("web", web.Subnet, web.Gateway, "c1", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteNetwork("web"); !errors.Is(err, ErrNetworkInUse) {
+		t.Fatalf("delete with attached container: %v", err)
+	}
+	if addrs, err := s.ContainerAddresses("c1"); err != nil || len(addrs) != 1 || addrs[0].IP != "10.50.0.2" {
+		t.Fatalf("ContainerAddresses = %v, %v", addrs, err)
+	}
+	if err := s.ReleaseIP("web", "c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteNetwork("web"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.ListNetworks(); err != nil || len(list) != 0 {
+		t.Fatalf("ListNetworks = %v, %v", list, err)
+	}
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrPortInUse is returned when a host port is reserved by another container.
+var ErrPortInUse = errors.New("port already in use")
+
+// PortMapping is a port or port range published by a container. The End
+// fields are zero for a single port; an empty HostIP binds all addresses
+// and an empty Proto means tcp.
+type PortMapping struct {
+	HostIP       string `json:"host_ip,omitempty"`
+	Host         int    `json:"host"`
+	HostEnd      int    `json:"host_end,omitempty"`
+	Container    int    `json:"container"`
+	ContainerEnd int    `json:"container_end,omitempty"`
+	Proto        string `json:"proto,omitempty"`
+}
+
+// encodePorts returns the value of the ports column.
+func encodePorts(ports []PortMapping) string {
+	if len(ports) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(ports)
+	return string(data)
+}
+
+// decodePorts parses the ports column. Rows written before mappings were
+// stored as JSON hold a comma-separated list of host:container pairs.
+func decodePorts(s string) []PortMapping {
+	if s == "" {
+		return nil
+	}
+	var ports []PortMapping
+	if strings.HasPrefix(s, "[") {
+		_ = json.Unmarshal([]byte(s), &ports)
+		return ports
+	}
+	for _, p := range strings.Split(s, ",") {
+		host, cont, ok := strings.Cut(p, ":")
+		if !ok {
+			continue
+		}
+		h, err1 := strconv.Atoi(host)
+		c, err2 := strconv.Atoi(cont)
+		if err1 == nil && err2 == nil {
+			ports = append(ports, PortMapping{Host: h, Container: c})
+		}
+	}
+	return ports
+}
+
+// ReservePorts reserves the host ports of ports for containerID inside a
+// single transaction, so concurrent runs never publish the same port. A
+// port reserved on all addresses conflicts with the same port on any other
+// address. Ports containerID already holds are reserved again without
+// error.
+func (s *Store) ReservePorts(containerID string, ports []PortMapping) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range ports {
+		last := p.Host
+		if p.HostEnd > p.Host {
+			last = p.HostEnd
+		}
+		for port := p.Host; port <= last; port++ {
+			var owner string
+			err := tx.QueryRow(`SELECT container_id FROM port_reservations
+				WHERE proto = ? AND port = ? AND container_id != ? AND (host_ip = ? OR host_ip = '' OR ? = '')
+				LIMIT 1`, p.Protocol(), port, containerID, p.HostIP, p.HostIP).Scan(&owner)
+			if err == nil {
+				conflict := PortMapping{HostIP: p.HostIP, Host: port, Proto: p.Proto}
+				return fmt.Errorf("%s is published by %s: %w", conflict.HostString(), owner, ErrPortInUse)
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO port_reservations(proto, host_ip, port, container_id) VALUES (?, ?, ?, ?)`,
+				p.Protocol(), p.HostIP, port, containerID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// ReleasePorts drops the host port reservations of containerID.
+func (s *Store) ReleasePorts(containerID string) error {
+	_, err := s.db.Exec(`DELETE FROM port_reservations WHERE container_id = ?`, containerID)
+	return err
+}
+
+// ListPortReservations returns the reserved host ports, one mapping per
+// port, with the container side left empty.
+func (s *Store) ListPortReservations() ([]PortMapping, error) {
+	rows, err := s.db.Query(`SELECT proto, host_ip, port FROM port_reservations ORDER BY proto, port, host_ip`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PortMapping
+	for rows.Next() {
+		var p PortMapping
+		if err := rows.Scan(&p.Proto, &p.HostIP, &p.Host); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// HostString formats the host side of p as ip:port[-end]/proto, with an
+// IPv6 address in brackets.
+func (p PortMapping) HostString() string {
+	ip := p.HostIP
+	if ip == "" {
+		ip = "0.0.0.0"
+	} else if strings.Contains(ip, ":") {
+		ip = "[" + ip + "]"
+	}
+	return ip + ":" + portRange(p.Host, p.HostEnd) + "/" + p.Protocol()
+}
+
+// ContainerString formats the container side of p as port[-end]/proto.
+func (p PortMapping) ContainerString() string {
+	return portRange(p.Container, p.ContainerEnd) + "/" + p.Protocol()
+}
+
+// Protocol returns the protocol of p, defaulting to tcp.
+func (p PortMapping) Protocol() string {
+	if p.Proto == "" {
+		return "tcp"
+	}
+	return p.Proto
+}
+
+func portRange(start, end int) string {
+	if end > start {
+		return strconv.Itoa(start) + "-" + strconv.Itoa(end)
+	}
+	return strconv.Itoa(start)
+}
@@ -0,0 +1,65 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeLegacyPorts(t *testing.T) {
+	got := decodePorts("8080:80,bad,9000:90")
+	want := []PortMapping{{Host: 8080, Container: 80}, {Host: 9000, Container: 90}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodePorts = %+v, want %+v", got, want)
+	}
+	if got := decodePorts(encodePorts(want)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip = %+v", got)
+	}
+}
+
+func TestReservePorts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	a, b := newTestStore(t, path), newTestStore(t, path)
+	if err := a.ReservePorts("c1", []PortMapping{{Host: 8080, HostEnd: 8081, Container: 80, ContainerEnd: 81}, {HostIP: "127.0.0.1", Host: 53, Container: 53, Proto: "udp"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Reserving again is a no-op for the owner.
+	if err := a.ReservePorts("c1", []PortMapping{{Host: 8080, Container: 80}}); err != nil {
+		t.Fatalf("reserving own port again: %v", err)
+	}
+	for _, p := range []PortMapping{
+		{Host: 8081, Container: 80},
+		{HostIP: "10.0.0.1", Host: 8080, Container: 80},
+		{Host: 53, Container: 53, Proto: "udp"},
+		{HostIP: "127.0.0.1", Host: 53, Container: 53, Proto: "udp"},
+	} {
+		if err := b.ReservePorts("c2", []PortMapping{{Host: 9000, Container: 90}, p}); !errors.Is(err, ErrPortInUse) {
+			t.Errorf("ReservePorts(%s) = %v", p.HostString(), err)
+		}
+	}
+	// A failed reservation leaves nothing behind.
+	if list, err := b.ListPortReservations(); err != nil || len(list) != 3 {
+		t.Fatalf("ListPortReservations = %+v, %v", list, err)
+	}
+	for _, p := range []PortMapping{
+		{HostIP: "10.0.0.1", Host: 53, Container: 53, Proto: "udp"},
+		{Host: 8080, Container: 80, Proto: "udp"},
+	} {
+		if err := b.ReservePorts("c2", []PortMapping{p}); err != nil {
+			t.Errorf("ReservePorts(%s) = %v", p.HostString(), err)
+		}
+	}
+	if err := a.ReleasePorts("c1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ReservePorts("c2", []PortMapping{{Host: 8080, Container: 80}}); err != nil {
+		t.Fatalf("port not released: %v", err)
+	}
+	if err := b.DeleteContainer("c2"); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := b.ListPortReservations(); err != nil || len(list) != 0 {
+		t.Fatalf("reservations left after delete: %+v, %v", list, err)
+	}
+}
@@ -2,6 +2,8 @@ package store
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -18,11 +20,30 @@ type ContainerInfo struct {
 	RestartCount   int
 	HealthCmd      string
 	HealthInterval int
+	HealthPSI      string
 	RestartMax     int
-	Ports          string
+	Ports          []PortMapping
 	IpForwardOrig  string
+	Ip6ForwardOrig string
 	NetworkSetup   bool
-	IPSuffix       int
+	Network        string
+	Firewall       string
+	ProxyPID       int
+	SlirpPID       int
+	Aliases        []string
+	EgressAllow    []string
+	NetRate        string
+	NetDelay       string
+	NetLoss        string
+	CNIResult      string
+	IPAddress      string
+	IPv6Address    string
+	OOMKilled      bool
+	OOMKilledAt    time.Time
+	MemoryLimit    int64
+	CPUs           float64
+	PidsLimit      int64
+	CPUShares      int64
 }
 
 type Store struct {
@@ -30,13 +51,61 @@ type Store struct {
 }
 
 func NewStore(dbPath string) (*Store, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Transactions take the write lock up front and wait for concurrent
+	// writers, which makes read-modify-write sequences such as IP allocation
+	// safe across processes. The pragmas are applied per connection since
+	// journal_mode cannot be changed inside the migration transaction.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
 	return &Store{db: db}, nil
 }
 
+// containerMigrations lists columns added to the containers table after
+// its initial schema, in the order they were introduced.
+var containerMigrations = []struct{ name, ddl string }{
+	{"rootfs_dir", "TEXT"},
+	{"restart_count", "INTEGER DEFAULT 0"},
+	{"health_cmd", "TEXT"},
+	{"health_interval", "INTEGER DEFAULT 0"},
+	{"restart_max", "INTEGER DEFAULT 0"},
+	{"ports", "TEXT"},
+	{"ip_forward_orig", "TEXT"},
+	{"network_setup", "INTEGER DEFAULT 0"},
+	{"ip_suffix", "INTEGER DEFAULT 0"},
+	{"oom_killed", "INTEGER DEFAULT 0"},
+	{"oom_killed_at", "TEXT"},
+	{"memory_limit", "INTEGER DEFAULT 0"},
+	{"cpus", "REAL DEFAULT 0"},
+	{"pids_limit", "INTEGER DEFAULT 0"},
+	{"cpu_shares", "INTEGER DEFAULT 0"},
+	{"health_psi", "TEXT"},
+	{"ip_address", "TEXT"},
+	{"network", "TEXT"},
+	{"firewall", "TEXT"},
+	{"proxy_pid", "INTEGER DEFAULT 0"},
+	{"slirp_pid", "INTEGER DEFAULT 0"},
+	{"aliases", "TEXT"},
+	{"ip6_address", "TEXT"},
+	{"ip6_forward_orig", "TEXT"},
+	{"egress_allow", "TEXT"},
+	{"net_rate", "TEXT"},
+	{"net_delay", "TEXT"},
+	{"net_loss", "TEXT"},
+	{"cni_result", "TEXT"},
+	{"stop_requested", "INTEGER DEFAULT 0"},
+}
+
+// networkMigrations lists columns added to the networks table after its
+// initial schema.
+var networkMigrations = []struct{ name, ddl string }{
+	{"subnet6", "TEXT"},
+	{"gateway6", "TEXT"},
+	{"isolated", "INTEGER DEFAULT 0"},
+	{"internal", "INTEGER DEFAULT 0"},
+}
+
 func (s *Store) Init() error {
 	// Serialize migrations to avoid duplicate‑column races
 	tx, err := s.db.Begin()
@@ -78,11 +147,66 @@ func (s *Store) Init() error {
 		return err
 	}
 
-	rows, err := tx.Query("PRAGMA table_info(containers)")
-	if err != nil {
+	if _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS ip_allocations (
+        network TEXT NOT NULL,
+        ip TEXT NOT NULL,
+        container_id TEXT NOT NULL,
+        PRIMARY KEY (network, ip),
+        UNIQUE (network, container_id)
+    )`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS port_reservations (
+        proto TEXT NOT NULL,
+        host_ip TEXT NOT NULL,
+        port INTEGER NOT NULL,
+        container_id TEXT NOT NULL,
+        PRIMARY KEY (proto, host_ip, port)
+    )`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS networks (
+        name TEXT PRIMARY KEY,
+        bridge TEXT NOT NULL UNIQUE,
+        subnet TEXT NOT NULL,
+        gateway TEXT NOT NULL,
+        created_at TEXT
+    )`); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := addColumns(tx, "containers", containerMigrations); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := addColumns(tx, "networks", networkMigrations); err != nil {
+		tx.Rollback()
+		return err
+	}
+	// Rows written before ip_allocations existed only stored the last octet
+	// of an address on the default network; reserve the addresses of those
+	// still running so that AllocateIP does not hand them out again.
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO ip_allocations (network, ip, container_id)
+        SELECT 'bridge', '10.42.0.' || ip_suffix, id FROM containers
+        WHERE ip_suffix > 0 AND COALESCE(ip_address, '') = '' AND COALESCE(network, '') IN ('', 'bridge')
+        AND state IN ('Running', 'Paused')`); err != nil {
 		tx.Rollback()
 		return err
 	}
+	return tx.Commit()
+}
+
+// addColumns adds the columns of migrations that table lacks.
+func addColumns(tx *sql.Tx, table string, migrations []struct{ name, ddl string }) error {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
 	cols := map[string]bool{}
 	for rows.Next() {
 		var cid int
@@ -91,128 +215,109 @@ func (s *Store) Init() error {
 		var dfltValue sql.NullString
 		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk); err != nil {
 			rows.Close()
-			tx.Rollback()
 			return err
 		}
 		cols[name] = true
 	}
 	rows.Close()
-	if !cols["rootfs_dir"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN rootfs_dir TEXT"); err != nil {
-			tx.Rollback()
-			return err
+	for _, m := range migrations {
+		if cols[m.name] {
+			continue
 		}
-	}
-	if !cols["restart_count"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN restart_count INTEGER DEFAULT 0"); err != nil {
-			tx.Rollback()
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + m.name + " " + m.ddl); err != nil {
 			return err
 		}
 	}
-	if !cols["health_cmd"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN health_cmd TEXT"); err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	if !cols["health_interval"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN health_interval INTEGER DEFAULT 0"); err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	if !cols["restart_max"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN restart_max INTEGER DEFAULT 0"); err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	if !cols["ports"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN ports TEXT"); err != nil {
-			tx.Rollback()
-			return err
-		}
-	}
-	if !cols["ip_forward_orig"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN ip_forward_orig TEXT"); err != nil {
-			tx.Rollback()
-			return err
-		}
+	return nil
+}
+
+// containerColumns lists the columns read by scanContainer, in order.
+const containerColumns = `id, name, image, pid, state, started_at, rootfs_dir, restart_count, COALESCE(health_cmd, ''), health_interval, restart_max, COALESCE(ports, ''), COALESCE(ip_forward_orig, ''), COALESCE(network_setup, 0), COALESCE(ip_suffix, 0), COALESCE(oom_killed, 0), COALESCE(oom_killed_at, ''), COALESCE(memory_limit, 0), COALESCE(cpus, 0), COALESCE(pids_limit, 0), COALESCE(cpu_shares, 0), COALESCE(health_psi, ''), COALESCE(ip_address, ''), COALESCE(network, ''), COALESCE(firewall, ''), COALESCE(proxy_pid, 0), COALESCE(slirp_pid, 0), COALESCE(aliases, ''), COALESCE(ip6_address, ''), COALESCE(ip6_forward_orig, ''), COALESCE(egress_allow, ''), COALESCE(net_rate, ''), COALESCE(net_delay, ''), COALESCE(net_loss, ''), COALESCE(cni_result, '')`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanContainer(row rowScanner) (ContainerInfo, error) {
+	var c ContainerInfo
+	var t, rootfsDir, ports, ipForwardOrig, oomKilledAt, aliases, egressAllow string
+	var networkSetup, oomKilled, ipSuffix int
+	if err := row.Scan(&c.ID, &c.Name, &c.Image, &c.PID, &c.State, &t, &rootfsDir, &c.RestartCount, &c.HealthCmd, &c.HealthInterval, &c.RestartMax, &ports, &ipForwardOrig, &networkSetup, &ipSuffix, &oomKilled, &oomKilledAt, &c.MemoryLimit, &c.CPUs, &c.PidsLimit, &c.CPUShares, &c.HealthPSI, &c.IPAddress, &c.Network, &c.Firewall, &c.ProxyPID, &c.SlirpPID, &aliases, &c.IPv6Address, &c.Ip6ForwardOrig, &egressAllow, &c.NetRate, &c.NetDelay, &c.NetLoss, &c.CNIResult); err != nil {
+		return ContainerInfo{}, err
 	}
-	if !cols["network_setup"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN network_setup INTEGER DEFAULT 0"); err != nil {
-			tx.Rollback()
-			return err
-		}
+	c.StartedAt, _ = time.Parse(time.RFC3339, t)
+	c.RootfsDir = rootfsDir
+	c.Ports = decodePorts(ports)
+	c.IpForwardOrig = ipForwardOrig
+	c.NetworkSetup = networkSetup != 0
+	c.OOMKilled = oomKilled != 0
+	if aliases != "" {
+		c.Aliases = strings.Split(aliases, ",")
 	}
-	if !cols["ip_suffix"] {
-		if _, err := tx.Exec("ALTER TABLE containers ADD COLUMN ip_suffix INTEGER DEFAULT 0"); err != nil {
-			tx.Rollback()
-			return err
-		}
+	if egressAllow != "" {
+		c.EgressAllow = strings.Split(egressAllow, ",")
 	}
-	if _, err = tx.Exec("PRAGMA journal_mode = WAL;"); err != nil {
-		tx.Rollback()
-		return err
+	if c.IPAddress == "" && ipSuffix > 0 {
+		// Rows written before ip_address existed only stored the last octet.
+		c.IPAddress = fmt.Sprintf("10.42.0.%d", ipSuffix)
 	}
-	if _, err = tx.Exec("PRAGMA foreign_keys = ON;"); err != nil {
-		tx.Rollback()
-		return err
+	if oomKilledAt != "" {
+		c.OOMKilledAt, _ = time.Parse(time.RFC3339, oomKilledAt)
 	}
-	return tx.Commit()
+	return c, nil
 }
 
 func (s *Store) SaveContainer(c ContainerInfo) error {
-	_, err := s.db.Exec(`INSERT INTO containers(id, name, image, pid, state, started_at, rootfs_dir, restart_count, health_cmd, health_interval, restart_max, ports, ip_forward_orig, network_setup, ip_suffix)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-        ON CONFLICT(id) DO UPDATE SET name=excluded.name,image=excluded.image,pid=excluded.pid,state=excluded.state,started_at=excluded.started_at,rootfs_dir=excluded.rootfs_dir,restart_count=excluded.restart_count,health_cmd=excluded.health_cmd,health_interval=excluded.health_interval,restart_max=excluded.restart_max,ports=excluded.ports,ip_forward_orig=excluded.ip_forward_orig,network_setup=excluded.network_setup,ip_suffix=excluded.ip_suffix`,
-		c.ID, c.Name, c.Image, c.PID, c.State, c.StartedAt.Format(time.RFC3339), c.RootfsDir, c.RestartCount, c.HealthCmd, c.HealthInterval, c.RestartMax, c.Ports, c.IpForwardOrig, c.NetworkSetup, c.IPSuffix)
+	var oomKilledAt string
+	if !c.OOMKilledAt.IsZero() {
+		oomKilledAt = c.OOMKilledAt.Format(time.RFC3339)
+	}
+	_, err := s.db.Exec(`INSERT INTO containers(id, name, image, pid, state, started_at, rootfs_dir, restart_count, health_cmd, health_interval, restart_max, ports, ip_forward_orig, network_setup, ip_address, oom_killed, oom_killed_at, memory_limit, cpus, pids_limit, cpu_shares, health_psi, network, firewall, proxy_pid, slirp_pid, aliases, ip6_address, ip6_forward_orig, egress_allow, net_rate, net_delay, net_loss, cni_result)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(id) DO UPDATE SET name=excluded.name,image=excluded.image,pid=excluded.pid,state=excluded.state,started_at=excluded.started_at,rootfs_dir=excluded.rootfs_dir,restart_count=excluded.restart_count,health_cmd=excluded.health_cmd,health_interval=excluded.health_interval,restart_max=excluded.restart_max,ports=excluded.ports,ip_forward_orig=excluded.ip_forward_orig,network_setup=excluded.network_setup,ip_address=excluded.ip_address,oom_killed=excluded.oom_killed,oom_killed_at=excluded.oom_killed_at,memory_limit=excluded.memory_limit,cpus=excluded.cpus,pids_limit=excluded.pids_limit,cpu_shares=excluded.cpu_shares,health_psi=excluded.health_psi,network=excluded.network,firewall=excluded.firewall,proxy_pid=excluded.proxy_pid,slirp_pid=excluded.slirp_pid,aliases=excluded.aliases,ip6_address=excluded.ip6_address,ip6_forward_orig=excluded.ip6_forward_orig,egress_allow=excluded.egress_allow,net_rate=excluded.net_rate,net_delay=excluded.net_delay,net_loss=excluded.net_loss,cni_result=excluded.cni_result`,
+		c.ID, c.Name, c.Image, c.PID, c.State, c.StartedAt.Format(time.RFC3339), c.RootfsDir, c.RestartCount, c.HealthCmd, c.HealthInterval, c.RestartMax, encodePorts(c.Ports), c.IpForwardOrig, c.NetworkSetup, c.IPAddress, c.OOMKilled, oomKilledAt, c.MemoryLimit, c.CPUs, c.PidsLimit, c.CPUShares, c.HealthPSI, c.Network, c.Firewall, c.ProxyPID, c.SlirpPID, strings.Join(c.Aliases, ","), c.IPv6Address, c.Ip6ForwardOrig, strings.Join(c.EgressAllow, ","), c.NetRate, c.NetDelay, c.NetLoss, c.CNIResult)
 	return err
 }
 
 func (s *Store) ListContainers() ([]ContainerInfo, error) {
-	rows, err := s.db.Query(`SELECT id, name, image, pid, state, started_at, rootfs_dir, restart_count, COALESCE(health_cmd, ''), health_interval, restart_max, COALESCE(ports, ''), COALESCE(ip_forward_orig, ''), COALESCE(network_setup, 0), COALESCE(ip_suffix, 0) FROM containers`)
+	rows, err := s.db.Query(`SELECT ` + containerColumns + ` FROM containers`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var out []ContainerInfo
 	for rows.Next() {
-		var c ContainerInfo
-		var t, rootfsDir, ports, ipForwardOrig string
-		var networkSetup int
-		if err := rows.Scan(&c.ID, &c.Name, &c.Image, &c.PID, &c.State, &t, &rootfsDir, &c.RestartCount, &c.HealthCmd, &c.HealthInterval, &c.RestartMax, &ports, &ipForwardOrig, &networkSetup, &c.IPSuffix); err != nil {
+		c, err := scanContainer(rows)
+		if err != nil {
 			return nil, err
 		}
-		c.StartedAt, _ = time.Parse(time.RFC3339, t)
-		c.RootfsDir = rootfsDir
-		c.Ports = ports
-		c.IpForwardOrig = ipForwardOrig
-		c.NetworkSetup = networkSetup != 0
 		out = append(out, c)
 	}
 	return out, rows.Err()
 }
 
 func (s *Store) GetContainer(id string) (ContainerInfo, error) {
-	row := s.db.QueryRow(`SELECT id, name, image, pid, state, started_at, rootfs_dir, restart_count, COALESCE(health_cmd, ''), health_interval, restart_max, COALESCE(ports, ''), COALESCE(ip_forward_orig, ''), COALESCE(network_setup, 0), COALESCE(ip_suffix, 0) FROM containers WHERE id = ?`, id)
-	var c ContainerInfo
-	var t, rootfsDir, ports, ipForwardOrig string
-	var networkSetup int
-	if err := row.Scan(&c.ID, &c.Name, &c.Image, &c.PID, &c.State, &t, &rootfsDir, &c.RestartCount, &c.HealthCmd, &c.HealthInterval, &c.RestartMax, &ports, &ipForwardOrig, &networkSetup, &c.IPSuffix); err != nil {
-		return ContainerInfo{}, err
-	}
-	c.StartedAt, _ = time.Parse(time.RFC3339, t)
-	c.RootfsDir = rootfsDir
-	c.Ports = ports
-	c.IpForwardOrig = ipForwardOrig
-	c.NetworkSetup = networkSetup != 0
-	return c, nil
+	return scanContainer(s.db.QueryRow(`SELECT `+containerColumns+` FROM containers WHERE id = ?`, id))
 }
 
+// DeleteContainer removes the container record together with any addresses
+// and host ports still reserved for it.
 func (s *Store) DeleteContainer(id string) error {
-	_, err := s.db.Exec(`DELETE FROM containers WHERE id = ?`, id)
-	return err
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM ip_allocations WHERE container_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM port_reservations WHERE container_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM containers WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *Store) UpdateContainerState(id, state string) error {
@@ -220,6 +325,21 @@ func (s *Store) UpdateContainerState(id, state string) error {
 	return err
 }
 
+// MarkStopped sets the container to Stopped on behalf of `stop`, so that
+// the run supervising it neither restarts it nor records its exit.
+func (s *Store) MarkStopped(id string) error {
+	_, err := s.db.Exec(`UPDATE containers SET state = 'Stopped', stop_requested = 1 WHERE id = ?`, id)
+	return err
+}
+
+// StopRequested reports whether the container was stopped with MarkStopped
+// or its record removed.
+func (s *Store) StopRequested(id string) bool {
+	var stopped bool
+	err := s.db.QueryRow(`SELECT COALESCE(stop_requested, 0) FROM containers WHERE id = ?`, id).Scan(&stopped)
+	return err == sql.ErrNoRows || stopped
+}
+
 func (s *Store) UpdateContainerPID(id string, pid int) error {
 	_, err := s.db.Exec(`UPDATE containers SET pid = ? WHERE id = ?`, pid, id)
 	return err
@@ -2,6 +2,7 @@ package store
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -19,7 +20,7 @@ func TestStoreCRUD(t *testing.T) {
 	if err := s.Init(); err != nil {
 		t.Fatal(err)
 	}
-	info := ContainerInfo{ID: "1", Name: "n", Image: "img", PID: 123, State: "Running", StartedAt: time.Now(), RestartMax: 0, Ports: "8080:80"}
+	info := ContainerInfo{ID: "1", Name: "n", Image: "img", PID: 123, State: "Running", StartedAt: time.Now(), RestartMax: 0, Ports: []PortMapping{{HostIP: "127.0.0.1", Host: 8000, HostEnd: 8001, Container: 80, ContainerEnd: 81, Proto: "udp"}}, Aliases: []string{"db", "cache"}}
 	if err := s.SaveContainer(info); err != nil {
 		t.Fatalf("save: %v", err)
 	}
@@ -27,9 +28,16 @@ func TestStoreCRUD(t *testing.T) {
 	if err != nil || len(list) != 1 {
 		t.Fatalf("list: %v len=%d", err, len(list))
 	}
-	if _, err := s.GetContainer("1"); err != nil {
+	got, err := s.GetContainer("1")
+	if err != nil {
 		t.Fatalf("get: %v", err)
 	}
+	if len(got.Ports) != 1 || got.Ports[0] != info.Ports[0] {
+		t.Fatalf("ports not preserved: %+v", got.Ports)
+	}
+	if len(got.Aliases) != 2 || got.Aliases[0] != "db" || got.Aliases[1] != "cache" {
+		t.Fatalf("aliases not preserved: %v", got.Aliases)
+	}
 	if err := s.UpdateContainerState("1", "Stopped"); err != nil {
 		t.Fatalf("update: %v", err)
 	}
@@ -57,3 +65,51 @@ func TestStoreCRUD(t *testing.T) {
 		t.Fatalf("list images failed")
 	}
 }
+
+func TestStoreOOMKilled(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	info := ContainerInfo{ID: "oom", State: "Stopped", StartedAt: time.Now(), OOMKilled: true, OOMKilledAt: at}
+	if err := s.SaveContainer(info); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	got, err := s.GetContainer("oom")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !got.OOMKilled || !got.OOMKilledAt.Equal(at) {
+		t.Fatalf("oom state not persisted: %v %v", got.OOMKilled, got.OOMKilledAt)
+	}
+}
+
+func TestMarkStopped(t *testing.T) {
+	s := newTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	info := ContainerInfo{ID: "c1", State: "Running", StartedAt: time.Now()}
+	if err := s.SaveContainer(info); err != nil {
+		t.Fatal(err)
+	}
+	if s.StopRequested("c1") {
+		t.Fatal("running container reported stopped")
+	}
+	// States set for exited processes are not a stop request.
+	if err := s.UpdateContainerState("c1", "Stopped"); err != nil || s.StopRequested("c1") {
+		t.Fatalf("UpdateContainerState: %v, stop requested", err)
+	}
+	if err := s.MarkStopped("c1"); err != nil {
+		t.Fatal(err)
+	}
+	// Saving the container again keeps the request.
+	if err := s.SaveContainer(info); err != nil || !s.StopRequested("c1") {
+		t.Fatalf("stop request lost: %v", err)
+	}
+	if !s.StopRequested("removed") {
+		t.Fatal("removed container not reported stopped")
+	}
+}